@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"file-uploader/models"
+)
+
+// ErrInvalidCredentials is returned when the username or password is wrong
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator verifies a username and password and returns the matching local user
+type Authenticator interface {
+	Name() string
+	Authenticate(username, password string) (*models.User, error)
+}
+
+// ChainAuthenticator tries several authenticators in order
+type ChainAuthenticator struct {
+	authenticators []Authenticator
+}
+
+// NewChainAuthenticator creates a new ChainAuthenticator
+func NewChainAuthenticator(authenticators ...Authenticator) *ChainAuthenticator {
+	return &ChainAuthenticator{authenticators: authenticators}
+}
+
+// Name returns the names of the chained authenticators
+func (c *ChainAuthenticator) Name() string {
+	names := make([]string, len(c.authenticators))
+	for i, a := range c.authenticators {
+		names[i] = a.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Authenticate returns the first successful authentication.
+// Backend failures are only reported when no other backend accepted the credentials.
+func (c *ChainAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	var backendErr error
+	for _, a := range c.authenticators {
+		user, err := a.Authenticate(username, password)
+		if err == nil {
+			return user, nil
+		}
+		if err != ErrInvalidCredentials {
+			log.Printf("%s authentication failed: %v", a.Name(), err)
+			backendErr = err
+		}
+	}
+	if backendErr != nil {
+		return nil, backendErr
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// NewFromEnv builds the authenticator configured by AUTH_BACKENDS,
+// a comma-separated list of "local" and "ldap" (default "local")
+func NewFromEnv(userModel *models.UserModel, identityModel *models.UserIdentityModel) (Authenticator, error) {
+	backends := os.Getenv("AUTH_BACKENDS")
+	if backends == "" {
+		backends = "local"
+	}
+
+	var authenticators []Authenticator
+	for _, backend := range strings.Split(backends, ",") {
+		switch strings.TrimSpace(backend) {
+		case "local":
+			authenticators = append(authenticators, NewLocalAuthenticator(userModel))
+		case "ldap":
+			config, err := GetLDAPConfig()
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, NewLDAPAuthenticator(config, userModel, identityModel))
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown authentication backend %q", backend)
+		}
+	}
+
+	if len(authenticators) == 0 {
+		return nil, errors.New("no authentication backend configured")
+	}
+	if len(authenticators) == 1 {
+		return authenticators[0], nil
+	}
+	return NewChainAuthenticator(authenticators...), nil
+}
@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig holds the settings for binding against an LDAP or Active Directory server
+type LDAPConfig struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string // e.g. (uid=%s) or (sAMAccountName=%s)
+	GroupAttribute     string // Attribute on the user entry listing group DNs, e.g. memberOf
+	GroupBaseDN        string // Used together with GroupFilter when memberOf is unavailable
+	GroupFilter        string // e.g. (member=%s), receives the user DN
+	GroupRoles         map[string]string
+}
+
+// GetLDAPConfig reads the LDAP configuration from environment variables
+func GetLDAPConfig() (*LDAPConfig, error) {
+	config := &LDAPConfig{
+		URL:                os.Getenv("LDAP_URL"),
+		StartTLS:           os.Getenv("LDAP_START_TLS") == "true",
+		InsecureSkipVerify: os.Getenv("LDAP_INSECURE_SKIP_VERIFY") == "true",
+		BindDN:             os.Getenv("LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:             os.Getenv("LDAP_BASE_DN"),
+		UserFilter:         os.Getenv("LDAP_USER_FILTER"),
+		GroupAttribute:     os.Getenv("LDAP_GROUP_ATTRIBUTE"),
+		GroupBaseDN:        os.Getenv("LDAP_GROUP_BASE_DN"),
+		GroupFilter:        os.Getenv("LDAP_GROUP_FILTER"),
+		GroupRoles:         make(map[string]string),
+	}
+
+	if config.URL == "" || config.BaseDN == "" {
+		return nil, errors.New("LDAP_URL and LDAP_BASE_DN are required for the ldap backend")
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	if config.GroupBaseDN == "" {
+		config.GroupBaseDN = config.BaseDN
+	}
+
+	// LDAP_GROUP_ROLES maps group DNs to roles: "cn=admins,ou=groups,dc=example,dc=org:admin;..."
+	for _, mapping := range strings.Split(os.Getenv("LDAP_GROUP_ROLES"), ";") {
+		mapping = strings.TrimSpace(mapping)
+		if mapping == "" {
+			continue
+		}
+		sep := strings.LastIndex(mapping, ":")
+		if sep <= 0 {
+			return nil, fmt.Errorf("invalid LDAP_GROUP_ROLES entry %q", mapping)
+		}
+		role := strings.TrimSpace(mapping[sep+1:])
+		if role != models.RoleUser && role != models.RoleAdmin {
+			return nil, fmt.Errorf("unknown role %q in LDAP_GROUP_ROLES", role)
+		}
+		config.GroupRoles[normalizeDN(mapping[:sep])] = role
+	}
+
+	return config, nil
+}
+
+// LDAPAuthenticator authenticates users by binding as them against an LDAP server.
+// A local users row is provisioned on first login so files can reference the user.
+type LDAPAuthenticator struct {
+	config        *LDAPConfig
+	userModel     *models.UserModel
+	identityModel *models.UserIdentityModel
+}
+
+// NewLDAPAuthenticator creates a new LDAPAuthenticator
+func NewLDAPAuthenticator(config *LDAPConfig, userModel *models.UserModel, identityModel *models.UserIdentityModel) *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		config:        config,
+		userModel:     userModel,
+		identityModel: identityModel,
+	}
+}
+
+// Name returns the backend name
+func (a *LDAPAuthenticator) Name() string {
+	return "ldap"
+}
+
+// Authenticate searches for the user entry, binds with the given password and syncs the local user
+func (a *LDAPAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	// An empty password would turn the bind into an unauthenticated bind that always succeeds
+	username = strings.ToLower(strings.TrimSpace(username))
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := a.bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", a.config.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("user search failed: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	// Verify the password by binding as the user
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("user bind failed: %w", err)
+	}
+
+	groups := entry.GetAttributeValues(a.config.GroupAttribute)
+	if a.config.GroupFilter != "" {
+		groups, err = a.searchGroups(conn, entry.DN)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return a.syncUser(username, a.mapRole(groups))
+}
+
+// connect dials the LDAP server, upgrading to TLS when configured
+func (a *LDAPAuthenticator) connect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.config.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(a.config.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+
+	if a.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// bindServiceAccount binds with the search account, or stays anonymous when none is configured
+func (a *LDAPAuthenticator) bindServiceAccount(conn *ldap.Conn) error {
+	if a.config.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+		return fmt.Errorf("service account bind failed: %w", err)
+	}
+	return nil
+}
+
+// searchGroups finds the groups listing the user as a member
+func (a *LDAPAuthenticator) searchGroups(conn *ldap.Conn, userDN string) ([]string, error) {
+	// Searching as the user may not be allowed, switch back to the service account
+	if err := a.bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.GroupBaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(a.config.GroupFilter, ldap.EscapeFilter(userDN)),
+		[]string{"dn"},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("group search failed: %w", err)
+	}
+
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+// mapRole returns the most privileged role granted by the user's groups.
+// An empty role means no mapping is configured and the local role is kept.
+func (a *LDAPAuthenticator) mapRole(groups []string) string {
+	if len(a.config.GroupRoles) == 0 {
+		return ""
+	}
+
+	role := models.RoleUser
+	for _, group := range groups {
+		if a.config.GroupRoles[normalizeDN(group)] == models.RoleAdmin {
+			role = models.RoleAdmin
+		}
+	}
+	return role
+}
+
+// syncUser finds or provisions the local user and applies the mapped role. Directory
+// names are checked against the username policy like registrations; accounts that had
+// to get a generated name are found again through their linked identity.
+func (a *LDAPAuthenticator) syncUser(username, role string) (*models.User, error) {
+	var user *models.User
+	identity, err := a.identityModel.GetBySubject(a.config.URL, username)
+	switch {
+	case err == nil:
+		user, err = a.userModel.GetByID(identity.UserID)
+	case err == sql.ErrNoRows:
+		user, err = a.userModel.GetByUsername(username)
+		if err == sql.ErrNoRows {
+			user, err = a.provisionUser(username)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Never take over a local account that happens to share the username
+	if user.AuthSource != models.AuthSourceLDAP {
+		log.Printf("LDAP login for %q rejected: a %s account with this username exists", username, user.AuthSource)
+		return nil, ErrInvalidCredentials
+	}
+
+	if role != "" && user.Role != role {
+		if err := a.userModel.SetRole(user.ID, role); err != nil {
+			return nil, err
+		}
+		user.Role = role
+	}
+	return user, nil
+}
+
+// provisionUser creates the local user for a directory account and links it
+func (a *LDAPAuthenticator) provisionUser(username string) (*models.User, error) {
+	localName, err := utils.GetUsernamePolicy().ExternalUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	return a.userModel.CreateLinked(localName, models.AuthSourceLDAP, a.config.URL, username, "")
+}
+
+// normalizeDN lowercases a DN and strips spaces around separators for comparison
+func normalizeDN(dn string) string {
+	parts := strings.Split(strings.ToLower(dn), ",")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	return strings.Join(parts, ",")
+}
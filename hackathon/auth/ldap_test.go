@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"file-uploader/models"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// LDAP protocol operations and result codes used by the fake server
+const (
+	ldapBindRequest      = 0
+	ldapBindResponse     = 1
+	ldapUnbindRequest    = 2
+	ldapSearchRequest    = 3
+	ldapSearchResultItem = 4
+	ldapSearchResultDone = 5
+
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+const (
+	testBaseDN      = "dc=example,dc=org"
+	testServiceDN   = "cn=search,dc=example,dc=org"
+	testServicePass = "search-secret"
+	testAdminsGroup = "cn=admins,ou=groups,dc=example,dc=org"
+)
+
+// ldapEntry is a user in the fake directory
+type ldapEntry struct {
+	uid      string
+	password string
+	groups   []string
+}
+
+func (e ldapEntry) dn() string {
+	return "uid=" + e.uid + ",ou=people," + testBaseDN
+}
+
+// fakeLDAPServer answers simple binds and equality searches on uid, which is all the
+// authenticator needs
+type fakeLDAPServer struct {
+	listener net.Listener
+	entries  []ldapEntry
+}
+
+func newFakeLDAPServer(t *testing.T, entries ...ldapEntry) *fakeLDAPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeLDAPServer{listener: listener, entries: entries}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeLDAPServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// serve answers the requests on one connection until it is closed or unbound
+func (s *fakeLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		messageID := request.Children[0].Value
+		op := request.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldapBindRequest:
+			responses = append(responses, ldapResult(ldapBindResponse, s.bind(op.Children[1].Data.String(), op.Children[2].Data.String())))
+		case ldapSearchRequest:
+			responses = s.search(op)
+		case ldapUnbindRequest:
+			return
+		default:
+			return
+		}
+
+		for _, response := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+			envelope.AppendChild(response)
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bind checks a DN and password against the service account and the entries
+func (s *fakeLDAPServer) bind(dn, password string) int {
+	if dn == testServiceDN && password == testServicePass {
+		return ldapSuccess
+	}
+	for _, entry := range s.entries {
+		if dn == entry.dn() && password == entry.password {
+			return ldapSuccess
+		}
+	}
+	return ldapInvalidCredentials
+}
+
+// search returns the entries whose uid matches an equality filter
+func (s *fakeLDAPServer) search(op *ber.Packet) []*ber.Packet {
+	filter, err := ldap.DecompileFilter(op.Children[6])
+	if err != nil {
+		return []*ber.Packet{ldapResult(ldapSearchResultDone, 1)}
+	}
+
+	var responses []*ber.Packet
+	for _, entry := range s.entries {
+		if filter != fmt.Sprintf("(uid=%s)", ldap.EscapeFilter(entry.uid)) {
+			continue
+		}
+		item := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchResultItem, nil, "")
+		item.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn(), ""))
+		attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		memberOf := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		memberOf.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", ""))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, group := range entry.groups {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, group, ""))
+		}
+		memberOf.AppendChild(values)
+		attributes.AppendChild(memberOf)
+		item.AppendChild(attributes)
+		responses = append(responses, item)
+	}
+	return append(responses, ldapResult(ldapSearchResultDone, ldapSuccess))
+}
+
+// ldapResult builds an LDAPResult operation with the given code
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return op
+}
+
+// ldapTest holds an authenticator pointed at a fake directory
+type ldapTest struct {
+	db            *sql.DB
+	userModel     *models.UserModel
+	authenticator *LDAPAuthenticator
+}
+
+func newLDAPTest(t *testing.T, servicePassword string, entries ...ldapEntry) *ldapTest {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	userModel := models.NewUserModel(db)
+	identityModel := models.NewUserIdentityModel(db)
+	if err := userModel.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := identityModel.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := newFakeLDAPServer(t, entries...)
+	config := &LDAPConfig{
+		URL:            server.url(),
+		BindDN:         testServiceDN,
+		BindPassword:   servicePassword,
+		BaseDN:         testBaseDN,
+		UserFilter:     "(uid=%s)",
+		GroupAttribute: "memberOf",
+		GroupBaseDN:    testBaseDN,
+		GroupRoles:     map[string]string{normalizeDN(testAdminsGroup): models.RoleAdmin},
+	}
+	return &ldapTest{
+		db:            db,
+		userModel:     userModel,
+		authenticator: NewLDAPAuthenticator(config, userModel, identityModel),
+	}
+}
+
+func (l *ldapTest) countUsers(t *testing.T) int {
+	t.Helper()
+	var n int
+	if err := l.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestLDAPLoginProvisionsUserWithMappedRole(t *testing.T) {
+	l := newLDAPTest(t, testServicePass,
+		ldapEntry{uid: "dana", password: "dana-pass", groups: []string{testAdminsGroup}},
+		ldapEntry{uid: "erin", password: "erin-pass"},
+	)
+
+	user, err := l.authenticator.Authenticate("Dana", "dana-pass")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if user.Username != "dana" || user.AuthSource != models.AuthSourceLDAP || user.Role != models.RoleAdmin {
+		t.Errorf("user = %+v, want ldap admin dana", user)
+	}
+
+	user, err = l.authenticator.Authenticate("erin", "erin-pass")
+	if err != nil || user.Role != models.RoleUser {
+		t.Fatalf("erin = %+v, %v, want a regular user", user, err)
+	}
+	again, err := l.authenticator.Authenticate("erin", "erin-pass")
+	if err != nil || again.ID != user.ID {
+		t.Errorf("second login = %+v, %v, want user %d", again, err, user.ID)
+	}
+	if n := l.countUsers(t); n != 2 {
+		t.Errorf("users = %d, want 2", n)
+	}
+}
+
+func TestLDAPLoginRejectsBadCredentials(t *testing.T) {
+	l := newLDAPTest(t, testServicePass, ldapEntry{uid: "dana", password: "dana-pass"})
+
+	for _, tt := range []struct{ name, username, password string }{
+		{"wrong password", "dana", "guess"},
+		{"unknown user", "nobody", "dana-pass"},
+		{"empty password", "dana", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := l.authenticator.Authenticate(tt.username, tt.password); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("err = %v, want ErrInvalidCredentials", err)
+			}
+		})
+	}
+	if n := l.countUsers(t); n != 0 {
+		t.Errorf("users = %d, want 0", n)
+	}
+}
+
+func TestLDAPLoginFailsWhenServiceBindFails(t *testing.T) {
+	l := newLDAPTest(t, "wrong-secret", ldapEntry{uid: "dana", password: "dana-pass"})
+
+	_, err := l.authenticator.Authenticate("dana", "dana-pass")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "service account bind failed") {
+		t.Errorf("err = %v, want a service account bind failure", err)
+	}
+}
+
+func TestLDAPLoginAppliesUsernamePolicy(t *testing.T) {
+	l := newLDAPTest(t, testServicePass, ldapEntry{uid: "admin", password: "admin-pass"})
+
+	user, err := l.authenticator.Authenticate("admin", "admin-pass")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if !strings.HasPrefix(user.Username, "user-") {
+		t.Fatalf("username = %q, want a generated name instead of a reserved one", user.Username)
+	}
+	again, err := l.authenticator.Authenticate("admin", "admin-pass")
+	if err != nil || again.ID != user.ID {
+		t.Errorf("second login = %+v, %v, want user %d", again, err, user.ID)
+	}
+}
+
+func TestLDAPLoginDoesNotTakeOverLocalAccount(t *testing.T) {
+	l := newLDAPTest(t, testServicePass, ldapEntry{uid: "dana", password: "dana-pass"})
+	if _, err := l.userModel.CreateExternal("dana", models.AuthSourceLocal); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.authenticator.Authenticate("dana", "dana-pass"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("err = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestLDAPProvisioningLeavesNoUserWhenLinkFails(t *testing.T) {
+	l := newLDAPTest(t, testServicePass, ldapEntry{uid: "dana", password: "dana-pass"})
+	if _, err := l.db.Exec(`CREATE TRIGGER fail_link BEFORE INSERT ON user_identities BEGIN SELECT RAISE(ABORT, 'link failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.authenticator.Authenticate("dana", "dana-pass"); err == nil {
+		t.Fatal("login succeeded although the identity could not be linked")
+	}
+	if n := l.countUsers(t); n != 0 {
+		t.Fatalf("users = %d after a failed link, want 0", n)
+	}
+
+	// Without a half-created account in the way, the next login provisions normally
+	if _, err := l.db.Exec(`DROP TRIGGER fail_link`); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := l.authenticator.Authenticate("dana", "dana-pass"); err != nil || user.Username != "dana" {
+		t.Errorf("login after recovery = %+v, %v, want user dana", user, err)
+	}
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"database/sql"
+	"log"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+// LocalAuthenticator checks passwords stored in the users table
+type LocalAuthenticator struct {
+	userModel *models.UserModel
+}
+
+// NewLocalAuthenticator creates a new LocalAuthenticator
+func NewLocalAuthenticator(userModel *models.UserModel) *LocalAuthenticator {
+	return &LocalAuthenticator{userModel: userModel}
+}
+
+// Name returns the backend name
+func (a *LocalAuthenticator) Name() string {
+	return "local"
+}
+
+// Authenticate validates the password against the stored hash and
+// transparently upgrades hashes created with outdated parameters
+func (a *LocalAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	// Usernames are stored normalized, accounts created before normalization keep their spelling
+	user, err := a.userModel.GetByUsername(utils.NormalizeUsername(username))
+	if err == sql.ErrNoRows && utils.NormalizeUsername(username) != username {
+		user, err = a.userModel.GetByUsername(username)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	match, needsRehash := user.CheckPassword(password)
+	if !match {
+		return nil, ErrInvalidCredentials
+	}
+
+	if needsRehash {
+		// The login already succeeded, a failed upgrade is retried next time
+		if err := a.userModel.UpdatePassword(user.ID, password); err != nil {
+			log.Printf("Failed to rehash password for user %d: %v", user.ID, err)
+		}
+	}
+	return user, nil
+}
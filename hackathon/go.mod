@@ -3,8 +3,19 @@ module file-uploader
 go 1.21
 
 require (
+	github.com/chai2010/webp v1.4.0
+	github.com/go-asn1-ber/asn1-ber v1.5.5
+	github.com/go-ldap/ldap/v3 v3.4.6
 	github.com/golang-jwt/jwt/v5 v5.2.0
 	github.com/gorilla/mux v1.8.1
 	github.com/mattn/go-sqlite3 v1.14.18
 	golang.org/x/crypto v0.17.0
+	golang.org/x/image v0.14.0
+	golang.org/x/text v0.14.0
+)
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/google/uuid v1.3.1 // indirect
+	golang.org/x/sys v0.15.0 // indirect
 )
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"file-uploader/auth"
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+// AccountHandler handles self-service data export and account deletion
+type AccountHandler struct {
+	userModel     *models.UserModel
+	fileModel     *models.FileModel
+	authenticator auth.Authenticator
+}
+
+// NewAccountHandler creates a new AccountHandler
+func NewAccountHandler(userModel *models.UserModel, fileModel *models.FileModel, authenticator auth.Authenticator) *AccountHandler {
+	return &AccountHandler{
+		userModel:     userModel,
+		fileModel:     fileModel,
+		authenticator: authenticator,
+	}
+}
+
+// DeleteAccountRequest represents the account deletion payload
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// ProfileResponse represents the current user's profile and how the request was authenticated
+type ProfileResponse struct {
+	*models.User
+	Scopes         []string          `json:"scopes"`
+	AuthMethod     string            `json:"auth_method"`
+	ImpersonatedBy *utils.ActorClaim `json:"impersonated_by,omitempty"`
+}
+
+// Me returns the authenticated user's profile
+func (h *AccountHandler) Me(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	user, err := h.userModel.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	response := ProfileResponse{User: user}
+	response.Scopes, _ = r.Context().Value("scopes").([]string)
+	response.AuthMethod, _ = r.Context().Value("auth_method").(string)
+	response.ImpersonatedBy, _ = r.Context().Value("impersonator").(*utils.ActorClaim)
+	if response.Scopes == nil {
+		response.Scopes = []string{}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Export streams a ZIP archive with the user's profile, file metadata and original files
+func (h *AccountHandler) Export(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	user, err := h.userModel.GetByID(userID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	files, err := h.fileModel.ListByUser(userID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list files"})
+		return
+	}
+
+	// Headers are sent with the first write, errors after this point can only be logged
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"export-%d-%s.zip\"",
+		user.ID, time.Now().UTC().Format("20060102")))
+
+	archive := zip.NewWriter(w)
+	if err := writeExportArchive(archive, user, files); err != nil {
+		log.Printf("Failed to export data for user %d: %v", userID, err)
+		return
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Failed to export data for user %d: %v", userID, err)
+	}
+}
+
+// writeExportArchive writes profile.json, files.json and files/ to the archive
+func writeExportArchive(archive *zip.Writer, user *models.User, files []*models.FileMetadata) error {
+	if err := writeJSONEntry(archive, "profile.json", user); err != nil {
+		return err
+	}
+	if err := writeJSONEntry(archive, "files.json", files); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		// Prefix with the ID so equal filenames cannot collide
+		name := "files/" + strconv.Itoa(file.ID) + "_" + filepath.Base(file.Filename)
+		if err := copyFileEntry(archive, name, file); err != nil {
+			if os.IsNotExist(err) {
+				log.Printf("Skipping missing file %d in export", file.ID)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSONEntry adds an indented JSON document to the archive
+func writeJSONEntry(archive *zip.Writer, name string, value interface{}) error {
+	entry, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// copyFileEntry adds an uploaded file to the archive
+func copyFileEntry(archive *zip.Writer, name string, file *models.FileMetadata) error {
+	source, err := os.Open(file.FilePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store, // Images are already compressed
+		Modified: file.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, source)
+	return err
+}
+
+// Delete schedules deletion of the authenticated user's account after the grace period.
+// Logging in again before then cancels the deletion.
+func (h *AccountHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	var req DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	if req.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Password is required"})
+		return
+	}
+
+	user, err := h.userModel.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	if user.AuthSource == models.AuthSourceOIDC {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Account has no password, ask an administrator to delete it"})
+		return
+	}
+
+	// Confirm the password with the backend the account belongs to
+	confirmed, err := h.authenticator.Authenticate(user.Username, req.Password)
+	if err != nil || confirmed.ID != user.ID {
+		if err != nil && err != auth.ErrInvalidCredentials {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Authentication backend error"})
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid password"})
+		return
+	}
+
+	// Organizations must keep an owner, also through the grace period
+	if err := h.userModel.CheckDeletable(user.ID); err != nil {
+		writeAccountDeletionError(w, err)
+		return
+	}
+
+	gracePeriod := getAccountDeletionGracePeriod()
+	if gracePeriod == 0 {
+		filePaths, err := h.userModel.Delete(user.ID)
+		if err != nil {
+			writeAccountDeletionError(w, err)
+			return
+		}
+		utils.RemoveFiles(filePaths)
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Account deleted successfully",
+		})
+		return
+	}
+
+	deleteAt := time.Now().Add(gracePeriod).UTC()
+	if err := h.userModel.ScheduleDeletion(user.ID, deleteAt); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to schedule account deletion"})
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":               "Account scheduled for deletion. Log in again before then to cancel",
+		"deletion_scheduled_at": deleteAt,
+	})
+}
+
+// writeAccountDeletionError maps errors from deleting an account to responses
+func writeAccountDeletionError(w http.ResponseWriter, err error) {
+	if err == models.ErrLastOrgOwner {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Account is the last owner of an organization, transfer ownership or delete the organization first"})
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to delete account"})
+}
+
+// getAccountDeletionGracePeriod gets how long deleted accounts can still be restored
+func getAccountDeletionGracePeriod() time.Duration {
+	hours, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_HOURS"))
+	if err != nil || hours < 0 {
+		return 7 * 24 * time.Hour // Default 7 days
+	}
+	return time.Duration(hours) * time.Hour
+}
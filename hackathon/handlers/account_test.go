@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"file-uploader/auth"
+	"file-uploader/models"
+)
+
+// accountTest holds an account handler and a user with a password and a personal file
+type accountTest struct {
+	*testModels
+	handler *AccountHandler
+	user    *models.User
+	file    *models.FileMetadata
+}
+
+func newAccountTest(t *testing.T) *accountTest {
+	t.Helper()
+	t.Setenv("ARGON2_MEMORY_KB", "1024")
+	t.Setenv("ARGON2_ITERATIONS", "1")
+	m := newTestModels(t)
+
+	user, err := m.users.Create("alice", "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "upload_test")
+	if err := os.WriteFile(path, []byte("not really a png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := m.files.Create(&models.FileMetadata{
+		UserID: user.ID, Filename: "a.png", ContentType: "image/png", Size: 16, FilePath: path,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &accountTest{
+		testModels: m,
+		handler:    NewAccountHandler(m.users, m.files, auth.NewLocalAuthenticator(m.users)),
+		user:       user,
+		file:       file,
+	}
+}
+
+// delete requests deletion of the test user's account with the given password
+func (a *accountTest) delete(t *testing.T, password string) int {
+	t.Helper()
+	return call(t, a.handler.Delete, withUser(jsonRequest(t, map[string]string{"password": password}), a.user), nil)
+}
+
+func TestMeReportsHowTheRequestWasAuthenticated(t *testing.T) {
+	a := newAccountTest(t)
+
+	var profile struct {
+		Username   string   `json:"username"`
+		Password   *string  `json:"password"`
+		Scopes     []string `json:"scopes"`
+		AuthMethod string   `json:"auth_method"`
+	}
+	r := withUser(httptest.NewRequest(http.MethodGet, "/", nil), a.user)
+	r = r.WithContext(context.WithValue(r.Context(), "auth_method", "api_key"))
+	w := httptest.NewRecorder()
+	a.handler.Me(w, r)
+	if err := json.Unmarshal(w.Body.Bytes(), &profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Username != "alice" || profile.Password != nil || profile.AuthMethod != "api_key" {
+		t.Errorf("profile = %+v", profile)
+	}
+	// Clients can always iterate the scopes
+	if profile.Scopes == nil || len(profile.Scopes) != 0 {
+		t.Errorf("scopes = %#v, want an empty list", profile.Scopes)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+}
+
+func TestExportContainsOnlyTheUsersData(t *testing.T) {
+	a := newAccountTest(t)
+	bob, err := a.users.CreateExternal("bob", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.files.Create(&models.FileMetadata{
+		UserID: bob.ID, Filename: "b.png", ContentType: "image/png", Size: 5, FilePath: a.file.FilePath,
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Files missing on disk are left out rather than failing the export
+	if _, err := a.files.Create(&models.FileMetadata{
+		UserID: a.user.ID, Filename: "gone.png", ContentType: "image/png", Size: 5, FilePath: filepath.Join(t.TempDir(), "gone"),
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	a.handler.Export(w, withUser(httptest.NewRequest(http.MethodGet, "/", nil), a.user))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("status = %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(map[string]string)
+	for _, entry := range archive.File {
+		f, err := entry.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(f)
+		f.Close()
+		entries[entry.Name] = string(content)
+	}
+	fileEntry := "files/" + strconv.Itoa(a.file.ID) + "_a.png"
+	if len(entries) != 3 || entries[fileEntry] != "not really a png" {
+		t.Errorf("entries = %v, want profile.json, files.json and %s", entries, fileEntry)
+	}
+	if profile := entries["profile.json"]; !strings.Contains(profile, `"username": "alice"`) || strings.Contains(profile, "$argon2id$") {
+		t.Errorf("profile.json = %s", profile)
+	}
+	if files := entries["files.json"]; !strings.Contains(files, "gone.png") || strings.Contains(files, "b.png") {
+		t.Errorf("files.json = %s, want both of alice's files and none of bob's", files)
+	}
+}
+
+func TestAccountDeletionRequiresThePassword(t *testing.T) {
+	a := newAccountTest(t)
+
+	if status := a.delete(t, ""); status != http.StatusBadRequest {
+		t.Errorf("missing password status = %d, want 400", status)
+	}
+	if status := a.delete(t, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("wrong password status = %d, want 401", status)
+	}
+	if user, _ := a.users.GetByID(a.user.ID); user.DeletionScheduledAt != nil {
+		t.Error("a rejected request scheduled the deletion")
+	}
+
+	// Accounts without a password are deleted by an administrator
+	oidcUser, err := a.users.CreateExternal("carol", models.AuthSourceOIDC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := withUser(jsonRequest(t, map[string]string{"password": "anything"}), oidcUser)
+	if status := call(t, a.handler.Delete, r, nil); status != http.StatusBadRequest {
+		t.Errorf("OIDC account status = %d, want 400", status)
+	}
+}
+
+func TestAccountDeletionWaitsForTheGracePeriod(t *testing.T) {
+	a := newAccountTest(t)
+	t.Setenv("ACCOUNT_DELETION_GRACE_HOURS", "24")
+
+	if status := a.delete(t, "correct horse"); status != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", status)
+	}
+	user, err := a.users.GetByID(a.user.ID)
+	if err != nil || user.DeletionScheduledAt == nil {
+		t.Fatalf("user = %+v, %v, want a scheduled deletion", user, err)
+	}
+	if _, err := os.Stat(a.file.FilePath); err != nil {
+		t.Errorf("file removed during the grace period: %v", err)
+	}
+
+	t.Setenv("ACCOUNT_DELETION_GRACE_HOURS", "0")
+	if status := a.delete(t, "correct horse"); status != http.StatusOK {
+		t.Fatalf("status without grace period = %d, want 200", status)
+	}
+	if _, err := a.users.GetByID(a.user.ID); err == nil {
+		t.Error("user still exists")
+	}
+	if _, err := os.Stat(a.file.FilePath); !os.IsNotExist(err) {
+		t.Errorf("file still on disk: %v", err)
+	}
+	if n := a.count(t, "files"); n != 0 {
+		t.Errorf("files rows = %d, want 0", n)
+	}
+}
+
+func TestLastOrganizationOwnerCannotDeleteTheAccount(t *testing.T) {
+	a := newAccountTest(t)
+	if _, err := a.orgs.Create("acme", a.user.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := a.delete(t, "correct horse"); status != http.StatusConflict {
+		t.Errorf("status = %d, want 409", status)
+	}
+	if user, _ := a.users.GetByID(a.user.ID); user.DeletionScheduledAt != nil {
+		t.Error("deletion was scheduled for the last owner")
+	}
+}
@@ -0,0 +1,559 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-uploader/jobs"
+	"file-uploader/models"
+	"file-uploader/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// Paging limits for the admin user listing
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+// AdminHandler handles account management by administrators
+type AdminHandler struct {
+	userModel  *models.UserModel
+	fileModel  *models.FileModel
+	auditModel *models.AuditModel
+}
+
+// NewAdminHandler creates a new AdminHandler
+func NewAdminHandler(userModel *models.UserModel, fileModel *models.FileModel, auditModel *models.AuditModel) *AdminHandler {
+	return &AdminHandler{
+		userModel:  userModel,
+		fileModel:  fileModel,
+		auditModel: auditModel,
+	}
+}
+
+// AdminUser is a user together with their storage usage
+type AdminUser struct {
+	*models.User
+	Usage *models.FileUsage `json:"usage"`
+}
+
+// SetRoleRequest represents the role change payload
+type SetRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// SetFileRetentionRequest represents the file retention payload
+type SetFileRetentionRequest struct {
+	FileRetentionHours *int `json:"file_retention_hours"` // null restores the default, 0 keeps files forever
+}
+
+// ReconcileRequest represents the reconciliation payload
+type ReconcileRequest struct {
+	Mode string `json:"mode"` // report (default), quarantine or clean
+}
+
+// ImpersonateRequest represents the impersonation payload
+type ImpersonateRequest struct {
+	ExpiresIn int    `json:"expires_in"` // Lifetime in seconds, capped by IMPERSONATION_MAX_MINUTES
+	Reason    string `json:"reason"`     // Recorded in the audit log
+}
+
+// ImpersonateResponse represents a newly issued impersonation token
+type ImpersonateResponse struct {
+	Token     string       `json:"token"`
+	User      *models.User `json:"user"`
+	Scopes    []string     `json:"scopes"`
+	ExpiresAt time.Time    `json:"expires_at"`
+}
+
+// ListUsers lists and searches users.
+// Query parameters: q (username or email substring), role, status (active or disabled), limit, offset.
+func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	filter := models.UserFilter{
+		Query:  strings.TrimSpace(query.Get("q")),
+		Role:   query.Get("role"),
+		Status: query.Get("status"),
+		Limit:  defaultAdminPageSize,
+	}
+
+	if filter.Role != "" && !isValidRole(filter.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid role"})
+		return
+	}
+	if filter.Status != "" && filter.Status != models.UserStatusActive && filter.Status != models.UserStatusDisabled {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Status must be active or disabled"})
+		return
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxAdminPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "limit must be between 1 and 200"})
+			return
+		}
+		filter.Limit = limit
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "offset must not be negative"})
+			return
+		}
+		filter.Offset = offset
+	}
+
+	users, total, err := h.userModel.Search(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list users"})
+		return
+	}
+
+	result := make([]*AdminUser, 0, len(users))
+	for _, user := range users {
+		usage, err := h.fileModel.GetUsageByUser(user.ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load usage"})
+			return
+		}
+		result = append(result, &AdminUser{User: user, Usage: usage})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":  result,
+		"total":  total,
+		"limit":  filter.Limit,
+		"offset": filter.Offset,
+	})
+}
+
+// GetUser returns a single user with their storage usage
+func (h *AdminHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	usage, err := h.fileModel.GetUsageByUser(user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load usage"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(AdminUser{User: user, Usage: usage})
+}
+
+// ListUserFiles returns the metadata of all files uploaded by a user
+func (h *AdminHandler) ListUserFiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	files, err := h.fileModel.ListByUser(user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list files"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files": files,
+	})
+}
+
+// DisableUser disables an account. Existing tokens and API keys stop working immediately.
+func (h *AdminHandler) DisableUser(w http.ResponseWriter, r *http.Request) {
+	h.setDisabled(w, r, true)
+}
+
+// EnableUser re-enables a disabled account
+func (h *AdminHandler) EnableUser(w http.ResponseWriter, r *http.Request) {
+	h.setDisabled(w, r, false)
+}
+
+// setDisabled changes the disabled state of the user in the URL
+func (h *AdminHandler) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	if disabled && isCurrentUser(r, user) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "You cannot disable your own account"})
+		return
+	}
+
+	if err := h.userModel.SetDisabled(user.ID, disabled); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update user"})
+		return
+	}
+
+	action, message := AuditActionUserEnable, "User enabled successfully"
+	if disabled {
+		action, message = AuditActionUserDisable, "User disabled successfully"
+	}
+	h.auditUserChange(r, action, user, fmt.Sprintf("disabled %t -> %t", user.IsDisabled(), disabled))
+	h.writeUser(w, user.ID, message)
+}
+
+// ForcePasswordReset requires the user to choose a new password on next login.
+// Existing tokens and API keys are rejected until then.
+func (h *AdminHandler) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.AuthSource != models.AuthSourceLocal {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Password is managed by " + user.AuthSource})
+		return
+	}
+
+	if err := h.userModel.SetPasswordResetRequired(user.ID, true); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update user"})
+		return
+	}
+
+	h.auditUserChange(r, AuditActionPasswordReset, user,
+		fmt.Sprintf("password_reset_required %t -> true", user.PasswordResetRequired))
+	h.writeUser(w, user.ID, "Password reset required on next login")
+}
+
+// SetRole changes a user's role. It takes effect on the user's next request.
+func (h *AdminHandler) SetRole(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req SetRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	if !isValidRole(req.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Role must be user or admin"})
+		return
+	}
+
+	if req.Role != models.RoleAdmin && isCurrentUser(r, user) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "You cannot remove your own admin role"})
+		return
+	}
+
+	if err := h.userModel.SetRole(user.ID, req.Role); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update user"})
+		return
+	}
+
+	h.auditUserChange(r, AuditActionRoleChange, user, fmt.Sprintf("role %s -> %s", user.Role, req.Role))
+	h.writeUser(w, user.ID, "Role updated successfully")
+}
+
+// SetFileRetention changes how long a user's future uploads are kept. Files already
+// uploaded keep their expiry.
+func (h *AdminHandler) SetFileRetention(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req SetFileRetentionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	if req.FileRetentionHours != nil && *req.FileRetentionHours < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "file_retention_hours must not be negative"})
+		return
+	}
+
+	if err := h.userModel.SetFileRetention(user.ID, req.FileRetentionHours); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update user"})
+		return
+	}
+
+	h.auditUserChange(r, AuditActionFileRetention, user, fmt.Sprintf("file_retention_hours %s -> %s",
+		formatRetention(user.FileRetentionHours), formatRetention(req.FileRetentionHours)))
+	h.writeUser(w, user.ID, "File retention updated successfully")
+}
+
+// Reconcile compares the database with the upload directory and reports rows without
+// blobs, blobs without rows and size mismatches, optionally quarantining or cleaning them
+func (h *AdminHandler) Reconcile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// The body is optional
+	var req ReconcileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = jobs.ReconcileModeReport
+	}
+	if !jobs.IsValidReconcileMode(req.Mode) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Mode must be report, quarantine or clean"})
+		return
+	}
+
+	report, err := jobs.Reconcile(h.fileModel, getUploadDir(), req.Mode)
+	if err != nil {
+		log.Printf("Reconciliation failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Reconciliation failed"})
+		return
+	}
+
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:  AuditActionReconcile,
+		Outcome: models.AuditOutcomeSuccess,
+		Detail: fmt.Sprintf("%s: %d missing, %d mismatched, %d orphaned",
+			req.Mode, len(report.MissingBlobs), len(report.SizeMismatches), len(report.OrphanBlobs)),
+	})
+	json.NewEncoder(w).Encode(report)
+}
+
+// DeleteUser deletes an account with its files, API keys and linked identities
+func (h *AdminHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	if isCurrentUser(r, user) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "You cannot delete your own account"})
+		return
+	}
+
+	filePaths, err := h.userModel.Delete(user.ID)
+	if err == models.ErrLastOrgOwner {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User is the last owner of an organization, transfer ownership first"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to delete user"})
+		return
+	}
+
+	// The rows are gone, a blob that cannot be removed now is only wasted space
+	removed := utils.RemoveFiles(filePaths)
+	h.auditUserChange(r, AuditActionUserDelete, user, fmt.Sprintf("role %s, %d files deleted", user.Role, removed))
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "User deleted successfully",
+		"files_deleted": removed,
+	})
+}
+
+// auditUserChange records a change an administrator made to a user. The detail holds the
+// old and new values and starts with the username, which outlives a deleted account.
+func (h *AdminHandler) auditUserChange(r *http.Request, action string, user *models.User, detail string) {
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:     action,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Outcome:    models.AuditOutcomeSuccess,
+		Detail:     user.Username + ": " + detail,
+	})
+}
+
+// Impersonate issues a short-lived token that acts as the user. The token records the
+// administrator, requests made with it are logged and audited, and actions reserved for the
+// account owner are blocked. Administrators cannot be impersonated.
+func (h *AdminHandler) Impersonate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	adminID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+	adminUsername, _ := r.Context().Value("username").(string)
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req ImpersonateRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+			return
+		}
+	}
+
+	maxTTL := getImpersonationMaxTTL()
+	ttl := maxTTL
+	if req.ExpiresIn < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "expires_in must not be negative"})
+		return
+	}
+	if req.ExpiresIn > 0 && time.Duration(req.ExpiresIn)*time.Second < maxTTL {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+
+	event := models.AuditEvent{
+		Action:     AuditActionImpersonate,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Outcome:    models.AuditOutcomeDenied,
+		Detail:     req.Reason,
+	}
+
+	switch {
+	case user.ID == adminID:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "You cannot impersonate yourself"})
+		return
+	case user.Role == models.RoleAdmin:
+		recordAudit(h.auditModel, r, event)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Administrators cannot be impersonated"})
+		return
+	case user.IsDisabled() || user.IsPendingDeletion():
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Account is disabled or scheduled for deletion"})
+		return
+	}
+
+	actor := utils.ActorClaim{UserID: adminID, Username: adminUsername}
+	token, claims, err := utils.GenerateImpersonationToken(actor, user.ID, user.Username, utils.DelegableScopes(user.Scopes()), ttl)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+
+	event.Outcome = models.AuditOutcomeSuccess
+	recordAudit(h.auditModel, r, event)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ImpersonateResponse{
+		Token:     token,
+		User:      user,
+		Scopes:    claims.Scopes,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+}
+
+// getImpersonationMaxTTL gets the maximum lifetime of impersonation tokens
+func getImpersonationMaxTTL() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("IMPERSONATION_MAX_MINUTES"))
+	if err != nil || minutes <= 0 {
+		return 15 * time.Minute // Default 15 minutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// formatRetention formats a file retention override for the audit log
+func formatRetention(hours *int) string {
+	if hours == nil {
+		return "default"
+	}
+	return strconv.Itoa(*hours)
+}
+
+// loadUser loads the user named by the userId route variable, writing an error response on failure
+func (h *AdminHandler) loadUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid user ID"})
+		return nil, false
+	}
+
+	user, err := h.userModel.GetByID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "User not found"})
+			return nil, false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return nil, false
+	}
+	return user, true
+}
+
+// writeUser reloads a user after an update and writes it with a message
+func (h *AdminHandler) writeUser(w http.ResponseWriter, userID int, message string) {
+	user, err := h.userModel.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": message,
+		"user":    user,
+	})
+}
+
+// isCurrentUser reports whether user is the authenticated caller
+func isCurrentUser(r *http.Request, user *models.User) bool {
+	userID, _ := r.Context().Value("user_id").(int)
+	return userID == user.ID
+}
+
+// isValidRole reports whether role is a known user role
+func isValidRole(role string) bool {
+	return role == models.RoleUser || role == models.RoleAdmin
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"file-uploader/models"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAdminActionsAreAudited(t *testing.T) {
+	m := newTestModels(t)
+	handler := NewAdminHandler(m.users, m.files, m.audit)
+
+	admin, err := m.users.CreateExternal("root-admin", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := m.users.CreateExternal("bob", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetID := strconv.Itoa(target.ID)
+	retention := 48
+
+	for _, step := range []struct {
+		handler http.HandlerFunc
+		body    interface{}
+		action  string
+		detail  string
+	}{
+		{handler.DisableUser, nil, AuditActionUserDisable, "bob: disabled false -> true"},
+		{handler.EnableUser, nil, AuditActionUserEnable, "bob: disabled true -> false"},
+		{handler.SetRole, SetRoleRequest{Role: models.RoleAdmin}, AuditActionRoleChange, "bob: role user -> admin"},
+		{handler.ForcePasswordReset, nil, AuditActionPasswordReset, "bob: password_reset_required false -> true"},
+		{handler.SetFileRetention, SetFileRetentionRequest{FileRetentionHours: &retention}, AuditActionFileRetention, "bob: file_retention_hours default -> 48"},
+		{handler.SetFileRetention, SetFileRetentionRequest{}, AuditActionFileRetention, "bob: file_retention_hours 48 -> default"},
+		{handler.DeleteUser, nil, AuditActionUserDelete, "bob: role admin, 0 files deleted"},
+	} {
+		r := mux.SetURLVars(withUser(jsonRequest(t, step.body), admin), map[string]string{"userId": targetID})
+		if code := call(t, step.handler, r, nil); code != http.StatusOK {
+			t.Fatalf("%s status = %d", step.action, code)
+		}
+
+		events, _, err := m.audit.Query(models.AuditFilter{Action: step.action, Limit: 1})
+		if err != nil || len(events) != 1 {
+			t.Fatalf("%s: events = %v, %v", step.action, events, err)
+		}
+		event := events[0]
+		if event.ActorID == nil || *event.ActorID != admin.ID || event.TargetType != "user" || event.TargetID != targetID {
+			t.Errorf("%s: actor %v, target %s %s, want admin acting on user %s", step.action, event.ActorID, event.TargetType, event.TargetID, targetID)
+		}
+		if event.Outcome != models.AuditOutcomeSuccess || event.Detail != step.detail {
+			t.Errorf("%s: %s %q, want success %q", step.action, event.Outcome, event.Detail, step.detail)
+		}
+	}
+}
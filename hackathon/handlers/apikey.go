@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-uploader/middleware"
+	"file-uploader/models"
+	"file-uploader/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAPIKeyNameLength limits the length of API key names
+const maxAPIKeyNameLength = 100
+
+// APIKeyHandler handles personal API key management
+type APIKeyHandler struct {
+	apiKeyModel *models.APIKeyModel
+}
+
+// NewAPIKeyHandler creates a new APIKeyHandler
+func NewAPIKeyHandler(apiKeyModel *models.APIKeyModel) *APIKeyHandler {
+	return &APIKeyHandler{
+		apiKeyModel: apiKeyModel,
+	}
+}
+
+// CreateAPIKeyRequest represents the API key creation payload
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"` // 0 means the key never expires
+}
+
+// CreateAPIKeyResponse represents the API key creation response.
+// Key holds the raw secret and is only ever returned here.
+type CreateAPIKeyResponse struct {
+	Message string         `json:"message"`
+	Key     string         `json:"key"`
+	APIKey  *models.APIKey `json:"api_key"`
+}
+
+// Create issues a new API key for the authenticated user
+func (h *APIKeyHandler) Create(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	// Keys must not be able to mint further keys
+	if method, _ := r.Context().Value("auth_method").(string); method == middleware.AuthMethodAPIKey {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "API keys cannot be used to create API keys"})
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	// Validate input
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPIKeyNameLength {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Name is required and must be at most 100 characters"})
+		return
+	}
+
+	if req.ExpiresInDays < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "expires_in_days must not be negative"})
+		return
+	}
+
+	granted, _ := r.Context().Value("scopes").([]string)
+	granted = utils.DelegableScopes(granted)
+	scopes := req.Scopes
+	if len(scopes) == 0 {
+		scopes = granted
+	}
+	if err := utils.ValidateDelegatedScopes(scopes); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	if !utils.IsSubset(scopes, granted) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Requested scopes exceed your permissions"})
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+		expiresAt = &t
+	}
+
+	key, rawKey, err := h.apiKeyModel.Create(userID, req.Name, scopes, expiresAt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to create API key"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateAPIKeyResponse{
+		Message: "API key created successfully. Store it now, it will not be shown again",
+		Key:     rawKey,
+		APIKey:  key,
+	})
+}
+
+// List returns the authenticated user's API keys without their secrets
+func (h *APIKeyHandler) List(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	keys, err := h.apiKeyModel.ListByUser(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list API keys"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"api_keys": keys,
+	})
+}
+
+// Revoke revokes one of the authenticated user's API keys
+func (h *APIKeyHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	keyID, err := strconv.Atoi(mux.Vars(r)["keyId"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid API key ID"})
+		return
+	}
+
+	if err := h.apiKeyModel.Revoke(keyID, userID); err != nil {
+		if err == models.ErrAPIKeyNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "API key not found or already revoked"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to revoke API key"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "API key revoked successfully",
+	})
+}
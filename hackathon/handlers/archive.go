@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-uploader/models"
+)
+
+// ArchiveRequest represents the payload selecting files for a ZIP download
+type ArchiveRequest struct {
+	FileIDs []FileRef `json:"file_ids"` // Public IDs, or legacy integer IDs
+}
+
+// Archive streams a ZIP of the selected files. Every file is checked with the same
+// rules as downloads before anything is written, so the request either fails with
+// a normal error response or streams the complete archive.
+func (h *FileHandler) Archive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	var req ArchiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	// Keep the requested order, ignoring repeated IDs
+	seen := make(map[FileRef]bool)
+	fileIDs := []FileRef{}
+	for _, id := range req.FileIDs {
+		if !seen[id] {
+			seen[id] = true
+			fileIDs = append(fileIDs, id)
+		}
+	}
+	if len(fileIDs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "file_ids must list at least one file"})
+		return
+	}
+	if maxFiles := getArchiveMaxFiles(); len(fileIDs) > maxFiles {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("An archive may contain at most %d files", maxFiles)})
+		return
+	}
+
+	files := make([]*models.FileMetadata, 0, len(fileIDs))
+	added := make(map[int]bool)
+	for _, id := range fileIDs {
+		file, err := lookupFile(w, h.fileModel, string(id))
+		if err != nil && err != sql.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load files"})
+			return
+		}
+		if err != nil {
+			h.auditRead(r, string(id), models.AuditOutcomeFailure, "not_found")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("File %s not found", id)})
+			return
+		}
+		// A file may be listed by both its public and its legacy ID
+		if added[file.ID] {
+			continue
+		}
+		added[file.ID] = true
+		fileIDStr := strconv.Itoa(file.ID)
+
+		allowed, reason, err := checkFileAccess(h.orgModel, file, userID, models.OrgRoleViewer)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to check access"})
+			return
+		}
+		if !allowed {
+			h.auditRead(r, fileIDStr, models.AuditOutcomeDenied, reason)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("Access denied to file %s", id)})
+			return
+		}
+
+		if _, err := os.Stat(file.FilePath); err != nil {
+			h.auditRead(r, fileIDStr, models.AuditOutcomeFailure, "missing_on_disk")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("File %s not found on disk", id)})
+			return
+		}
+		files = append(files, file)
+	}
+
+	// Headers are sent with the first write, errors after this point abort the response
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="files-%s.zip"`, time.Now().UTC().Format("20060102-150405")))
+	w.Header().Set("Cache-Control", "no-store")
+
+	archive := zip.NewWriter(w)
+	names := make(map[string]bool)
+	for _, file := range files {
+		if err := copyFileEntry(archive, uniqueArchiveName(names, file), file); err != nil {
+			// The status is already sent, abort the connection so the client
+			// does not mistake a truncated archive for a complete one
+			log.Printf("Failed to add file %d to archive: %v", file.ID, err)
+			panic(http.ErrAbortHandler)
+		}
+		h.auditRead(r, strconv.Itoa(file.ID), models.AuditOutcomeSuccess, "archive")
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Failed to finish archive: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// auditRead records a read of a file through an archive
+func (h *FileHandler) auditRead(r *http.Request, fileID, outcome, detail string) {
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:     AuditActionFileRead,
+		TargetType: "file",
+		TargetID:   fileID,
+		Outcome:    outcome,
+		Detail:     detail,
+	})
+}
+
+// uniqueArchiveName returns a safe entry name for a file, numbering repeated names
+// like "photo (1).jpg". Names are compared case-insensitively, as most file systems do.
+func uniqueArchiveName(names map[string]bool, file *models.FileMetadata) string {
+	name := path.Base(strings.ReplaceAll(file.Filename, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." || name == "/" {
+		name = fmt.Sprintf("file-%d", file.ID)
+	}
+
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; names[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+	}
+	names[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// getArchiveMaxFiles gets the maximum number of files per archive from environment variable
+func getArchiveMaxFiles() int {
+	maxFiles, err := strconv.Atoi(os.Getenv("ARCHIVE_MAX_FILES"))
+	if err != nil || maxFiles <= 0 {
+		return 500 // Default
+	}
+	return maxFiles
+}
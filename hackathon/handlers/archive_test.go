@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"file-uploader/models"
+)
+
+// archive requests a ZIP of the given file references as the static test's owner
+func (s *staticTest) archive(t *testing.T, ids ...interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	r := withUser(jsonRequest(t, map[string]interface{}{"file_ids": ids}), s.owner)
+	w := httptest.NewRecorder()
+	NewFileHandler(s.files, s.orgs, s.audit).Archive(w, r)
+	return w
+}
+
+// addFile stores content as another file of a user
+func (s *staticTest) addFile(t *testing.T, userID int, filename, content string) *models.FileMetadata {
+	t.Helper()
+	f, err := os.CreateTemp(filepath.Dir(s.file.FilePath), "upload_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	path := f.Name()
+	file, err := s.files.Create(&models.FileMetadata{
+		UserID: userID, Filename: filename, ContentType: "image/png", Size: int64(len(content)), FilePath: path,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestArchiveContainsEachSelectedFileOnce(t *testing.T) {
+	t.Setenv("LEGACY_FILE_IDS", "true")
+	s := newStaticTest(t)
+	same := s.addFile(t, s.owner.ID, "A.PNG", "same name")
+	other := s.addFile(t, s.owner.ID, "../../etc/passwd", "traversal")
+
+	// The first file is listed by public and legacy ID, the second twice
+	w := s.archive(t, s.file.PublicID, s.file.ID, same.PublicID, same.PublicID, other.PublicID)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("status = %d, Content-Type %q, body %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ name, content string }{
+		{"a.png", "not really a png"},
+		{"A (1).PNG", "same name"},
+		{"passwd", "traversal"},
+	}
+	if len(archive.File) != len(want) {
+		t.Fatalf("%d entries, want %d", len(archive.File), len(want))
+	}
+	for i, entry := range archive.File {
+		f, err := entry.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(f)
+		f.Close()
+		if entry.Name != want[i].name || string(content) != want[i].content {
+			t.Errorf("entry %d = %q with %q, want %q with %q", i, entry.Name, content, want[i].name, want[i].content)
+		}
+	}
+	if n := s.count(t, "audit_log WHERE detail = 'archive'"); n != 3 {
+		t.Errorf("%d archive audit events, want 3", n)
+	}
+}
+
+func TestArchiveChecksEveryFileBeforeStreaming(t *testing.T) {
+	s := newStaticTest(t)
+	bob, err := s.users.CreateExternal("bob", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := s.addFile(t, bob.ID, "b.png", "bob's")
+	missing := s.addFile(t, s.owner.ID, "gone.png", "removed")
+	os.Remove(missing.FilePath)
+
+	for _, tt := range []struct {
+		name   string
+		ids    []interface{}
+		status int
+	}{
+		{"no files", nil, http.StatusBadRequest},
+		{"unknown file", []interface{}{s.file.PublicID, "0192f3c4-5d6e-7f80-9a1b-2c3d4e5f6a7b"}, http.StatusNotFound},
+		{"another user's file", []interface{}{s.file.PublicID, foreign.PublicID}, http.StatusForbidden},
+		{"missing on disk", []interface{}{s.file.PublicID, missing.PublicID}, http.StatusNotFound},
+	} {
+		w := s.archive(t, tt.ids...)
+		if w.Code != tt.status || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: status = %d, Content-Type %q, want %d with a JSON error", tt.name, w.Code, w.Header().Get("Content-Type"), tt.status)
+		}
+	}
+	if n := s.count(t, "audit_log WHERE detail = 'archive'"); n != 0 {
+		t.Errorf("%d files read from rejected archives", n)
+	}
+
+	t.Setenv("ARCHIVE_MAX_FILES", "1")
+	if w := s.archive(t, s.file.PublicID, missing.PublicID); w.Code != http.StatusBadRequest {
+		t.Errorf("too many files status = %d, want 400", w.Code)
+	}
+}
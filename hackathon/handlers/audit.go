@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+// Audited actions
+const (
+	AuditActionRegister        = "auth.register"
+	AuditActionLogin           = "auth.login"
+	AuditActionLogout          = "auth.logout"
+	AuditActionMintToken       = "auth.token_mint"
+	AuditActionPasswordChange  = "auth.password_change"
+	AuditActionFileUpload      = "file.upload"
+	AuditActionFileRead        = "file.read"
+	AuditActionFileUpdate      = "file.update"
+	AuditActionFileReplace     = "file.replace"
+	AuditActionFileRestore     = "file.restore"
+	AuditActionFileReadPublic  = "file.read_public"
+	AuditActionUserDisable     = "admin.user_disable"
+	AuditActionUserEnable      = "admin.user_enable"
+	AuditActionPasswordReset   = "admin.password_reset"
+	AuditActionRoleChange      = "admin.role_change"
+	AuditActionFileRetention   = "admin.file_retention"
+	AuditActionUserDelete      = "admin.user_delete"
+	AuditActionImpersonate     = "admin.impersonate"
+	AuditActionReconcile       = "admin.reconcile"
+	AuditActionOAuthAuthorize  = "oauth.authorize"
+	AuditActionOAuthToken      = "oauth.token"
+	AuditActionPasskeyRegister = "auth.passkey_register"
+	AuditActionPasskeyDelete   = "auth.passkey_delete"
+)
+
+// recordAudit appends an event to the audit log. The actor is taken from the request
+// context unless already set. Failures are logged and never fail the request.
+func recordAudit(auditModel *models.AuditModel, r *http.Request, event models.AuditEvent) {
+	if auditModel == nil {
+		return
+	}
+
+	if event.ActorID == nil {
+		if userID, ok := r.Context().Value("user_id").(int); ok {
+			event.ActorID = &userID
+		}
+	}
+	if event.ActorUsername == "" {
+		event.ActorUsername, _ = r.Context().Value("username").(string)
+	}
+	if actor, ok := r.Context().Value("impersonator").(*utils.ActorClaim); ok && event.ImpersonatorID == nil {
+		event.ImpersonatorID = &actor.UserID
+	}
+	event.IP = getClientIP(r)
+	event.UserAgent = r.Header.Get("User-Agent")
+
+	if err := auditModel.Record(&event); err != nil {
+		log.Printf("Failed to record audit event %s: %v", event.Action, err)
+	}
+}
+
+// AuditHandler serves the audit log to administrators
+type AuditHandler struct {
+	auditModel *models.AuditModel
+}
+
+// NewAuditHandler creates a new AuditHandler
+func NewAuditHandler(auditModel *models.AuditModel) *AuditHandler {
+	return &AuditHandler{
+		auditModel: auditModel,
+	}
+}
+
+// Query returns audit events, newest first.
+// Query parameters: user_id, action (exact or a prefix ending in "."), since, until (RFC 3339), limit, offset.
+func (h *AuditHandler) Query(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	filter.Limit = defaultAdminPageSize
+	query := r.URL.Query()
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxAdminPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "limit must be between 1 and 200"})
+			return
+		}
+		filter.Limit = limit
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "offset must not be negative"})
+			return
+		}
+		filter.Offset = offset
+	}
+
+	events, total, err := h.auditModel.Query(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to query audit log"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": events,
+		"total":  total,
+		"limit":  filter.Limit,
+		"offset": filter.Offset,
+	})
+}
+
+// Export streams all matching audit events as JSON Lines, one event per line.
+// It accepts the same filters as Query without paging.
+func (h *AuditHandler) Export(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"audit-"+time.Now().UTC().Format("20060102T150405Z")+".jsonl\"")
+
+	// json.Encoder terminates every value with a newline
+	encoder := json.NewEncoder(w)
+	if err := h.auditModel.Each(filter, func(event *models.AuditEvent) error {
+		return encoder.Encode(event)
+	}); err != nil {
+		log.Printf("Failed to export audit log: %v", err)
+	}
+}
+
+// parseAuditFilter reads the user_id, action, since and until query parameters
+func parseAuditFilter(r *http.Request) (models.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := models.AuditFilter{
+		Action: query.Get("action"),
+	}
+
+	if value := query.Get("user_id"); value != "" {
+		userID, err := strconv.Atoi(value)
+		if err != nil || userID <= 0 {
+			return filter, errors.New("user_id must be a positive integer")
+		}
+		filter.ActorID = userID
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("since must be an RFC 3339 timestamp")
+		}
+		filter.Since = since
+	}
+	if value := query.Get("until"); value != "" {
+		until, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("until must be an RFC 3339 timestamp")
+		}
+		filter.Until = until
+	}
+	return filter, nil
+}
@@ -1,23 +1,35 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
+	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
+	"file-uploader/auth"
 	"file-uploader/models"
 	"file-uploader/utils"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
 // AuthHandler handles authentication operations
 type AuthHandler struct {
-	userModel *models.UserModel
+	userModel     *models.UserModel
+	authenticator auth.Authenticator
+	emailHandler  *EmailHandler
+	auditModel    *models.AuditModel
 }
 
 // NewAuthHandler creates a new AuthHandler
-func NewAuthHandler(userModel *models.UserModel) *AuthHandler {
+func NewAuthHandler(userModel *models.UserModel, authenticator auth.Authenticator, emailHandler *EmailHandler, auditModel *models.AuditModel) *AuthHandler {
 	return &AuthHandler{
-		userModel: userModel,
+		userModel:     userModel,
+		authenticator: authenticator,
+		emailHandler:  emailHandler,
+		auditModel:    auditModel,
 	}
 }
 
@@ -25,12 +37,21 @@ func NewAuthHandler(userModel *models.UserModel) *AuthHandler {
 type RegisterRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email"`
 }
 
-// LoginRequest represents the login request payload
+// LoginRequest represents the login request payload.
+// NewPassword is only used when an administrator has forced a password reset.
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password,omitempty"`
+}
+
+// ChangePasswordRequest represents the password change payload
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
 }
 
 // AuthResponse represents the authentication response
@@ -40,6 +61,25 @@ type AuthResponse struct {
 	Message string       `json:"message"`
 }
 
+// PolicyErrorResponse lists every policy rule a registration failed
+type PolicyErrorResponse struct {
+	Error      string                  `json:"error"`
+	Violations []utils.PolicyViolation `json:"violations"`
+}
+
+// MintTokenRequest represents the payload for minting a down-scoped token
+type MintTokenRequest struct {
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"` // Lifetime in seconds, capped by the presented credential and MINT_TOKEN_MAX_TTL_MINUTES
+}
+
+// MintTokenResponse represents a newly minted down-scoped token
+type MintTokenResponse struct {
+	Token     string    `json:"token"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 // ErrorResponse represents an error response
 type ErrorResponse struct {
 	Error string `json:"error"`
@@ -63,18 +103,47 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check minimum password length
-	if len(req.Password) < 6 {
+	// Apply username and password policies
+	username, violations := utils.GetUsernamePolicy().Validate(req.Username)
+	violations = append(violations, utils.GetPasswordPolicy().Validate(req.Password, username)...)
+	if len(violations) > 0 {
+		recordAudit(h.auditModel, r, models.AuditEvent{
+			ActorUsername: username,
+			Action:        AuditActionRegister,
+			Outcome:       models.AuditOutcomeFailure,
+			Detail:        "policy_violation",
+		})
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Password must be at least 6 characters long"})
+		json.NewEncoder(w).Encode(PolicyErrorResponse{
+			Error:      "Username or password does not meet the policy",
+			Violations: violations,
+		})
 		return
 	}
 
+	// Email is optional unless EMAIL_REQUIRED is set
+	email := ""
+	if req.Email != "" || isEmailRequired() {
+		var ok bool
+		email, ok = normalizeEmail(req.Email)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "A valid email address is required"})
+			return
+		}
+	}
+
 	// Create user
-	user, err := h.userModel.Create(req.Username, req.Password)
+	user, err := h.userModel.Create(username, req.Password, email)
 	if err != nil {
 		// Check if it's a duplicate username error
 		if err.Error() == "UNIQUE constraint failed: users.username" {
+			recordAudit(h.auditModel, r, models.AuditEvent{
+				ActorUsername: username,
+				Action:        AuditActionRegister,
+				Outcome:       models.AuditOutcomeFailure,
+				Detail:        "username_taken",
+			})
 			w.WriteHeader(http.StatusConflict)
 			json.NewEncoder(w).Encode(ErrorResponse{Error: "Username already exists"})
 			return
@@ -85,19 +154,39 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate JWT token
-	token, err := utils.GenerateToken(user.ID, user.Username)
+	token, err := utils.GenerateToken(user.ID, user.Username, user.Scopes())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to generate token"})
 		return
 	}
 
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		ActorID:       &user.ID,
+		ActorUsername: user.Username,
+		Action:        AuditActionRegister,
+		TargetType:    "user",
+		TargetID:      strconv.Itoa(user.ID),
+		Outcome:       models.AuditOutcomeSuccess,
+	})
+
+	// Send the verification email, registration succeeds even if delivery fails
+	message := "User registered successfully"
+	if user.Email != "" {
+		if err := h.emailHandler.SendVerification(user); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+			message = "User registered successfully, but the verification email could not be sent"
+		} else {
+			message = "User registered successfully. Check your email to verify your address"
+		}
+	}
+
 	// Return success response
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(AuthResponse{
 		Token:   token,
 		User:    user,
-		Message: "User registered successfully",
+		Message: message,
 	})
 }
 
@@ -119,42 +208,188 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user by username
-	user, err := h.userModel.GetByUsername(req.Username)
+	// Verify credentials against the configured backends
+	user, err := h.authenticator.Authenticate(req.Username, req.Password)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == auth.ErrInvalidCredentials {
+			recordAudit(h.auditModel, r, models.AuditEvent{
+				ActorUsername: req.Username,
+				Action:        AuditActionLogin,
+				Outcome:       models.AuditOutcomeFailure,
+				Detail:        "invalid_credentials",
+			})
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid credentials"})
 			return
 		}
 		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Authentication backend error"})
 		return
 	}
 
-	// Validate password
-	if !user.ValidatePassword(req.Password) {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid credentials"})
+	loginEvent := models.AuditEvent{
+		ActorID:       &user.ID,
+		ActorUsername: user.Username,
+		Action:        AuditActionLogin,
+		Outcome:       models.AuditOutcomeDenied,
+	}
+
+	if user.IsDisabled() {
+		loginEvent.Detail = "account_disabled"
+		recordAudit(h.auditModel, r, loginEvent)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Account is disabled"})
 		return
 	}
 
+	// A forced reset is completed by logging in with a new password
+	if user.PasswordResetRequired {
+		if req.NewPassword == "" {
+			loginEvent.Detail = "password_reset_required"
+			recordAudit(h.auditModel, r, loginEvent)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Password reset required, log in again with new_password set",
+				"code":  "password_reset_required",
+			})
+			return
+		}
+		if !h.setNewPassword(w, user, req.Password, req.NewPassword) {
+			return
+		}
+		user.PasswordResetRequired = false
+		recordAudit(h.auditModel, r, models.AuditEvent{
+			ActorID:       &user.ID,
+			ActorUsername: user.Username,
+			Action:        AuditActionPasswordChange,
+			TargetType:    "user",
+			TargetID:      strconv.Itoa(user.ID),
+			Outcome:       models.AuditOutcomeSuccess,
+			Detail:        "forced_reset",
+		})
+	}
+
+	// Logging in during the grace period keeps the account
+	message := "Login successful"
+	if user.IsPendingDeletion() {
+		if err := h.userModel.CancelDeletion(user.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to cancel account deletion"})
+			return
+		}
+		user.DeletionScheduledAt = nil
+		message = "Login successful, scheduled account deletion was cancelled"
+	}
+
 	// Generate JWT token
-	token, err := utils.GenerateToken(user.ID, user.Username)
+	token, err := utils.GenerateToken(user.ID, user.Username, user.Scopes())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to generate token"})
 		return
 	}
 
+	loginEvent.Outcome = models.AuditOutcomeSuccess
+	recordAudit(h.auditModel, r, loginEvent)
+
 	// Return success response
 	json.NewEncoder(w).Encode(AuthResponse{
 		Token:   token,
 		User:    user,
-		Message: "Login successful",
+		Message: message,
 	})
 }
 
+// ChangePassword lets the authenticated user replace their local password
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Current and new password are required"})
+		return
+	}
+
+	user, err := h.userModel.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	if user.AuthSource != models.AuthSourceLocal {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Password is managed by " + user.AuthSource})
+		return
+	}
+
+	passwordEvent := models.AuditEvent{
+		Action:     AuditActionPasswordChange,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Outcome:    models.AuditOutcomeFailure,
+	}
+
+	if !user.ValidatePassword(req.CurrentPassword) {
+		passwordEvent.Detail = "invalid_current_password"
+		recordAudit(h.auditModel, r, passwordEvent)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Current password is incorrect"})
+		return
+	}
+
+	if !h.setNewPassword(w, user, req.CurrentPassword, req.NewPassword) {
+		return
+	}
+
+	passwordEvent.Outcome = models.AuditOutcomeSuccess
+	recordAudit(h.auditModel, r, passwordEvent)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password changed successfully",
+	})
+}
+
+// setNewPassword applies the password policy and stores the new password.
+// It writes the error response and returns false if the password is rejected.
+func (h *AuthHandler) setNewPassword(w http.ResponseWriter, user *models.User, currentPassword, newPassword string) bool {
+	if newPassword == currentPassword {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "New password must differ from the current password"})
+		return false
+	}
+
+	if violations := utils.GetPasswordPolicy().Validate(newPassword, user.Username); len(violations) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(PolicyErrorResponse{
+			Error:      "Password does not meet the policy",
+			Violations: violations,
+		})
+		return false
+	}
+
+	if err := h.userModel.ChangePassword(user.ID, newPassword); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update password"})
+		return false
+	}
+	return true
+}
+
 // Revoke handles token revocation (logout)
 func (h *AuthHandler) Revoke(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -169,8 +404,110 @@ func (h *AuthHandler) Revoke(w http.ResponseWriter, r *http.Request) {
 	blacklist := utils.GetTokenBlacklist()
 	blacklist.RevokeToken(tokenString)
 
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:  AuditActionLogout,
+		Outcome: models.AuditOutcomeSuccess,
+	})
+
 	// Return success response
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "Token revoked successfully",
 	})
 }
+
+// MintToken issues a token carrying a subset of the caller's scopes
+func (h *AuthHandler) MintToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	var req MintTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	// Validate input
+	if len(req.Scopes) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "At least one scope is required"})
+		return
+	}
+	if err := utils.ValidateDelegatedScopes(req.Scopes); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.ExpiresIn < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "expires_in must not be negative"})
+		return
+	}
+
+	maxTTL := getMintTokenMaxTTL()
+	ttl := min(time.Hour, maxTTL) // Default lifetime of derived tokens
+	if req.ExpiresIn > 0 {
+		ttl = min(time.Duration(req.ExpiresIn)*time.Second, maxTTL)
+	}
+
+	// API key callers have no parent token, derive from the key instead. The token
+	// records the key, so it stops working when the key is revoked, and never outlives it.
+	parent, ok := r.Context().Value("claims").(*utils.Claims)
+	if !ok {
+		key, ok := r.Context().Value("api_key").(*models.APIKey)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+			return
+		}
+		parent = &utils.Claims{UserID: userID, Username: key.Username, Scopes: key.Scopes, APIKeyID: key.ID}
+		if key.ExpiresAt != nil {
+			parent.ExpiresAt = jwt.NewNumericDate(*key.ExpiresAt)
+		}
+	}
+
+	token, claims, err := utils.GenerateScopedToken(parent, req.Scopes, ttl)
+	if err != nil {
+		if err == utils.ErrScopeEscalation {
+			recordAudit(h.auditModel, r, models.AuditEvent{
+				Action:  AuditActionMintToken,
+				Outcome: models.AuditOutcomeDenied,
+				Detail:  "scopes=" + utils.JoinScopes(req.Scopes),
+			})
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Requested scopes exceed your permissions"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:  AuditActionMintToken,
+		Outcome: models.AuditOutcomeSuccess,
+		Detail:  "scopes=" + utils.JoinScopes(claims.Scopes),
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(MintTokenResponse{
+		Token:     token,
+		Scopes:    claims.Scopes,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+}
+
+// getMintTokenMaxTTL gets the maximum lifetime of tokens derived through MintToken
+func getMintTokenMaxTTL() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("MINT_TOKEN_MAX_TTL_MINUTES"))
+	if err != nil || minutes <= 0 {
+		return time.Hour // Default 1 hour
+	}
+	return time.Duration(minutes) * time.Minute
+}
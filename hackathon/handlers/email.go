@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-uploader/mailer"
+	"file-uploader/models"
+)
+
+// EmailHandler handles email address changes and verification
+type EmailHandler struct {
+	userModel         *models.UserModel
+	verificationModel *models.EmailVerificationModel
+	mailer            mailer.Mailer
+}
+
+// NewEmailHandler creates a new EmailHandler
+func NewEmailHandler(userModel *models.UserModel, verificationModel *models.EmailVerificationModel, m mailer.Mailer) *EmailHandler {
+	return &EmailHandler{
+		userModel:         userModel,
+		verificationModel: verificationModel,
+		mailer:            m,
+	}
+}
+
+// VerifyEmailRequest represents the email verification payload
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// ChangeEmailRequest represents the email change payload
+type ChangeEmailRequest struct {
+	Email string `json:"email"`
+}
+
+// Verify confirms an email address using the token from the verification email.
+// The token is accepted as JSON body or as ?token= so the emailed link works directly.
+func (h *EmailHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		var req VerifyEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+			return
+		}
+		token = req.Token
+	}
+
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Verification token is required"})
+		return
+	}
+
+	userID, err := h.verificationModel.Verify(token)
+	if err != nil {
+		if err == models.ErrVerificationTokenInvalid {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Verification token is invalid or has expired"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to verify email"})
+		return
+	}
+
+	user, err := h.userModel.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Email verified successfully",
+		"user":    user,
+	})
+}
+
+// Resend sends a fresh verification email to the authenticated user
+func (h *EmailHandler) Resend(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	user, err := h.userModel.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	if user.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "No email address on file"})
+		return
+	}
+	if user.EmailVerified() {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Email is already verified"})
+		return
+	}
+
+	// Throttle resends to avoid mail flooding
+	if lastSent, err := h.verificationModel.LastSentAt(user.ID); err == nil {
+		if wait := getEmailResendCooldown() - time.Since(lastSent); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Please wait before requesting another verification email"})
+			return
+		}
+	}
+
+	if err := h.SendVerification(user); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to send verification email"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Verification email sent",
+	})
+}
+
+// ChangeEmail sets a new email address for the authenticated user and sends a verification email
+func (h *EmailHandler) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	var req ChangeEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid email address"})
+		return
+	}
+
+	if err := h.userModel.SetEmail(userID, email, false); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update email"})
+		return
+	}
+
+	user, err := h.userModel.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	message := "Email updated, check your inbox to verify it"
+	if err := h.SendVerification(user); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		message = "Email updated, but the verification email could not be sent. Request a new one later"
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": message,
+		"user":    user,
+	})
+}
+
+// SendVerification issues a verification token for the user's current email and mails it
+func (h *EmailHandler) SendVerification(user *models.User) error {
+	token, err := h.verificationModel.Create(user.ID, user.Email, getEmailVerificationTTL())
+	if err != nil {
+		return err
+	}
+
+	link := getAppBaseURL() + "/api/v1/email/verify?token=" + url.QueryEscape(token)
+	return h.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nPlease confirm your email address by opening the link below:\n\n%s\n\n"+
+			"The link expires in %s. If you did not create an account, you can ignore this email.\n",
+			user.Username, link, getEmailVerificationTTL()),
+	})
+}
+
+// normalizeEmail validates a bare email address (no display name) and lowercases it
+func normalizeEmail(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || addr.Address != raw || len(raw) > 254 {
+		return "", false
+	}
+	return strings.ToLower(addr.Address), true
+}
+
+// isEmailRequired reports whether registration requires an email address
+func isEmailRequired() bool {
+	return os.Getenv("EMAIL_REQUIRED") == "true"
+}
+
+// getEmailVerificationTTL gets how long verification links stay valid
+func getEmailVerificationTTL() time.Duration {
+	hours, err := strconv.Atoi(os.Getenv("EMAIL_VERIFICATION_TTL_HOURS"))
+	if err != nil || hours <= 0 {
+		return 24 * time.Hour // Default 24 hours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// getEmailResendCooldown gets the minimum delay between verification emails
+func getEmailResendCooldown() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("EMAIL_RESEND_COOLDOWN_SECONDS"))
+	if err != nil || seconds < 0 {
+		return time.Minute // Default 1 minute
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// getAppBaseURL gets the public base URL used in links sent to users
+func getAppBaseURL() string {
+	baseURL := os.Getenv("APP_BASE_URL")
+	if baseURL == "" {
+		return "http://localhost:8080" // Default fallback
+	}
+	return strings.TrimSuffix(baseURL, "/")
+}
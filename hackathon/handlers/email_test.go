@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"file-uploader/mailer"
+	"file-uploader/models"
+)
+
+// recordingMailer keeps sent messages, or fails every send when err is set
+type recordingMailer struct {
+	sent []mailer.Message
+	err  error
+}
+
+func (m *recordingMailer) Send(msg mailer.Message) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// newEmailTest returns an email handler and a user with an unverified address
+func newEmailTest(t *testing.T, m mailer.Mailer) (*testModels, *EmailHandler, *models.User) {
+	t.Helper()
+	tm := newTestModels(t)
+	verifications := models.NewEmailVerificationModel(tm.db)
+	if err := verifications.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	user, err := tm.users.CreateExternal("dana", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.users.SetEmail(user.ID, "dana@example.com", false); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = tm.users.GetByID(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	return tm, NewEmailHandler(tm.users, verifications, m), user
+}
+
+var verifyLink = regexp.MustCompile(`http://\S+/api/v1/email/verify\?token=\S+`)
+
+func TestEmailVerificationLinkVerifiesAddress(t *testing.T) {
+	sink := &recordingMailer{}
+	tm, handler, user := newEmailTest(t, sink)
+
+	if code := call(t, handler.Resend, withUser(jsonRequest(t, nil), user), nil); code != http.StatusOK {
+		t.Fatalf("resend status = %d", code)
+	}
+	if len(sink.sent) != 1 || sink.sent[0].To != "dana@example.com" {
+		t.Fatalf("sent = %+v, want one message to dana@example.com", sink.sent)
+	}
+	link, err := url.Parse(verifyLink.FindString(sink.sent[0].Body))
+	if err != nil || link.Query().Get("token") == "" {
+		t.Fatalf("message has no verification link:\n%s", sink.sent[0].Body)
+	}
+
+	verify := httptest.NewRequest(http.MethodGet, link.RequestURI(), nil)
+	if code := call(t, handler.Verify, verify, nil); code != http.StatusOK {
+		t.Fatalf("verify status = %d", code)
+	}
+	if user, err = tm.users.GetByID(user.ID); err != nil || !user.EmailVerified() {
+		t.Errorf("email is not verified after following the link: %+v, %v", user, err)
+	}
+
+	// Links work once
+	verify = httptest.NewRequest(http.MethodGet, link.RequestURI(), nil)
+	if code := call(t, handler.Verify, verify, nil); code != http.StatusBadRequest {
+		t.Errorf("second verify status = %d, want 400", code)
+	}
+}
+
+func TestEmailResendReportsSendFailure(t *testing.T) {
+	_, handler, user := newEmailTest(t, &recordingMailer{err: errors.New("connection refused")})
+
+	if code := call(t, handler.Resend, withUser(jsonRequest(t, nil), user), nil); code != http.StatusBadGateway {
+		t.Errorf("resend status = %d, want 502", code)
+	}
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+// FileRef refers to a file in a request: its public ID, or its legacy integer ID while
+// those are accepted. In JSON it may be a string or a number.
+type FileRef string
+
+// UnmarshalJSON accepts both "0190..." and 12
+func (f *FileRef) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*f = FileRef(s)
+		return nil
+	}
+	var id int
+	if err := json.Unmarshal(data, &id); err != nil {
+		return err
+	}
+	*f = FileRef(strconv.Itoa(id))
+	return nil
+}
+
+// lookupFile loads the file a reference points to, returning sql.ErrNoRows for unknown
+// or malformed references. Integer IDs are resolved only while LEGACY_FILE_IDS is
+// enabled, and mark the response as deprecated so clients move to public IDs. It is
+// meant for authenticated routes, unauthenticated ones accept public IDs only.
+func lookupFile(w http.ResponseWriter, fileModel *models.FileModel, ref string) (*models.FileMetadata, error) {
+	if utils.IsUUID(ref) {
+		return fileModel.GetByPublicID(ref)
+	}
+	id, err := strconv.Atoi(ref)
+	if err != nil || !legacyFileIDsEnabled() {
+		return nil, sql.ErrNoRows
+	}
+	file, err := fileModel.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set("Deprecation", "true")
+	return file, nil
+}
+
+// legacyFileIDsEnabled reports whether files can still be addressed by their integer ID
+func legacyFileIDsEnabled() bool {
+	return os.Getenv("LEGACY_FILE_IDS") != "false"
+}
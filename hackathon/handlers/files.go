@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"file-uploader/models"
+
+	"github.com/gorilla/mux"
+)
+
+// Editable file metadata length limits
+const (
+	maxFilenameLength    = 255
+	maxDescriptionLength = 2000
+	maxAltTextLength     = 1000
+)
+
+// FileHandler handles file metadata operations
+type FileHandler struct {
+	fileModel  *models.FileModel
+	orgModel   *models.OrganizationModel
+	auditModel *models.AuditModel
+}
+
+// NewFileHandler creates a new FileHandler
+func NewFileHandler(fileModel *models.FileModel, orgModel *models.OrganizationModel, auditModel *models.AuditModel) *FileHandler {
+	return &FileHandler{
+		fileModel:  fileModel,
+		orgModel:   orgModel,
+		auditModel: auditModel,
+	}
+}
+
+// List returns the metadata of the files the authenticated user can access:
+// personal files plus the files of every organization the user belongs to.
+// The optional org_id query parameter restricts the list to one organization.
+func (h *FileHandler) List(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	var files []*models.FileMetadata
+	var err error
+	if value := r.URL.Query().Get("org_id"); value != "" {
+		orgID, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid organization ID"})
+			return
+		}
+		if _, roleErr := h.orgModel.GetRole(orgID, userID); roleErr != nil {
+			if roleErr == models.ErrNotOrgMember {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(ErrorResponse{Error: "Organization not found"})
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load organization"})
+			return
+		}
+		files, err = h.fileModel.ListByOrg(orgID)
+	} else {
+		files, err = h.fileModel.ListAccessible(userID)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list files"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files": files,
+	})
+}
+
+// UpdateFileRequest represents the file metadata update payload. Omitted fields are left
+// unchanged, revision must be the revision the client last read.
+type UpdateFileRequest struct {
+	Revision    int     `json:"revision"`
+	Filename    *string `json:"filename"`
+	Description *string `json:"description"`
+	AltText     *string `json:"alt_text"`
+}
+
+// Update changes the filename, description and alt text of a file. Personal files can be
+// edited by their owner, organization files by editors and owners. The update is rejected
+// with 409 Conflict if the file changed since the client read the given revision.
+func (h *FileHandler) Update(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	var req UpdateFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+	if req.Revision <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "revision is required"})
+		return
+	}
+
+	file, err := lookupFile(w, h.fileModel, mux.Vars(r)["fileId"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "File not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load file"})
+		return
+	}
+	fileIDStr := strconv.Itoa(file.ID)
+
+	allowed, reason, err := checkFileAccess(h.orgModel, file, userID, models.OrgRoleEditor)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to check access"})
+		return
+	}
+	if !allowed {
+		h.auditUpdate(r, fileIDStr, models.AuditOutcomeDenied, reason)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	update := models.FileMetadataUpdate{}
+	changed := []string{}
+	if req.Filename != nil {
+		filename := strings.TrimSpace(*req.Filename)
+		if message := validateFilename(filename, file.Filename); message != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+			return
+		}
+		update.Filename = &filename
+		changed = append(changed, "filename")
+	}
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Description must be at most 2000 characters long"})
+			return
+		}
+		update.Description = &description
+		changed = append(changed, "description")
+	}
+	if req.AltText != nil {
+		altText := strings.TrimSpace(*req.AltText)
+		if utf8.RuneCountInString(altText) > maxAltTextLength {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Alt text must be at most 1000 characters long"})
+			return
+		}
+		update.AltText = &altText
+		changed = append(changed, "alt_text")
+	}
+	if len(changed) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Nothing to update"})
+		return
+	}
+
+	updated, err := h.fileModel.UpdateMetadata(file.ID, req.Revision, update)
+	if err == models.ErrFileRevisionConflict {
+		h.auditUpdate(r, fileIDStr, models.AuditOutcomeFailure, "revision_conflict")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "File was modified since revision " + strconv.Itoa(req.Revision) + ", reload it and try again"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update file"})
+		return
+	}
+
+	h.auditUpdate(r, fileIDStr, models.AuditOutcomeSuccess, strings.Join(changed, ","))
+	json.NewEncoder(w).Encode(updated)
+}
+
+// auditUpdate records a change of a file's metadata
+func (h *FileHandler) auditUpdate(r *http.Request, fileID, outcome, detail string) {
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:     AuditActionFileUpdate,
+		TargetType: "file",
+		TargetID:   fileID,
+		Outcome:    outcome,
+		Detail:     detail,
+	})
+}
+
+// validateFilename checks a new display filename, returning an error message if it is invalid.
+// The extension must stay the same so the name keeps matching the stored content.
+func validateFilename(filename, current string) string {
+	if filename == "" || utf8.RuneCountInString(filename) > maxFilenameLength {
+		return "Filename must be between 1 and 255 characters long"
+	}
+	if filename == "." || filename == ".." || strings.ContainsAny(filename, `/\`) {
+		return "Filename must not contain path separators"
+	}
+	if strings.IndexFunc(filename, unicode.IsControl) >= 0 {
+		return "Filename must not contain control characters"
+	}
+	if !strings.EqualFold(filepath.Ext(filename), filepath.Ext(current)) {
+		return "Filename must keep the extension " + strconv.Quote(filepath.Ext(current))
+	}
+	return ""
+}
+
+// checkFileAccess reports whether a user holds at least the required organization role on
+// an organization file, or owns a personal file. The returned reason is used for auditing.
+func checkFileAccess(orgModel *models.OrganizationModel, file *models.FileMetadata, userID int, required string) (bool, string, error) {
+	if file.OrgID == nil {
+		if file.UserID != userID {
+			return false, "not_owner", nil
+		}
+		return true, "", nil
+	}
+
+	role, err := orgModel.GetRole(*file.OrgID, userID)
+	if err == models.ErrNotOrgMember {
+		return false, "not_member", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	if !models.OrgRoleAtLeast(role, required) {
+		return false, "insufficient_role", nil
+	}
+	return true, "", nil
+}
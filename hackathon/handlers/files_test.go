@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"file-uploader/models"
+
+	"github.com/gorilla/mux"
+)
+
+// update sends a metadata update of the static test's file as its owner
+func (s *staticTest) update(t *testing.T, ref string, req map[string]interface{}, out interface{}) int {
+	t.Helper()
+	r := mux.SetURLVars(withUser(jsonRequest(t, req), s.owner), map[string]string{"fileId": ref})
+	return call(t, NewFileHandler(s.files, s.orgs, s.audit).Update, r, out)
+}
+
+func TestFileUpdatesRequireTheCurrentRevision(t *testing.T) {
+	s := newStaticTest(t)
+
+	var updated models.FileMetadata
+	status := s.update(t, s.file.PublicID, map[string]interface{}{"revision": s.file.Revision, "description": "first"}, &updated)
+	if status != http.StatusOK || updated.Description != "first" || updated.Revision != s.file.Revision+1 {
+		t.Fatalf("first update = %d, %+v", status, updated)
+	}
+
+	// A client still holding the old revision must not overwrite the first update
+	var resp ErrorResponse
+	status = s.update(t, s.file.PublicID, map[string]interface{}{"revision": s.file.Revision, "description": "stale"}, &resp)
+	if status != http.StatusConflict {
+		t.Errorf("stale revision status = %d, want 409", status)
+	}
+	if current, _ := s.files.GetByID(s.file.ID); current.Description != "first" || current.Revision != updated.Revision {
+		t.Errorf("stale update changed the file: %+v", current)
+	}
+	if n := s.count(t, "audit_log WHERE action = 'file.update' AND detail = 'revision_conflict'"); n != 1 {
+		t.Errorf("%d revision_conflict audit events, want 1", n)
+	}
+
+	if status := s.update(t, s.file.PublicID, map[string]interface{}{"description": "none"}, nil); status != http.StatusBadRequest {
+		t.Errorf("missing revision status = %d, want 400", status)
+	}
+}
+
+func TestFileRenamesKeepTheExtension(t *testing.T) {
+	s := newStaticTest(t)
+	revision := s.file.Revision
+
+	for _, tt := range []struct {
+		filename string
+		status   int
+	}{
+		{"holiday.png", http.StatusOK},
+		{"HOLIDAY.PNG", http.StatusOK},
+		{"holiday.jpg", http.StatusBadRequest},
+		{"holiday", http.StatusBadRequest},
+		{"holiday.png.html", http.StatusBadRequest},
+	} {
+		var updated models.FileMetadata
+		status := s.update(t, s.file.PublicID, map[string]interface{}{"revision": revision, "filename": tt.filename}, &updated)
+		if status != tt.status {
+			t.Errorf("renaming to %q status = %d, want %d", tt.filename, status, tt.status)
+		}
+		if status == http.StatusOK {
+			revision = updated.Revision
+		}
+	}
+	if current, _ := s.files.GetByID(s.file.ID); current.Filename != "HOLIDAY.PNG" {
+		t.Errorf("filename = %q after the renames", current.Filename)
+	}
+}
+
+func TestFileUpdateLookupErrors(t *testing.T) {
+	s := newStaticTest(t)
+	req := map[string]interface{}{"revision": s.file.Revision, "description": "x"}
+
+	if status := s.update(t, "0192f3c4-5d6e-7f80-9a1b-2c3d4e5f6a7b", req, nil); status != http.StatusNotFound {
+		t.Errorf("unknown file status = %d, want 404", status)
+	}
+
+	// A failing database is not reported as a missing file
+	s.db.Close()
+	if status := s.update(t, s.file.PublicID, req, nil); status != http.StatusInternalServerError {
+		t.Errorf("database error status = %d, want 500", status)
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"file-uploader/models"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// failCommits makes every transaction commit on the test database fail while set
+var failCommits atomic.Bool
+
+func init() {
+	sql.Register("sqlite3_test", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// A non-zero return value turns the COMMIT into a rollback
+			conn.RegisterCommitHook(func() int {
+				if failCommits.Load() {
+					return 1
+				}
+				return 0
+			})
+			return nil
+		},
+	})
+}
+
+// testModels holds the models backed by a fresh test database
+type testModels struct {
+	db       *sql.DB
+	users    *models.UserModel
+	orgs     *models.OrganizationModel
+	files    *models.FileModel
+	audit    *models.AuditModel
+	identity *models.UserIdentityModel
+}
+
+// newTestModels creates an empty database in a temporary directory with all tables
+func newTestModels(t *testing.T) *testModels {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3_test", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	m := &testModels{
+		db:       db,
+		users:    models.NewUserModel(db),
+		orgs:     models.NewOrganizationModel(db),
+		files:    models.NewFileModel(db),
+		audit:    models.NewAuditModel(db),
+		identity: models.NewUserIdentityModel(db),
+	}
+	for _, create := range []func() error{
+		m.users.CreateTable,
+		m.orgs.CreateTable,
+		m.files.CreateTable,
+		m.audit.CreateTable,
+		m.identity.CreateTable,
+		// Deleting a user touches every table that references users
+		models.NewAPIKeyModel(db).CreateTable,
+		models.NewEmailVerificationModel(db).CreateTable,
+		models.NewOAuthClientModel(db).CreateTable,
+		models.NewWebAuthnCredentialModel(db).CreateTable,
+	} {
+		if err := create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+// count returns the number of rows in a table
+func (m *testModels) count(t *testing.T, table string) int {
+	t.Helper()
+	var n int
+	if err := m.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// call runs a handler with a JSON body and decodes the JSON response into out
+func call(t *testing.T, handler http.HandlerFunc, r *http.Request, out interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+	}
+	return w.Code
+}
+
+// jsonRequest builds a POST request with v as its JSON body
+func jsonRequest(t *testing.T, v interface{}) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	if v != nil {
+		if err := json.NewEncoder(&body).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return httptest.NewRequest(http.MethodPost, "/", &body)
+}
+
+// withUser authenticates a request as the given user, like AuthMiddleware does
+func withUser(r *http.Request, user *models.User) *http.Request {
+	ctx := context.WithValue(r.Context(), "user_id", user.ID)
+	ctx = context.WithValue(ctx, "username", user.Username)
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"file-uploader/imaging"
+
+	"github.com/gorilla/mux"
+)
+
+// IIIF Image API 3.0 identifiers
+const (
+	iiifContext    = "http://iiif.io/api/image/3/context.json"
+	iiifProtocol   = "http://iiif.io/api/image"
+	iiifProfileURI = "http://iiif.io/api/image/3/level2.json"
+	iiifTileSize   = 512
+)
+
+// IIIFSize is a size of the full image that viewers may request
+type IIIFSize struct {
+	Type   string `json:"type"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// IIIFTile describes the tiles viewers may request
+type IIIFTile struct {
+	Type         string `json:"type"`
+	Width        int    `json:"width"`
+	ScaleFactors []int  `json:"scaleFactors"`
+}
+
+// IIIFInfo is the info.json image information document
+type IIIFInfo struct {
+	Context        string     `json:"@context"`
+	ID             string     `json:"id"`
+	Type           string     `json:"type"`
+	Protocol       string     `json:"protocol"`
+	Profile        string     `json:"profile"`
+	Width          int        `json:"width"`
+	Height         int        `json:"height"`
+	MaxWidth       int        `json:"maxWidth"`
+	MaxHeight      int        `json:"maxHeight"`
+	Sizes          []IIIFSize `json:"sizes"`
+	Tiles          []IIIFTile `json:"tiles"`
+	ExtraQualities []string   `json:"extraQualities"`
+	ExtraFormats   []string   `json:"extraFormats"`
+	ExtraFeatures  []string   `json:"extraFeatures"`
+}
+
+// IIIFBase redirects the base URI of an image to its information document
+func (h *StaticHandler) IIIFBase(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, strings.TrimSuffix(r.URL.Path, "/")+"/info.json", http.StatusSeeOther)
+}
+
+// IIIFInfo serves the IIIF image information document of a file
+func (h *StaticHandler) IIIFInfo(w http.ResponseWriter, r *http.Request) {
+	fileMetadata, ok := h.readableFile(w, r, "iiif")
+	if !ok {
+		return
+	}
+
+	width, height, err := h.transformer.Dimensions(fileMetadata.FilePath)
+	if err != nil {
+		h.writeIIIFError(w, fileMetadata.ID, err)
+		return
+	}
+
+	info := IIIFInfo{
+		Context:        iiifContext,
+		ID:             getAppBaseURL() + "/iiif/" + fileMetadata.PublicID,
+		Type:           "ImageService3",
+		Protocol:       iiifProtocol,
+		Profile:        "level2",
+		Width:          width,
+		Height:         height,
+		MaxWidth:       imaging.MaxDimension,
+		MaxHeight:      imaging.MaxDimension,
+		Sizes:          []IIIFSize{},
+		ExtraQualities: []string{"bitonal"},
+		ExtraFormats:   []string{"webp"},
+		ExtraFeatures:  []string{"mirroring", "sizeUpscaling", "profileLinkHeader"},
+	}
+
+	// Offer halvings of the image down to one tile, smallest first
+	tile := IIIFTile{Type: "Tile", Width: iiifTileSize, ScaleFactors: []int{}}
+	for factor := 1; ; factor *= 2 {
+		tile.ScaleFactors = append(tile.ScaleFactors, factor)
+		sizeWidth, sizeHeight := (width+factor-1)/factor, (height+factor-1)/factor
+		if sizeWidth <= imaging.MaxDimension && sizeHeight <= imaging.MaxDimension {
+			info.Sizes = append([]IIIFSize{{Type: "Size", Width: sizeWidth, Height: sizeHeight}}, info.Sizes...)
+		}
+		if sizeWidth <= iiifTileSize && sizeHeight <= iiifTileSize {
+			break
+		}
+	}
+	info.Tiles = []IIIFTile{tile}
+
+	contentType := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		contentType = `application/ld+json;profile="` + iiifContext + `"`
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Link", `<`+iiifProfileURI+`>;rel="profile"`)
+	w.Header().Set("Cache-Control", h.privateCacheControl())
+	w.Header().Set("Vary", authVary+", Accept")
+	json.NewEncoder(w).Encode(info)
+}
+
+// IIIFImage serves an IIIF image request: /iiif/{id}/{region}/{size}/{rotation}/{quality}.{format}
+func (h *StaticHandler) IIIFImage(w http.ResponseWriter, r *http.Request) {
+	fileMetadata, ok := h.readableFile(w, r, "iiif")
+	if !ok {
+		return
+	}
+	h.ensureContentHash(fileMetadata)
+
+	vars := mux.Vars(r)
+	result, err := h.transformer.RenderIIIF(fileMetadata.FilePath, fileMetadata.ContentHash, imaging.IIIFRequest{
+		Region:   vars["region"],
+		Size:     vars["size"],
+		Rotation: vars["rotation"],
+		Quality:  vars["quality"],
+		Format:   vars["format"],
+	})
+	if err != nil {
+		h.writeIIIFError(w, fileMetadata.ID, err)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%s%s", fileMetadata.PublicID, vars["quality"], result.Extension)
+	w.Header().Set("Link", `<`+iiifProfileURI+`>;rel="profile"`)
+	w.Header().Set("Vary", authVary)
+	writeContent(w, r, result.Path, result.ContentType, filename, result.Key, h.privateCacheControl())
+}
+
+// writeIIIFError maps rendering errors to the status codes of the IIIF Image API
+func (h *StaticHandler) writeIIIFError(w http.ResponseWriter, fileID int, err error) {
+	switch {
+	case errors.Is(err, imaging.ErrIIIFInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, imaging.ErrIIIFNotImplemented):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case err == imaging.ErrUnsupported:
+		http.Error(w, "This image format cannot be served through IIIF", http.StatusUnprocessableEntity)
+	case err == imaging.ErrTooLarge:
+		http.Error(w, "Image is too large to transform", http.StatusUnprocessableEntity)
+	default:
+		log.Printf("Failed to render IIIF image of file %d: %v", fileID, err)
+		http.Error(w, "Failed to render image", http.StatusInternalServerError)
+	}
+}
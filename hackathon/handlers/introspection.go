@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+// Token types reported by introspection
+const (
+	tokenTypeBearer = "Bearer"
+	tokenTypeAPIKey = "api_key"
+)
+
+// IntrospectionHandler lets downstream services check tokens issued by this server (RFC 7662)
+type IntrospectionHandler struct {
+	userModel        *models.UserModel
+	apiKeyModel      *models.APIKeyModel
+	oauthClientModel *models.OAuthClientModel
+	clients          map[string]string // client ID -> client secret
+}
+
+// NewIntrospectionHandler creates a new IntrospectionHandler.
+// Clients are read from INTROSPECTION_CLIENTS as comma-separated id:secret pairs.
+func NewIntrospectionHandler(userModel *models.UserModel, apiKeyModel *models.APIKeyModel, oauthClientModel *models.OAuthClientModel) *IntrospectionHandler {
+	return &IntrospectionHandler{
+		userModel:        userModel,
+		apiKeyModel:      apiKeyModel,
+		oauthClientModel: oauthClientModel,
+		clients:          parseClientCredentials(os.Getenv("INTROSPECTION_CLIENTS")),
+	}
+}
+
+// IntrospectionResponse represents the introspection result. Inactive tokens only carry active=false.
+type IntrospectionResponse struct {
+	Active    bool              `json:"active"`
+	Scope     string            `json:"scope,omitempty"`
+	Username  string            `json:"username,omitempty"`
+	Subject   string            `json:"sub,omitempty"`
+	UserID    int               `json:"user_id,omitempty"`
+	TokenType string            `json:"token_type,omitempty"`
+	ExpiresAt int64             `json:"exp,omitempty"`
+	IssuedAt  int64             `json:"iat,omitempty"`
+	Actor     *utils.ActorClaim `json:"act,omitempty"`
+	ClientID  string            `json:"client_id,omitempty"`
+	APIKeyID  int               `json:"api_key_id,omitempty"`
+}
+
+// Introspect reports whether a JWT or API key is currently usable and returns its claims.
+// The caller authenticates with HTTP Basic client credentials, or client_id and
+// client_secret form parameters, and passes the token in the "token" form parameter.
+func (h *IntrospectionHandler) Introspect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !h.authenticateClient(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspection"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid client credentials"})
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "token is required"})
+		return
+	}
+
+	var response *IntrospectionResponse
+	if strings.HasPrefix(token, models.APIKeyPrefix) {
+		response = h.introspectAPIKey(token)
+	} else {
+		response = h.introspectJWT(token)
+	}
+	if response == nil {
+		response = &IntrospectionResponse{Active: false}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// introspectJWT returns the claims of a valid, unrevoked token or nil
+func (h *IntrospectionHandler) introspectJWT(token string) *IntrospectionResponse {
+	if utils.GetTokenBlacklist().IsRevoked(token) {
+		return nil
+	}
+	claims, err := utils.ValidateToken(token)
+	if err != nil {
+		return nil
+	}
+
+	// Tokens issued to OAuth clients die with the client
+	if claims.ClientID != "" {
+		if _, err := h.oauthClientModel.GetActive(claims.ClientID); err != nil {
+			return nil
+		}
+	}
+
+	// Impersonation ends as soon as the acting administrator loses access
+	if claims.IsImpersonation() {
+		admin, err := h.userModel.GetByID(claims.Actor.UserID)
+		if err != nil || admin.Role != models.RoleAdmin || admin.IsDisabled() {
+			return nil
+		}
+	}
+
+	response := h.activeResponse(claims.UserID, claims.GrantedScopes())
+	if response == nil {
+		return nil
+	}
+	response.TokenType = tokenTypeBearer
+	response.Actor = claims.Actor
+	response.ClientID = claims.ClientID
+	if claims.ExpiresAt != nil {
+		response.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.IssuedAt = claims.IssuedAt.Unix()
+	}
+	return response
+}
+
+// introspectAPIKey returns the details of a usable API key or nil
+func (h *IntrospectionHandler) introspectAPIKey(rawKey string) *IntrospectionResponse {
+	key, err := h.apiKeyModel.Lookup(rawKey)
+	if err != nil {
+		return nil
+	}
+
+	response := h.activeResponse(key.UserID, key.Scopes)
+	if response == nil {
+		return nil
+	}
+	response.TokenType = tokenTypeAPIKey
+	response.APIKeyID = key.ID
+	response.IssuedAt = key.CreatedAt.Unix()
+	if key.ExpiresAt != nil {
+		response.ExpiresAt = key.ExpiresAt.Unix()
+	}
+	return response
+}
+
+// activeResponse applies the same account checks as AuthMiddleware and returns nil
+// if the user can no longer authenticate
+func (h *IntrospectionHandler) activeResponse(userID int, scopes []string) *IntrospectionResponse {
+	user, err := h.userModel.GetByID(userID)
+	if err != nil || !user.CanAuthenticate() {
+		return nil
+	}
+	if user.Role != models.RoleAdmin {
+		scopes = utils.RemoveScope(scopes, utils.ScopeAdmin)
+	}
+
+	return &IntrospectionResponse{
+		Active:   true,
+		Scope:    utils.JoinScopes(scopes),
+		Username: user.Username,
+		Subject:  strconv.Itoa(user.ID),
+		UserID:   user.ID,
+	}
+}
+
+// authenticateClient checks the client credentials of the request
+func (h *IntrospectionHandler) authenticateClient(r *http.Request) bool {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostFormValue("client_id")
+		clientSecret = r.PostFormValue("client_secret")
+	}
+	if clientID == "" || clientSecret == "" {
+		return false
+	}
+
+	expected, ok := h.clients[clientID]
+	if !ok {
+		return false
+	}
+	// Compare digests so the comparison time does not depend on the secret length
+	got := sha256.Sum256([]byte(clientSecret))
+	want := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+// parseClientCredentials parses comma-separated id:secret pairs
+func parseClientCredentials(value string) map[string]string {
+	clients := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" || secret == "" {
+			continue
+		}
+		clients[id] = secret
+	}
+	return clients
+}
@@ -0,0 +1,652 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-uploader/auth"
+	"file-uploader/models"
+	"file-uploader/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// OAuth client limits
+const (
+	maxOAuthClientNameLength = 100
+	maxOAuthRedirectURIs     = 10
+)
+
+// oauthCodeTTL bounds how long an authorization code can be exchanged
+const oauthCodeTTL = 10 * time.Minute
+
+// OAuth 2.0 error codes (RFC 6749)
+const (
+	oauthErrInvalidRequest         = "invalid_request"
+	oauthErrInvalidClient          = "invalid_client"
+	oauthErrInvalidGrant           = "invalid_grant"
+	oauthErrInvalidScope           = "invalid_scope"
+	oauthErrUnauthorizedClient     = "unauthorized_client"
+	oauthErrUnsupportedGrantType   = "unsupported_grant_type"
+	oauthErrUnsupportedResponse    = "unsupported_response_type"
+	oauthErrAccessDenied           = "access_denied"
+	oauthErrServerError            = "server_error"
+	oauthErrTemporarilyUnavailable = "temporarily_unavailable"
+)
+
+// pendingAuthorization is remembered between consent and the code exchange
+type pendingAuthorization struct {
+	ClientID            string
+	UserID              int
+	RedirectURI         string
+	RedirectURIProvided bool // Whether the client sent redirect_uri, which it must then repeat
+	Scopes              []string
+	CodeChallenge       string
+}
+
+// matchesRedirectURI checks the redirect_uri of a token request (RFC 6749 section 4.1.3).
+// It must repeat the one of the authorization request, and may be omitted when that
+// request omitted it too.
+func (p *pendingAuthorization) matchesRedirectURI(uri string) bool {
+	if uri == "" {
+		return !p.RedirectURIProvided
+	}
+	return uri == p.RedirectURI
+}
+
+// authorizationRequest holds the validated parameters of an authorization request
+type authorizationRequest struct {
+	Client              *models.OAuthClient
+	RedirectURI         string
+	RedirectURIProvided bool
+	Scopes              []string
+	State               string
+	CodeChallenge       string
+}
+
+// OAuthHandler is an OAuth 2.0 authorization server for third-party applications
+type OAuthHandler struct {
+	clientModel   *models.OAuthClientModel
+	userModel     *models.UserModel
+	authenticator auth.Authenticator
+	auditModel    *models.AuditModel
+	codes         *utils.StateStore
+}
+
+// NewOAuthHandler creates a new OAuthHandler
+func NewOAuthHandler(clientModel *models.OAuthClientModel, userModel *models.UserModel, authenticator auth.Authenticator, auditModel *models.AuditModel) *OAuthHandler {
+	return &OAuthHandler{
+		clientModel:   clientModel,
+		userModel:     userModel,
+		authenticator: authenticator,
+		auditModel:    auditModel,
+		codes:         utils.NewStateStore(),
+	}
+}
+
+// RegisterClientRequest represents the client registration payload
+type RegisterClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	Confidential *bool    `json:"confidential"` // Defaults to true
+}
+
+// RegisterClientResponse represents the client registration response.
+// ClientSecret is only ever returned here, and only for confidential clients.
+type RegisterClientResponse struct {
+	Message      string              `json:"message"`
+	ClientSecret string              `json:"client_secret,omitempty"`
+	Client       *models.OAuthClient `json:"client"`
+}
+
+// TokenResponse represents a successful token response (RFC 6749 section 5.1)
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// OAuthErrorResponse represents an error response (RFC 6749 section 5.2)
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// RegisterClient registers a third-party application owned by the authenticated user
+func (h *OAuthHandler) RegisterClient(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	var req RegisterClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxOAuthClientNameLength {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Name is required and must be at most 100 characters"})
+		return
+	}
+
+	confidential := req.Confidential == nil || *req.Confidential
+	if !confidential && len(req.RedirectURIs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Public clients need at least one redirect URI"})
+		return
+	}
+	if len(req.RedirectURIs) > maxOAuthRedirectURIs {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "At most 10 redirect URIs can be registered"})
+		return
+	}
+	for _, uri := range req.RedirectURIs {
+		if !isValidRedirectURI(uri) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Redirect URIs must be absolute https URLs, or http URLs on localhost, without a fragment"})
+			return
+		}
+	}
+
+	// Third-party applications never act as administrators
+	granted, _ := r.Context().Value("scopes").([]string)
+	granted = utils.DelegableScopes(utils.RemoveScope(granted, utils.ScopeAdmin))
+	scopes := req.Scopes
+	if len(scopes) == 0 {
+		scopes = granted
+	}
+	if err := utils.ValidateDelegatedScopes(scopes); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	if !utils.IsSubset(scopes, granted) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Requested scopes exceed your permissions"})
+		return
+	}
+	if len(scopes) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "At least one scope is required"})
+		return
+	}
+
+	client, secret, err := h.clientModel.Create(userID, req.Name, req.RedirectURIs, scopes, confidential)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to register client"})
+		return
+	}
+
+	message := "Client registered successfully"
+	if confidential {
+		message += ". Store the client secret now, it will not be shown again"
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(RegisterClientResponse{
+		Message:      message,
+		ClientSecret: secret,
+		Client:       client,
+	})
+}
+
+// ListClients returns the clients registered by the authenticated user
+func (h *OAuthHandler) ListClients(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	clients, err := h.clientModel.ListByUser(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list clients"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"clients": clients,
+	})
+}
+
+// RevokeClient revokes one of the authenticated user's clients and every token issued to it
+func (h *OAuthHandler) RevokeClient(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	if err := h.clientModel.Revoke(mux.Vars(r)["clientId"], userID); err != nil {
+		if err == models.ErrOAuthClientNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Client not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to revoke client"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Client revoked successfully",
+	})
+}
+
+// Authorize shows the consent page of the authorization code flow
+func (h *OAuthHandler) Authorize(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.parseAuthorizationRequest(w, r)
+	if !ok {
+		return
+	}
+	h.renderConsent(w, http.StatusOK, req, r.Form, "")
+}
+
+// Consent handles the consent form. The user signs in with their password and either
+// approves, which redirects back to the client with a code, or denies the request.
+func (h *OAuthHandler) Consent(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.parseAuthorizationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if r.PostFormValue("decision") != "approve" {
+		redirectWithError(w, r, req, oauthErrAccessDenied, "The user denied the request")
+		return
+	}
+
+	user, err := h.authenticator.Authenticate(r.PostFormValue("username"), r.PostFormValue("password"))
+	if err != nil {
+		if err == auth.ErrInvalidCredentials {
+			recordAudit(h.auditModel, r, models.AuditEvent{
+				ActorUsername: r.PostFormValue("username"),
+				Action:        AuditActionOAuthAuthorize,
+				TargetType:    "oauth_client",
+				TargetID:      req.Client.ClientID,
+				Outcome:       models.AuditOutcomeFailure,
+				Detail:        "invalid_credentials",
+			})
+			h.renderConsent(w, http.StatusUnauthorized, req, r.Form, "Invalid credentials")
+			return
+		}
+		h.renderConsent(w, http.StatusInternalServerError, req, r.Form, "Authentication backend error")
+		return
+	}
+	if !user.CanAuthenticate() {
+		h.renderConsent(w, http.StatusForbidden, req, r.Form, "This account cannot authorize applications, log in to the API first")
+		return
+	}
+
+	// The client only receives scopes the user holds
+	scopes := intersectScopes(req.Scopes, user.Scopes())
+	if len(scopes) == 0 {
+		redirectWithError(w, r, req, oauthErrInvalidScope, "The user holds none of the requested scopes")
+		return
+	}
+
+	code, err := utils.RandomToken(32)
+	if err != nil {
+		redirectWithError(w, r, req, oauthErrServerError, "")
+		return
+	}
+	err = h.codes.Put(code, &pendingAuthorization{
+		ClientID:            req.Client.ClientID,
+		UserID:              user.ID,
+		RedirectURI:         req.RedirectURI,
+		RedirectURIProvided: req.RedirectURIProvided,
+		Scopes:              scopes,
+		CodeChallenge:       req.CodeChallenge,
+	}, oauthCodeTTL)
+	if err != nil {
+		redirectWithError(w, r, req, oauthErrTemporarilyUnavailable, "Too many pending authorizations")
+		return
+	}
+
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		ActorID:       &user.ID,
+		ActorUsername: user.Username,
+		Action:        AuditActionOAuthAuthorize,
+		TargetType:    "oauth_client",
+		TargetID:      req.Client.ClientID,
+		Outcome:       models.AuditOutcomeSuccess,
+		Detail:        utils.JoinScopes(scopes),
+	})
+
+	params := url.Values{"code": {code}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	http.Redirect(w, r, appendQuery(req.RedirectURI, params), http.StatusFound)
+}
+
+// Token exchanges an authorization code, or client credentials, for an access token
+func (h *OAuthHandler) Token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, oauthErrInvalidRequest, "Malformed form body")
+		return
+	}
+
+	clientID, clientSecret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostFormValue("client_id")
+		clientSecret = r.PostFormValue("client_secret")
+	}
+
+	var client *models.OAuthClient
+	var err error
+	if clientSecret != "" {
+		client, err = h.clientModel.Authenticate(clientID, clientSecret)
+	} else {
+		client, err = h.clientModel.GetActive(clientID)
+		// Confidential clients must always authenticate
+		if err == nil && client.Confidential {
+			err = models.ErrInvalidClientSecret
+		}
+	}
+	if err != nil {
+		if err != models.ErrOAuthClientNotFound && err != models.ErrOAuthClientRevoked && err != models.ErrInvalidClientSecret {
+			writeOAuthError(w, http.StatusInternalServerError, oauthErrServerError, "")
+			return
+		}
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, oauthErrInvalidClient, "Client authentication failed")
+		return
+	}
+
+	var userID int
+	var scopes []string
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		pending, ok := h.codes.Take(r.PostFormValue("code"))
+		grant, _ := pending.(*pendingAuthorization)
+		if !ok || grant.ClientID != client.ClientID || !grant.matchesRedirectURI(r.PostFormValue("redirect_uri")) {
+			writeOAuthError(w, http.StatusBadRequest, oauthErrInvalidGrant, "Invalid or expired authorization code")
+			return
+		}
+		if !verifyCodeChallenge(r.PostFormValue("code_verifier"), grant.CodeChallenge) {
+			writeOAuthError(w, http.StatusBadRequest, oauthErrInvalidGrant, "PKCE verification failed")
+			return
+		}
+		userID, scopes = grant.UserID, grant.Scopes
+
+	case "client_credentials":
+		if !client.Confidential {
+			writeOAuthError(w, http.StatusBadRequest, oauthErrUnauthorizedClient, "Public clients cannot use the client credentials grant")
+			return
+		}
+		scopes = client.Scopes
+		if requested := utils.ParseScopes(r.PostFormValue("scope")); len(requested) > 0 {
+			if !utils.IsSubset(requested, client.Scopes) {
+				writeOAuthError(w, http.StatusBadRequest, oauthErrInvalidScope, "Requested scopes exceed the client's scopes")
+				return
+			}
+			scopes = requested
+		}
+		// Service account tokens act as the client's owner
+		userID = client.UserID
+
+	default:
+		writeOAuthError(w, http.StatusBadRequest, oauthErrUnsupportedGrantType, "Supported grant types are authorization_code and client_credentials")
+		return
+	}
+
+	user, err := h.userModel.GetByID(userID)
+	if err != nil || !user.CanAuthenticate() {
+		writeOAuthError(w, http.StatusBadRequest, oauthErrInvalidGrant, "The account can no longer be used")
+		return
+	}
+	scopes = intersectScopes(scopes, user.Scopes())
+
+	ttl := getOAuthTokenTTL()
+	token, _, err := utils.GenerateClientToken(client.ClientID, user.ID, user.Username, scopes, ttl)
+	if err != nil {
+		if err == utils.ErrNoScopes {
+			writeOAuthError(w, http.StatusBadRequest, oauthErrInvalidScope, "The account holds none of the granted scopes")
+			return
+		}
+		writeOAuthError(w, http.StatusInternalServerError, oauthErrServerError, "")
+		return
+	}
+
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		ActorID:       &user.ID,
+		ActorUsername: user.Username,
+		Action:        AuditActionOAuthToken,
+		TargetType:    "oauth_client",
+		TargetID:      client.ClientID,
+		Outcome:       models.AuditOutcomeSuccess,
+		Detail:        r.PostFormValue("grant_type"),
+	})
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(ttl.Seconds()),
+		Scope:       utils.JoinScopes(scopes),
+	})
+}
+
+// parseAuthorizationRequest validates the authorization request parameters. Errors that
+// make the redirect URI untrustworthy are shown to the user, all others are sent back
+// to the client.
+func (h *OAuthHandler) parseAuthorizationRequest(w http.ResponseWriter, r *http.Request) (*authorizationRequest, bool) {
+	if err := r.ParseForm(); err != nil {
+		renderOAuthError(w, http.StatusBadRequest, "Malformed request")
+		return nil, false
+	}
+
+	client, err := h.clientModel.GetActive(r.Form.Get("client_id"))
+	if err != nil {
+		if err != models.ErrOAuthClientNotFound && err != models.ErrOAuthClientRevoked {
+			log.Printf("Failed to load OAuth client: %v", err)
+		}
+		renderOAuthError(w, http.StatusBadRequest, "Unknown or revoked client")
+		return nil, false
+	}
+
+	req := &authorizationRequest{
+		Client:              client,
+		RedirectURI:         r.Form.Get("redirect_uri"),
+		RedirectURIProvided: r.Form.Get("redirect_uri") != "",
+		State:               r.Form.Get("state"),
+	}
+	// Clients with a single redirect URI may omit it
+	if !req.RedirectURIProvided && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !client.HasRedirectURI(req.RedirectURI) {
+		renderOAuthError(w, http.StatusBadRequest, "The redirect URI is not registered for this client")
+		return nil, false
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		redirectWithError(w, r, req, oauthErrUnsupportedResponse, "Only the code response type is supported")
+		return nil, false
+	}
+
+	req.CodeChallenge = r.Form.Get("code_challenge")
+	if req.CodeChallenge == "" || r.Form.Get("code_challenge_method") != "S256" {
+		redirectWithError(w, r, req, oauthErrInvalidRequest, "PKCE with code_challenge_method=S256 is required")
+		return nil, false
+	}
+
+	req.Scopes = client.Scopes
+	if requested := utils.ParseScopes(r.Form.Get("scope")); len(requested) > 0 {
+		if !utils.IsSubset(requested, client.Scopes) {
+			redirectWithError(w, r, req, oauthErrInvalidScope, "Requested scopes exceed the client's scopes")
+			return nil, false
+		}
+		req.Scopes = requested
+	}
+	return req, true
+}
+
+// consentTemplate renders the consent page
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<body>
+	<h2>Authorize {{.ClientName}}</h2>
+	<p><b>{{.ClientName}}</b> wants to access your account with these permissions:</p>
+	<ul>
+	{{range .Scopes}}<li>{{.}}</li>
+	{{end}}</ul>
+	{{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+	<form method="post" action="/api/v1/oauth/authorize">
+		{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+		{{end}}<input type="text" name="username" placeholder="Username" autocomplete="username"><br><br>
+		<input type="password" name="password" placeholder="Password" autocomplete="current-password"><br><br>
+		<button type="submit" name="decision" value="approve">Allow</button>
+		<button type="submit" name="decision" value="deny">Deny</button>
+	</form>
+</body>
+</html>`))
+
+// consentParams lists the request parameters carried through the consent form
+var consentParams = []string{"response_type", "client_id", "redirect_uri", "scope", "state", "code_challenge", "code_challenge_method"}
+
+// renderConsent renders the consent page for a validated request
+func (h *OAuthHandler) renderConsent(w http.ResponseWriter, status int, req *authorizationRequest, form url.Values, message string) {
+	params := make(map[string]string)
+	for _, name := range consentParams {
+		if value := form.Get(name); value != "" {
+			params[name] = value
+		}
+	}
+
+	setConsentHeaders(w)
+	w.WriteHeader(status)
+	if err := consentTemplate.Execute(w, map[string]interface{}{
+		"ClientName": req.Client.Name,
+		"Scopes":     req.Scopes,
+		"Params":     params,
+		"Error":      message,
+	}); err != nil {
+		log.Printf("Failed to render consent page: %v", err)
+	}
+}
+
+// errorTemplate renders authorization errors that cannot be sent to the client
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<body>
+	<h2>Authorization failed</h2>
+	<p>{{.}}</p>
+</body>
+</html>`))
+
+// renderOAuthError shows an authorization error to the user
+func renderOAuthError(w http.ResponseWriter, status int, message string) {
+	setConsentHeaders(w)
+	w.WriteHeader(status)
+	errorTemplate.Execute(w, message)
+}
+
+// setConsentHeaders prevents caching and framing of authorization pages
+func setConsentHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+}
+
+// redirectWithError sends an authorization error back to the client's redirect URI
+func redirectWithError(w http.ResponseWriter, r *http.Request, req *authorizationRequest, code, description string) {
+	params := url.Values{"error": {code}}
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	http.Redirect(w, r, appendQuery(req.RedirectURI, params), http.StatusFound)
+}
+
+// writeOAuthError writes a token endpoint error
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OAuthErrorResponse{Error: code, ErrorDescription: description})
+}
+
+// appendQuery adds parameters to a URI that may already have a query string
+func appendQuery(uri string, params url.Values) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + params.Encode()
+	}
+	return uri + "?" + params.Encode()
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against an S256 challenge (RFC 7636)
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(utils.PKCEChallenge(verifier)), []byte(challenge)) == 1
+}
+
+// isValidRedirectURI accepts absolute https URLs and http URLs on the loopback interface
+func isValidRedirectURI(uri string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Host == "" || parsed.Fragment != "" || strings.ContainsAny(uri, " #") {
+		return false
+	}
+	switch parsed.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := parsed.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+// intersectScopes returns the requested scopes that are also granted
+func intersectScopes(requested, granted []string) []string {
+	var scopes []string
+	for _, scope := range requested {
+		if utils.HasScope(granted, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// getOAuthTokenTTL gets the lifetime of access tokens issued to OAuth clients
+func getOAuthTokenTTL() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("OAUTH_TOKEN_TTL_MINUTES"))
+	if err != nil || minutes <= 0 {
+		return time.Hour // Default 60 minutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
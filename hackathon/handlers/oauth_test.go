@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"file-uploader/auth"
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+const (
+	testRedirectURI  = "https://partner.example/callback"
+	testPassword     = "correct-horse-battery"
+	testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk-test-verifier"
+)
+
+// oauthTest holds an OAuth handler and a user with a password who can approve clients
+type oauthTest struct {
+	*testModels
+	clients *models.OAuthClientModel
+	handler *OAuthHandler
+	user    *models.User
+}
+
+func newOAuthTest(t *testing.T) *oauthTest {
+	t.Helper()
+	m := newTestModels(t)
+	user, err := m.users.Create("alice", testPassword, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := models.NewOAuthClientModel(m.db)
+	return &oauthTest{
+		testModels: m,
+		clients:    clients,
+		handler:    NewOAuthHandler(clients, m.users, auth.NewLocalAuthenticator(m.users), m.audit),
+		user:       user,
+	}
+}
+
+// register registers a client through the handler with the user's login scopes
+func (o *oauthTest) register(t *testing.T, req RegisterClientRequest) (int, RegisterClientResponse) {
+	t.Helper()
+	r := withUser(jsonRequest(t, req), o.user)
+	r = r.WithContext(context.WithValue(r.Context(), "scopes", o.user.Scopes()))
+	var response RegisterClientResponse
+	code := call(t, o.handler.RegisterClient, r, &response)
+	return code, response
+}
+
+// newClient registers a client for the test redirect URI and returns it with its secret
+func (o *oauthTest) newClient(t *testing.T, confidential bool) (*models.OAuthClient, string) {
+	t.Helper()
+	code, response := o.register(t, RegisterClientRequest{
+		Name:         "Partner App",
+		RedirectURIs: []string{testRedirectURI},
+		Scopes:       []string{utils.ScopeFilesRead, utils.ScopeFilesWrite},
+		Confidential: &confidential,
+	})
+	if code != http.StatusCreated {
+		t.Fatalf("register status = %d", code)
+	}
+	return response.Client, response.ClientSecret
+}
+
+// authorizationParams returns the parameters of a valid authorization request
+func authorizationParams(client *models.OAuthClient) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {utils.ScopeFilesRead},
+		"state":                 {"xyz"},
+		"code_challenge":        {utils.PKCEChallenge(testCodeVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// consent approves an authorization request and returns the redirect parameters
+func (o *oauthTest) consent(t *testing.T, params url.Values) url.Values {
+	t.Helper()
+	form := url.Values{"decision": {"approve"}, "username": {"alice"}, "password": {testPassword}}
+	for name, values := range params {
+		form[name] = values
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/oauth/authorize", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	o.handler.Consent(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("consent status = %d, body %s", w.Code, w.Body)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirect := location.Scheme + "://" + location.Host + location.Path; redirect != testRedirectURI {
+		t.Fatalf("redirected to %s, want %s", redirect, testRedirectURI)
+	}
+	return location.Query()
+}
+
+// authorize approves a valid authorization request and returns the code
+func (o *oauthTest) authorize(t *testing.T, client *models.OAuthClient) string {
+	t.Helper()
+	query := o.consent(t, authorizationParams(client))
+	if query.Get("code") == "" || query.Get("state") != "xyz" {
+		t.Fatalf("consent redirect = %v, want a code and the state", query)
+	}
+	return query.Get("code")
+}
+
+// token calls the token endpoint with the form and returns the status and error code
+func (o *oauthTest) token(t *testing.T, form url.Values) (int, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/oauth/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var response struct {
+		OAuthErrorResponse
+		AccessToken string `json:"access_token"`
+	}
+	code := call(t, o.handler.Token, r, &response)
+	if code == http.StatusOK && response.AccessToken == "" {
+		t.Fatal("token response without an access token")
+	}
+	return code, response.Error
+}
+
+// codeExchange returns the form of a valid authorization code exchange
+func codeExchange(client *models.OAuthClient, secret, code string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ClientID},
+		"client_secret": {secret},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {testCodeVerifier},
+	}
+}
+
+func TestOAuthCodesAreSingleUse(t *testing.T) {
+	o := newOAuthTest(t)
+	client, secret := o.newClient(t, true)
+
+	form := codeExchange(client, secret, o.authorize(t, client))
+	if code, errorCode := o.token(t, form); code != http.StatusOK {
+		t.Fatalf("first exchange = %d %s", code, errorCode)
+	}
+	if code, errorCode := o.token(t, form); code != http.StatusBadRequest || errorCode != oauthErrInvalidGrant {
+		t.Errorf("second exchange = %d %s, want 400 invalid_grant", code, errorCode)
+	}
+}
+
+func TestOAuthTokenRejectsMismatchedCodes(t *testing.T) {
+	o := newOAuthTest(t)
+	client, secret := o.newClient(t, true)
+	other, otherSecret := o.newClient(t, true)
+
+	for _, tt := range []struct {
+		name   string
+		change func(form url.Values)
+	}{
+		{"wrong verifier", func(form url.Values) { form.Set("code_verifier", strings.Repeat("a", 43)) }},
+		{"missing verifier", func(form url.Values) { form.Del("code_verifier") }},
+		{"short verifier", func(form url.Values) { form.Set("code_verifier", "short") }},
+		{"other client", func(form url.Values) {
+			form.Set("client_id", other.ClientID)
+			form.Set("client_secret", otherSecret)
+		}},
+		{"other redirect URI", func(form url.Values) { form.Set("redirect_uri", "https://attacker.example/callback") }},
+		{"omitted redirect URI", func(form url.Values) { form.Del("redirect_uri") }},
+		{"unknown code", func(form url.Values) { form.Set("code", "not-a-code") }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			form := codeExchange(client, secret, o.authorize(t, client))
+			tt.change(form)
+			if code, errorCode := o.token(t, form); code != http.StatusBadRequest || errorCode != oauthErrInvalidGrant {
+				t.Errorf("exchange = %d %s, want 400 invalid_grant", code, errorCode)
+			}
+		})
+	}
+}
+
+func TestOAuthRedirectURIOnlyRequiredWhenSent(t *testing.T) {
+	o := newOAuthTest(t)
+	client, secret := o.newClient(t, true)
+
+	// The client has a single redirect URI, so it may leave it out of both requests
+	params := authorizationParams(client)
+	params.Del("redirect_uri")
+	form := codeExchange(client, secret, o.consent(t, params).Get("code"))
+	form.Del("redirect_uri")
+	if code, errorCode := o.token(t, form); code != http.StatusOK {
+		t.Errorf("exchange without redirect URI = %d %s", code, errorCode)
+	}
+
+	// Repeating the registered URI anyway is fine, any other is not
+	form = codeExchange(client, secret, o.consent(t, params).Get("code"))
+	if code, errorCode := o.token(t, form); code != http.StatusOK {
+		t.Errorf("exchange with the registered redirect URI = %d %s", code, errorCode)
+	}
+	form = codeExchange(client, secret, o.consent(t, params).Get("code"))
+	form.Set("redirect_uri", "https://attacker.example/callback")
+	if code, errorCode := o.token(t, form); code != http.StatusBadRequest || errorCode != oauthErrInvalidGrant {
+		t.Errorf("exchange with another redirect URI = %d %s, want 400 invalid_grant", code, errorCode)
+	}
+}
+
+func TestOAuthAuthorizationRequiresS256(t *testing.T) {
+	o := newOAuthTest(t)
+	client, _ := o.newClient(t, false)
+
+	for _, tt := range []struct {
+		name   string
+		change func(params url.Values)
+	}{
+		{"no challenge", func(params url.Values) { params.Del("code_challenge") }},
+		{"no method", func(params url.Values) { params.Del("code_challenge_method") }},
+		{"plain method", func(params url.Values) { params.Set("code_challenge_method", "plain") }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			params := authorizationParams(client)
+			tt.change(params)
+			query := o.consent(t, params)
+			if query.Get("error") != oauthErrInvalidRequest || query.Get("code") != "" {
+				t.Errorf("consent redirect = %v, want invalid_request without a code", query)
+			}
+		})
+	}
+}
+
+func TestOAuthClientCredentialsRequireConfidentialClient(t *testing.T) {
+	o := newOAuthTest(t)
+	public, _ := o.newClient(t, false)
+	confidential, secret := o.newClient(t, true)
+
+	for _, tt := range []struct {
+		name      string
+		form      url.Values
+		status    int
+		errorCode string
+	}{
+		{"public client", url.Values{"client_id": {public.ClientID}}, http.StatusBadRequest, oauthErrUnauthorizedClient},
+		{"confidential client without secret", url.Values{"client_id": {confidential.ClientID}}, http.StatusUnauthorized, oauthErrInvalidClient},
+		{"wrong secret", url.Values{"client_id": {confidential.ClientID}, "client_secret": {"wrong"}}, http.StatusUnauthorized, oauthErrInvalidClient},
+		{"scope beyond the client", url.Values{"client_id": {confidential.ClientID}, "client_secret": {secret}, "scope": {utils.ScopeFilesDelete}}, http.StatusBadRequest, oauthErrInvalidScope},
+		{"confidential client", url.Values{"client_id": {confidential.ClientID}, "client_secret": {secret}}, http.StatusOK, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.Set("grant_type", "client_credentials")
+			if code, errorCode := o.token(t, tt.form); code != tt.status || errorCode != tt.errorCode {
+				t.Errorf("token = %d %q, want %d %q", code, errorCode, tt.status, tt.errorCode)
+			}
+		})
+	}
+}
+
+func TestOAuthRegistrationNeverGrantsAdminOrAccount(t *testing.T) {
+	o := newOAuthTest(t)
+	if err := o.users.SetRole(o.user.ID, models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if o.user, err = o.users.GetByID(o.user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	code, response := o.register(t, RegisterClientRequest{Name: "Default scopes", RedirectURIs: []string{testRedirectURI}})
+	if code != http.StatusCreated {
+		t.Fatalf("register status = %d", code)
+	}
+	if scopes := response.Client.Scopes; utils.HasScope(scopes, utils.ScopeAdmin) || utils.HasScope(scopes, utils.ScopeAccount) || !utils.HasScope(scopes, utils.ScopeFilesRead) {
+		t.Errorf("default client scopes = %v, want the user's scopes without admin and account", scopes)
+	}
+
+	for _, tt := range []struct {
+		scope  string
+		status int
+	}{
+		{utils.ScopeAdmin, http.StatusForbidden},
+		{utils.ScopeAccount, http.StatusBadRequest},
+	} {
+		request := RegisterClientRequest{Name: "Greedy", RedirectURIs: []string{testRedirectURI}, Scopes: []string{tt.scope}}
+		if code, _ := o.register(t, request); code != tt.status {
+			t.Errorf("register with %s = %d, want %d", tt.scope, code, tt.status)
+		}
+	}
+}
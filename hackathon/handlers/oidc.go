@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+// oidcStateTTL bounds how long a user has to complete the provider login
+const oidcStateTTL = 10 * time.Minute
+
+// oidcStateCookie binds the login state to the browser that started the flow, so a
+// callback URL cannot be replayed in someone else's browser (login CSRF)
+const oidcStateCookie = "oidc_state"
+
+// pendingOIDCLogin is remembered between the redirect to the provider and the callback
+type pendingOIDCLogin struct {
+	Nonce        string
+	CodeVerifier string
+	LinkUserID   int // Non-zero when linking the identity to an existing account
+}
+
+// OIDCHandler handles OpenID Connect login with an external identity provider
+type OIDCHandler struct {
+	provider      *utils.OIDCProvider
+	issuer        string
+	userModel     *models.UserModel
+	identityModel *models.UserIdentityModel
+	auditModel    *models.AuditModel
+	states        *utils.StateStore
+	secureCookies bool
+}
+
+// NewOIDCHandler creates a new OIDCHandler
+func NewOIDCHandler(config *utils.OIDCConfig, userModel *models.UserModel, identityModel *models.UserIdentityModel, auditModel *models.AuditModel) *OIDCHandler {
+	return &OIDCHandler{
+		provider:      utils.NewOIDCProvider(config),
+		issuer:        config.IssuerURL,
+		userModel:     userModel,
+		identityModel: identityModel,
+		auditModel:    auditModel,
+		states:        utils.NewStateStore(),
+		secureCookies: strings.HasPrefix(config.RedirectURL, "https://"),
+	}
+}
+
+// OIDCLinkResponse returns the provider URL the user must visit to link an account
+type OIDCLinkResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+}
+
+// Login redirects the browser to the identity provider
+func (h *OIDCHandler) Login(w http.ResponseWriter, r *http.Request) {
+	authURL, err := h.startFlow(w, 0)
+	if err == utils.ErrStateStoreFull {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Too many pending logins, try again later"})
+		return
+	}
+	if err != nil {
+		log.Printf("OIDC login failed to start: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Identity provider is unavailable"})
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Link starts a flow that attaches an external identity to the authenticated user
+func (h *OIDCHandler) Link(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	authURL, err := h.startFlow(w, userID)
+	if err == utils.ErrStateStoreFull {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Too many pending logins, try again later"})
+		return
+	}
+	if err != nil {
+		log.Printf("OIDC link failed to start: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Identity provider is unavailable"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(OIDCLinkResponse{AuthorizationURL: authURL})
+}
+
+// startFlow generates state, nonce and PKCE verifier, sets the state cookie and returns
+// the authorization URL
+func (h *OIDCHandler) startFlow(w http.ResponseWriter, linkUserID int) (string, error) {
+	state, err := utils.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := utils.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	codeVerifier, err := utils.RandomToken(48)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := h.provider.AuthCodeURL(state, nonce, codeVerifier)
+	if err != nil {
+		return "", err
+	}
+
+	err = h.states.Put(state, &pendingOIDCLogin{
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		LinkUserID:   linkUserID,
+	}, oidcStateTTL)
+	if err != nil {
+		return "", err
+	}
+	h.setStateCookie(w, utils.SignOIDCState(state), int(oidcStateTTL.Seconds()))
+	return authURL, nil
+}
+
+// setStateCookie sets or, with maxAge -1, clears the state cookie. It must survive the
+// top-level redirect back from the provider, so it is SameSite=Lax rather than Strict.
+func (h *OIDCHandler) setStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/api/v1/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   h.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Callback completes the authorization-code flow and issues our own JWT
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		h.auditLoginFailure(r, "provider_error: "+providerErr)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Identity provider returned an error: " + providerErr})
+		return
+	}
+
+	// The state must come back to the browser that started the flow
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || !utils.VerifyOIDCState(cookie.Value, state) {
+		h.auditLoginFailure(r, "state_mismatch")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Login state does not match this browser"})
+		return
+	}
+	h.setStateCookie(w, "", -1)
+
+	value, ok := h.states.Take(state)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid or expired login state"})
+		return
+	}
+	pending := value.(*pendingOIDCLogin)
+
+	code := query.Get("code")
+	if code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Missing authorization code"})
+		return
+	}
+
+	tokens, err := h.provider.Exchange(code, pending.CodeVerifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to exchange authorization code"})
+		return
+	}
+
+	idClaims, err := h.provider.VerifyIDToken(tokens.IDToken, pending.Nonce)
+	if err != nil {
+		h.auditLoginFailure(r, "invalid_id_token")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid ID token: " + err.Error()})
+		return
+	}
+
+	identity, err := h.identityModel.GetBySubject(h.issuer, idClaims.Subject)
+	if err != nil && err != sql.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
+		return
+	}
+
+	var user *models.User
+	message := "Login successful"
+	loginEvent := models.AuditEvent{
+		Action:     AuditActionLogin,
+		TargetType: "identity",
+		TargetID:   h.issuer + "#" + idClaims.Subject,
+		Outcome:    models.AuditOutcomeDenied,
+	}
+
+	switch {
+	case pending.LinkUserID != 0:
+		// Linking an identity to the account that started the flow
+		if identity != nil {
+			if identity.UserID != pending.LinkUserID {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(ErrorResponse{Error: "This identity is already linked to another account"})
+				return
+			}
+		} else if _, err := h.identityModel.Link(pending.LinkUserID, h.issuer, idClaims.Subject, idClaims.Email); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to link identity"})
+			return
+		}
+		user, err = h.userModel.GetByID(pending.LinkUserID)
+		message = "Identity linked successfully"
+		loginEvent.Detail = "identity_linked"
+
+	case identity != nil:
+		user, err = h.userModel.GetByID(identity.UserID)
+
+	default:
+		// First login with this identity, provision a local account
+		user, err = h.provisionUser(idClaims)
+		message = "Account created successfully"
+		loginEvent.Detail = "account_provisioned"
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	loginEvent.ActorID = &user.ID
+	loginEvent.ActorUsername = user.Username
+
+	if user.IsDisabled() {
+		loginEvent.Detail = "account_disabled"
+		recordAudit(h.auditModel, r, loginEvent)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Account is disabled"})
+		return
+	}
+
+	// Logging in during the grace period keeps the account
+	if user.IsPendingDeletion() {
+		if err := h.userModel.CancelDeletion(user.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to cancel account deletion"})
+			return
+		}
+		user.DeletionScheduledAt = nil
+		message = "Login successful, scheduled account deletion was cancelled"
+	}
+
+	// Generate JWT token
+	token, err := utils.GenerateToken(user.ID, user.Username, user.Scopes())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+
+	loginEvent.Outcome = models.AuditOutcomeSuccess
+	recordAudit(h.auditModel, r, loginEvent)
+
+	json.NewEncoder(w).Encode(AuthResponse{
+		Token:   token,
+		User:    user,
+		Message: message,
+	})
+}
+
+// auditLoginFailure records a callback that failed before the user was known
+func (h *OIDCHandler) auditLoginFailure(r *http.Request, detail string) {
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:     AuditActionLogin,
+		TargetType: "identity",
+		TargetID:   h.issuer,
+		Outcome:    models.AuditOutcomeFailure,
+		Detail:     detail,
+	})
+}
+
+// provisionUser creates a local user for a new external identity and links it
+func (h *OIDCHandler) provisionUser(idClaims *utils.IDTokenClaims) (*models.User, error) {
+	base := sanitizeExternalUsername(idClaims.PreferredUsername)
+	if base == "" {
+		base = sanitizeExternalUsername(strings.SplitN(idClaims.Email, "@", 2)[0])
+	}
+	if base == "" {
+		base = "user"
+	}
+
+	// Never attach to an existing local account by name, pick a free username instead.
+	// Names the username policy rejects fall back to a generated one.
+	var user *models.User
+	var err error
+	for attempt := 1; attempt <= 100; attempt++ {
+		candidate := base
+		if attempt > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, attempt)
+		}
+		username, policyErr := utils.GetUsernamePolicy().ExternalUsername(candidate)
+		if policyErr != nil {
+			return nil, policyErr
+		}
+		user, err = h.userModel.CreateLinked(username, models.AuthSourceOIDC, h.issuer, idClaims.Subject, idClaims.Email)
+		if err == nil {
+			break
+		}
+		// Only a taken username is worth another attempt
+		if err.Error() != "UNIQUE constraint failed: users.username" {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Trust addresses the provider has verified
+	if idClaims.Email != "" && idClaims.EmailVerified {
+		if err := h.userModel.SetEmail(user.ID, strings.ToLower(idClaims.Email), true); err != nil {
+			return nil, err
+		}
+		return h.userModel.GetByID(user.ID)
+	}
+	return user, nil
+}
+
+// sanitizeExternalUsername keeps only characters that are safe in a local username
+func sanitizeExternalUsername(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+			b.WriteRune(c)
+		}
+	}
+	username := b.String()
+	if len(username) > 32 {
+		username = username[:32]
+	}
+	return username
+}
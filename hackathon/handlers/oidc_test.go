@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testClientID = "file-uploader"
+
+// mockOIDCProvider is an OpenID Connect provider that signs in a fixed user
+// without asking, and checks PKCE when the code is exchanged
+type mockOIDCProvider struct {
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+
+	mutex sync.Mutex
+	codes map[string]mockAuthorization
+
+	// Claims of the user who signs in, and a nonce that replaces the requested one
+	subject           string
+	preferredUsername string
+	nonceOverride     string
+}
+
+// mockAuthorization is remembered between the authorization request and the code exchange
+type mockAuthorization struct {
+	nonce         string
+	codeChallenge string
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{
+		key:               key,
+		codes:             make(map[string]mockAuthorization),
+		subject:           "sub-1",
+		preferredUsername: "Carol",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "EC", "kid": "test", "use": "sig", "crv": "P-256",
+				"x": encode(key.X.FillBytes(make([]byte, 32))),
+				"y": encode(key.Y.FillBytes(make([]byte, 32))),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// authorize plays the user signing in at the authorization URL and returns the
+// query of the redirect back to the relying party
+func (p *mockOIDCProvider) authorize(t *testing.T, authURL string) url.Values {
+	t.Helper()
+	parsed, err := url.Parse(authURL)
+	if err != nil || !strings.HasPrefix(authURL, p.server.URL+"/authorize") {
+		t.Fatalf("unexpected authorization URL %q", authURL)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != testClientID {
+		t.Fatalf("authorization request is missing PKCE or the client: %v", query)
+	}
+
+	code, _ := utils.RandomToken(16)
+	p.mutex.Lock()
+	p.codes[code] = mockAuthorization{nonce: query.Get("nonce"), codeChallenge: query.Get("code_challenge")}
+	p.mutex.Unlock()
+	return url.Values{"state": {query.Get("state")}, "code": {code}}
+}
+
+// token exchanges a code for a signed ID token
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	authorization, ok := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	p.mutex.Unlock()
+	if !ok || utils.PKCEChallenge(r.FormValue("code_verifier")) != authorization.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	nonce := authorization.nonce
+	if p.nonceOverride != "" {
+		nonce = p.nonceOverride
+	}
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodES256, utils.IDTokenClaims{
+		Nonce:             nonce,
+		Email:             "carol@example.com",
+		EmailVerified:     true,
+		PreferredUsername: p.preferredUsername,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.server.URL,
+			Subject:   p.subject,
+			Audience:  jwt.ClaimStrings{testClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	})
+	idToken.Header["kid"] = "test"
+	signed, err := idToken.SignedString(p.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.OIDCTokenResponse{AccessToken: "access", TokenType: "Bearer", IDToken: signed})
+}
+
+// oidcTest holds an OIDC handler that trusts a mock provider
+type oidcTest struct {
+	*testModels
+	provider *mockOIDCProvider
+	handler  *OIDCHandler
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	t.Helper()
+	m := newTestModels(t)
+	provider := newMockOIDCProvider(t)
+	config := &utils.OIDCConfig{
+		IssuerURL:   provider.server.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost:8080/api/v1/oidc/callback",
+		Scopes:      []string{"openid", "profile", "email"},
+	}
+	return &oidcTest{
+		testModels: m,
+		provider:   provider,
+		handler:    NewOIDCHandler(config, m.users, m.identity, m.audit),
+	}
+}
+
+// startLogin runs the Login step and returns the authorization URL and state cookie
+func (o *oidcTest) startLogin(t *testing.T) (string, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	o.handler.Login(w, httptest.NewRequest(http.MethodGet, "/api/v1/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status = %d, body %s", w.Code, w.Body)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || !cookies[0].HttpOnly {
+		t.Fatalf("login did not set an HttpOnly state cookie: %v", cookies)
+	}
+	return w.Header().Get("Location"), cookies[0]
+}
+
+// callback runs the Callback step with the given query and cookie
+func (o *oidcTest) callback(t *testing.T, query url.Values, cookie *http.Cookie) (int, AuthResponse) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/oidc/callback?"+query.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	var response AuthResponse
+	code := call(t, o.handler.Callback, r, &response)
+	return code, response
+}
+
+// loginEvents returns the audited logins, newest first
+func (o *oidcTest) loginEvents(t *testing.T) []*models.AuditEvent {
+	t.Helper()
+	events, _, err := o.audit.Query(models.AuditFilter{Action: AuditActionLogin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestOIDCLoginProvisionsAndReusesAccount(t *testing.T) {
+	o := newOIDCTest(t)
+
+	authURL, cookie := o.startLogin(t)
+	code, response := o.callback(t, o.provider.authorize(t, authURL), cookie)
+	if code != http.StatusOK {
+		t.Fatalf("callback status = %d, response %+v", code, response)
+	}
+	if response.User == nil || response.User.Username != "carol" || response.User.AuthSource != "oidc" {
+		t.Fatalf("provisioned user = %+v, want oidc user carol", response.User)
+	}
+	if _, err := utils.ValidateToken(response.Token); err != nil {
+		t.Fatalf("callback issued an invalid token: %v", err)
+	}
+
+	// The same subject logs in to the same account, even under another name
+	o.provider.preferredUsername = "carol2"
+	authURL, cookie = o.startLogin(t)
+	code, again := o.callback(t, o.provider.authorize(t, authURL), cookie)
+	if code != http.StatusOK || again.User.ID != response.User.ID {
+		t.Fatalf("second login status = %d, user %+v, want user %d", code, again.User, response.User.ID)
+	}
+	if n := o.count(t, "users"); n != 1 {
+		t.Errorf("users = %d, want 1", n)
+	}
+
+	events := o.loginEvents(t)
+	if len(events) != 2 {
+		t.Fatalf("audited logins = %d, want 2", len(events))
+	}
+	for i, detail := range []string{"", "account_provisioned"} {
+		event := events[i]
+		if event.Outcome != models.AuditOutcomeSuccess || event.ActorID == nil || *event.ActorID != response.User.ID || event.Detail != detail {
+			t.Errorf("login event %d = %+v, want success of user %d with detail %q", i, event, response.User.ID, detail)
+		}
+		if event.TargetType != "identity" || event.TargetID != o.provider.server.URL+"#"+o.provider.subject {
+			t.Errorf("login event %d target = %s %s", i, event.TargetType, event.TargetID)
+		}
+	}
+}
+
+func TestOIDCProvisioningAppliesUsernamePolicy(t *testing.T) {
+	o := newOIDCTest(t)
+	o.provider.preferredUsername = "admin"
+
+	authURL, cookie := o.startLogin(t)
+	code, response := o.callback(t, o.provider.authorize(t, authURL), cookie)
+	if code != http.StatusOK {
+		t.Fatalf("callback status = %d, response %+v", code, response)
+	}
+	if !strings.HasPrefix(response.User.Username, "user-") {
+		t.Errorf("username = %q, want a generated name instead of a reserved one", response.User.Username)
+	}
+}
+
+func TestOIDCProvisioningLeavesNoUserWhenLinkFails(t *testing.T) {
+	o := newOIDCTest(t)
+	if _, err := o.db.Exec(`CREATE TRIGGER fail_link BEFORE INSERT ON user_identities BEGIN SELECT RAISE(ABORT, 'link failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, cookie := o.startLogin(t)
+	if code, _ := o.callback(t, o.provider.authorize(t, authURL), cookie); code != http.StatusInternalServerError {
+		t.Fatalf("callback status = %d, want 500", code)
+	}
+	if n := o.count(t, "users"); n != 0 {
+		t.Fatalf("users = %d after a failed link, want 0", n)
+	}
+
+	// The next login gets the provider's name, not one taken by a half-created account
+	if _, err := o.db.Exec(`DROP TRIGGER fail_link`); err != nil {
+		t.Fatal(err)
+	}
+	authURL, cookie = o.startLogin(t)
+	code, response := o.callback(t, o.provider.authorize(t, authURL), cookie)
+	if code != http.StatusOK || response.User.Username != "carol" {
+		t.Errorf("login after recovery = %d, user %+v, want carol", code, response.User)
+	}
+}
+
+func TestOIDCCallbackRejectsBadState(t *testing.T) {
+	o := newOIDCTest(t)
+
+	authURL, cookie := o.startLogin(t)
+	query := o.provider.authorize(t, authURL)
+
+	// The callback URL replayed in a browser that did not start the login
+	if code, _ := o.callback(t, query, nil); code != http.StatusBadRequest {
+		t.Errorf("callback without cookie status = %d, want 400", code)
+	}
+	_, otherCookie := o.startLogin(t)
+	if code, _ := o.callback(t, query, otherCookie); code != http.StatusBadRequest {
+		t.Errorf("callback with another login's cookie status = %d, want 400", code)
+	}
+	forged := *cookie
+	forged.Value = query.Get("state") + ".forged"
+	if code, _ := o.callback(t, query, &forged); code != http.StatusBadRequest {
+		t.Errorf("callback with forged cookie status = %d, want 400", code)
+	}
+
+	// A state is good for one callback only
+	if code, _ := o.callback(t, query, cookie); code != http.StatusOK {
+		t.Fatalf("callback status = %d, want 200", code)
+	}
+	if code, _ := o.callback(t, query, cookie); code != http.StatusBadRequest {
+		t.Errorf("replayed callback status = %d, want 400", code)
+	}
+}
+
+func TestOIDCCallbackRejectsBadNonce(t *testing.T) {
+	o := newOIDCTest(t)
+	o.provider.nonceOverride = "replayed-nonce"
+
+	authURL, cookie := o.startLogin(t)
+	code, _ := o.callback(t, o.provider.authorize(t, authURL), cookie)
+	if code != http.StatusUnauthorized {
+		t.Errorf("callback status = %d, want 401", code)
+	}
+	if n := o.count(t, "users"); n != 0 {
+		t.Errorf("users = %d, want 0", n)
+	}
+	if events := o.loginEvents(t); len(events) != 1 || events[0].Outcome != models.AuditOutcomeFailure || events[0].Detail != "invalid_id_token" {
+		t.Errorf("audited logins = %+v, want one invalid_id_token failure", events)
+	}
+}
+
+func TestOIDCCallbackRejectsBadCode(t *testing.T) {
+	o := newOIDCTest(t)
+
+	authURL, cookie := o.startLogin(t)
+	query := o.provider.authorize(t, authURL)
+	query.Set("code", "not-issued")
+	if code, _ := o.callback(t, query, cookie); code != http.StatusBadGateway {
+		t.Errorf("callback status = %d, want 502", code)
+	}
+}
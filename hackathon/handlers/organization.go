@@ -0,0 +1,535 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// Organization name length limits
+const (
+	minOrgNameLength = 2
+	maxOrgNameLength = 64
+)
+
+// OrganizationHandler handles organizations, their members and invitations
+type OrganizationHandler struct {
+	orgModel  *models.OrganizationModel
+	userModel *models.UserModel
+	fileModel *models.FileModel
+}
+
+// NewOrganizationHandler creates a new OrganizationHandler
+func NewOrganizationHandler(orgModel *models.OrganizationModel, userModel *models.UserModel, fileModel *models.FileModel) *OrganizationHandler {
+	return &OrganizationHandler{
+		orgModel:  orgModel,
+		userModel: userModel,
+		fileModel: fileModel,
+	}
+}
+
+// CreateOrganizationRequest represents the organization creation payload
+type CreateOrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+// InviteRequest represents the invitation payload
+type InviteRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// SetMemberRoleRequest represents the member role change payload
+type SetMemberRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// SetQuotaRequest represents the organization quota payload
+type SetQuotaRequest struct {
+	QuotaBytes int64 `json:"quota_bytes"` // 0 removes the limit
+}
+
+// Create creates an organization owned by the authenticated user
+func (h *OrganizationHandler) Create(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	var req CreateOrganizationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if length := utf8.RuneCountInString(name); length < minOrgNameLength || length > maxOrgNameLength {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Name must be between 2 and 64 characters long"})
+		return
+	}
+
+	org, err := h.orgModel.Create(name, userID, getDefaultOrgQuota())
+	if err != nil {
+		if err.Error() == "UNIQUE constraint failed: organizations.name" {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Organization name already exists"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to create organization"})
+		return
+	}
+	org.Role = models.OrgRoleOwner
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+// List returns the organizations the authenticated user belongs to
+func (h *OrganizationHandler) List(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	orgs, err := h.orgModel.ListByUser(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list organizations"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"organizations": orgs,
+	})
+}
+
+// Get returns an organization with its members and usage
+func (h *OrganizationHandler) Get(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	org, ok := h.loadOrg(w, r, models.OrgRoleViewer)
+	if !ok {
+		return
+	}
+
+	members, err := h.orgModel.ListMembers(org.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list members"})
+		return
+	}
+
+	usage, err := h.fileModel.GetUsageByOrg(org.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load usage"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"organization": org,
+		"members":      members,
+		"usage":        usage,
+	})
+}
+
+// Delete deletes an organization that no longer owns any files
+func (h *OrganizationHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	org, ok := h.loadOrg(w, r, models.OrgRoleOwner)
+	if !ok {
+		return
+	}
+
+	usage, err := h.fileModel.GetUsageByOrg(org.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load usage"})
+		return
+	}
+	if usage.FileCount > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Organization still owns files"})
+		return
+	}
+
+	if err := h.orgModel.Delete(org.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to delete organization"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Organization deleted successfully",
+	})
+}
+
+// ListFiles returns the metadata of an organization's files
+func (h *OrganizationHandler) ListFiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	org, ok := h.loadOrg(w, r, models.OrgRoleViewer)
+	if !ok {
+		return
+	}
+
+	files, err := h.fileModel.ListByOrg(org.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list files"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files": files,
+	})
+}
+
+// Invite invites a user to the organization by username
+func (h *OrganizationHandler) Invite(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	org, ok := h.loadOrg(w, r, models.OrgRoleOwner)
+	if !ok {
+		return
+	}
+	userID, _ := r.Context().Value("user_id").(int)
+
+	var req InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = models.OrgRoleViewer
+	}
+	if !models.IsValidOrgRole(req.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Role must be owner, editor or viewer"})
+		return
+	}
+
+	invitee, err := h.userModel.GetByUsername(utils.NormalizeUsername(req.Username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "User not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	invitation, err := h.orgModel.Invite(org.ID, invitee.ID, req.Role, userID)
+	if err != nil {
+		if err == models.ErrAlreadyOrgMember {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "User is already a member"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to create invitation"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invitation)
+}
+
+// SetMemberRole changes the role of a member
+func (h *OrganizationHandler) SetMemberRole(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	org, ok := h.loadOrg(w, r, models.OrgRoleOwner)
+	if !ok {
+		return
+	}
+
+	memberID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid user ID"})
+		return
+	}
+
+	var req SetMemberRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	if !models.IsValidOrgRole(req.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Role must be owner, editor or viewer"})
+		return
+	}
+
+	if err := h.orgModel.SetMemberRole(org.ID, memberID, req.Role); err != nil {
+		writeMembershipError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Member role updated successfully",
+	})
+}
+
+// RemoveMember removes a member. Owners can remove anyone, other members only themselves.
+func (h *OrganizationHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, _ := r.Context().Value("user_id").(int)
+	memberID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid user ID"})
+		return
+	}
+
+	required := models.OrgRoleOwner
+	if memberID == userID {
+		required = models.OrgRoleViewer
+	}
+	org, ok := h.loadOrg(w, r, required)
+	if !ok {
+		return
+	}
+
+	if err := h.orgModel.RemoveMember(org.ID, memberID); err != nil {
+		writeMembershipError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Member removed successfully",
+	})
+}
+
+// ListInvitations returns the invitations addressed to the authenticated user
+func (h *OrganizationHandler) ListInvitations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	invitations, err := h.orgModel.ListInvitationsByUser(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list invitations"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"invitations": invitations,
+	})
+}
+
+// AcceptInvitation joins the organization of one of the user's invitations
+func (h *OrganizationHandler) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, invitationID, ok := invitationParams(w, r)
+	if !ok {
+		return
+	}
+
+	invitation, err := h.orgModel.AcceptInvitation(invitationID, userID)
+	if err != nil {
+		writeMembershipError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Invitation accepted",
+		"invitation": invitation,
+	})
+}
+
+// DeclineInvitation discards one of the user's invitations
+func (h *OrganizationHandler) DeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, invitationID, ok := invitationParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.orgModel.DeclineInvitation(invitationID, userID); err != nil {
+		writeMembershipError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Invitation declined",
+	})
+}
+
+// SetQuota changes an organization's storage quota (administrators only)
+func (h *OrganizationHandler) SetQuota(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	orgID, err := strconv.Atoi(mux.Vars(r)["orgId"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid organization ID"})
+		return
+	}
+
+	var req SetQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	if req.QuotaBytes < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "quota_bytes must not be negative"})
+		return
+	}
+
+	if _, err := h.orgModel.GetByID(orgID); err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Organization not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load organization"})
+		return
+	}
+
+	if err := h.orgModel.SetQuota(orgID, req.QuotaBytes); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update quota"})
+		return
+	}
+
+	org, err := h.orgModel.GetByID(orgID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load organization"})
+		return
+	}
+	json.NewEncoder(w).Encode(org)
+}
+
+// loadOrg loads the organization named by the orgId route variable and checks that the
+// authenticated user holds at least the required role. Non-members get 404 so that
+// organization IDs cannot be probed.
+func (h *OrganizationHandler) loadOrg(w http.ResponseWriter, r *http.Request, required string) (*models.Organization, bool) {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return nil, false
+	}
+
+	orgID, err := strconv.Atoi(mux.Vars(r)["orgId"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid organization ID"})
+		return nil, false
+	}
+
+	role, err := h.orgModel.GetRole(orgID, userID)
+	if err != nil {
+		if err == models.ErrNotOrgMember {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Organization not found"})
+			return nil, false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load organization"})
+		return nil, false
+	}
+
+	if !models.OrgRoleAtLeast(role, required) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Requires the " + required + " role in this organization"})
+		return nil, false
+	}
+
+	org, err := h.orgModel.GetByID(orgID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load organization"})
+		return nil, false
+	}
+	org.Role = role
+	return org, true
+}
+
+// invitationParams reads the authenticated user and the invitationId route variable
+func invitationParams(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return 0, 0, false
+	}
+
+	invitationID, err := strconv.Atoi(mux.Vars(r)["invitationId"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid invitation ID"})
+		return 0, 0, false
+	}
+	return userID, invitationID, true
+}
+
+// writeMembershipError maps organization model errors to responses
+func writeMembershipError(w http.ResponseWriter, err error) {
+	switch err {
+	case models.ErrNotOrgMember:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Member not found"})
+	case models.ErrInvitationNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invitation not found"})
+	case models.ErrLastOrgOwner:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Organization must keep at least one owner"})
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update membership"})
+	}
+}
+
+// getDefaultOrgQuota gets the storage quota of new organizations
+func getDefaultOrgQuota() int64 {
+	quota, err := strconv.ParseInt(os.Getenv("ORG_DEFAULT_QUOTA_BYTES"), 10, 64)
+	if err != nil || quota < 0 {
+		return 0 // Default unlimited
+	}
+	return quota
+}
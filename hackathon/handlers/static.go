@@ -1,102 +1,343 @@
 package handlers
 
 import (
+	"database/sql"
+	"fmt"
+	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
+	"file-uploader/imaging"
 	"file-uploader/models"
+	"file-uploader/utils"
 
 	"github.com/gorilla/mux"
 )
 
+// authVary lists the request headers that identify the caller of authenticated routes
+const authVary = "Authorization, X-API-Key"
+
+// immutableMaxAge is the cache lifetime of public downloads addressed by content hash
+const immutableMaxAge = 365 * 24 * time.Hour
+
+// CachePolicy controls the Cache-Control headers of served files
+type CachePolicy struct {
+	PrivateMaxAge time.Duration // Browser cache lifetime of authenticated downloads, zero revalidates every time
+	PublicMaxAge  time.Duration // Shared cache lifetime of public downloads by file ID, whose content can be replaced
+}
+
 // StaticHandler handles static file serving
 type StaticHandler struct {
-	fileModel *models.FileModel
+	fileModel   *models.FileModel
+	orgModel    *models.OrganizationModel
+	auditModel  *models.AuditModel
+	transformer *imaging.Transformer
+	cachePolicy CachePolicy
 }
 
 // NewStaticHandler creates a new StaticHandler
-func NewStaticHandler(fileModel *models.FileModel) *StaticHandler {
+func NewStaticHandler(fileModel *models.FileModel, orgModel *models.OrganizationModel, auditModel *models.AuditModel, transformer *imaging.Transformer) *StaticHandler {
 	return &StaticHandler{
-		fileModel: fileModel,
+		fileModel:   fileModel,
+		orgModel:    orgModel,
+		auditModel:  auditModel,
+		transformer: transformer,
+		cachePolicy: getCachePolicy(),
 	}
 }
 
+// audit records an access to a file
+func (h *StaticHandler) audit(r *http.Request, action, fileID, outcome, detail string) {
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:     action,
+		TargetType: "file",
+		TargetID:   fileID,
+		Outcome:    outcome,
+		Detail:     detail,
+	})
+}
+
 // ServeFile serves uploaded files with authentication
 func (h *StaticHandler) ServeFile(w http.ResponseWriter, r *http.Request) {
-	// Get file ID from URL
-	vars := mux.Vars(r)
-	fileIDStr := vars["fileId"]
+	fileMetadata, ok := h.readableFile(w, r, "")
+	if !ok {
+		return
+	}
+
+	// Only the browser may cache authenticated downloads, and the response
+	// depends on who is asking
+	w.Header().Set("Vary", authVary)
+	h.serveContent(w, r, fileMetadata, h.privateCacheControl())
+}
 
-	fileID, err := strconv.Atoi(fileIDStr)
+// ServeVersion serves a specific version of a file, with the same access rules as ServeFile
+func (h *StaticHandler) ServeVersion(w http.ResponseWriter, r *http.Request) {
+	versionNumber, err := strconv.Atoi(mux.Vars(r)["version"])
 	if err != nil {
-		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		http.Error(w, "Invalid version", http.StatusBadRequest)
 		return
 	}
 
+	fileMetadata, ok := h.readableFile(w, r, "version:"+strconv.Itoa(versionNumber))
+	if !ok {
+		return
+	}
+
+	version, err := h.fileModel.GetVersion(fileMetadata.ID, versionNumber)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load version", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Vary", authVary)
+	writeContent(w, r, version.FilePath, version.ContentType, fileMetadata.Filename, version.ContentHash, h.privateCacheControl())
+}
+
+// readableFile loads the file named in the URL and checks that the authenticated user
+// may read it: personal files are readable by their owner, organization files by any
+// member. Every attempt is audited, successful reads with the given detail.
+func (h *StaticHandler) readableFile(w http.ResponseWriter, r *http.Request, detail string) (*models.FileMetadata, bool) {
+	// Get file ID from URL
+	fileRef := mux.Vars(r)["fileId"]
+
 	// Get user ID from context (set by auth middleware)
 	userID, ok := r.Context().Value("user_id").(int)
 	if !ok {
 		http.Error(w, "User not authenticated", http.StatusUnauthorized)
-		return
+		return nil, false
 	}
 
 	// Get file metadata from database
-	fileMetadata, err := h.fileModel.GetByID(fileID)
+	fileMetadata, err := lookupFile(w, h.fileModel, fileRef)
 	if err != nil {
+		h.audit(r, AuditActionFileRead, fileRef, models.AuditOutcomeFailure, "not_found")
 		http.Error(w, "File not found", http.StatusNotFound)
-		return
+		return nil, false
 	}
+	fileIDStr := strconv.Itoa(fileMetadata.ID)
 
-	// Check if user owns the file
-	if fileMetadata.UserID != userID {
+	allowed, reason, err := checkFileAccess(h.orgModel, fileMetadata, userID, models.OrgRoleViewer)
+	if err != nil {
+		http.Error(w, "Failed to check access", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !allowed {
+		h.audit(r, AuditActionFileRead, fileIDStr, models.AuditOutcomeDenied, reason)
 		http.Error(w, "Access denied", http.StatusForbidden)
-		return
+		return nil, false
 	}
 
 	// Check if file exists on disk
 	if _, err := os.Stat(fileMetadata.FilePath); os.IsNotExist(err) {
+		h.audit(r, AuditActionFileRead, fileIDStr, models.AuditOutcomeFailure, "missing_on_disk")
 		http.Error(w, "File not found on disk", http.StatusNotFound)
-		return
+		return nil, false
 	}
 
-	// Set appropriate headers
-	w.Header().Set("Content-Type", fileMetadata.ContentType)
-	w.Header().Set("Content-Disposition", "inline; filename=\""+fileMetadata.Filename+"\"")
+	h.audit(r, AuditActionFileRead, fileIDStr, models.AuditOutcomeSuccess, detail)
+	return fileMetadata, true
+}
 
-	// Serve the file
-	http.ServeFile(w, r, fileMetadata.FilePath)
+// privateCacheControl returns the Cache-Control header of authenticated downloads
+func (h *StaticHandler) privateCacheControl() string {
+	if h.cachePolicy.PrivateMaxAge > 0 {
+		return fmt.Sprintf("private, max-age=%d", int(h.cachePolicy.PrivateMaxAge.Seconds()))
+	}
+	return "private, no-cache"
 }
 
-// ServePublicFile serves files without authentication (optional endpoint)
+// ServePublicFile serves the current content of a file without authentication.
+// The content can be replaced, so it is only cached briefly; Content-Location names
+// the URL of this exact content, which can be cached for good.
 func (h *StaticHandler) ServePublicFile(w http.ResponseWriter, r *http.Request) {
-	// Get file ID from URL
-	vars := mux.Vars(r)
-	fileIDStr := vars["fileId"]
+	fileMetadata, ok := h.publicFile(w, r, "")
+	if !ok {
+		return
+	}
 
-	fileID, err := strconv.Atoi(fileIDStr)
-	if err != nil {
-		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+	location := publicContentURL(fileMetadata)
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Content-Location", location)
+	h.serveContent(w, r, fileMetadata, publicCacheControl(fileMetadata, h.cachePolicy.PublicMaxAge, false))
+}
+
+// ServePublicContent serves a file without authentication at a URL that includes its
+// content hash. The URL always returns the same bytes, or 404 once the content was
+// replaced, so caches may keep it without revalidating.
+func (h *StaticHandler) ServePublicContent(w http.ResponseWriter, r *http.Request) {
+	fileMetadata, ok := h.publicFile(w, r, mux.Vars(r)["contentHash"])
+	if !ok {
 		return
 	}
+	h.serveContent(w, r, fileMetadata, publicCacheControl(fileMetadata, immutableMaxAge, true))
+}
 
-	// Get file metadata from database
-	fileMetadata, err := h.fileModel.GetByID(fileID)
+// publicFile loads the file named in the URL for an unauthenticated download. When
+// contentHash is set, the file's current content must have that hash. Every attempt
+// is audited.
+func (h *StaticHandler) publicFile(w http.ResponseWriter, r *http.Request, contentHash string) (*models.FileMetadata, bool) {
+	// Get file ID from URL
+	fileRef := mux.Vars(r)["fileId"]
+
+	// Only public IDs, sequential legacy IDs would let anyone enumerate every file
+	var fileMetadata *models.FileMetadata
+	err := sql.ErrNoRows
+	if utils.IsUUID(fileRef) {
+		fileMetadata, err = h.fileModel.GetByPublicID(fileRef)
+	}
 	if err != nil {
+		h.audit(r, AuditActionFileReadPublic, fileRef, models.AuditOutcomeFailure, "not_found")
 		http.Error(w, "File not found", http.StatusNotFound)
-		return
+		return nil, false
 	}
+	fileIDStr := strconv.Itoa(fileMetadata.ID)
 
 	// Check if file exists on disk
 	if _, err := os.Stat(fileMetadata.FilePath); os.IsNotExist(err) {
+		h.audit(r, AuditActionFileReadPublic, fileIDStr, models.AuditOutcomeFailure, "missing_on_disk")
 		http.Error(w, "File not found on disk", http.StatusNotFound)
+		return nil, false
+	}
+
+	h.ensureContentHash(fileMetadata)
+	if contentHash != "" && contentHash != fileMetadata.ContentHash {
+		h.audit(r, AuditActionFileReadPublic, fileIDStr, models.AuditOutcomeFailure, "content_replaced")
+		http.Error(w, "File content has been replaced", http.StatusNotFound)
+		return nil, false
+	}
+
+	h.audit(r, AuditActionFileReadPublic, fileIDStr, models.AuditOutcomeSuccess, "")
+	return fileMetadata, true
+}
+
+// publicContentURL returns the URL of a file's current content for unauthenticated downloads
+func publicContentURL(fileMetadata *models.FileMetadata) string {
+	return "/public/files/" + fileMetadata.PublicID + "/" + fileMetadata.ContentHash
+}
+
+// publicCacheControl returns the Cache-Control header of a public download
+func publicCacheControl(fileMetadata *models.FileMetadata, maxAge time.Duration, immutable bool) string {
+	// Shared caches must not keep serving a file after it expired
+	if fileMetadata.ExpiresAt != nil {
+		maxAge = max(0, min(maxAge, time.Until(*fileMetadata.ExpiresAt)))
+	}
+	cacheControl := fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+	if immutable {
+		cacheControl += ", immutable"
+	}
+	return cacheControl
+}
+
+// serveContent writes a file, or a transformation requested in the query
+func (h *StaticHandler) serveContent(w http.ResponseWriter, r *http.Request, fileMetadata *models.FileMetadata, cacheControl string) {
+	h.ensureContentHash(fileMetadata)
+
+	path := fileMetadata.FilePath
+	contentType := fileMetadata.ContentType
+	filename := fileMetadata.Filename
+	etag := fileMetadata.ContentHash
+	if query := r.URL.Query(); imaging.IsTransformRequest(query) {
+		result, status, message := h.transform(fileMetadata, query)
+		if status != 0 {
+			http.Error(w, message, status)
+			return
+		}
+		path = result.Path
+		contentType = result.ContentType
+		filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + result.Extension
+		etag = result.Key
+	}
+
+	writeContent(w, r, path, contentType, filename, etag, cacheControl)
+}
+
+// ensureContentHash hashes files uploaded before hashes were recorded
+func (h *StaticHandler) ensureContentHash(fileMetadata *models.FileMetadata) {
+	if fileMetadata.ContentHash != "" {
 		return
 	}
+	contentHash, err := utils.HashFile(fileMetadata.FilePath)
+	if err == nil {
+		err = h.fileModel.SetContentHash(fileMetadata.ID, contentHash)
+	}
+	if err != nil {
+		log.Printf("Failed to record content hash of file %d: %v", fileMetadata.ID, err)
+	}
+	fileMetadata.ContentHash = contentHash
+}
+
+// writeContent writes a file with a strong ETag derived from its content.
+// http.ServeContent answers If-None-Match, If-Modified-Since and range requests.
+func writeContent(w http.ResponseWriter, r *http.Request, path, contentType, filename, etag, cacheControl string) {
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "File not found on disk", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	http.ServeContent(w, r, filename, info.ModTime(), file)
+}
 
-	// Set appropriate headers
-	w.Header().Set("Content-Type", fileMetadata.ContentType)
-	w.Header().Set("Content-Disposition", "inline; filename=\""+fileMetadata.Filename+"\"")
+// transform renders the transformation requested in the query.
+// It returns a zero status when the rendering is available.
+func (h *StaticHandler) transform(fileMetadata *models.FileMetadata, query url.Values) (*imaging.Result, int, string) {
+	opts, err := h.transformer.ParseQuery(query)
+	if err != nil {
+		return nil, http.StatusBadRequest, "Invalid transformation: " + err.Error()
+	}
+	if fileMetadata.ContentHash == "" {
+		return nil, http.StatusInternalServerError, "Failed to read file"
+	}
 
-	// Serve the file
-	http.ServeFile(w, r, fileMetadata.FilePath)
+	result, err := h.transformer.Render(fileMetadata.FilePath, fileMetadata.ContentHash, fileMetadata.ContentType, opts)
+	switch {
+	case err == imaging.ErrUnsupported:
+		return nil, http.StatusUnprocessableEntity, "This image format cannot be transformed"
+	case err == imaging.ErrTooLarge:
+		return nil, http.StatusUnprocessableEntity, "Image is too large to transform"
+	case err != nil:
+		log.Printf("Failed to transform file %d: %v", fileMetadata.ID, err)
+		return nil, http.StatusInternalServerError, "Failed to transform image"
+	}
+	return result, 0, ""
+}
+
+// getCachePolicy reads the cache policy from environment variables
+func getCachePolicy() CachePolicy {
+	// Content can be replaced by a new version, so public downloads are only cached briefly
+	policy := CachePolicy{
+		PublicMaxAge: 5 * time.Minute,
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("CACHE_PRIVATE_MAX_AGE_SECONDS")); err == nil && seconds > 0 {
+		policy.PrivateMaxAge = time.Duration(seconds) * time.Second
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("CACHE_PUBLIC_MAX_AGE_SECONDS")); err == nil && seconds >= 0 {
+		policy.PublicMaxAge = time.Duration(seconds) * time.Second
+	}
+	return policy
 }
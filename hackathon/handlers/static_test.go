@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"file-uploader/imaging"
+	"file-uploader/models"
+
+	"github.com/gorilla/mux"
+)
+
+// staticTest holds a static handler and a personal file of its owner
+type staticTest struct {
+	*testModels
+	handler *StaticHandler
+	owner   *models.User
+	file    *models.FileMetadata
+}
+
+func newStaticTest(t *testing.T) *staticTest {
+	t.Helper()
+	m := newTestModels(t)
+	uploadDir := t.TempDir()
+	config, err := imaging.GetConfig(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner, err := m.users.CreateExternal("alice", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(uploadDir, "upload_test")
+	if err := os.WriteFile(path, []byte("not really a png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := m.files.Create(&models.FileMetadata{
+		UserID: owner.ID, Filename: "a.png", ContentType: "image/png", Size: 16, FilePath: path,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &staticTest{
+		testModels: m,
+		handler:    NewStaticHandler(m.files, m.orgs, m.audit, imaging.NewTransformer(config)),
+		owner:      owner,
+		file:       file,
+	}
+}
+
+// get serves a file route with the given file reference
+func (s *staticTest) get(handler http.HandlerFunc, target, ref string, user *models.User) *httptest.ResponseRecorder {
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, target, nil), map[string]string{"fileId": ref})
+	if user != nil {
+		r = withUser(r, user)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestPublicFilesRequirePublicIDs(t *testing.T) {
+	t.Setenv("LEGACY_FILE_IDS", "true")
+	s := newStaticTest(t)
+	legacyID := strconv.Itoa(s.file.ID)
+
+	if w := s.get(s.handler.ServePublicFile, "/public/files/"+s.file.PublicID, s.file.PublicID, nil); w.Code != http.StatusOK {
+		t.Errorf("public ID status = %d, want 200", w.Code)
+	}
+	if w := s.get(s.handler.ServePublicFile, "/public/files/"+legacyID, legacyID, nil); w.Code != http.StatusNotFound {
+		t.Errorf("legacy ID on the public route status = %d, want 404", w.Code)
+	}
+
+	// Authenticated routes still accept legacy IDs while clients migrate
+	w := s.get(s.handler.ServeFile, "/files/"+legacyID, legacyID, s.owner)
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "true" {
+		t.Errorf("legacy ID on the authenticated route status = %d, Deprecation %q", w.Code, w.Header().Get("Deprecation"))
+	}
+}
+
+func TestAuthenticatedDownloadsStayPrivate(t *testing.T) {
+	s := newStaticTest(t)
+
+	w := s.get(s.handler.ServeFile, "/files/"+s.file.PublicID, s.file.PublicID, s.owner)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	// Shared caches must not hand one API key's download to another caller
+	if got := w.Header().Get("Cache-Control"); !strings.HasPrefix(got, "private") {
+		t.Errorf("Cache-Control = %q, want private", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Authorization, X-API-Key" {
+		t.Errorf("Vary = %q, want Authorization, X-API-Key", got)
+	}
+
+	w = s.get(s.handler.ServePublicFile, "/public/files/"+s.file.PublicID, s.file.PublicID, nil)
+	if got := w.Header().Get("Vary"); got != "" {
+		t.Errorf("public download Vary = %q, want none", got)
+	}
+}
+
+// getContent serves the public route of a file's content with the given hash
+func (s *staticTest) getContent(contentHash string) *httptest.ResponseRecorder {
+	target := "/public/files/" + s.file.PublicID + "/" + contentHash
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, target, nil), map[string]string{
+		"fileId": s.file.PublicID, "contentHash": contentHash,
+	})
+	w := httptest.NewRecorder()
+	s.handler.ServePublicContent(w, r)
+	return w
+}
+
+func TestPublicContentURLsAreImmutable(t *testing.T) {
+	s := newStaticTest(t)
+
+	// The stable URL is cached briefly and names the URL of its current content, query included
+	w := s.get(s.handler.ServePublicFile, "/public/files/"+s.file.PublicID+"?v=1", s.file.PublicID, nil)
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=300" {
+		t.Errorf("stable URL Cache-Control = %q, want public, max-age=300", got)
+	}
+	location := w.Header().Get("Content-Location")
+	original := strings.TrimPrefix(strings.TrimSuffix(location, "?v=1"), "/public/files/"+s.file.PublicID+"/")
+	if len(original) != 64 || location != "/public/files/"+s.file.PublicID+"/"+original+"?v=1" {
+		t.Fatalf("Content-Location = %q, want the content URL with the query", location)
+	}
+
+	w = s.getContent(original)
+	if w.Code != http.StatusOK || w.Body.String() != "not really a png" {
+		t.Fatalf("content URL status = %d, body %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=31536000, immutable" {
+		t.Errorf("content URL Cache-Control = %q, want a year and immutable", got)
+	}
+	if w := s.getContent(strings.Repeat("0", 64)); w.Code != http.StatusNotFound {
+		t.Errorf("unknown hash status = %d, want 404", w.Code)
+	}
+
+	// Once a new version replaces the content, its old URL is gone rather than changed
+	path := filepath.Join(t.TempDir(), "upload_v2")
+	if err := os.WriteFile(path, []byte("new content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := s.files.AddVersion(s.file.ID, 0, &models.FileVersion{
+		UserID: s.owner.ID, ContentType: "image/png", Size: 11, ContentHash: strings.Repeat("a", 64), FilePath: path,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := s.getContent(original); w.Code != http.StatusNotFound {
+		t.Errorf("replaced content status = %d, want 404", w.Code)
+	}
+	if w := s.getContent(replaced.ContentHash); w.Code != http.StatusOK || w.Body.String() != "new content" {
+		t.Errorf("new content status = %d, body %q", w.Code, w.Body.String())
+	}
+	if n := s.count(t, "audit_log WHERE detail = 'content_replaced'"); n != 2 {
+		t.Errorf("%d content_replaced audit events, want 2", n)
+	}
+}
+
+func TestPublicCachingEndsWithExpiry(t *testing.T) {
+	s := newStaticTest(t)
+	if _, err := s.db.Exec("UPDATE files SET expires_at = ? WHERE id = ?", time.Now().Add(90*time.Second), s.file.ID); err != nil {
+		t.Fatal(err)
+	}
+	s.file, _ = s.files.GetByID(s.file.ID)
+
+	maxAge := func(cacheControl string) int {
+		var seconds int
+		fmt.Sscanf(cacheControl, "public, max-age=%d", &seconds)
+		return seconds
+	}
+	w := s.get(s.handler.ServePublicFile, "/public/files/"+s.file.PublicID, s.file.PublicID, nil)
+	if got := maxAge(w.Header().Get("Cache-Control")); got > 90 || got < 80 {
+		t.Errorf("stable URL max-age = %d, want the time until expiry", got)
+	}
+	w = s.getContent(s.file.ContentHash)
+	if got := w.Header().Get("Cache-Control"); maxAge(got) > 90 || maxAge(got) < 80 || !strings.HasSuffix(got, ", immutable") {
+		t.Errorf("content URL Cache-Control = %q, want the time until expiry", got)
+	}
+}
@@ -1,9 +1,13 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -11,28 +15,39 @@ import (
 	"strings"
 	"time"
 
+	"file-uploader/jobs"
 	"file-uploader/models"
+	"file-uploader/utils"
 )
 
 // UploadHandler handles file upload operations
 type UploadHandler struct {
-	fileModel *models.FileModel
+	fileModel  *models.FileModel
+	orgModel   *models.OrganizationModel
+	userModel  *models.UserModel
+	auditModel *models.AuditModel
 }
 
 // NewUploadHandler creates a new UploadHandler
-func NewUploadHandler(fileModel *models.FileModel) *UploadHandler {
+func NewUploadHandler(fileModel *models.FileModel, orgModel *models.OrganizationModel, userModel *models.UserModel, auditModel *models.AuditModel) *UploadHandler {
 	return &UploadHandler{
-		fileModel: fileModel,
+		fileModel:  fileModel,
+		orgModel:   orgModel,
+		userModel:  userModel,
+		auditModel: auditModel,
 	}
 }
 
 // UploadResponse represents the upload response
 type UploadResponse struct {
-	Message   string               `json:"message"`
-	FileID    int                  `json:"file_id"`
-	FileURL   string               `json:"file_url"`
-	PublicURL string               `json:"public_url,omitempty"`
-	Metadata  *models.FileMetadata `json:"metadata"`
+	Message   string `json:"message"`
+	FileID    int    `json:"file_id"` // Legacy ID, use PublicID
+	PublicID  string `json:"public_id"`
+	FileURL   string `json:"file_url"`
+	PublicURL string `json:"public_url,omitempty"`
+	// Public URL of this exact content, cacheable for good but gone once the content is replaced
+	ImmutableURL string               `json:"immutable_url,omitempty"`
+	Metadata     *models.FileMetadata `json:"metadata"`
 }
 
 // Upload handles file upload with validation
@@ -47,92 +62,316 @@ func (h *UploadHandler) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse multipart form with configurable max memory
-	maxFileSize := getMaxFileSize()
-	err := r.ParseMultipartForm(maxFileSize)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to parse multipart form"})
-		return
-	}
-
-	// Get the file from form data
-	file, fileHeader, err := r.FormFile("data")
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "No file provided or invalid file field name"})
+	file, fileHeader, uploadErr := openUpload(r)
+	if uploadErr != nil {
+		if uploadErr.reason != "" {
+			h.auditFailure(r, uploadErr.reason)
+		}
+		w.WriteHeader(uploadErr.status)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: uploadErr.message})
 		return
 	}
 	defer file.Close()
-
-	if fileHeader.Size > maxFileSize {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{
-			Error: fmt.Sprintf("File size exceeds %d bytes limit", maxFileSize),
-		})
-		return
-	}
-
-	// Check content type is an image
 	contentType := fileHeader.Header.Get("Content-Type")
-	if !isImageContentType(contentType) {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "File must be an image (JPEG, PNG, GIF, WebP, BMP, TIFF)"})
-		return
-	}
 
-	uploadDir := getUploadDir()
-	tempFileName := fmt.Sprintf("upload_%d_%d_%s", userID, time.Now().Unix(), fileHeader.Filename)
-	tempFilePath := filepath.Join(uploadDir, tempFileName)
+	// Uploads can be owned by an organization the user may edit
+	var orgID *int
+	if value := r.FormValue("org_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid organization ID"})
+			return
+		}
+		if status, message := h.checkOrgUpload(id, userID, fileHeader.Size); status != 0 {
+			h.auditFailure(r, "org_rejected")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+			return
+		}
+		orgID = &id
+	}
 
-	// Create the temporary file
-	tempFile, err := os.Create(tempFilePath)
+	user, err := h.userModel.GetByID(userID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to create temporary file"})
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+	expiresAt, message := fileExpiry(r.FormValue("expires_in"), user, time.Now())
+	if message != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: message})
 		return
 	}
-	defer tempFile.Close()
 
-	// Copy uploaded file content to temporary file
-	_, err = io.Copy(tempFile, file)
-	if err != nil {
-		// Clean up the temporary file if copy fails
-		os.Remove(tempFilePath)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to save file"})
+	staged, uploadErr := stageUpload(file, fileHeader.Size, r.FormValue("sha256"))
+	if uploadErr != nil {
+		if uploadErr.reason != "" {
+			h.auditFailure(r, uploadErr.reason)
+		}
+		w.WriteHeader(uploadErr.status)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: uploadErr.message})
 		return
 	}
 
 	// Prepare file metadata
 	metadata := &models.FileMetadata{
 		UserID:      userID,
+		OrgID:       orgID,
 		Filename:    fileHeader.Filename,
 		ContentType: contentType,
-		Size:        fileHeader.Size,
-		FilePath:    tempFilePath,
+		Size:        staged.size,
+		ContentHash: staged.contentHash,
+		FilePath:    staged.path,
 		UserAgent:   r.Header.Get("User-Agent"),
 		RemoteAddr:  getClientIP(r),
+		ExpiresAt:   expiresAt,
 	}
 
-	// Save metadata to database
-	savedMetadata, err := h.fileModel.Create(metadata)
+	// Save metadata to database, moving the content into place before it commits
+	savedMetadata, err := h.fileModel.Create(metadata, staged.commit)
+	if err == models.ErrOrgQuotaExceeded {
+		// Another upload used up the room since the check above
+		staged.discard()
+		h.auditFailure(r, "org_rejected")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Organization storage quota exceeded"})
+		return
+	}
 	if err != nil {
-		// Clean up the temporary file if database save fails
-		os.Remove(tempFilePath)
+		// Clean up the content if database save fails
+		log.Printf("Failed to save upload: %v", err)
+		staged.discard()
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to save file metadata"})
 		return
 	}
 
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:     AuditActionFileUpload,
+		TargetType: "file",
+		TargetID:   strconv.Itoa(savedMetadata.ID),
+		Outcome:    models.AuditOutcomeSuccess,
+	})
+
 	// Return success response
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(UploadResponse{
-		Message:   "File uploaded successfully",
-		FileID:    savedMetadata.ID,
-		FileURL:   fmt.Sprintf("/files/%d", savedMetadata.ID),
-		PublicURL: fmt.Sprintf("/public/files/%d", savedMetadata.ID),
-		Metadata:  savedMetadata,
+		Message:      "File uploaded successfully",
+		FileID:       savedMetadata.ID,
+		PublicID:     savedMetadata.PublicID,
+		FileURL:      "/files/" + savedMetadata.PublicID,
+		PublicURL:    "/public/files/" + savedMetadata.PublicID,
+		ImmutableURL: publicContentURL(savedMetadata),
+		Metadata:     savedMetadata,
+	})
+}
+
+// uploadError describes why an uploaded file was rejected
+type uploadError struct {
+	status  int
+	message string
+	reason  string // Audit detail, empty for malformed requests
+}
+
+// openUpload parses the multipart form and opens the file in its data field,
+// checking its size and that it is an image
+func openUpload(r *http.Request) (multipart.File, *multipart.FileHeader, *uploadError) {
+	// Parse multipart form with configurable max memory
+	maxFileSize := getMaxFileSize()
+	if err := r.ParseMultipartForm(maxFileSize); err != nil {
+		return nil, nil, &uploadError{status: http.StatusBadRequest, message: "Failed to parse multipart form"}
+	}
+
+	// Get the file from form data
+	file, fileHeader, err := r.FormFile("data")
+	if err != nil {
+		return nil, nil, &uploadError{status: http.StatusBadRequest, message: "No file provided or invalid file field name"}
+	}
+
+	if fileHeader.Size > maxFileSize {
+		file.Close()
+		return nil, nil, &uploadError{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("File size exceeds %d bytes limit", maxFileSize),
+			reason:  "size_exceeded",
+		}
+	}
+
+	// Check content type is an image
+	if !isImageContentType(fileHeader.Header.Get("Content-Type")) {
+		file.Close()
+		return nil, nil, &uploadError{
+			status:  http.StatusBadRequest,
+			message: "File must be an image (JPEG, PNG, GIF, WebP, BMP, TIFF)",
+			reason:  "invalid_content_type",
+		}
+	}
+	return file, fileHeader, nil
+}
+
+// uploadFile is the staging file uploaded content is written to
+type uploadFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+	Name() string
+}
+
+// Filesystem steps of storing an upload, replaced in tests to inject failures
+var (
+	createStagingFile = func(dir, pattern string) (uploadFile, error) {
+		f, err := os.CreateTemp(dir, pattern)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	renameUpload  = os.Rename
+	syncUploadDir = syncDir
+)
+
+// stagedUpload is uploaded content that was written completely to the staging directory
+// and synced to disk, waiting to be moved to its final path
+type stagedUpload struct {
+	tempPath    string
+	path        string // Final path, a random name independent of the uploaded filename
+	size        int64
+	contentHash string // Hex SHA-256 of the content
+	committed   bool
+}
+
+// stageUpload copies an uploaded file to the staging directory inside the upload directory,
+// so a partly written upload never appears under a final path. The content must have the
+// expected size and, if expectedHash is set, that hex SHA-256.
+func stageUpload(file io.Reader, expectedSize int64, expectedHash string) (*stagedUpload, *uploadError) {
+	uploadDir := getUploadDir()
+	stagingDir := filepath.Join(uploadDir, jobs.StagingDirName)
+	if err := os.MkdirAll(stagingDir, 0700); err != nil {
+		return nil, storeFailed(err)
+	}
+	tempFile, err := createStagingFile(stagingDir, "upload_*")
+	if err != nil {
+		return nil, storeFailed(err)
+	}
+	staged := &stagedUpload{tempPath: tempFile.Name()}
+
+	hash := sha256.New()
+	staged.size, err = io.Copy(io.MultiWriter(tempFile, hash), io.LimitReader(file, expectedSize+1))
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		staged.discard()
+		return nil, storeFailed(err)
+	}
+
+	if staged.size != expectedSize {
+		staged.discard()
+		return nil, &uploadError{status: http.StatusBadRequest, message: "Uploaded file is incomplete", reason: "size_mismatch"}
+	}
+	staged.contentHash = hex.EncodeToString(hash.Sum(nil))
+	if expectedHash != "" && !strings.EqualFold(expectedHash, staged.contentHash) {
+		staged.discard()
+		return nil, &uploadError{status: http.StatusBadRequest, message: "Uploaded file does not match the sha256 checksum", reason: "checksum_mismatch"}
+	}
+
+	// Every stored content gets its own name, so a new version never overwrites an older
+	// one. The upload_ prefix is what reconciliation looks for.
+	name, err := utils.NewUUIDv7()
+	if err != nil {
+		staged.discard()
+		return nil, storeFailed(err)
+	}
+	staged.path = filepath.Join(uploadDir, "upload_"+name)
+	return staged, nil
+}
+
+// storeFailed logs a failure to store an upload and returns the error for the client
+func storeFailed(err error) *uploadError {
+	log.Printf("Failed to store upload: %v", err)
+	return &uploadError{status: http.StatusInternalServerError, message: "Failed to save file"}
+}
+
+// commit atomically moves the staged content to its final path and syncs the upload
+// directory, so the move survives a crash. It is called inside the database transaction
+// that records the file, which is rolled back if the move fails.
+func (s *stagedUpload) commit() error {
+	if err := renameUpload(s.tempPath, s.path); err != nil {
+		return err
+	}
+	s.committed = true
+	return syncUploadDir(filepath.Dir(s.path))
+}
+
+// discard removes the content, from its final path if it was already committed
+func (s *stagedUpload) discard() {
+	path := s.tempPath
+	if s.committed {
+		path = s.path
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove upload %s: %v", path, err)
+	}
+}
+
+// syncDir flushes a directory to disk, making renames into it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// checkOrgUpload checks that a user may add a file of the given size to an organization.
+// It returns a zero status when the upload is allowed.
+func (h *UploadHandler) checkOrgUpload(orgID, userID int, size int64) (int, string) {
+	role, err := h.orgModel.GetRole(orgID, userID)
+	if err == models.ErrNotOrgMember {
+		return http.StatusNotFound, "Organization not found"
+	}
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to load organization"
+	}
+	if !models.OrgRoleAtLeast(role, models.OrgRoleEditor) {
+		return http.StatusForbidden, "Requires the editor role in this organization"
+	}
+
+	return checkOrgQuota(h.orgModel, h.fileModel, orgID, size)
+}
+
+// checkOrgQuota checks that an organization has room for a file of the given size, so
+// uploads that cannot fit are rejected before their content is stored. It returns a
+// zero status when the file fits. FileModel checks again when the file is recorded.
+func checkOrgQuota(orgModel *models.OrganizationModel, fileModel *models.FileModel, orgID int, size int64) (int, string) {
+	org, err := orgModel.GetByID(orgID)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to load organization"
+	}
+	if org.QuotaBytes > 0 {
+		usage, err := fileModel.GetUsageByOrg(orgID)
+		if err != nil {
+			return http.StatusInternalServerError, "Failed to load usage"
+		}
+		if usage.TotalBytes+size > org.QuotaBytes {
+			return http.StatusRequestEntityTooLarge, "Organization storage quota exceeded"
+		}
+	}
+	return 0, ""
+}
+
+// auditFailure records a rejected upload
+func (h *UploadHandler) auditFailure(r *http.Request, reason string) {
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:  AuditActionFileUpload,
+		Outcome: models.AuditOutcomeFailure,
+		Detail:  reason,
 	})
 }
 
@@ -159,6 +398,51 @@ func isImageContentType(contentType string) bool {
 	return false
 }
 
+// fileExpiry returns when an upload expires: after expires_in if given, which may not exceed
+// the user's retention, otherwise after the retention. It returns nil for files kept forever,
+// and an error message if expires_in is invalid. expires_in is a number of seconds or a
+// duration such as "90m" or "24h".
+func fileExpiry(expiresIn string, user *models.User, now time.Time) (*time.Time, string) {
+	retention := getDefaultFileRetention()
+	if user.FileRetentionHours != nil {
+		retention = time.Duration(*user.FileRetentionHours) * time.Hour
+	}
+
+	lifetime := retention
+	if expiresIn != "" {
+		var requested time.Duration
+		if seconds, err := strconv.Atoi(expiresIn); err == nil {
+			requested = time.Duration(seconds) * time.Second
+		} else if requested, err = time.ParseDuration(expiresIn); err != nil {
+			requested = 0
+		}
+		if requested < time.Second {
+			return nil, "expires_in must be a number of seconds or a duration such as 24h"
+		}
+		if retention > 0 && requested > retention {
+			return nil, fmt.Sprintf("expires_in must not exceed your retention of %d hours", int(retention.Hours()))
+		}
+		lifetime = requested
+	}
+
+	if lifetime == 0 {
+		return nil, ""
+	}
+	// Whole seconds keep stored times comparable
+	expiresAt := now.UTC().Add(lifetime).Truncate(time.Second)
+	return &expiresAt, ""
+}
+
+// getDefaultFileRetention gets the default lifetime of uploads from environment variable,
+// zero keeps them forever
+func getDefaultFileRetention() time.Duration {
+	hours, err := strconv.Atoi(os.Getenv("FILE_RETENTION_HOURS"))
+	if err != nil || hours < 0 {
+		return 0 // Default
+	}
+	return time.Duration(hours) * time.Hour
+}
+
 // getClientIP extracts the client IP address from the request
 func getClientIP(r *http.Request) string {
 	// Check X-Forwarded-For header first (for proxies)
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"file-uploader/jobs"
+	"file-uploader/models"
+)
+
+var errInjected = errors.New("injected failure")
+
+// failingFile wraps a staging file and fails writes or syncs on request
+type failingFile struct {
+	uploadFile
+	failWrite bool
+	failSync  bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.failWrite {
+		return 0, errInjected
+	}
+	return f.uploadFile.Write(p)
+}
+
+func (f *failingFile) Sync() error {
+	if f.failSync {
+		return errInjected
+	}
+	return f.uploadFile.Sync()
+}
+
+// newUploadRequest builds a multipart upload of content as an image
+func newUploadRequest(t *testing.T, content []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="data"; filename="pixel.png"`)
+	header.Set("Content-Type", "image/png")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/upload", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+// storedUploads lists the content files in the upload directory and its staging directory
+func storedUploads(t *testing.T, uploadDir string) []string {
+	t.Helper()
+	var names []string
+	for _, dir := range []string{uploadDir, filepath.Join(uploadDir, jobs.StagingDirName)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				names = append(names, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	return names
+}
+
+func TestUploadStoresContentAndRow(t *testing.T) {
+	m := newTestModels(t)
+	uploadDir := t.TempDir()
+	t.Setenv("UPLOAD_DIR", uploadDir)
+	user, err := m.users.CreateExternal("alice", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewUploadHandler(m.files, m.orgs, m.users, m.audit)
+	w := httptest.NewRecorder()
+	handler.Upload(w, withUser(newUploadRequest(t, []byte("not really a png")), user))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	files := storedUploads(t, uploadDir)
+	if len(files) != 1 || filepath.Dir(files[0]) != uploadDir {
+		t.Fatalf("stored files = %v, want one committed file", files)
+	}
+	if n := m.count(t, "files"); n != 1 {
+		t.Fatalf("files rows = %d, want 1", n)
+	}
+	if n := m.count(t, "file_versions"); n != 1 {
+		t.Fatalf("file_versions rows = %d, want 1", n)
+	}
+}
+
+func TestUploadFailureLeavesNoOrphans(t *testing.T) {
+	tests := []struct {
+		name   string
+		inject func(t *testing.T)
+	}{
+		{"write", func(t *testing.T) { failStagingFile(t, &failingFile{failWrite: true}) }},
+		{"fsync", func(t *testing.T) { failStagingFile(t, &failingFile{failSync: true}) }},
+		{"rename", func(t *testing.T) {
+			replace(t, &renameUpload, func(string, string) error { return errInjected })
+		}},
+		{"dir fsync", func(t *testing.T) {
+			replace(t, &syncUploadDir, func(string) error { return errInjected })
+		}},
+		{"db commit", func(t *testing.T) {
+			failCommits.Store(true)
+			t.Cleanup(func() { failCommits.Store(false) })
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestModels(t)
+			uploadDir := t.TempDir()
+			t.Setenv("UPLOAD_DIR", uploadDir)
+			user, err := m.users.CreateExternal("alice", models.AuthSourceLocal)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.inject(t)
+			handler := NewUploadHandler(m.files, m.orgs, m.users, nil)
+			w := httptest.NewRecorder()
+			handler.Upload(w, withUser(newUploadRequest(t, []byte("not really a png")), user))
+			failCommits.Store(false) // Let the checks below read the database
+
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("status = %d, want 500, body %s", w.Code, w.Body)
+			}
+			if files := storedUploads(t, uploadDir); len(files) != 0 {
+				t.Errorf("orphaned files: %v", files)
+			}
+			if n := m.count(t, "files"); n != 0 {
+				t.Errorf("files rows = %d, want 0", n)
+			}
+			if n := m.count(t, "file_versions"); n != 0 {
+				t.Errorf("file_versions rows = %d, want 0", n)
+			}
+		})
+	}
+}
+
+// failStagingFile makes createStagingFile return real staging files wrapped by f
+func failStagingFile(t *testing.T, f *failingFile) {
+	original := createStagingFile
+	replace(t, &createStagingFile, func(dir, pattern string) (uploadFile, error) {
+		file, err := original(dir, pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.uploadFile = file
+		return f, nil
+	})
+}
+
+// replace swaps a hook for the duration of a test
+func replace[T any](t *testing.T, hook *T, value T) {
+	original := *hook
+	*hook = value
+	t.Cleanup(func() { *hook = original })
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// VersionHandler handles replacing file content and the version history of files
+type VersionHandler struct {
+	fileModel  *models.FileModel
+	orgModel   *models.OrganizationModel
+	auditModel *models.AuditModel
+	retention  int // Old versions kept per file, 0 keeps all
+}
+
+// NewVersionHandler creates a new VersionHandler
+func NewVersionHandler(fileModel *models.FileModel, orgModel *models.OrganizationModel, auditModel *models.AuditModel) *VersionHandler {
+	return &VersionHandler{
+		fileModel:  fileModel,
+		orgModel:   orgModel,
+		auditModel: auditModel,
+		retention:  getVersionRetention(),
+	}
+}
+
+// RestoreVersionRequest represents the optional version restore payload
+type RestoreVersionRequest struct {
+	Revision int `json:"revision"` // If set, the file must still be at this revision
+}
+
+// audit records a change of a file's content
+func (h *VersionHandler) audit(r *http.Request, action, fileID, outcome, detail string) {
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:     action,
+		TargetType: "file",
+		TargetID:   fileID,
+		Outcome:    outcome,
+		Detail:     detail,
+	})
+}
+
+// loadFile loads the file named in the URL and checks that the authenticated user holds
+// at least the required role on it. Denied attempts are audited with the given action.
+func (h *VersionHandler) loadFile(w http.ResponseWriter, r *http.Request, required, action string) (*models.FileMetadata, bool) {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return nil, false
+	}
+
+	file, err := lookupFile(w, h.fileModel, mux.Vars(r)["fileId"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "File not found"})
+			return nil, false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load file"})
+		return nil, false
+	}
+
+	allowed, reason, err := checkFileAccess(h.orgModel, file, userID, required)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to check access"})
+		return nil, false
+	}
+	if !allowed {
+		h.audit(r, action, strconv.Itoa(file.ID), models.AuditOutcomeDenied, reason)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Access denied"})
+		return nil, false
+	}
+	return file, true
+}
+
+// ReplaceContent stores uploaded content as the new current version of a file, keeping
+// its ID, metadata and older versions. The content type must stay the same. The optional
+// revision form field rejects the upload with 409 Conflict if the file changed since.
+func (h *VersionHandler) ReplaceContent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	file, ok := h.loadFile(w, r, models.OrgRoleEditor, AuditActionFileReplace)
+	if !ok {
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+	fileIDStr := strconv.Itoa(file.ID)
+
+	upload, fileHeader, uploadErr := openUpload(r)
+	if uploadErr != nil {
+		if uploadErr.reason != "" {
+			h.audit(r, AuditActionFileReplace, fileIDStr, models.AuditOutcomeFailure, uploadErr.reason)
+		}
+		w.WriteHeader(uploadErr.status)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: uploadErr.message})
+		return
+	}
+	defer upload.Close()
+
+	contentType := fileHeader.Header.Get("Content-Type")
+	if !strings.EqualFold(contentType, file.ContentType) {
+		h.audit(r, AuditActionFileReplace, fileIDStr, models.AuditOutcomeFailure, "content_type_changed")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "New content must have the same type as the file (" + file.ContentType + "), upload a new file instead"})
+		return
+	}
+
+	revision := 0
+	if value := r.FormValue("revision"); value != "" {
+		var err error
+		if revision, err = strconv.Atoi(value); err != nil || revision <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid revision"})
+			return
+		}
+	}
+
+	if file.OrgID != nil {
+		if status, message := checkOrgQuota(h.orgModel, h.fileModel, *file.OrgID, fileHeader.Size); status != 0 {
+			h.audit(r, AuditActionFileReplace, fileIDStr, models.AuditOutcomeFailure, "org_rejected")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+			return
+		}
+	}
+
+	staged, uploadErr := stageUpload(upload, fileHeader.Size, r.FormValue("sha256"))
+	if uploadErr != nil {
+		if uploadErr.reason != "" {
+			h.audit(r, AuditActionFileReplace, fileIDStr, models.AuditOutcomeFailure, uploadErr.reason)
+		}
+		w.WriteHeader(uploadErr.status)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: uploadErr.message})
+		return
+	}
+
+	updated, err := h.fileModel.AddVersion(file.ID, revision, &models.FileVersion{
+		UserID:      userID,
+		ContentType: file.ContentType,
+		Size:        staged.size,
+		ContentHash: staged.contentHash,
+		FilePath:    staged.path,
+	}, staged.commit)
+	if err != nil {
+		// Clean up the content if the version was not recorded
+		staged.discard()
+		h.writeVersionError(w, r, AuditActionFileReplace, fileIDStr, revision, err)
+		return
+	}
+
+	h.audit(r, AuditActionFileReplace, fileIDStr, models.AuditOutcomeSuccess, "version:"+strconv.Itoa(updated.Version))
+	h.prune(updated.ID)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// ListVersions returns the versions of a file, newest first. Any user who can read the
+// file can list them.
+func (h *VersionHandler) ListVersions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	file, ok := h.loadFile(w, r, models.OrgRoleViewer, AuditActionFileRead)
+	if !ok {
+		return
+	}
+
+	versions, err := h.fileModel.ListVersions(file.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list versions"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current_version": file.Version,
+		"versions":        versions,
+	})
+}
+
+// RestoreVersion makes the content of an old version current again. The restore is
+// recorded as a new version, so the history is never rewritten.
+func (h *VersionHandler) RestoreVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	file, ok := h.loadFile(w, r, models.OrgRoleEditor, AuditActionFileRestore)
+	if !ok {
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+	fileIDStr := strconv.Itoa(file.ID)
+
+	versionNumber, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid version"})
+		return
+	}
+
+	// The body is optional
+	var req RestoreVersionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	version, err := h.fileModel.GetVersion(file.ID, versionNumber)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Version not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load version"})
+		return
+	}
+	if version.Version == file.Version {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Version " + strconv.Itoa(version.Version) + " is already the current version"})
+		return
+	}
+	if _, err := os.Stat(version.FilePath); err != nil {
+		h.audit(r, AuditActionFileRestore, fileIDStr, models.AuditOutcomeFailure, "missing_on_disk")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Version not found on disk"})
+		return
+	}
+
+	// The new version shares the stored content of the restored one
+	restoredFrom := version.Version
+	updated, err := h.fileModel.AddVersion(file.ID, req.Revision, &models.FileVersion{
+		UserID:       userID,
+		ContentType:  version.ContentType,
+		Size:         version.Size,
+		ContentHash:  version.ContentHash,
+		FilePath:     version.FilePath,
+		RestoredFrom: &restoredFrom,
+	}, nil)
+	if err != nil {
+		h.writeVersionError(w, r, AuditActionFileRestore, fileIDStr, req.Revision, err)
+		return
+	}
+
+	h.audit(r, AuditActionFileRestore, fileIDStr, models.AuditOutcomeSuccess, "version:"+strconv.Itoa(restoredFrom))
+	h.prune(updated.ID)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// writeVersionError writes the response for a failure to add a version
+func (h *VersionHandler) writeVersionError(w http.ResponseWriter, r *http.Request, action, fileID string, revision int, err error) {
+	if err == models.ErrFileRevisionConflict {
+		h.audit(r, action, fileID, models.AuditOutcomeFailure, "revision_conflict")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "File was modified since revision " + strconv.Itoa(revision) + ", reload it and try again"})
+		return
+	}
+	if err == models.ErrOrgQuotaExceeded {
+		h.audit(r, action, fileID, models.AuditOutcomeFailure, "org_rejected")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Organization storage quota exceeded"})
+		return
+	}
+	log.Printf("Failed to add version of file %s: %v", fileID, err)
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to save file version"})
+}
+
+// prune deletes the old versions of a file beyond the retention
+func (h *VersionHandler) prune(fileID int) {
+	if h.retention == 0 {
+		return
+	}
+	filePaths, err := h.fileModel.PruneVersions(fileID, h.retention)
+	if err != nil {
+		log.Printf("Failed to prune versions of file %d: %v", fileID, err)
+		return
+	}
+	utils.RemoveFiles(filePaths)
+}
+
+// getVersionRetention gets the number of old versions kept per file from environment variable
+func getVersionRetention() int {
+	retention, err := strconv.Atoi(os.Getenv("FILE_VERSION_RETENTION"))
+	if err != nil || retention < 0 {
+		return 10 // Default
+	}
+	return retention
+}
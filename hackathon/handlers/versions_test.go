@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"file-uploader/models"
+
+	"github.com/gorilla/mux"
+)
+
+// versionTest holds a version handler for the static test's file
+type versionTest struct {
+	*staticTest
+	handler *VersionHandler
+}
+
+func newVersionTest(t *testing.T) *versionTest {
+	t.Helper()
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	s := newStaticTest(t)
+	return &versionTest{staticTest: s, handler: NewVersionHandler(s.files, s.orgs, s.audit)}
+}
+
+// replace uploads content as the new version of a file, with the revision form field if set
+func (v *versionTest) replace(t *testing.T, file *models.FileMetadata, content, revision string, out interface{}) int {
+	t.Helper()
+	r := newUploadRequest(t, []byte(content))
+	if revision != "" {
+		r.URL.RawQuery = "revision=" + revision
+	}
+	r = mux.SetURLVars(withUser(r, v.owner), map[string]string{"fileId": file.PublicID})
+	return call(t, v.handler.ReplaceContent, r, out)
+}
+
+// restore makes a version of the static test's file current again
+func (v *versionTest) restore(t *testing.T, version string, req interface{}, out interface{}) int {
+	t.Helper()
+	r := mux.SetURLVars(withUser(jsonRequest(t, req), v.owner), map[string]string{"fileId": v.file.PublicID, "version": version})
+	return call(t, v.handler.RestoreVersion, r, out)
+}
+
+// versions lists the versions of the static test's file, newest first
+func (v *versionTest) versions(t *testing.T) []models.FileVersion {
+	t.Helper()
+	var resp struct {
+		Versions []models.FileVersion `json:"versions"`
+	}
+	r := mux.SetURLVars(withUser(jsonRequest(t, nil), v.owner), map[string]string{"fileId": v.file.PublicID})
+	if status := call(t, v.handler.ListVersions, r, &resp); status != http.StatusOK {
+		t.Fatalf("listing versions status = %d", status)
+	}
+	return resp.Versions
+}
+
+func TestReplacingContentKeepsTheHistory(t *testing.T) {
+	v := newVersionTest(t)
+	v.handler.retention = 0
+
+	var replaced models.FileMetadata
+	if status := v.replace(t, v.file, "second content", "", &replaced); status != http.StatusOK {
+		t.Fatalf("replace status = %d", status)
+	}
+	if replaced.ID != v.file.ID || replaced.Version != 2 || replaced.Filename != v.file.Filename || replaced.Size != 14 {
+		t.Errorf("replaced file = %+v", replaced)
+	}
+	// A client still holding the revision from before the replacement is rejected
+	if status := v.replace(t, v.file, "stale", "1", nil); status != http.StatusConflict {
+		t.Errorf("stale revision status = %d, want 409", status)
+	}
+
+	var restored models.FileMetadata
+	if status := v.restore(t, "1", map[string]int{"revision": replaced.Revision}, &restored); status != http.StatusOK {
+		t.Fatalf("restore status = %d", status)
+	}
+	if restored.Version != 3 || restored.FilePath != v.file.FilePath {
+		t.Errorf("restored file = %+v, want version 3 with the content of version 1", restored)
+	}
+	versions := v.versions(t)
+	if len(versions) != 3 || versions[0].Version != 3 || versions[0].RestoredFrom == nil || *versions[0].RestoredFrom != 1 {
+		t.Errorf("versions = %+v, want 3 newest first with restored_from 1", versions)
+	}
+
+	for version, want := range map[string]int{
+		"3": http.StatusBadRequest, // Already current
+		"9": http.StatusNotFound,
+	} {
+		if status := v.restore(t, version, nil, nil); status != want {
+			t.Errorf("restoring version %s status = %d, want %d", version, status, want)
+		}
+	}
+	if status := v.restore(t, "2", map[string]int{"revision": replaced.Revision}, nil); status != http.StatusConflict {
+		t.Errorf("restore with a stale revision status = %d, want 409", status)
+	}
+}
+
+func TestReplacingContentKeepsTheContentType(t *testing.T) {
+	v := newVersionTest(t)
+	jpeg, err := v.files.Create(&models.FileMetadata{
+		UserID: v.owner.ID, Filename: "a.jpg", ContentType: "image/jpeg", Size: 16, FilePath: v.file.FilePath,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The upload is sent as image/png
+	if status := v.replace(t, jpeg, "png content", "", nil); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", status)
+	}
+	if n := v.count(t, "audit_log WHERE detail = 'content_type_changed'"); n != 1 {
+		t.Errorf("%d content_type_changed audit events, want 1", n)
+	}
+	if n := v.count(t, "file_versions"); n != 2 {
+		t.Errorf("file_versions rows = %d, want one per file", n)
+	}
+}
+
+func TestVersionRetentionKeepsSharedContent(t *testing.T) {
+	v := newVersionTest(t)
+	v.handler.retention = 1
+
+	var second models.FileMetadata
+	if status := v.replace(t, v.file, "second content", "", &second); status != http.StatusOK {
+		t.Fatalf("replace status = %d", status)
+	}
+	// Version 3 shares the content of version 1, which is pruned
+	if status := v.restore(t, "1", nil, nil); status != http.StatusOK {
+		t.Fatalf("restore status = %d", status)
+	}
+	if _, err := os.Stat(v.file.FilePath); err != nil {
+		t.Errorf("content of the restored version was removed: %v", err)
+	}
+
+	if status := v.replace(t, v.file, "fourth content", "", nil); status != http.StatusOK {
+		t.Fatalf("replace status = %d", status)
+	}
+	if _, err := os.Stat(second.FilePath); !os.IsNotExist(err) {
+		t.Errorf("content of pruned version 2 still exists: %v", err)
+	}
+	versions := v.versions(t)
+	if len(versions) != 2 || versions[0].Version != 4 || versions[1].Version != 3 {
+		t.Errorf("versions = %+v, want 4 and 3", versions)
+	}
+}
+
+func TestVersionsCountTowardsOrganizationQuotas(t *testing.T) {
+	v := newVersionTest(t)
+	org, err := v.orgs.Create("acme", v.owner.ID, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.db.Exec("UPDATE files SET org_id = ? WHERE id = ?", org.ID, v.file.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := v.replace(t, v.file, "16 bytes of data", "", nil); status != http.StatusOK {
+		t.Fatalf("replace within the quota status = %d", status)
+	}
+	if status := v.replace(t, v.file, "too much for the quota", "", nil); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("replace beyond the quota status = %d, want 413", status)
+	}
+	// Restores store no new content but count again, like every other version
+	if status := v.restore(t, "1", nil, nil); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("restore beyond the quota status = %d, want 413", status)
+	}
+	if n := v.count(t, "file_versions"); n != 2 {
+		t.Errorf("file_versions rows = %d, want 2", n)
+	}
+	if n := v.count(t, "audit_log WHERE detail = 'org_rejected'"); n != 2 {
+		t.Errorf("%d org_rejected audit events, want 2", n)
+	}
+	if files := storedUploads(t, os.Getenv("UPLOAD_DIR")); len(files) != 1 {
+		t.Errorf("stored uploads = %v, want only the accepted version", files)
+	}
+}
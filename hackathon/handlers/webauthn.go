@@ -0,0 +1,611 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// webauthnTimeout bounds how long a ceremony may take
+const webauthnTimeout = 5 * time.Minute
+
+// maxCredentialIDLength is the largest credential ID allowed by WebAuthn
+const maxCredentialIDLength = 1023
+
+// maxPasskeyNameLength limits the length of passkey names
+const maxPasskeyNameLength = 100
+
+// decoyCredentialIDLength matches the credential IDs of common platform passkeys
+const decoyCredentialIDLength = 16
+
+// WebAuthn ceremonies remembered with their challenge
+const (
+	ceremonyRegister = "register"
+	ceremonyLogin    = "login"
+)
+
+// pendingCeremony is remembered between the begin and finish steps of a ceremony
+type pendingCeremony struct {
+	Ceremony string
+	UserID   int // Zero for logins that let the authenticator pick the account
+}
+
+// WebAuthnHandler handles passkey registration and login
+type WebAuthnHandler struct {
+	config          *utils.WebAuthnConfig
+	userModel       *models.UserModel
+	credentialModel *models.WebAuthnCredentialModel
+	auditModel      *models.AuditModel
+	challenges      *utils.StateStore
+}
+
+// NewWebAuthnHandler creates a new WebAuthnHandler
+func NewWebAuthnHandler(config *utils.WebAuthnConfig, userModel *models.UserModel, credentialModel *models.WebAuthnCredentialModel, auditModel *models.AuditModel) *WebAuthnHandler {
+	return &WebAuthnHandler{
+		config:          config,
+		userModel:       userModel,
+		credentialModel: credentialModel,
+		auditModel:      auditModel,
+		challenges:      utils.NewStateStore(),
+	}
+}
+
+// credentialDescriptor identifies a passkey in ceremony options
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// PublicKeyCredentialJSON is the JSON serialization of a browser PublicKeyCredential.
+// Binary values are base64url encoded.
+type PublicKeyCredentialJSON struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject,omitempty"` // Registration only
+		AuthenticatorData string `json:"authenticatorData,omitempty"` // Login only
+		Signature         string `json:"signature,omitempty"`         // Login only
+		UserHandle        string `json:"userHandle,omitempty"`        // Login only
+	} `json:"response"`
+}
+
+// PasskeyRegistrationRequest represents the payload finishing a passkey registration
+type PasskeyRegistrationRequest struct {
+	Name       string                  `json:"name"`
+	Credential PublicKeyCredentialJSON `json:"credential"`
+}
+
+// PasskeyLoginRequest represents the payload starting a passkey login
+type PasskeyLoginRequest struct {
+	Username string `json:"username"` // Optional, omit to use discoverable credentials
+}
+
+// BeginRegistration returns the options for navigator.credentials.create()
+func (h *WebAuthnHandler) BeginRegistration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	user, err := h.userModel.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	credentials, err := h.credentialModel.ListByUser(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list passkeys"})
+		return
+	}
+
+	challenge, ok := h.newChallenge(w, pendingCeremony{Ceremony: ceremonyRegister, UserID: userID})
+	if !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge": challenge,
+			"rp": map[string]string{
+				"id":   h.config.RPID,
+				"name": h.config.RPName,
+			},
+			"user": map[string]string{
+				"id":          userHandle(user.ID),
+				"name":        user.Username,
+				"displayName": user.Username,
+			},
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": utils.COSEAlgES256},
+				{"type": "public-key", "alg": utils.COSEAlgEdDSA},
+				{"type": "public-key", "alg": utils.COSEAlgRS256},
+			},
+			"timeout":            webauthnTimeout.Milliseconds(),
+			"excludeCredentials": descriptors(credentials),
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "preferred",
+				"userVerification": "required",
+			},
+			"attestation": "none",
+		},
+	})
+}
+
+// FinishRegistration verifies the authenticator's response and stores the new passkey
+func (h *WebAuthnHandler) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	var req PasskeyRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+	if len(req.Name) > maxPasskeyNameLength {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Name must be at most 100 characters"})
+		return
+	}
+
+	clientDataJSON, err := utils.DecodeBase64URL(req.Credential.Response.ClientDataJSON)
+	if err != nil {
+		writePasskeyError(w, "Malformed client data")
+		return
+	}
+	attestationObject, err := utils.DecodeBase64URL(req.Credential.Response.AttestationObject)
+	if err != nil {
+		writePasskeyError(w, "Malformed attestation object")
+		return
+	}
+
+	if _, ok := h.takeChallenge(w, clientDataJSON, utils.WebAuthnTypeCreate, ceremonyRegister, userID); !ok {
+		return
+	}
+
+	authData, _, err := utils.ParseAttestationObject(attestationObject)
+	if err != nil {
+		writePasskeyError(w, err.Error())
+		return
+	}
+	if !h.config.CheckRPIDHash(authData) {
+		writePasskeyError(w, "Passkey was created for a different relying party")
+		return
+	}
+	if !authData.UserPresent() || !authData.UserVerified() {
+		writePasskeyError(w, "The authenticator did not verify the user")
+		return
+	}
+	if len(authData.CredentialID) == 0 || len(authData.CredentialID) > maxCredentialIDLength {
+		writePasskeyError(w, "Invalid credential ID")
+		return
+	}
+	credentialID := base64.RawURLEncoding.EncodeToString(authData.CredentialID)
+	if req.Credential.RawID != "" && strings.TrimRight(req.Credential.RawID, "=") != credentialID {
+		writePasskeyError(w, "Credential ID does not match the authenticator data")
+		return
+	}
+
+	_, alg, err := utils.ParseCOSEKey(authData.PublicKey)
+	if err != nil {
+		writePasskeyError(w, err.Error())
+		return
+	}
+
+	if _, err := h.credentialModel.GetByCredentialID(credentialID); err != models.ErrCredentialNotFound {
+		if err == nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Passkey is already registered"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to check passkey"})
+		return
+	}
+
+	credential, err := h.credentialModel.Create(&models.WebAuthnCredential{
+		UserID:       userID,
+		Name:         req.Name,
+		CredentialID: credentialID,
+		PublicKey:    authData.PublicKey,
+		Algorithm:    alg,
+		SignCount:    authData.SignCount,
+		AAGUID:       hex.EncodeToString(authData.AAGUID),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to store passkey"})
+		return
+	}
+
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:     AuditActionPasskeyRegister,
+		TargetType: "passkey",
+		TargetID:   strconv.Itoa(credential.ID),
+		Outcome:    models.AuditOutcomeSuccess,
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(credential)
+}
+
+// BeginLogin returns the options for navigator.credentials.get()
+func (h *WebAuthnHandler) BeginLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req PasskeyLoginRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+			return
+		}
+	}
+
+	pending := pendingCeremony{Ceremony: ceremonyLogin}
+	allowCredentials := []credentialDescriptor{}
+	if req.Username != "" {
+		username := utils.NormalizeUsername(req.Username)
+		if user, err := h.userModel.GetByUsername(username); err == nil {
+			credentials, err := h.credentialModel.ListByUser(user.ID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list passkeys"})
+				return
+			}
+			pending.UserID = user.ID
+			allowCredentials = descriptors(credentials)
+		}
+		// Unknown usernames and users without passkeys get a made-up passkey that stays
+		// the same on every request, so the response does not reveal which accounts
+		// exist or have passkeys
+		if len(allowCredentials) == 0 {
+			allowCredentials = []credentialDescriptor{decoyDescriptor(username)}
+		}
+	}
+
+	challenge, ok := h.newChallenge(w, pending)
+	if !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge":        challenge,
+			"rpId":             h.config.RPID,
+			"timeout":          webauthnTimeout.Milliseconds(),
+			"allowCredentials": allowCredentials,
+			"userVerification": "required",
+		},
+	})
+}
+
+// FinishLogin verifies a passkey assertion and issues the same JWT as a password login
+func (h *WebAuthnHandler) FinishLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var credentialJSON PublicKeyCredentialJSON
+	if err := json.NewDecoder(r.Body).Decode(&credentialJSON); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON payload"})
+		return
+	}
+
+	clientDataJSON, err1 := utils.DecodeBase64URL(credentialJSON.Response.ClientDataJSON)
+	rawAuthData, err2 := utils.DecodeBase64URL(credentialJSON.Response.AuthenticatorData)
+	signature, err3 := utils.DecodeBase64URL(credentialJSON.Response.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		writePasskeyError(w, "Malformed assertion")
+		return
+	}
+
+	credentialID := strings.TrimRight(credentialJSON.RawID, "=")
+	if credentialID == "" {
+		credentialID = strings.TrimRight(credentialJSON.ID, "=")
+	}
+	credential, err := h.credentialModel.GetByCredentialID(credentialID)
+	if err != nil {
+		if err == models.ErrCredentialNotFound {
+			h.auditLoginFailure(r, nil, "unknown_passkey")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Unknown passkey"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load passkey"})
+		return
+	}
+
+	pending, ok := h.takeChallenge(w, clientDataJSON, utils.WebAuthnTypeGet, ceremonyLogin, 0)
+	if !ok {
+		return
+	}
+	if pending.UserID != 0 && pending.UserID != credential.UserID {
+		writePasskeyError(w, "Passkey does not belong to the requested account")
+		return
+	}
+	if credentialJSON.Response.UserHandle != "" && strings.TrimRight(credentialJSON.Response.UserHandle, "=") != userHandle(credential.UserID) {
+		writePasskeyError(w, "User handle does not match the passkey")
+		return
+	}
+
+	authData, err := utils.ParseAuthenticatorData(rawAuthData)
+	if err != nil {
+		writePasskeyError(w, err.Error())
+		return
+	}
+	if !h.config.CheckRPIDHash(authData) {
+		writePasskeyError(w, "Assertion was created for a different relying party")
+		return
+	}
+	if !authData.UserPresent() || !authData.UserVerified() {
+		writePasskeyError(w, "The authenticator did not verify the user")
+		return
+	}
+
+	if err := utils.VerifyWebAuthnSignature(credential.PublicKey, rawAuthData, clientDataJSON, signature); err != nil {
+		h.auditLoginFailure(r, credential, "invalid_signature")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid passkey signature"})
+		return
+	}
+
+	// Authenticators that implement counters must report a larger value on every use.
+	// Anything else suggests the credential was cloned, so the login is refused.
+	if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		log.Printf("Passkey %d of user %d reported sign count %d, expected more than %d",
+			credential.ID, credential.UserID, authData.SignCount, credential.SignCount)
+		h.auditLoginFailure(r, credential, "sign_count_regression")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Passkey signature counter did not increase, the authenticator may have been cloned"})
+		return
+	}
+	if err := h.credentialModel.RecordUse(credential.ID, credential.SignCount, authData.SignCount); err != nil {
+		if err == models.ErrCredentialNotFound {
+			h.auditLoginFailure(r, credential, "sign_count_regression")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Passkey was used concurrently"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update passkey"})
+		return
+	}
+
+	user, err := h.userModel.GetByID(credential.UserID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+
+	loginEvent := models.AuditEvent{
+		ActorID:       &user.ID,
+		ActorUsername: user.Username,
+		Action:        AuditActionLogin,
+		TargetType:    "passkey",
+		TargetID:      strconv.Itoa(credential.ID),
+		Outcome:       models.AuditOutcomeDenied,
+	}
+
+	if user.IsDisabled() {
+		loginEvent.Detail = "account_disabled"
+		recordAudit(h.auditModel, r, loginEvent)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Account is disabled"})
+		return
+	}
+	if user.PasswordResetRequired {
+		loginEvent.Detail = "password_reset_required"
+		recordAudit(h.auditModel, r, loginEvent)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Password reset required, log in with your password and new_password set",
+			"code":  "password_reset_required",
+		})
+		return
+	}
+
+	// Logging in during the grace period keeps the account
+	message := "Login successful"
+	if user.IsPendingDeletion() {
+		if err := h.userModel.CancelDeletion(user.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to cancel account deletion"})
+			return
+		}
+		user.DeletionScheduledAt = nil
+		message = "Login successful, scheduled account deletion was cancelled"
+	}
+
+	token, err := utils.GenerateToken(user.ID, user.Username, user.Scopes())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+
+	loginEvent.Outcome = models.AuditOutcomeSuccess
+	loginEvent.Detail = "passkey"
+	recordAudit(h.auditModel, r, loginEvent)
+
+	json.NewEncoder(w).Encode(AuthResponse{
+		Token:   token,
+		User:    user,
+		Message: message,
+	})
+}
+
+// ListCredentials returns the authenticated user's passkeys
+func (h *WebAuthnHandler) ListCredentials(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	credentials, err := h.credentialModel.ListByUser(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list passkeys"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"passkeys": credentials,
+	})
+}
+
+// DeleteCredential removes one of the authenticated user's passkeys
+func (h *WebAuthnHandler) DeleteCredential(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "User not authenticated"})
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["passkeyId"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid passkey ID"})
+		return
+	}
+
+	if err := h.credentialModel.Delete(id, userID); err != nil {
+		if err == models.ErrCredentialNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Passkey not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to delete passkey"})
+		return
+	}
+
+	recordAudit(h.auditModel, r, models.AuditEvent{
+		Action:     AuditActionPasskeyDelete,
+		TargetType: "passkey",
+		TargetID:   strconv.Itoa(id),
+		Outcome:    models.AuditOutcomeSuccess,
+	})
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Passkey deleted successfully",
+	})
+}
+
+// newChallenge creates and remembers a random challenge for a ceremony
+func (h *WebAuthnHandler) newChallenge(w http.ResponseWriter, pending pendingCeremony) (string, bool) {
+	challenge, err := utils.RandomToken(32)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to create challenge"})
+		return "", false
+	}
+	if err := h.challenges.Put(challenge, &pending, webauthnTimeout); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Too many pending passkey ceremonies, try again later"})
+		return "", false
+	}
+	return challenge, true
+}
+
+// takeChallenge verifies the client data and consumes the challenge it signed.
+// A non-zero userID must match the user the challenge was issued to.
+func (h *WebAuthnHandler) takeChallenge(w http.ResponseWriter, clientDataJSON []byte, ceremonyType, ceremony string, userID int) (*pendingCeremony, bool) {
+	clientData, err := h.config.VerifyClientData(clientDataJSON, ceremonyType)
+	if err != nil {
+		writePasskeyError(w, err.Error())
+		return nil, false
+	}
+
+	value, ok := h.challenges.Take(strings.TrimRight(clientData.Challenge, "="))
+	pending, _ := value.(*pendingCeremony)
+	if !ok || pending.Ceremony != ceremony || (userID != 0 && pending.UserID != userID) {
+		writePasskeyError(w, "Unknown or expired challenge")
+		return nil, false
+	}
+	return pending, true
+}
+
+// auditLoginFailure records a rejected passkey login
+func (h *WebAuthnHandler) auditLoginFailure(r *http.Request, credential *models.WebAuthnCredential, reason string) {
+	event := models.AuditEvent{
+		Action:  AuditActionLogin,
+		Outcome: models.AuditOutcomeFailure,
+		Detail:  reason,
+	}
+	if credential != nil {
+		event.ActorID = &credential.UserID
+		event.TargetType = "passkey"
+		event.TargetID = strconv.Itoa(credential.ID)
+	}
+	recordAudit(h.auditModel, r, event)
+}
+
+// writePasskeyError rejects a malformed or unverifiable ceremony response
+func writePasskeyError(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+}
+
+// userHandle returns the opaque WebAuthn user handle of a user
+func userHandle(userID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(userID)))
+}
+
+// descriptors lists passkeys for allowCredentials and excludeCredentials
+func descriptors(credentials []*models.WebAuthnCredential) []credentialDescriptor {
+	list := make([]credentialDescriptor, len(credentials))
+	for i, credential := range credentials {
+		list[i] = credentialDescriptor{Type: "public-key", ID: credential.CredentialID}
+	}
+	return list
+}
+
+// decoyDescriptor derives a credential ID for a username from the server secret.
+// No authenticator holds it, so a login with it fails like one with a removed passkey.
+func decoyDescriptor(username string) credentialDescriptor {
+	mac := hmac.New(sha256.New, utils.GetJWTSecret())
+	mac.Write([]byte("webauthn-decoy:" + username))
+	id := mac.Sum(nil)[:decoyCredentialIDLength]
+	return credentialDescriptor{Type: "public-key", ID: base64.RawURLEncoding.EncodeToString(id)}
+}
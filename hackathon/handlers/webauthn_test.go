@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+const testOrigin = "http://localhost:8080"
+
+// cborPair is a map entry for encodeCBOR, which keeps the order of map keys
+type cborPair struct {
+	key, value interface{}
+}
+
+// encodeCBOR encodes the few CBOR types an authenticator produces
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+	}
+	switch value := v.(type) {
+	case int:
+		if value < 0 {
+			return head(1, uint64(-1-value))
+		}
+		return head(0, uint64(value))
+	case []byte:
+		return append(head(2, uint64(len(value))), value...)
+	case string:
+		return append(head(3, uint64(len(value))), value...)
+	case []cborPair:
+		out := head(5, uint64(len(value)))
+		for _, pair := range value {
+			out = append(out, encodeCBOR(pair.key)...)
+			out = append(out, encodeCBOR(pair.value)...)
+		}
+		return out
+	}
+	panic("unsupported CBOR value")
+}
+
+// softAuthenticator is a software passkey with a P-256 key and a signature counter
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	rpID         string
+	origin       string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{key: key, credentialID: credentialID, rpID: "localhost", origin: testOrigin}
+}
+
+// authData builds authenticator data with user presence and verification set
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := byte(utils.AuthenticatorFlagUserPresent | utils.AuthenticatorFlagUserVerified)
+	if attested {
+		flags |= utils.AuthenticatorFlagAttestedData
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if !attested {
+		return data
+	}
+
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+	data = append(data, a.credentialID...)
+	return append(data, encodeCBOR([]cborPair{
+		{1, 2},                  // kty: EC2
+		{3, utils.COSEAlgES256}, // alg
+		{-1, 1},                 // crv: P-256
+		{-2, a.key.X.FillBytes(make([]byte, 32))},
+		{-3, a.key.Y.FillBytes(make([]byte, 32))},
+	})...)
+}
+
+// clientData returns the client data JSON a browser would pass to the authenticator
+func (a *softAuthenticator) clientData(ceremonyType, challenge string) []byte {
+	data, _ := json.Marshal(utils.CollectedClientData{Type: ceremonyType, Challenge: challenge, Origin: a.origin})
+	return data
+}
+
+// create answers navigator.credentials.create()
+func (a *softAuthenticator) create(challenge string) PublicKeyCredentialJSON {
+	attestation := encodeCBOR([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(true)},
+	})
+	var credential PublicKeyCredentialJSON
+	credential.ID = b64(a.credentialID)
+	credential.RawID = credential.ID
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = b64(a.clientData(utils.WebAuthnTypeCreate, challenge))
+	credential.Response.AttestationObject = b64(attestation)
+	return credential
+}
+
+// get answers navigator.credentials.get(), counting the use
+func (a *softAuthenticator) get(t *testing.T, challenge string) PublicKeyCredentialJSON {
+	t.Helper()
+	a.signCount++
+	authData := a.authData(false)
+	clientData := a.clientData(utils.WebAuthnTypeGet, challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var credential PublicKeyCredentialJSON
+	credential.ID = b64(a.credentialID)
+	credential.RawID = credential.ID
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = b64(clientData)
+	credential.Response.AuthenticatorData = b64(authData)
+	credential.Response.Signature = b64(signature)
+	return credential
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// passkeyTest holds a WebAuthn handler and a user who can register passkeys
+type passkeyTest struct {
+	*testModels
+	handler *WebAuthnHandler
+	user    *models.User
+}
+
+func newPasskeyTest(t *testing.T) *passkeyTest {
+	t.Helper()
+	m := newTestModels(t)
+	credentials := models.NewWebAuthnCredentialModel(m.db)
+	if err := credentials.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	user, err := m.users.CreateExternal("alice", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &utils.WebAuthnConfig{RPID: "localhost", RPName: "Test", Origins: []string{testOrigin}}
+	return &passkeyTest{
+		testModels: m,
+		handler:    NewWebAuthnHandler(config, m.users, credentials, m.audit),
+		user:       user,
+	}
+}
+
+// challengeResponse is the part of the ceremony options the tests need
+type challengeResponse struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+	} `json:"publicKey"`
+}
+
+// register runs a registration ceremony and returns the status of its finish step
+func (p *passkeyTest) register(t *testing.T, authenticator *softAuthenticator) int {
+	t.Helper()
+	var options challengeResponse
+	if code := call(t, p.handler.BeginRegistration, withUser(jsonRequest(t, nil), p.user), &options); code != http.StatusOK {
+		t.Fatalf("begin registration status = %d", code)
+	}
+	request := PasskeyRegistrationRequest{Name: "Laptop", Credential: authenticator.create(options.PublicKey.Challenge)}
+	return call(t, p.handler.FinishRegistration, withUser(jsonRequest(t, request), p.user), nil)
+}
+
+// login runs a login ceremony and returns the status and response of its finish step
+func (p *passkeyTest) login(t *testing.T, authenticator *softAuthenticator) (int, map[string]interface{}) {
+	t.Helper()
+	var options challengeResponse
+	if code := call(t, p.handler.BeginLogin, jsonRequest(t, nil), &options); code != http.StatusOK {
+		t.Fatalf("begin login status = %d", code)
+	}
+	var response map[string]interface{}
+	code := call(t, p.handler.FinishLogin, jsonRequest(t, authenticator.get(t, options.PublicKey.Challenge)), &response)
+	return code, response
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	p := newPasskeyTest(t)
+	authenticator := newSoftAuthenticator(t)
+
+	if code := p.register(t, authenticator); code != http.StatusCreated {
+		t.Fatalf("registration status = %d", code)
+	}
+	if code := p.register(t, authenticator); code != http.StatusConflict {
+		t.Errorf("second registration status = %d, want 409", code)
+	}
+
+	for i := 0; i < 2; i++ {
+		code, response := p.login(t, authenticator)
+		if code != http.StatusOK {
+			t.Fatalf("login %d status = %d, response %v", i+1, code, response)
+		}
+		claims, err := utils.ValidateToken(response["token"].(string))
+		if err != nil || claims.UserID != p.user.ID {
+			t.Fatalf("login %d issued an invalid token: %v", i+1, err)
+		}
+	}
+}
+
+func TestPasskeyLoginRejectsSignCountRegression(t *testing.T) {
+	p := newPasskeyTest(t)
+	authenticator := newSoftAuthenticator(t)
+	if code := p.register(t, authenticator); code != http.StatusCreated {
+		t.Fatalf("registration status = %d", code)
+	}
+	if code, _ := p.login(t, authenticator); code != http.StatusOK {
+		t.Fatalf("login status = %d", code)
+	}
+
+	// A clone of the authenticator replays the counter value already seen
+	authenticator.signCount--
+	code, response := p.login(t, authenticator)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("cloned login status = %d, want 401, response %v", code, response)
+	}
+
+	var detail string
+	err := p.db.QueryRow(`SELECT detail FROM audit_log WHERE outcome = ? ORDER BY id DESC LIMIT 1`, models.AuditOutcomeFailure).Scan(&detail)
+	if err != nil || detail != "sign_count_regression" {
+		t.Errorf("audit detail = %q (%v), want sign_count_regression", detail, err)
+	}
+}
+
+func TestPasskeyRejectsWrongOrigin(t *testing.T) {
+	p := newPasskeyTest(t)
+
+	phished := newSoftAuthenticator(t)
+	phished.origin = "https://login.example.net"
+	if code := p.register(t, phished); code != http.StatusBadRequest {
+		t.Errorf("registration from another origin status = %d, want 400", code)
+	}
+
+	authenticator := newSoftAuthenticator(t)
+	if code := p.register(t, authenticator); code != http.StatusCreated {
+		t.Fatalf("registration status = %d", code)
+	}
+	authenticator.origin = "https://login.example.net"
+	if code, _ := p.login(t, authenticator); code != http.StatusBadRequest {
+		t.Errorf("login from another origin status = %d, want 400", code)
+	}
+
+	// A passkey created for another relying party is refused as well
+	authenticator = newSoftAuthenticator(t)
+	authenticator.rpID = "example.net"
+	if code := p.register(t, authenticator); code != http.StatusBadRequest {
+		t.Errorf("registration for another RP ID status = %d, want 400", code)
+	}
+}
+
+func TestPasskeyLoginDoesNotRevealAccounts(t *testing.T) {
+	p := newPasskeyTest(t)
+	if _, err := p.users.CreateExternal("bob", models.AuthSourceLocal); err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := func(username string) []credentialDescriptor {
+		t.Helper()
+		var options struct {
+			PublicKey struct {
+				AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+			} `json:"publicKey"`
+		}
+		if code := call(t, p.handler.BeginLogin, jsonRequest(t, PasskeyLoginRequest{Username: username}), &options); code != http.StatusOK {
+			t.Fatalf("begin login for %q status = %d", username, code)
+		}
+		return options.PublicKey.AllowCredentials
+	}
+
+	// Unknown users and users without passkeys get one stable made-up passkey each
+	authenticator := newSoftAuthenticator(t)
+	for _, username := range []string{"alice", "bob", "nobody"} {
+		first := allowed(username)
+		if len(first) != 1 || len(first[0].ID) != len(b64(authenticator.credentialID)) {
+			t.Fatalf("%s: allowCredentials = %v, want one passkey like a real one", username, first)
+		}
+		if again := allowed(strings.ToUpper(username)); again[0] != first[0] {
+			t.Errorf("%s: allowCredentials changed between requests: %v, then %v", username, first, again)
+		}
+	}
+	if allowed("bob")[0] == allowed("nobody")[0] {
+		t.Error("different usernames got the same made-up passkey")
+	}
+
+	// Once a user has a passkey, only the real one is offered
+	decoy := allowed("alice")[0]
+	if code := p.register(t, authenticator); code != http.StatusCreated {
+		t.Fatalf("registration status = %d", code)
+	}
+	if got := allowed("alice"); len(got) != 1 || got[0].ID != b64(authenticator.credentialID) || got[0] == decoy {
+		t.Errorf("allowCredentials = %v, want only the registered passkey", got)
+	}
+}
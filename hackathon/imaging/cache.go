@@ -0,0 +1,87 @@
+package imaging
+
+import (
+	"container/list"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// diskCache tracks the rendered files in the cache directory and removes the least
+// recently used ones once their total size exceeds the limit. IIIF regions and sizes
+// are chosen freely by clients, so without a limit the cache could fill the disk.
+type diskCache struct {
+	maxBytes int64
+
+	mutex   sync.Mutex
+	size    int64
+	order   *list.List               // Most recently used at the front
+	entries map[string]*list.Element // Values are *cacheEntry
+}
+
+// cacheEntry is a rendered file in the cache
+type cacheEntry struct {
+	path string
+	size int64
+}
+
+// newDiskCache indexes the renderings already in dir, oldest first, and trims them to maxBytes
+func newDiskCache(dir string, maxBytes int64) *diskCache {
+	c := &diskCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	type existing struct {
+		path string
+		info fs.FileInfo
+	}
+	var files []existing
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		// Skip unreadable entries and the temporary files of unfinished renders
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".render-") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, existing{path, info})
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].info.ModTime().Before(files[j].info.ModTime()) })
+	for _, file := range files {
+		c.use(file.path, file.info.Size())
+	}
+	return c
+}
+
+// use marks a rendering as recently used, adding it if it is not indexed yet,
+// and evicts the least recently used renderings that no longer fit
+func (c *diskCache) use(path string, size int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[path]; ok {
+		c.order.MoveToFront(element)
+		entry := element.Value.(*cacheEntry)
+		c.size += size - entry.size
+		entry.size = size
+	} else {
+		c.entries[path] = c.order.PushFront(&cacheEntry{path: path, size: size})
+		c.size += size
+	}
+
+	// The rendering just used always stays, even if it alone is larger than the limit
+	for c.size > c.maxBytes && c.order.Len() > 1 {
+		oldest := c.order.Remove(c.order.Back()).(*cacheEntry)
+		delete(c.entries, oldest.path)
+		c.size -= oldest.size
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to evict cached rendering %s: %v", oldest.path, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestImage writes a noisy PNG, so renderings of it do not compress to nothing
+func newTestImage(t *testing.T, width, height int) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 7), uint8(y * 13), uint8(x * y), 255})
+		}
+	}
+	path := filepath.Join(t.TempDir(), "source.png")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// cacheSize returns the total size of the renderings in a cache directory
+func cacheSize(t *testing.T, dir string) (int64, int) {
+	t.Helper()
+	var size int64
+	var count int
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			info, _ := d.Info()
+			size += info.Size()
+			count++
+		}
+		return nil
+	})
+	return size, count
+}
+
+func TestIIIFRendersStayWithinCacheLimit(t *testing.T) {
+	source := newTestImage(t, 200, 200)
+	config := &Config{CacheDir: t.TempDir(), CacheMaxBytes: 20_000, MaxPixels: 1_000_000, Concurrency: 1}
+	transformer := NewTransformer(config)
+
+	render := func(x int) *Result {
+		t.Helper()
+		result, err := transformer.RenderIIIF(source, "hash", IIIFRequest{
+			Region: fmt.Sprintf("%d,0,100,100", x), Size: "max", Rotation: "0", Quality: "default", Format: "png",
+		})
+		if err != nil {
+			t.Fatalf("RenderIIIF: %v", err)
+		}
+		return result
+	}
+
+	first := render(0)
+	for x := 1; x <= 50; x++ {
+		render(x)
+		// Keep the first rendering in use, it must survive the evictions
+		if _, err := os.Stat(first.Path); err != nil {
+			t.Fatalf("recently used rendering was evicted after %d renders", x)
+		}
+		render(0)
+	}
+
+	size, count := cacheSize(t, config.CacheDir)
+	if size > config.CacheMaxBytes {
+		t.Errorf("cache holds %d bytes in %d files, limit is %d", size, count, config.CacheMaxBytes)
+	}
+	if count < 2 {
+		t.Errorf("cache holds %d files, want the limit to keep several", count)
+	}
+
+	// A restarted transformer indexes the existing renderings and keeps enforcing the limit
+	transformer = NewTransformer(config)
+	for x := 51; x <= 60; x++ {
+		render(x)
+	}
+	if size, count := cacheSize(t, config.CacheDir); size > config.CacheMaxBytes {
+		t.Errorf("after restart cache holds %d bytes in %d files, limit is %d", size, count, config.CacheMaxBytes)
+	}
+}
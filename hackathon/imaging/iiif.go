@@ -0,0 +1,312 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	// ErrIIIFInvalid is returned for malformed IIIF requests and regions or sizes
+	// that do not fit the image
+	ErrIIIFInvalid = errors.New("invalid IIIF request")
+	// ErrIIIFNotImplemented is returned for valid IIIF features that are not supported
+	ErrIIIFNotImplemented = errors.New("IIIF feature not supported")
+)
+
+// IIIFFormats maps the IIIF format extensions served to output formats
+var IIIFFormats = map[string]string{
+	"jpg":  FormatJPEG,
+	"png":  FormatPNG,
+	"webp": FormatWebP,
+}
+
+// IIIFQualities are the supported IIIF qualities
+var IIIFQualities = []string{"default", "color", "gray", "bitonal"}
+
+// IIIFRequest holds the path parameters of an IIIF Image API 3.0 image request
+type IIIFRequest struct {
+	Region   string
+	Size     string
+	Rotation string
+	Quality  string
+	Format   string
+}
+
+// iiifPlan is an IIIF request resolved against the dimensions of an image
+type iiifPlan struct {
+	region   image.Rectangle
+	width    int
+	height   int
+	mirror   bool
+	rotation int // Clockwise degrees, a multiple of 90
+	quality  string
+	format   string
+}
+
+// String returns the canonical form of the plan, used in cache keys
+func (p *iiifPlan) String() string {
+	return fmt.Sprintf("iiif:%d,%d,%d,%d/%d,%d/%t/%d/%s.%s",
+		p.region.Min.X, p.region.Min.Y, p.region.Dx(), p.region.Dy(),
+		p.width, p.height, p.mirror, p.rotation, p.quality, p.format)
+}
+
+// RenderIIIF returns the cached rendering of an IIIF image request
+func (t *Transformer) RenderIIIF(sourcePath, sourceHash string, req IIIFRequest) (*Result, error) {
+	width, height, err := t.Dimensions(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := planIIIF(req, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := t.cached(sourceHash, plan.String(), plan.format, DefaultQuality, func() (image.Image, error) {
+		img, err := t.decode(sourcePath)
+		if err != nil {
+			return nil, err
+		}
+		return applyIIIF(img, plan), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Extension = "." + req.Format
+	return result, nil
+}
+
+// planIIIF validates an IIIF request and resolves it against the image dimensions.
+// Parameters are applied in the order region, size, rotation, quality, format.
+func planIIIF(req IIIFRequest, width, height int) (*iiifPlan, error) {
+	plan := &iiifPlan{quality: req.Quality}
+
+	var ok bool
+	if plan.format, ok = IIIFFormats[req.Format]; !ok {
+		return nil, fmt.Errorf("%w: unsupported format %q", ErrIIIFInvalid, req.Format)
+	}
+
+	validQuality := false
+	for _, quality := range IIIFQualities {
+		validQuality = validQuality || quality == req.Quality
+	}
+	if !validQuality {
+		return nil, fmt.Errorf("%w: unsupported quality %q", ErrIIIFInvalid, req.Quality)
+	}
+	if plan.quality == "color" {
+		plan.quality = "default" // Same rendering, share the cache entry
+	}
+
+	var err error
+	if plan.region, err = parseRegion(req.Region, width, height); err != nil {
+		return nil, err
+	}
+	if plan.width, plan.height, err = parseSize(req.Size, plan.region.Dx(), plan.region.Dy()); err != nil {
+		return nil, err
+	}
+
+	rotation := req.Rotation
+	if strings.HasPrefix(rotation, "!") {
+		plan.mirror = true
+		rotation = rotation[1:]
+	}
+	degrees, err := strconv.ParseFloat(rotation, 64)
+	if err != nil || degrees < 0 || degrees > 360 {
+		return nil, fmt.Errorf("%w: rotation must be between 0 and 360", ErrIIIFInvalid)
+	}
+	if math.Mod(degrees, 90) != 0 {
+		return nil, fmt.Errorf("%w: only rotations by multiples of 90 degrees", ErrIIIFNotImplemented)
+	}
+	plan.rotation = int(degrees) % 360
+	return plan, nil
+}
+
+// parseRegion parses full, square, x,y,w,h and pct:x,y,w,h regions,
+// cropping regions that extend past the image
+func parseRegion(region string, width, height int) (image.Rectangle, error) {
+	bounds := image.Rect(0, 0, width, height)
+	switch region {
+	case "full":
+		return bounds, nil
+	case "square":
+		side := min(width, height)
+		x, y := (width-side)/2, (height-side)/2
+		return image.Rect(x, y, x+side, y+side), nil
+	}
+
+	values, isPercent := strings.CutPrefix(region, "pct:")
+	parts := strings.Split(values, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("%w: malformed region %q", ErrIIIFInvalid, region)
+	}
+	var numbers [4]float64
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 || (!isPercent && n != math.Trunc(n)) {
+			return image.Rectangle{}, fmt.Errorf("%w: malformed region %q", ErrIIIFInvalid, region)
+		}
+		numbers[i] = n
+	}
+	if isPercent {
+		numbers[0] *= float64(width) / 100
+		numbers[1] *= float64(height) / 100
+		numbers[2] *= float64(width) / 100
+		numbers[3] *= float64(height) / 100
+	}
+
+	x, y := int(math.Round(numbers[0])), int(math.Round(numbers[1]))
+	w, h := int(math.Round(numbers[2])), int(math.Round(numbers[3]))
+	rect := image.Rect(x, y, x+w, y+h).Intersect(bounds)
+	if w <= 0 || h <= 0 || rect.Empty() {
+		return image.Rectangle{}, fmt.Errorf("%w: region %q is outside the image", ErrIIIFInvalid, region)
+	}
+	return rect, nil
+}
+
+// parseSize parses the size forms of IIIF Image API 3.0 for a region of the given size.
+// Only sizes prefixed with ^ may be larger than the region.
+func parseSize(size string, regionWidth, regionHeight int) (int, int, error) {
+	spec, upscale := strings.CutPrefix(size, "^")
+	rw, rh := float64(regionWidth), float64(regionHeight)
+	invalid := fmt.Errorf("%w: malformed size %q", ErrIIIFInvalid, size)
+
+	var width, height float64
+	switch {
+	case spec == "max":
+		scale := math.Min(MaxDimension/rw, MaxDimension/rh)
+		if !upscale {
+			scale = math.Min(scale, 1)
+		}
+		width, height = rw*scale, rh*scale
+
+	case strings.HasPrefix(spec, "pct:"):
+		n, err := strconv.ParseFloat(spec[4:], 64)
+		if err != nil || n <= 0 {
+			return 0, 0, invalid
+		}
+		width, height = rw*n/100, rh*n/100
+
+	case strings.HasPrefix(spec, "!"):
+		w, h, ok := parseSizePair(spec[1:])
+		if !ok || w == 0 || h == 0 {
+			return 0, 0, invalid
+		}
+		scale := math.Min(w/rw, h/rh)
+		if !upscale {
+			scale = math.Min(scale, 1)
+		}
+		width, height = rw*scale, rh*scale
+
+	default:
+		w, h, ok := parseSizePair(spec)
+		if !ok || (w == 0 && h == 0) {
+			return 0, 0, invalid
+		}
+		width, height = w, h
+		if w == 0 {
+			width = rw * h / rh
+		}
+		if h == 0 {
+			height = rh * w / rw
+		}
+	}
+
+	w, h := max(1, int(math.Round(width))), max(1, int(math.Round(height)))
+	if !upscale && (w > regionWidth || h > regionHeight) {
+		return 0, 0, fmt.Errorf("%w: size %q is larger than the region, use ^ to upscale", ErrIIIFInvalid, size)
+	}
+	if w > MaxDimension || h > MaxDimension {
+		return 0, 0, fmt.Errorf("%w: size %q exceeds %d pixels", ErrIIIFInvalid, size, MaxDimension)
+	}
+	return w, h, nil
+}
+
+// parseSizePair parses "w,h", "w," and ",h", returning zero for a missing value
+func parseSizePair(spec string) (float64, float64, bool) {
+	wText, hText, found := strings.Cut(spec, ",")
+	if !found {
+		return 0, 0, false
+	}
+	var values [2]float64
+	for i, text := range []string{wText, hText} {
+		if text == "" {
+			continue
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		values[i] = float64(n)
+	}
+	return values[0], values[1], true
+}
+
+// applyIIIF renders a resolved IIIF request
+func applyIIIF(img image.Image, plan *iiifPlan) image.Image {
+	region := plan.region.Add(img.Bounds().Min)
+	scaled := image.NewRGBA(image.Rect(0, 0, plan.width, plan.height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, region, draw.Src, nil)
+
+	result := rotate(scaled, plan.mirror, plan.rotation)
+
+	switch plan.quality {
+	case "gray", "bitonal":
+		// Flatten transparency onto white, as for JPEG output
+		gray := image.NewGray(result.Bounds())
+		draw.Draw(gray, gray.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(gray, gray.Bounds(), result, result.Bounds().Min, draw.Over)
+		if plan.quality == "bitonal" {
+			for i, value := range gray.Pix {
+				if value < 128 {
+					gray.Pix[i] = 0
+				} else {
+					gray.Pix[i] = 255
+				}
+			}
+		}
+		return gray
+	}
+	return result
+}
+
+// rotate mirrors an image horizontally if requested, then rotates it clockwise
+// by a multiple of 90 degrees
+func rotate(src *image.RGBA, mirror bool, degrees int) *image.RGBA {
+	if !mirror && degrees == 0 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dstW, dstH := w, h
+	if degrees == 90 || degrees == 270 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx := x
+			if mirror {
+				sx = w - 1 - x
+			}
+			var dx, dy int
+			switch degrees {
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			dst.SetRGBA(dx, dy, src.RGBAAt(sx, y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,208 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Fit modes deciding how an image is brought to the requested box
+const (
+	FitContain = "contain" // Scale down to fit inside the box, keeping the aspect ratio
+	FitCover   = "cover"   // Fill the box, cropping the overflow around the centre
+	FitFill    = "fill"    // Stretch to exactly the box
+)
+
+// Output formats
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+)
+
+// MaxDimension is the largest width or height a preset may request
+const MaxDimension = 4096
+
+// DefaultQuality is used for lossy formats when no quality is given
+const DefaultQuality = 85
+
+// DefaultPresets are used when IMAGE_PRESETS is unset. original has no geometry and
+// allows converting an image at its original size.
+const DefaultPresets = "thumb:w=150&h=150&fit=cover;small:w=320;medium:w=800;large:w=1600;original:"
+
+var (
+	// ErrNotAllowed is returned for transformations that match no preset
+	ErrNotAllowed = errors.New("transformation does not match an allowed preset")
+	// ErrUnknownPreset is returned for preset names that are not configured
+	ErrUnknownPreset = errors.New("unknown preset")
+)
+
+// Options describe a transformation. A zero width and height keep the original size.
+type Options struct {
+	Width   int    `json:"w,omitempty"`
+	Height  int    `json:"h,omitempty"`
+	Fit     string `json:"fit,omitempty"`
+	Format  string `json:"format,omitempty"` // Empty keeps the source format where possible
+	Quality int    `json:"q,omitempty"`      // 1-100, lossy formats only
+}
+
+// String returns the canonical form of the options, used in cache keys
+func (o Options) String() string {
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&format=%s&q=%d", o.Width, o.Height, o.Fit, o.Format, o.Quality)
+}
+
+// sameGeometry reports whether two options produce the same dimensions
+func (o Options) sameGeometry(other Options) bool {
+	return o.Width == other.Width && o.Height == other.Height && o.Fit == other.Fit
+}
+
+// override applies the format and quality of a request to a preset. A preset without
+// a format may be rendered in any format, but a format or quality the preset sets may
+// not be changed, so each preset has at most one rendering per format.
+func (o Options) override(request Options) (Options, bool) {
+	if request.Format != "" {
+		if o.Format != "" && o.Format != request.Format {
+			return o, false
+		}
+		o.Format = request.Format
+	}
+	quality := o.Quality
+	if quality == 0 {
+		quality = DefaultQuality
+	}
+	if request.Quality != 0 && request.Quality != quality {
+		return o, false
+	}
+	return o, true
+}
+
+// transformParams are the query parameters that request a transformation
+var transformParams = []string{"preset", "w", "h", "fit", "format", "q"}
+
+// IsTransformRequest reports whether a query asks for a transformation
+func IsTransformRequest(query url.Values) bool {
+	for _, param := range transformParams {
+		if query.Has(param) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOptions parses the w, h, fit, format and q parameters without checking presets
+func parseOptions(query url.Values) (Options, error) {
+	var opts Options
+	var err error
+	if opts.Width, err = parseDimension(query, "w"); err != nil {
+		return opts, err
+	}
+	if opts.Height, err = parseDimension(query, "h"); err != nil {
+		return opts, err
+	}
+
+	opts.Fit = strings.ToLower(query.Get("fit"))
+	switch opts.Fit {
+	case "":
+		if opts.Width > 0 || opts.Height > 0 {
+			opts.Fit = FitContain
+		}
+	case FitContain, FitCover, FitFill:
+		if opts.Width == 0 && opts.Height == 0 {
+			return opts, errors.New("fit requires w or h")
+		}
+	default:
+		return opts, fmt.Errorf("fit must be one of %s, %s or %s", FitContain, FitCover, FitFill)
+	}
+
+	opts.Format = strings.ToLower(query.Get("format"))
+	switch opts.Format {
+	case "", FormatJPEG, FormatPNG, FormatWebP:
+	case "jpg":
+		opts.Format = FormatJPEG
+	default:
+		return opts, fmt.Errorf("format must be one of %s, %s or %s", FormatJPEG, FormatPNG, FormatWebP)
+	}
+
+	if value := query.Get("q"); value != "" {
+		opts.Quality, err = strconv.Atoi(value)
+		if err != nil || opts.Quality < 1 || opts.Quality > 100 {
+			return opts, errors.New("q must be between 1 and 100")
+		}
+	}
+	return opts, nil
+}
+
+// parseDimension parses a width or height parameter
+func parseDimension(query url.Values, name string) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > MaxDimension {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, MaxDimension)
+	}
+	return n, nil
+}
+
+// ParsePresets parses semicolon-separated presets of the form name:query,
+// e.g. "thumb:w=150&h=150&fit=cover;small:w=320"
+func ParsePresets(value string) (map[string]Options, error) {
+	presets := make(map[string]Options)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rawQuery, ok := strings.Cut(entry, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid preset %q, expected name:query", entry)
+		}
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preset %q: %w", name, err)
+		}
+		opts, err := parseOptions(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preset %q: %w", name, err)
+		}
+		presets[name] = opts
+	}
+	return presets, nil
+}
+
+// ParseQuery returns the transformation requested by a query. Either a preset is named
+// with ?preset=, or w, h and fit must match the geometry of a preset. format and q must
+// agree with the preset, see Options.override.
+func (t *Transformer) ParseQuery(query url.Values) (Options, error) {
+	if name := query.Get("preset"); name != "" {
+		preset, ok := t.config.Presets[name]
+		if !ok {
+			return Options{}, ErrUnknownPreset
+		}
+		request, err := parseOptions(url.Values{"format": {query.Get("format")}, "q": {query.Get("q")}})
+		if err != nil {
+			return Options{}, err
+		}
+		if preset, ok = preset.override(request); !ok {
+			return Options{}, ErrNotAllowed
+		}
+		return preset, nil
+	}
+
+	request, err := parseOptions(query)
+	if err != nil {
+		return request, err
+	}
+	for _, preset := range t.config.Presets {
+		if !request.sameGeometry(preset) {
+			continue
+		}
+		if opts, ok := preset.override(request); ok {
+			return opts, nil
+		}
+	}
+	return request, ErrNotAllowed
+}
@@ -0,0 +1,55 @@
+package imaging
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseQueryOnlyAllowsPresetRenderings(t *testing.T) {
+	presets, err := ParsePresets(DefaultPresets + ";hero:w=1200&format=webp&q=70")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer := NewTransformer(&Config{CacheDir: t.TempDir(), CacheMaxBytes: 1 << 20, Presets: presets, Concurrency: 1})
+
+	for _, tt := range []struct {
+		query string
+		want  Options
+		err   error
+	}{
+		{query: "preset=thumb", want: Options{Width: 150, Height: 150, Fit: FitCover}},
+		{query: "preset=thumb&format=webp", want: Options{Width: 150, Height: 150, Fit: FitCover, Format: FormatWebP}},
+		{query: "w=320", want: Options{Width: 320, Fit: FitContain}},
+		{query: "w=320&format=jpg&q=85", want: Options{Width: 320, Fit: FitContain, Format: FormatJPEG}},
+		{query: "format=webp", want: Options{Format: FormatWebP}},
+		{query: "w=1200&format=webp&q=70", want: Options{Width: 1200, Fit: FitContain, Format: FormatWebP, Quality: 70}},
+		{query: "preset=hero", want: Options{Width: 1200, Fit: FitContain, Format: FormatWebP, Quality: 70}},
+
+		// Every quality would be a separate rendering
+		{query: "format=jpeg&q=37", err: ErrNotAllowed},
+		{query: "q=99", err: ErrNotAllowed},
+		{query: "preset=small&q=12", err: ErrNotAllowed},
+		{query: "preset=hero&q=71", err: ErrNotAllowed},
+		{query: "preset=hero&format=png", err: ErrNotAllowed},
+		{query: "w=321", err: ErrNotAllowed},
+		{query: "w=320&fit=fill", err: ErrNotAllowed},
+		{query: "preset=huge", err: ErrUnknownPreset},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			opts, err := transformer.ParseQuery(query)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && opts != tt.want {
+				t.Errorf("options = %+v, want %+v", opts, tt.want)
+			}
+		})
+	}
+
+	// Without a preset that has no geometry, conversions at the original size are refused
+	delete(presets, "original")
+	if _, err := transformer.ParseQuery(url.Values{"format": {"webp"}}); err != ErrNotAllowed {
+		t.Errorf("format alone without an original preset: err = %v, want ErrNotAllowed", err)
+	}
+}
@@ -0,0 +1,307 @@
+package imaging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	// Register decoders for the upload formats
+	_ "image/gif"
+
+	"github.com/chai2010/webp"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+)
+
+var (
+	// ErrUnsupported is returned for sources that cannot be decoded, such as SVG
+	ErrUnsupported = errors.New("image format cannot be transformed")
+	// ErrTooLarge is returned for sources with more pixels than allowed
+	ErrTooLarge = errors.New("image is too large to transform")
+)
+
+// Config holds the transformation settings
+type Config struct {
+	CacheDir      string             // Directory of rendered results
+	CacheMaxBytes int64              // Total size of rendered results kept on disk
+	Presets       map[string]Options // Allowed transformations by name
+	MaxPixels     int64              // Largest source image that is decoded
+	Concurrency   int                // Transformations rendered at the same time
+}
+
+// GetConfig reads the transformation settings from environment variables.
+// The cache defaults to a directory inside the upload directory.
+func GetConfig(uploadDir string) (*Config, error) {
+	config := &Config{
+		CacheDir:      os.Getenv("IMAGE_CACHE_DIR"),
+		CacheMaxBytes: 1 << 30,
+		MaxPixels:     50_000_000,
+		Concurrency:   runtime.NumCPU(),
+	}
+	if config.CacheDir == "" {
+		config.CacheDir = filepath.Join(uploadDir, ".transforms")
+	}
+
+	presets := os.Getenv("IMAGE_PRESETS")
+	if presets == "" {
+		presets = DefaultPresets
+	}
+	var err error
+	if config.Presets, err = ParsePresets(presets); err != nil {
+		return nil, err
+	}
+
+	if value := os.Getenv("IMAGE_CACHE_MAX_BYTES"); value != "" {
+		if config.CacheMaxBytes, err = strconv.ParseInt(value, 10, 64); err != nil || config.CacheMaxBytes <= 0 {
+			return nil, fmt.Errorf("invalid IMAGE_CACHE_MAX_BYTES %q", value)
+		}
+	}
+	if value := os.Getenv("IMAGE_MAX_PIXELS"); value != "" {
+		if config.MaxPixels, err = strconv.ParseInt(value, 10, 64); err != nil || config.MaxPixels <= 0 {
+			return nil, fmt.Errorf("invalid IMAGE_MAX_PIXELS %q", value)
+		}
+	}
+	if value := os.Getenv("IMAGE_TRANSFORM_CONCURRENCY"); value != "" {
+		if config.Concurrency, err = strconv.Atoi(value); err != nil || config.Concurrency <= 0 {
+			return nil, fmt.Errorf("invalid IMAGE_TRANSFORM_CONCURRENCY %q", value)
+		}
+	}
+	return config, nil
+}
+
+// Transformer renders transformed images and caches them on disk
+type Transformer struct {
+	config *Config
+	cache  *diskCache
+	slots  chan struct{} // Bounds the number of concurrent renders
+}
+
+// NewTransformer creates a new Transformer
+func NewTransformer(config *Config) *Transformer {
+	return &Transformer{
+		config: config,
+		cache:  newDiskCache(config.CacheDir, config.CacheMaxBytes),
+		slots:  make(chan struct{}, config.Concurrency),
+	}
+}
+
+// Result is a rendered image in the cache
+type Result struct {
+	Path        string
+	ContentType string
+	Extension   string
+	Key         string // Identifies the rendered bytes, suitable as an ETag
+}
+
+// Render returns the cached rendering of a source image, creating it if needed.
+// The cache key combines the source content hash with the options, so results
+// never need to be invalidated.
+func (t *Transformer) Render(sourcePath, sourceHash, sourceType string, opts Options) (*Result, error) {
+	if opts.Format == "" {
+		opts.Format = formatFor(sourceType)
+	}
+	if opts.Format == FormatPNG {
+		opts.Quality = 0
+	} else if opts.Quality == 0 {
+		opts.Quality = DefaultQuality
+	}
+
+	return t.cached(sourceHash, opts.String(), opts.Format, opts.Quality, func() (image.Image, error) {
+		img, err := t.decode(sourcePath)
+		if err != nil {
+			return nil, err
+		}
+		return resize(img, opts), nil
+	})
+}
+
+// cached returns the cached rendering identified by the source hash and a canonical
+// description of the transformation, calling render to create it if needed
+func (t *Transformer) cached(sourceHash, description, format string, quality int, render func() (image.Image, error)) (*Result, error) {
+	if sourceHash == "" {
+		return nil, errors.New("source content hash is required")
+	}
+
+	sum := sha256.Sum256([]byte(sourceHash + "?" + description))
+	key := hex.EncodeToString(sum[:])
+	result := &Result{
+		Path:        filepath.Join(t.config.CacheDir, key[:2], key+"."+format),
+		ContentType: "image/" + format,
+		Extension:   "." + format,
+		Key:         key,
+	}
+	if info, err := os.Stat(result.Path); err == nil {
+		t.cache.use(result.Path, info.Size())
+		return result, nil
+	}
+
+	t.slots <- struct{}{}
+	defer func() { <-t.slots }()
+
+	// Another request may have rendered it while this one waited
+	if info, err := os.Stat(result.Path); err == nil {
+		t.cache.use(result.Path, info.Size())
+		return result, nil
+	}
+
+	img, err := render()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeImage(result.Path, img, format, quality); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(result.Path)
+	if err != nil {
+		return nil, err
+	}
+	t.cache.use(result.Path, info.Size())
+	return result, nil
+}
+
+// Dimensions returns the width and height of an image without decoding it
+func (t *Transformer) Dimensions(sourcePath string) (int, int, error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer source.Close()
+
+	config, _, err := image.DecodeConfig(source)
+	if err != nil {
+		return 0, 0, ErrUnsupported
+	}
+	return config.Width, config.Height, nil
+}
+
+// decode reads a source image, refusing images with more pixels than allowed
+func (t *Transformer) decode(sourcePath string) (image.Image, error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	// Check the dimensions before decoding so huge images cannot exhaust memory
+	config, _, err := image.DecodeConfig(source)
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if int64(config.Width)*int64(config.Height) > t.config.MaxPixels {
+		return nil, ErrTooLarge
+	}
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(source)
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	return img, nil
+}
+
+// writeImage encodes an image to a temporary file and renames it into place,
+// so concurrent readers never see a partial file
+func writeImage(targetPath string, img image.Image, format string, quality int) error {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(targetPath), ".render-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := encode(tmp, img, format, quality); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), targetPath)
+}
+
+// resize applies the geometry of the options
+func resize(img image.Image, opts Options) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := float64(bounds.Dx()), float64(bounds.Dy())
+	if opts.Width == 0 && opts.Height == 0 || srcW == 0 || srcH == 0 {
+		return img
+	}
+
+	width, height := float64(opts.Width), float64(opts.Height)
+	crop := bounds
+	switch {
+	case opts.Fit == FitCover && width > 0 && height > 0:
+		scale := math.Max(width/srcW, height/srcH)
+		cropW, cropH := int(math.Round(width/scale)), int(math.Round(height/scale))
+		x := bounds.Min.X + (bounds.Dx()-cropW)/2
+		y := bounds.Min.Y + (bounds.Dy()-cropH)/2
+		crop = image.Rect(x, y, x+cropW, y+cropH)
+
+	case opts.Fit == FitFill:
+		if width == 0 {
+			width = srcW * height / srcH
+		}
+		if height == 0 {
+			height = srcH * width / srcW
+		}
+
+	default:
+		// Contain never enlarges the image
+		scale := 1.0
+		if width > 0 {
+			scale = math.Min(scale, width/srcW)
+		}
+		if height > 0 {
+			scale = math.Min(scale, height/srcH)
+		}
+		width, height = srcW*scale, srcH*scale
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, max(1, int(math.Round(width))), max(1, int(math.Round(height)))))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Src, nil)
+	return dst
+}
+
+// encode writes an image in the requested format
+func encode(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case FormatJPEG:
+		// JPEG has no transparency, flatten onto white instead of black
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		return jpeg.Encode(w, flat, &jpeg.Options{Quality: quality})
+	case FormatWebP:
+		return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+	default:
+		return png.Encode(w, img)
+	}
+}
+
+// formatFor returns the output format that keeps a source's format where it can be encoded
+func formatFor(contentType string) string {
+	switch strings.ToLower(contentType) {
+	case "image/jpeg", "image/jpg":
+		return FormatJPEG
+	case "image/webp":
+		return FormatWebP
+	default:
+		return FormatPNG
+	}
+}
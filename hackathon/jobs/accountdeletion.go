@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+// DeleteDueAccounts deletes every account whose scheduled deletion time has passed,
+// including their files on disk, and returns the number of deleted accounts
+func DeleteDueAccounts(userModel *models.UserModel) (int, error) {
+	ids, err := userModel.ListDueForDeletion(time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		filePaths, err := userModel.Delete(id)
+		if err == models.ErrLastOrgOwner {
+			// Ownership was gained during the grace period, retried on the next sweep
+			log.Printf("Postponing deletion of user %d: last owner of an organization", id)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to delete user %d: %v", id, err)
+			continue
+		}
+		removed := utils.RemoveFiles(filePaths)
+		log.Printf("Deleted user %d and %d of %d files", id, removed, len(filePaths))
+		deleted++
+	}
+	return deleted, nil
+}
+
+// StartAccountDeletionSweeper runs DeleteDueAccounts in the background every interval
+func StartAccountDeletionSweeper(userModel *models.UserModel, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := DeleteDueAccounts(userModel); err != nil {
+				log.Printf("Account deletion sweep failed: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,52 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"file-uploader/models"
+)
+
+func TestDeleteDueAccountsWaitsForTheScheduledTime(t *testing.T) {
+	m := newTestModels(t)
+	dir := t.TempDir()
+
+	user := func(name string, deleteAt time.Time) (*models.User, string) {
+		u, err := m.users.CreateExternal(name, models.AuthSourceLocal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !deleteAt.IsZero() {
+			if err := m.users.ScheduleDeletion(u.ID, deleteAt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		path := writeBlob(t, dir, name, 0)
+		m.createFile(t, u.ID, path, int64(len(name)), nil)
+		return u, path
+	}
+	due, duePath := user("alice", time.Now().Add(-time.Minute))
+	later, laterPath := user("bob", time.Now().Add(time.Hour))
+	kept, keptPath := user("carol", time.Time{})
+	// An owner gained during the grace period postpones the deletion
+	owner, ownerPath := user("dave", time.Now().Add(-time.Minute))
+	if _, err := m.orgs.Create("acme", owner.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := DeleteDueAccounts(m.users)
+	if err != nil || deleted != 1 {
+		t.Fatalf("DeleteDueAccounts = %d, %v, want 1", deleted, err)
+	}
+	if _, err := m.users.GetByID(due.ID); err == nil || exists(duePath) {
+		t.Errorf("due account or its file still exists")
+	}
+	for _, u := range []struct {
+		user *models.User
+		path string
+	}{{later, laterPath}, {kept, keptPath}, {owner, ownerPath}} {
+		if _, err := m.users.GetByID(u.user.ID); err != nil || !exists(u.path) {
+			t.Errorf("%s: account or file was deleted: %v", u.user.Username, err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+// DeleteExpiredFiles deletes every file whose expiry has passed, including all its
+// versions on disk, and returns the number of deleted files
+func DeleteExpiredFiles(fileModel *models.FileModel) (int, error) {
+	deleted, filePaths, err := fileModel.DeleteExpired(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		removed := utils.RemoveFiles(filePaths)
+		log.Printf("Deleted %d expired files and %d of %d stored contents", deleted, removed, len(filePaths))
+	}
+	return deleted, nil
+}
+
+// StartFileExpirySweeper runs DeleteExpiredFiles in the background every interval
+func StartFileExpirySweeper(fileModel *models.FileModel, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := DeleteExpiredFiles(fileModel); err != nil {
+				log.Printf("File expiry sweep failed: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
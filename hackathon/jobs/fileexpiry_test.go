@@ -0,0 +1,51 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"file-uploader/models"
+)
+
+func TestDeleteExpiredFilesRemovesEveryVersion(t *testing.T) {
+	m := newTestModels(t)
+	dir := t.TempDir()
+	user, err := m.users.CreateExternal("alice", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour).UTC()
+	expire := func(file *models.FileMetadata) {
+		if _, err := m.db.Exec("UPDATE files SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute).UTC(), file.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldVersion, current := writeBlob(t, dir, "first", 0), writeBlob(t, dir, "second", 0)
+	expired := m.createFile(t, user.ID, oldVersion, 5, nil)
+	m.addVersion(t, expired, current, 6)
+	expire(expired)
+	// Content shared with a file that is kept stays on disk
+	shared := writeBlob(t, dir, "shared", 0)
+	expire(m.createFile(t, user.ID, shared, 6, nil))
+	m.createFile(t, user.ID, shared, 6, nil)
+	later := writeBlob(t, dir, "later", 0)
+	m.createFile(t, user.ID, later, 5, &future)
+
+	deleted, err := DeleteExpiredFiles(m.files)
+	if err != nil || deleted != 2 {
+		t.Fatalf("DeleteExpiredFiles = %d, %v, want 2", deleted, err)
+	}
+	if exists(oldVersion) || exists(current) {
+		t.Error("content of the expired file is still on disk")
+	}
+	if !exists(shared) || !exists(later) {
+		t.Error("content of a kept file was removed")
+	}
+	if n := m.count(t, "files"); n != 2 {
+		t.Errorf("files rows = %d, want 2", n)
+	}
+	if n := m.count(t, "file_versions"); n != 2 {
+		t.Errorf("file_versions rows = %d, want 2", n)
+	}
+}
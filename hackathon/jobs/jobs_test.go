@@ -0,0 +1,112 @@
+package jobs
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"file-uploader/models"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testModels holds the models backed by a fresh test database
+type testModels struct {
+	db    *sql.DB
+	users *models.UserModel
+	orgs  *models.OrganizationModel
+	files *models.FileModel
+}
+
+// newTestModels creates an empty database in a temporary directory with all tables
+func newTestModels(t *testing.T) *testModels {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	m := &testModels{
+		db:    db,
+		users: models.NewUserModel(db),
+		orgs:  models.NewOrganizationModel(db),
+		files: models.NewFileModel(db),
+	}
+	for _, create := range []func() error{
+		m.users.CreateTable,
+		m.orgs.CreateTable,
+		m.files.CreateTable,
+		// Deleting a user touches every table that references users
+		models.NewAPIKeyModel(db).CreateTable,
+		models.NewUserIdentityModel(db).CreateTable,
+		models.NewEmailVerificationModel(db).CreateTable,
+		models.NewOAuthClientModel(db).CreateTable,
+		models.NewWebAuthnCredentialModel(db).CreateTable,
+	} {
+		if err := create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+// count returns the number of rows in a table
+func (m *testModels) count(t *testing.T, table string) int {
+	t.Helper()
+	var n int
+	if err := m.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// writeBlob stores content under a new upload name in dir, dated age ago
+func writeBlob(t *testing.T, dir, content string, age time.Duration) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.CreateTemp(dir, "upload_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	modified := time.Now().Add(-age)
+	if err := os.Chtimes(f.Name(), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// createFile records a file of a user whose current content is stored at path
+func (m *testModels) createFile(t *testing.T, userID int, path string, size int64, expiresAt *time.Time) *models.FileMetadata {
+	t.Helper()
+	file, err := m.files.Create(&models.FileMetadata{
+		UserID: userID, Filename: "a.png", ContentType: "image/png", Size: size, FilePath: path, ExpiresAt: expiresAt,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// addVersion records new content at path as the current version of a file
+func (m *testModels) addVersion(t *testing.T, file *models.FileMetadata, path string, size int64) {
+	t.Helper()
+	if _, err := m.files.AddVersion(file.ID, 0, &models.FileVersion{
+		UserID: file.UserID, ContentType: file.ContentType, Size: size, FilePath: path,
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// exists reports whether a path exists on disk
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,216 @@
+package jobs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+)
+
+// Reconciliation modes
+const (
+	ReconcileModeReport     = "report"     // Only report problems
+	ReconcileModeQuarantine = "quarantine" // Move unreferenced and damaged blobs out of the way
+	ReconcileModeClean      = "clean"      // Delete unreferenced blobs and rows without usable blobs
+)
+
+// Reconciliation actions taken on a problem
+const (
+	ReconcileActionQuarantined = "quarantined"
+	ReconcileActionDeleted     = "deleted"
+)
+
+// QuarantineDirName is the directory inside the upload directory quarantined blobs are moved to
+const QuarantineDirName = ".quarantine"
+
+// StagingDirName is the directory inside the upload directory uploads are written to until
+// they are complete and recorded
+const StagingDirName = ".staging"
+
+// orphanGracePeriod keeps blobs of uploads that are still being stored from being reported
+const orphanGracePeriod = time.Hour
+
+// ReconcileIssue is a mismatch between the database and the upload directory
+type ReconcileIssue struct {
+	FileID     int    `json:"file_id,omitempty"`
+	Version    int    `json:"version,omitempty"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`                  // Recorded size, or the size on disk of orphans
+	ActualSize int64  `json:"actual_size,omitempty"` // Size on disk of size mismatches
+	Action     string `json:"action,omitempty"`      // What was done, or why it failed
+	// QuarantinePath is where a quarantined blob was moved to
+	QuarantinePath string `json:"quarantine_path,omitempty"`
+}
+
+// ReconcileReport lists the problems found by a reconciliation
+type ReconcileReport struct {
+	Mode           string            `json:"mode"`
+	CheckedRows    int               `json:"checked_rows"`
+	CheckedBlobs   int               `json:"checked_blobs"`
+	MissingBlobs   []*ReconcileIssue `json:"missing_blobs"`   // Rows whose blob does not exist
+	SizeMismatches []*ReconcileIssue `json:"size_mismatches"` // Blobs whose size differs from the row
+	OrphanBlobs    []*ReconcileIssue `json:"orphan_blobs"`    // Blobs no row refers to
+	Notes          []string          `json:"notes,omitempty"` // Follow-up needed after the actions taken
+}
+
+// IsValidReconcileMode reports whether mode is a known reconciliation mode
+func IsValidReconcileMode(mode string) bool {
+	return mode == ReconcileModeReport || mode == ReconcileModeQuarantine || mode == ReconcileModeClean
+}
+
+// Reconcile compares the stored versions of all files with the upload directory.
+// Only files named like uploads at the top level and in the staging directory are
+// considered orphans, so other files and directories such as the transformation cache
+// are never touched.
+//
+// In quarantine mode orphans and blobs with the wrong size are moved to the quarantine
+// directory. The rows of moved blobs are kept, so their downloads fail until the blob is
+// restored or the rows are removed by a clean run; the report notes this. In clean mode orphans are deleted, and rows with a missing or damaged blob
+// are deleted with the blob: an old version on its own, a current version with the file.
+func Reconcile(fileModel *models.FileModel, uploadDir, mode string) (*ReconcileReport, error) {
+	report := &ReconcileReport{
+		Mode:           mode,
+		MissingBlobs:   []*ReconcileIssue{},
+		SizeMismatches: []*ReconcileIssue{},
+		OrphanBlobs:    []*ReconcileIssue{},
+	}
+
+	versions, err := fileModel.ListAllVersions()
+	if err != nil {
+		return nil, err
+	}
+	report.CheckedRows = len(versions)
+
+	// The current version of a file is its newest one
+	current := make(map[int]int)
+	referenced := make(map[string]bool)
+	for _, version := range versions {
+		current[version.FileID] = max(current[version.FileID], version.Version)
+		referenced[absPath(version.FilePath)] = true
+	}
+
+	damaged := []*ReconcileIssue{}
+	for _, version := range versions {
+		issue := &ReconcileIssue{FileID: version.FileID, Version: version.Version, Path: version.FilePath, Size: version.Size}
+		info, err := os.Stat(version.FilePath)
+		switch {
+		case os.IsNotExist(err):
+			report.MissingBlobs = append(report.MissingBlobs, issue)
+			damaged = append(damaged, issue)
+		case err != nil:
+			return nil, err
+		case info.Size() != version.Size:
+			issue.ActualSize = info.Size()
+			report.SizeMismatches = append(report.SizeMismatches, issue)
+			damaged = append(damaged, issue)
+		}
+	}
+
+	// Uploads left in the staging directory by a crash are orphans as well
+	for _, dir := range []string{uploadDir, filepath.Join(uploadDir, StagingDirName)} {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) && dir != uploadDir {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), "upload_") {
+				continue
+			}
+			report.CheckedBlobs++
+			path := filepath.Join(dir, entry.Name())
+			if referenced[absPath(path)] {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < orphanGracePeriod {
+				continue
+			}
+			report.OrphanBlobs = append(report.OrphanBlobs, &ReconcileIssue{Path: path, Size: info.Size()})
+		}
+	}
+
+	switch mode {
+	case ReconcileModeQuarantine:
+		quarantineDir := filepath.Join(uploadDir, QuarantineDirName)
+		for _, issue := range append(report.SizeMismatches, report.OrphanBlobs...) {
+			issue.QuarantinePath, issue.Action = quarantine(issue.Path, quarantineDir)
+		}
+		kept := 0
+		for _, issue := range report.SizeMismatches {
+			if issue.Action == ReconcileActionQuarantined {
+				kept++
+			}
+		}
+		if kept > 0 {
+			report.Notes = append(report.Notes, fmt.Sprintf(
+				"%d file versions still refer to their quarantined blob and cannot be downloaded: "+
+					"move the blob back from quarantine_path, or run mode clean to delete the rows", kept))
+		}
+	case ReconcileModeClean:
+		for _, issue := range report.OrphanBlobs {
+			issue.Action = remove(issue.Path)
+		}
+		deletedFiles := make(map[int]bool)
+		for _, issue := range damaged {
+			if deletedFiles[issue.FileID] {
+				issue.Action = ReconcileActionDeleted
+				continue
+			}
+			var filePaths []string
+			if issue.Version == current[issue.FileID] {
+				filePaths, err = fileModel.Delete(issue.FileID)
+				deletedFiles[issue.FileID] = true
+			} else {
+				filePaths, err = fileModel.DeleteVersion(issue.FileID, issue.Version)
+			}
+			if err != nil {
+				issue.Action = "failed: " + err.Error()
+				continue
+			}
+			utils.RemoveFiles(filePaths)
+			issue.Action = ReconcileActionDeleted
+		}
+	}
+
+	log.Printf("Reconciliation (%s): %d missing blobs, %d size mismatches, %d orphan blobs",
+		mode, len(report.MissingBlobs), len(report.SizeMismatches), len(report.OrphanBlobs))
+	return report, nil
+}
+
+// absPath returns the absolute form of a path, so relative and absolute upload
+// directories compare equal
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// quarantine moves a blob into the quarantine directory and returns its new path and
+// the action taken
+func quarantine(path, quarantineDir string) (string, string) {
+	if err := os.MkdirAll(quarantineDir, 0700); err != nil {
+		return "", "failed: " + err.Error()
+	}
+	target := filepath.Join(quarantineDir, fmt.Sprintf("%d_%s", time.Now().Unix(), filepath.Base(path)))
+	if err := os.Rename(path, target); err != nil {
+		return "", "failed: " + err.Error()
+	}
+	return target, ReconcileActionQuarantined
+}
+
+// remove deletes a blob and returns the action taken
+func remove(path string) string {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "failed: " + err.Error()
+	}
+	return ReconcileActionDeleted
+}
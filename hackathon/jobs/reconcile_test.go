@@ -0,0 +1,163 @@
+package jobs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"file-uploader/models"
+)
+
+// reconcileTest holds an upload directory with one of every kind of problem
+type reconcileTest struct {
+	*testModels
+	dir         string
+	intact      string // Current version of a healthy file
+	replaced    string // Intact old version of a file whose current version is damaged
+	truncated   string // Damaged current version
+	damagedOld  string // Damaged old version of a file whose current version is intact
+	healthyNew  string // Current version of that file
+	missingFile *models.FileMetadata
+	orphan      string
+	staged      string // Orphan left in the staging directory
+	fresh       string // Upload in progress
+	other       string // Not an upload
+}
+
+func newReconcileTest(t *testing.T) *reconcileTest {
+	t.Helper()
+	m := newTestModels(t)
+	dir := t.TempDir()
+	user, err := m.users.CreateExternal("alice", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &reconcileTest{testModels: m, dir: dir}
+
+	rt.intact = writeBlob(t, dir, "intact", 0)
+	m.createFile(t, user.ID, rt.intact, 6, nil)
+
+	rt.replaced, rt.truncated = writeBlob(t, dir, "first", 0), writeBlob(t, dir, "trunc", 0)
+	file := m.createFile(t, user.ID, rt.replaced, 5, nil)
+	m.addVersion(t, file, rt.truncated, 10)
+
+	rt.damagedOld, rt.healthyNew = writeBlob(t, dir, "trunc", 0), writeBlob(t, dir, "healthy", 0)
+	file = m.createFile(t, user.ID, rt.damagedOld, 10, nil)
+	m.addVersion(t, file, rt.healthyNew, 7)
+
+	rt.missingFile = m.createFile(t, user.ID, filepath.Join(dir, "upload_missing"), 5, nil)
+
+	rt.orphan = writeBlob(t, dir, "orphan", 2*time.Hour)
+	rt.staged = writeBlob(t, filepath.Join(dir, StagingDirName), "staged", 2*time.Hour)
+	rt.fresh = writeBlob(t, dir, "fresh", 0)
+	rt.other = filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(rt.other, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+func TestReconcileReportsWithoutChangingAnything(t *testing.T) {
+	rt := newReconcileTest(t)
+
+	report, err := Reconcile(rt.files, rt.dir, ReconcileModeReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.CheckedRows != 6 || len(report.MissingBlobs) != 1 || len(report.SizeMismatches) != 2 || len(report.OrphanBlobs) != 2 {
+		t.Fatalf("report = %d rows, %d missing, %d mismatches, %d orphans", report.CheckedRows,
+			len(report.MissingBlobs), len(report.SizeMismatches), len(report.OrphanBlobs))
+	}
+	if issue := report.MissingBlobs[0]; issue.FileID != rt.missingFile.ID || issue.Action != "" {
+		t.Errorf("missing blob = %+v", issue)
+	}
+	if issue := report.SizeMismatches[0]; issue.Size != 10 || issue.ActualSize != 5 {
+		t.Errorf("size mismatch = %+v, want recorded 10 and actual 5", issue)
+	}
+	for _, path := range []string{rt.intact, rt.replaced, rt.truncated, rt.damagedOld, rt.orphan, rt.staged, rt.fresh, rt.other} {
+		if !exists(path) {
+			t.Errorf("%s was removed in report mode", path)
+		}
+	}
+	if n := rt.count(t, "file_versions"); n != 6 {
+		t.Errorf("file_versions rows = %d, want 6", n)
+	}
+}
+
+func TestReconcileCleanDeletesDamagedRowsAndOrphans(t *testing.T) {
+	rt := newReconcileTest(t)
+
+	report, err := Reconcile(rt.files, rt.dir, ReconcileModeClean)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issues := range [][]*ReconcileIssue{report.MissingBlobs, report.SizeMismatches, report.OrphanBlobs} {
+		for _, issue := range issues {
+			if issue.Action != ReconcileActionDeleted {
+				t.Errorf("issue %+v was not deleted", issue)
+			}
+		}
+	}
+
+	// A damaged current version takes the whole file with it, including its intact old versions
+	for _, path := range []string{rt.truncated, rt.replaced, rt.damagedOld, rt.orphan, rt.staged} {
+		if exists(path) {
+			t.Errorf("%s still exists", path)
+		}
+	}
+	// A damaged old version is deleted on its own, uploads in progress and other files are kept
+	for _, path := range []string{rt.intact, rt.healthyNew, rt.fresh, rt.other} {
+		if !exists(path) {
+			t.Errorf("%s was removed", path)
+		}
+	}
+	if n := rt.count(t, "files"); n != 2 {
+		t.Errorf("files rows = %d, want the intact file and the one with a damaged old version", n)
+	}
+	if n := rt.count(t, "file_versions"); n != 2 {
+		t.Errorf("file_versions rows = %d, want 2", n)
+	}
+
+	// Afterwards the database and the upload directory agree
+	report, err = Reconcile(rt.files, rt.dir, ReconcileModeReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.MissingBlobs)+len(report.SizeMismatches)+len(report.OrphanBlobs) != 0 {
+		t.Errorf("problems left after cleaning: %+v", report)
+	}
+}
+
+func TestReconcileQuarantineKeepsRowsAndSaysSo(t *testing.T) {
+	rt := newReconcileTest(t)
+
+	report, err := Reconcile(rt.files, rt.dir, ReconcileModeQuarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range append(report.SizeMismatches, report.OrphanBlobs...) {
+		if issue.Action != ReconcileActionQuarantined || exists(issue.Path) || !exists(issue.QuarantinePath) {
+			t.Errorf("issue %+v was not moved to its quarantine path", issue)
+		}
+		if filepath.Dir(issue.QuarantinePath) != filepath.Join(rt.dir, QuarantineDirName) {
+			t.Errorf("quarantine path %s is outside the quarantine directory", issue.QuarantinePath)
+		}
+	}
+	if len(report.Notes) != 1 {
+		t.Errorf("notes = %v, want one about the rows of quarantined blobs", report.Notes)
+	}
+	if n := rt.count(t, "file_versions"); n != 6 {
+		t.Errorf("file_versions rows = %d, want all 6 kept", n)
+	}
+
+	// The kept rows now lack their blob
+	report, err = Reconcile(rt.files, rt.dir, ReconcileModeReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.MissingBlobs) != 3 || len(report.SizeMismatches) != 0 || len(report.OrphanBlobs) != 0 {
+		t.Errorf("after quarantine: %d missing, %d mismatches, %d orphans, want 3, 0, 0",
+			len(report.MissingBlobs), len(report.SizeMismatches), len(report.OrphanBlobs))
+	}
+}
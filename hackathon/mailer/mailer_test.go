@@ -0,0 +1,192 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpSink is an SMTP server that keeps the messages it accepts
+type smtpSink struct {
+	listener net.Listener
+
+	// rejectRecipients makes RCPT TO fail like a mailbox that does not exist
+	rejectRecipients bool
+
+	mutex    sync.Mutex
+	messages []sinkMessage
+}
+
+// sinkMessage is a message received by the sink
+type sinkMessage struct {
+	from, auth string
+	to         []string
+	data       string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// mailer returns an SMTPMailer that delivers to the sink
+func (s *smtpSink) mailer() *SMTPMailer {
+	return &SMTPMailer{
+		Addr: s.listener.Addr().String(),
+		Host: "127.0.0.1",
+		From: "no-reply@example.com",
+	}
+}
+
+func (s *smtpSink) received() []sinkMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]sinkMessage{}, s.messages...)
+}
+
+// serve speaks just enough SMTP for net/smtp
+func (s *smtpSink) serve(conn net.Conn) {
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	var msg sinkMessage
+	text.PrintfLine("220 sink ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-sink")
+			text.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			_, credentials, _ := strings.Cut(arg, " ")
+			decoded, _ := base64.StdEncoding.DecodeString(credentials)
+			msg.auth = string(decoded)
+			text.PrintfLine("235 authenticated")
+		case "MAIL":
+			msg.from = arg
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			if s.rejectRecipients {
+				text.PrintfLine("550 no such mailbox")
+				continue
+			}
+			msg.to = append(msg.to, arg)
+			text.PrintfLine("250 ok")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.mutex.Lock()
+			s.messages = append(s.messages, msg)
+			s.mutex.Unlock()
+			msg = sinkMessage{}
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 ok")
+		}
+	}
+}
+
+func TestSMTPMailerDeliversMessage(t *testing.T) {
+	sink := newSMTPSink(t)
+	m := sink.mailer()
+	m.Username = "mailer"
+	m.Password = "secret"
+
+	err := m.Send(Message{To: "dana@example.com", Subject: "Verify your email address", Body: "Hello\n\nOpen the link"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	messages := sink.received()
+	if len(messages) != 1 {
+		t.Fatalf("received %d messages, want 1", len(messages))
+	}
+	msg := messages[0]
+	if msg.from != "FROM:<no-reply@example.com>" || len(msg.to) != 1 || msg.to[0] != "TO:<dana@example.com>" {
+		t.Errorf("envelope = %q -> %q", msg.from, msg.to)
+	}
+	if msg.auth != "\x00mailer\x00secret" {
+		t.Errorf("auth = %q, want PLAIN credentials", msg.auth)
+	}
+	for _, want := range []string{"To: dana@example.com\n", "Subject: Verify your email address\n", "Content-Type: text/plain; charset=UTF-8\n", "\nHello\n\nOpen the link"} {
+		if !strings.Contains(msg.data, want) {
+			t.Errorf("message is missing %q:\n%s", want, msg.data)
+		}
+	}
+}
+
+func TestSMTPMailerReportsSendFailures(t *testing.T) {
+	t.Run("rejected recipient", func(t *testing.T) {
+		sink := newSMTPSink(t)
+		sink.rejectRecipients = true
+		if err := sink.mailer().Send(Message{To: "nobody@example.com", Subject: "Hi", Body: "Hi"}); err == nil {
+			t.Error("Send succeeded, want the server's rejection")
+		}
+		if n := len(sink.received()); n != 0 {
+			t.Errorf("received %d messages, want 0", n)
+		}
+	})
+
+	t.Run("server unreachable", func(t *testing.T) {
+		sink := newSMTPSink(t)
+		m := sink.mailer()
+		sink.listener.Close()
+		if err := m.Send(Message{To: "dana@example.com", Subject: "Hi", Body: "Hi"}); err == nil {
+			t.Error("Send succeeded, want a connection error")
+		}
+	})
+
+	t.Run("header injection", func(t *testing.T) {
+		sink := newSMTPSink(t)
+		err := sink.mailer().Send(Message{To: "dana@example.com", Subject: "Hi\r\nBcc: eve@example.com", Body: "Hi"})
+		if err == nil {
+			t.Error("Send succeeded, want header injection to be refused")
+		}
+		if n := len(sink.received()); n != 0 {
+			t.Errorf("received %d messages, want 0", n)
+		}
+	})
+}
+
+func TestNewFromEnvFallsBackToLogMailer(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	if _, ok := NewFromEnv().(*LogMailer); !ok {
+		t.Error("NewFromEnv without SMTP_HOST did not return a LogMailer")
+	}
+
+	t.Setenv("SMTP_HOST", "mail.example.com")
+	t.Setenv("SMTP_PORT", "")
+	m, ok := NewFromEnv().(*SMTPMailer)
+	if !ok || m.Addr != "mail.example.com:25" {
+		t.Errorf("NewFromEnv = %+v, want an SMTPMailer for mail.example.com:25", m)
+	}
+}
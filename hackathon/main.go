@@ -2,14 +2,24 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"flag"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"file-uploader/auth"
 	"file-uploader/handlers"
+	"file-uploader/imaging"
+	"file-uploader/jobs"
+	"file-uploader/mailer"
 	"file-uploader/middleware"
 	"file-uploader/models"
+	"file-uploader/utils"
 
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
@@ -36,16 +46,66 @@ func main() {
 	// Initialize models
 	userModel := models.NewUserModel(db)
 	fileModel := models.NewFileModel(db)
+	apiKeyModel := models.NewAPIKeyModel(db)
+	identityModel := models.NewUserIdentityModel(db)
+	emailVerificationModel := models.NewEmailVerificationModel(db)
+	auditModel := models.NewAuditModel(db)
+	orgModel := models.NewOrganizationModel(db)
+	oauthClientModel := models.NewOAuthClientModel(db)
+	webAuthnCredentialModel := models.NewWebAuthnCredentialModel(db)
 
 	// Create tables
 	if err := userModel.CreateTable(); err != nil {
 		log.Fatal("Failed to create users table:", err)
 	}
 
+	if err := orgModel.CreateTable(); err != nil {
+		log.Fatal("Failed to create organization tables:", err)
+	}
+
 	if err := fileModel.CreateTable(); err != nil {
 		log.Fatal("Failed to create files table:", err)
 	}
 
+	if err := apiKeyModel.CreateTable(); err != nil {
+		log.Fatal("Failed to create api_keys table:", err)
+	}
+
+	if err := identityModel.CreateTable(); err != nil {
+		log.Fatal("Failed to create user_identities table:", err)
+	}
+
+	if err := emailVerificationModel.CreateTable(); err != nil {
+		log.Fatal("Failed to create email_verifications table:", err)
+	}
+
+	if err := auditModel.CreateTable(); err != nil {
+		log.Fatal("Failed to create audit_log table:", err)
+	}
+
+	if err := oauthClientModel.CreateTable(); err != nil {
+		log.Fatal("Failed to create oauth_clients table:", err)
+	}
+
+	if err := webAuthnCredentialModel.CreateTable(); err != nil {
+		log.Fatal("Failed to create webauthn_credentials table:", err)
+	}
+
+	// Promote configured administrators
+	for _, username := range strings.Split(os.Getenv("ADMIN_USERNAMES"), ",") {
+		username = utils.NormalizeUsername(username)
+		if username == "" {
+			continue
+		}
+		promoted, err := userModel.SetRoleByUsername(username, models.RoleAdmin)
+		if err != nil {
+			log.Fatal("Failed to promote administrator:", err)
+		}
+		if !promoted {
+			log.Printf("Administrator %q does not exist yet, register it and restart", username)
+		}
+	}
+
 	uploadDir := os.Getenv("UPLOAD_DIR")
 	if uploadDir == "" {
 		uploadDir = "/tmp" // Default fallback
@@ -54,27 +114,176 @@ func main() {
 		log.Fatal("Failed to create upload directory:", err)
 	}
 
+	// Subcommands run against the database and exit instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		runReconcile(fileModel, uploadDir, os.Args[2:])
+		return
+	}
+
+	// Initialize password authentication backends
+	authenticator, err := auth.NewFromEnv(userModel, identityModel)
+	if err != nil {
+		log.Fatal("Failed to configure authentication:", err)
+	}
+	log.Printf("Password authentication backends: %s", authenticator.Name())
+
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(userModel)
-	uploadHandler := handlers.NewUploadHandler(fileModel)
-	staticHandler := handlers.NewStaticHandler(fileModel)
+	emailHandler := handlers.NewEmailHandler(userModel, emailVerificationModel, mailer.NewFromEnv())
+	authHandler := handlers.NewAuthHandler(userModel, authenticator, emailHandler, auditModel)
+	uploadHandler := handlers.NewUploadHandler(fileModel, orgModel, userModel, auditModel)
+	imagingConfig, err := imaging.GetConfig(uploadDir)
+	if err != nil {
+		log.Fatal("Invalid image transformation configuration:", err)
+	}
+	staticHandler := handlers.NewStaticHandler(fileModel, orgModel, auditModel, imaging.NewTransformer(imagingConfig))
+	apiKeyHandler := handlers.NewAPIKeyHandler(apiKeyModel)
+	adminHandler := handlers.NewAdminHandler(userModel, fileModel, auditModel)
+	auditHandler := handlers.NewAuditHandler(auditModel)
+	accountHandler := handlers.NewAccountHandler(userModel, fileModel, authenticator)
+	orgHandler := handlers.NewOrganizationHandler(orgModel, userModel, fileModel)
+	fileHandler := handlers.NewFileHandler(fileModel, orgModel, auditModel)
+	versionHandler := handlers.NewVersionHandler(fileModel, orgModel, auditModel)
+	introspectionHandler := handlers.NewIntrospectionHandler(userModel, apiKeyModel, oauthClientModel)
+	oauthHandler := handlers.NewOAuthHandler(oauthClientModel, userModel, authenticator, auditModel)
+	webAuthnHandler := handlers.NewWebAuthnHandler(utils.GetWebAuthnConfig(), userModel, webAuthnCredentialModel, auditModel)
+
+	// Allow AuthMiddleware to accept API keys
+	middleware.SetAPIKeyModel(apiKeyModel)
+	middleware.SetUserModel(userModel)
+	middleware.SetOAuthClientModel(oauthClientModel)
+
+	// Carry out account deletions once their grace period has passed
+	sweepMinutes, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_SWEEP_MINUTES"))
+	if err != nil || sweepMinutes <= 0 {
+		sweepMinutes = 60 // Default hourly
+	}
+	jobs.StartAccountDeletionSweeper(userModel, time.Duration(sweepMinutes)*time.Minute)
+
+	// Delete expired files
+	expirySweepMinutes, err := strconv.Atoi(os.Getenv("FILE_EXPIRY_SWEEP_MINUTES"))
+	if err != nil || expirySweepMinutes <= 0 {
+		expirySweepMinutes = 60 // Default hourly
+	}
+	jobs.StartFileExpirySweeper(fileModel, time.Duration(expirySweepMinutes)*time.Minute)
+
+	// Endpoints that start a login without authentication store state per request
+	loginRateLimit, err := strconv.Atoi(os.Getenv("LOGIN_RATE_LIMIT_PER_MINUTE"))
+	if err != nil || loginRateLimit <= 0 {
+		loginRateLimit = 20 // Default 20 per client and minute
+	}
+	loginLimiter := middleware.NewRateLimiter(loginRateLimit)
 
 	// Setup routes
 	r := mux.NewRouter()
 
 	apiV1Router := r.PathPrefix("/api/v1").Subrouter()
 
+	// Files are addressed by public ID, or by legacy integer ID while LEGACY_FILE_IDS allows it.
+	// Public links take public IDs only.
+	fileRef := "{fileId:[0-9]+|[0-9a-f-]{36}}"
+	publicFileRef := "{fileId:[0-9a-f-]{36}}"
+
 	// Static file routes
-	r.HandleFunc("/files/{fileId:[0-9]+}", middleware.AuthMiddleware(staticHandler.ServeFile)).Methods("GET")
-	r.HandleFunc("/public/files/{fileId:[0-9]+}", staticHandler.ServePublicFile).Methods("GET")
+	r.HandleFunc("/files/"+fileRef, middleware.Protect(staticHandler.ServeFile, utils.ScopeFilesRead)).Methods("GET")
+	r.HandleFunc("/files/"+fileRef+"/versions/{version:[0-9]+}", middleware.Protect(staticHandler.ServeVersion, utils.ScopeFilesRead)).Methods("GET")
+	r.HandleFunc("/public/files/"+publicFileRef, staticHandler.ServePublicFile).Methods("GET")
+	r.HandleFunc("/public/files/"+publicFileRef+"/{contentHash:[0-9a-f]{64}}", staticHandler.ServePublicContent).Methods("GET")
+
+	// IIIF Image API routes, with the same access rules as /files
+	iiifRouter := r.PathPrefix("/iiif/" + fileRef).Subrouter()
+	iiifRouter.HandleFunc("", middleware.AllowCrossOrigin(middleware.Protect(staticHandler.IIIFBase, utils.ScopeFilesRead))).Methods("GET", "OPTIONS")
+	iiifRouter.HandleFunc("/info.json", middleware.AllowCrossOrigin(middleware.Protect(staticHandler.IIIFInfo, utils.ScopeFilesRead))).Methods("GET", "OPTIONS")
+	iiifRouter.HandleFunc("/{region}/{size}/{rotation}/{quality}.{format}", middleware.AllowCrossOrigin(middleware.Protect(staticHandler.IIIFImage, utils.ScopeFilesRead))).Methods("GET", "OPTIONS")
+
+	// Routes state the scopes they require. Routes without scopes only read the caller's own
+	// account or narrow their own credentials. Changes to credentials and identities need the
+	// account scope, which only tokens from an interactive login carry.
 
 	// Auth routes
 	apiV1Router.HandleFunc("/register", authHandler.Register).Methods("POST")
 	apiV1Router.HandleFunc("/login", authHandler.Login).Methods("POST")
-	apiV1Router.HandleFunc("/revoke", middleware.AuthMiddleware(authHandler.Revoke)).Methods("POST")
+	apiV1Router.HandleFunc("/revoke", middleware.Protect(authHandler.Revoke)).Methods("POST")
+	apiV1Router.HandleFunc("/tokens", middleware.Protect(authHandler.MintToken)).Methods("POST")
+	apiV1Router.HandleFunc("/introspect", introspectionHandler.Introspect).Methods("POST")
+	apiV1Router.HandleFunc("/me", middleware.Protect(accountHandler.Me)).Methods("GET")
+	apiV1Router.HandleFunc("/me", middleware.Protect(middleware.BlockImpersonation(accountHandler.Delete), utils.ScopeAccount, utils.ScopeFilesDelete)).Methods("DELETE")
+	apiV1Router.HandleFunc("/me/export", middleware.Protect(accountHandler.Export, utils.ScopeFilesRead)).Methods("GET")
+	apiV1Router.HandleFunc("/me/password", middleware.Protect(middleware.BlockImpersonation(authHandler.ChangePassword), utils.ScopeAccount)).Methods("PUT")
+
+	// Email verification routes
+	apiV1Router.HandleFunc("/email/verify", emailHandler.Verify).Methods("GET", "POST")
+	apiV1Router.HandleFunc("/email/resend", middleware.Protect(emailHandler.Resend, utils.ScopeAccount)).Methods("POST")
+	apiV1Router.HandleFunc("/me/email", middleware.Protect(middleware.BlockImpersonation(emailHandler.ChangeEmail), utils.ScopeAccount)).Methods("PUT")
+
+	// OpenID Connect routes, only when an identity provider is configured
+	if oidcConfig, ok := utils.GetOIDCConfig(); ok {
+		oidcHandler := handlers.NewOIDCHandler(oidcConfig, userModel, identityModel, auditModel)
+		apiV1Router.HandleFunc("/oidc/login", loginLimiter.Limit(oidcHandler.Login)).Methods("GET")
+		apiV1Router.HandleFunc("/oidc/callback", oidcHandler.Callback).Methods("GET")
+		apiV1Router.HandleFunc("/oidc/link", middleware.Protect(middleware.BlockImpersonation(oidcHandler.Link), utils.ScopeAccount)).Methods("POST")
+		log.Printf("OpenID Connect login enabled for issuer %s", oidcConfig.IssuerURL)
+	}
+
+	// Passkey routes
+	apiV1Router.HandleFunc("/webauthn/register/begin", middleware.Protect(middleware.BlockImpersonation(webAuthnHandler.BeginRegistration), utils.ScopeAccount)).Methods("POST")
+	apiV1Router.HandleFunc("/webauthn/register/finish", middleware.Protect(middleware.BlockImpersonation(webAuthnHandler.FinishRegistration), utils.ScopeAccount)).Methods("POST")
+	apiV1Router.HandleFunc("/webauthn/login/begin", loginLimiter.Limit(webAuthnHandler.BeginLogin)).Methods("POST")
+	apiV1Router.HandleFunc("/webauthn/login/finish", webAuthnHandler.FinishLogin).Methods("POST")
+	apiV1Router.HandleFunc("/webauthn/passkeys", middleware.Protect(webAuthnHandler.ListCredentials)).Methods("GET")
+	apiV1Router.HandleFunc("/webauthn/passkeys/{passkeyId:[0-9]+}", middleware.Protect(middleware.BlockImpersonation(webAuthnHandler.DeleteCredential), utils.ScopeAccount)).Methods("DELETE")
 
-	// Upload routes
-	apiV1Router.HandleFunc("/upload", middleware.AuthMiddleware(uploadHandler.Upload)).Methods("POST")
+	// API key routes
+	apiV1Router.HandleFunc("/api-keys", middleware.Protect(middleware.BlockImpersonation(middleware.RequireVerifiedEmail(apiKeyHandler.Create, middleware.ActionAPIKeys)), utils.ScopeAccount)).Methods("POST")
+	apiV1Router.HandleFunc("/api-keys", middleware.Protect(apiKeyHandler.List)).Methods("GET")
+	apiV1Router.HandleFunc("/api-keys/{keyId:[0-9]+}", middleware.Protect(apiKeyHandler.Revoke, utils.ScopeAccount)).Methods("DELETE")
+
+	// OAuth 2.0 authorization server routes
+	apiV1Router.HandleFunc("/oauth/clients", middleware.Protect(middleware.BlockImpersonation(oauthHandler.RegisterClient), utils.ScopeAccount)).Methods("POST")
+	apiV1Router.HandleFunc("/oauth/clients", middleware.Protect(oauthHandler.ListClients)).Methods("GET")
+	apiV1Router.HandleFunc("/oauth/clients/{clientId}", middleware.Protect(middleware.BlockImpersonation(oauthHandler.RevokeClient), utils.ScopeAccount)).Methods("DELETE")
+	apiV1Router.HandleFunc("/oauth/authorize", oauthHandler.Authorize).Methods("GET")
+	apiV1Router.HandleFunc("/oauth/authorize", loginLimiter.Limit(oauthHandler.Consent)).Methods("POST")
+	apiV1Router.HandleFunc("/oauth/token", oauthHandler.Token).Methods("POST")
+
+	// Organization routes
+	apiV1Router.HandleFunc("/orgs", middleware.Protect(orgHandler.Create, utils.ScopeOrgsManage)).Methods("POST")
+	apiV1Router.HandleFunc("/orgs", middleware.Protect(orgHandler.List)).Methods("GET")
+	apiV1Router.HandleFunc("/orgs/{orgId:[0-9]+}", middleware.Protect(orgHandler.Get)).Methods("GET")
+	apiV1Router.HandleFunc("/orgs/{orgId:[0-9]+}", middleware.Protect(orgHandler.Delete, utils.ScopeOrgsManage)).Methods("DELETE")
+	apiV1Router.HandleFunc("/orgs/{orgId:[0-9]+}/files", middleware.Protect(orgHandler.ListFiles, utils.ScopeFilesRead)).Methods("GET")
+	apiV1Router.HandleFunc("/orgs/{orgId:[0-9]+}/invitations", middleware.Protect(orgHandler.Invite, utils.ScopeOrgsManage)).Methods("POST")
+	apiV1Router.HandleFunc("/orgs/{orgId:[0-9]+}/members/{userId:[0-9]+}", middleware.Protect(orgHandler.SetMemberRole, utils.ScopeOrgsManage)).Methods("PUT")
+	apiV1Router.HandleFunc("/orgs/{orgId:[0-9]+}/members/{userId:[0-9]+}", middleware.Protect(orgHandler.RemoveMember, utils.ScopeOrgsManage)).Methods("DELETE")
+	apiV1Router.HandleFunc("/me/invitations", middleware.Protect(orgHandler.ListInvitations)).Methods("GET")
+	apiV1Router.HandleFunc("/me/invitations/{invitationId:[0-9]+}/accept", middleware.Protect(orgHandler.AcceptInvitation, utils.ScopeOrgsManage)).Methods("POST")
+	apiV1Router.HandleFunc("/me/invitations/{invitationId:[0-9]+}", middleware.Protect(orgHandler.DeclineInvitation, utils.ScopeOrgsManage)).Methods("DELETE")
+
+	// Admin routes
+	apiV1Router.HandleFunc("/admin/users", middleware.Protect(adminHandler.ListUsers, utils.ScopeAdmin)).Methods("GET")
+	apiV1Router.HandleFunc("/admin/users/{userId:[0-9]+}", middleware.Protect(adminHandler.GetUser, utils.ScopeAdmin)).Methods("GET")
+	apiV1Router.HandleFunc("/admin/users/{userId:[0-9]+}", middleware.Protect(adminHandler.DeleteUser, utils.ScopeAdmin)).Methods("DELETE")
+	apiV1Router.HandleFunc("/admin/users/{userId:[0-9]+}/files", middleware.Protect(adminHandler.ListUserFiles, utils.ScopeAdmin)).Methods("GET")
+	apiV1Router.HandleFunc("/admin/users/{userId:[0-9]+}/disable", middleware.Protect(adminHandler.DisableUser, utils.ScopeAdmin)).Methods("POST")
+	apiV1Router.HandleFunc("/admin/users/{userId:[0-9]+}/enable", middleware.Protect(adminHandler.EnableUser, utils.ScopeAdmin)).Methods("POST")
+	apiV1Router.HandleFunc("/admin/users/{userId:[0-9]+}/password-reset", middleware.Protect(adminHandler.ForcePasswordReset, utils.ScopeAdmin)).Methods("POST")
+	apiV1Router.HandleFunc("/admin/users/{userId:[0-9]+}/impersonate", middleware.Protect(adminHandler.Impersonate, utils.ScopeAdmin)).Methods("POST")
+	apiV1Router.HandleFunc("/admin/users/{userId:[0-9]+}/role", middleware.Protect(adminHandler.SetRole, utils.ScopeAdmin)).Methods("PUT")
+	apiV1Router.HandleFunc("/admin/users/{userId:[0-9]+}/retention", middleware.Protect(adminHandler.SetFileRetention, utils.ScopeAdmin)).Methods("PUT")
+
+	apiV1Router.HandleFunc("/admin/orgs/{orgId:[0-9]+}/quota", middleware.Protect(orgHandler.SetQuota, utils.ScopeAdmin)).Methods("PUT")
+
+	apiV1Router.HandleFunc("/admin/reconcile", middleware.Protect(adminHandler.Reconcile, utils.ScopeAdmin)).Methods("POST")
+	apiV1Router.HandleFunc("/admin/audit", middleware.Protect(auditHandler.Query, utils.ScopeAdmin)).Methods("GET")
+	apiV1Router.HandleFunc("/admin/audit/export", middleware.Protect(auditHandler.Export, utils.ScopeAdmin)).Methods("GET")
+
+	// File routes
+	apiV1Router.HandleFunc("/files", middleware.Protect(fileHandler.List, utils.ScopeFilesRead)).Methods("GET")
+	apiV1Router.HandleFunc("/files/"+fileRef, middleware.Protect(fileHandler.Update, utils.ScopeFilesWrite)).Methods("PATCH")
+	apiV1Router.HandleFunc("/files/"+fileRef+"/content", middleware.Protect(middleware.RequireVerifiedEmail(versionHandler.ReplaceContent, middleware.ActionUpload), utils.ScopeFilesWrite)).Methods("PUT")
+	apiV1Router.HandleFunc("/files/"+fileRef+"/versions", middleware.Protect(versionHandler.ListVersions, utils.ScopeFilesRead)).Methods("GET")
+	apiV1Router.HandleFunc("/files/"+fileRef+"/versions/{version:[0-9]+}/restore", middleware.Protect(versionHandler.RestoreVersion, utils.ScopeFilesWrite)).Methods("POST")
+	apiV1Router.HandleFunc("/files/archive", middleware.Protect(fileHandler.Archive, utils.ScopeFilesRead)).Methods("POST")
+	apiV1Router.HandleFunc("/upload", middleware.Protect(middleware.RequireVerifiedEmail(uploadHandler.Upload, middleware.ActionUpload), utils.ScopeFilesWrite)).Methods("POST")
 	// Simple HTML form for testing (as requested - not pretty)
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		html := `
@@ -166,3 +375,23 @@ func main() {
 	log.Printf("Server starting on port %s", port)
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
+
+// runReconcile runs the reconcile subcommand and prints the report as JSON:
+//
+//	app reconcile [-mode report|quarantine|clean]
+func runReconcile(fileModel *models.FileModel, uploadDir string, args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	mode := flags.String("mode", jobs.ReconcileModeReport, "report, quarantine or clean")
+	flags.Parse(args)
+	if !jobs.IsValidReconcileMode(*mode) {
+		log.Fatalf("Invalid mode %q, use report, quarantine or clean", *mode)
+	}
+
+	report, err := jobs.Reconcile(fileModel, uploadDir, *mode)
+	if err != nil {
+		log.Fatal("Reconciliation failed:", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
@@ -2,16 +2,48 @@ package middleware
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"log"
 	"net/http"
 	"strings"
 
+	"file-uploader/models"
 	"file-uploader/utils"
 )
 
+// Authentication methods stored in the request context under "auth_method"
+const (
+	AuthMethodJWT    = "jwt"
+	AuthMethodAPIKey = "api_key"
+)
+
+// apiKeyModel is used to authenticate requests presenting an API key
+var apiKeyModel *models.APIKeyModel
+
+// SetAPIKeyModel enables API key authentication in AuthMiddleware
+func SetAPIKeyModel(m *models.APIKeyModel) {
+	apiKeyModel = m
+}
+
+// userModel is used to look up the authenticated user's current state
+var userModel *models.UserModel
+
+// SetUserModel enables account status checks in AuthMiddleware and
+// checks that need the authenticated user's database record
+func SetUserModel(m *models.UserModel) {
+	userModel = m
+}
+
 // AuthMiddleware validates JWT tokens and checks for revocation
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// API keys take precedence when explicitly presented
+		if rawKey := getAPIKey(r); rawKey != "" {
+			authenticateAPIKey(w, r, rawKey, next)
+			return
+		}
+
 		// Get token from Authorization header or form data
 		var tokenString string
 
@@ -51,8 +83,173 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
 		ctx = context.WithValue(ctx, "username", claims.Username)
 		ctx = context.WithValue(ctx, "token", tokenString)
+		ctx = context.WithValue(ctx, "claims", claims)
+		ctx = context.WithValue(ctx, "scopes", claims.GrantedScopes())
+		ctx = context.WithValue(ctx, "auth_method", AuthMethodJWT)
+
+		// Tokens issued to OAuth clients die with the client
+		if claims.ClientID != "" {
+			if oauthClientModel != nil {
+				if _, err := oauthClientModel.GetActive(claims.ClientID); err != nil {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusUnauthorized)
+					json.NewEncoder(w).Encode(map[string]string{"error": "OAuth client is no longer authorized"})
+					return
+				}
+			}
+			ctx = context.WithValue(ctx, "client_id", claims.ClientID)
+		}
+
+		// Tokens minted from an API key die with the key
+		if claims.APIKeyID != 0 && apiKeyModel != nil {
+			key, err := apiKeyModel.GetByID(claims.APIKeyID)
+			if err != nil || !key.IsUsable() {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "API key the token was minted from is no longer valid"})
+				return
+			}
+			ctx = context.WithValue(ctx, "api_key_id", claims.APIKeyID)
+		}
+
+		// Flag every request made by an administrator acting as another user
+		if claims.IsImpersonation() {
+			ctx = context.WithValue(ctx, "impersonator", claims.Actor)
+			log.Printf("Impersonated request: admin %s (%d) acting as %s (%d): %s %s",
+				claims.Actor.Username, claims.Actor.UserID, claims.Username, claims.UserID, r.Method, r.URL.Path)
+		}
 
 		// Call next handler with updated context
-		next.ServeHTTP(w, r.WithContext(ctx))
+		serveActiveAccount(w, r.WithContext(ctx), next)
+	}
+}
+
+// serveActiveAccount calls next only if the authenticated account may still be used.
+// Tokens and keys outlive changes made to the account, so disabled, deleted,
+// deletion-pending and reset-pending accounts are rejected here, and the admin scope is
+// dropped once the user no longer has the admin role.
+func serveActiveAccount(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if userModel == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(int)
+	user, err := userModel.GetByID(userID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Account no longer exists"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		return
+	}
+
+	if user.IsDisabled() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Account is disabled",
+			"code":  "account_disabled",
+		})
+		return
+	}
+
+	if user.IsPendingDeletion() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Account is scheduled for deletion, log in again to cancel",
+			"code":  "account_pending_deletion",
+		})
+		return
+	}
+
+	if user.PasswordResetRequired {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Password reset required, log in again with a new password",
+			"code":  "password_reset_required",
+		})
+		return
+	}
+
+	// Impersonation ends as soon as the acting administrator loses access
+	if actor, ok := r.Context().Value("impersonator").(*utils.ActorClaim); ok {
+		admin, err := userModel.GetByID(actor.UserID)
+		if err != nil || admin.Role != models.RoleAdmin || admin.IsDisabled() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Impersonation is no longer permitted"})
+			return
+		}
+	}
+
+	ctx := r.Context()
+	if user.Role != models.RoleAdmin {
+		scopes, _ := ctx.Value("scopes").([]string)
+		if utils.HasScope(scopes, utils.ScopeAdmin) {
+			ctx = context.WithValue(ctx, "scopes", utils.RemoveScope(scopes, utils.ScopeAdmin))
+		}
+	}
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// getAPIKey extracts an API key from the X-API-Key or "Authorization: ApiKey" headers
+func getAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return strings.TrimSpace(key)
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "ApiKey ") {
+		return strings.TrimSpace(strings.TrimPrefix(authHeader, "ApiKey "))
+	}
+	return ""
+}
+
+// authenticateAPIKey validates an API key and calls next with the key owner in context
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, rawKey string, next http.HandlerFunc) {
+	if apiKeyModel == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "API key authentication is not enabled"})
+		return
 	}
+
+	key, err := apiKeyModel.Authenticate(rawKey)
+	if err != nil {
+		message := "Invalid API key"
+		switch err {
+		case models.ErrAPIKeyExpired:
+			message = "API key has expired"
+		case models.ErrAPIKeyRevoked:
+			message = "API key has been revoked"
+		case models.ErrAPIKeyNotFound:
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+		return
+	}
+
+	// Add key owner info to request context
+	ctx := context.WithValue(r.Context(), "user_id", key.UserID)
+	ctx = context.WithValue(ctx, "username", key.Username)
+	ctx = context.WithValue(ctx, "scopes", key.Scopes)
+	ctx = context.WithValue(ctx, "api_key_id", key.ID)
+	ctx = context.WithValue(ctx, "api_key", key)
+	ctx = context.WithValue(ctx, "auth_method", AuthMethodAPIKey)
+
+	serveActiveAccount(w, r.WithContext(ctx), next)
 }
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"file-uploader/models"
+	"file-uploader/utils"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// authTest holds a user with an API key, enabled in AuthMiddleware for one test
+type authTest struct {
+	keys   *models.APIKeyModel
+	user   *models.User
+	key    *models.APIKey
+	rawKey string
+}
+
+func newAuthTest(t *testing.T) *authTest {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	users, keys := models.NewUserModel(db), models.NewAPIKeyModel(db)
+	for _, create := range []func() error{users.CreateTable, keys.CreateTable} {
+		if err := create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	user, err := users.CreateExternal("alice", models.AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, rawKey, err := keys.Create(user.ID, "ci", []string{utils.ScopeFilesRead}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetAPIKeyModel(keys)
+	SetUserModel(users)
+	t.Cleanup(func() {
+		SetAPIKeyModel(nil)
+		SetUserModel(nil)
+	})
+	return &authTest{keys: keys, user: user, key: key, rawKey: rawKey}
+}
+
+// authenticate runs a request with the header through AuthMiddleware and returns
+// the status and the scopes the handler saw
+func authenticate(header, value string) (int, []string) {
+	var scopes []string
+	handler := AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		scopes, _ = r.Context().Value("scopes").([]string)
+	})
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/files", nil)
+	r.Header.Set(header, value)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code, scopes
+}
+
+func TestAPIKeysAreAcceptedInBothHeaders(t *testing.T) {
+	a := newAuthTest(t)
+
+	for _, tt := range []struct {
+		header, value string
+		status        int
+	}{
+		{"X-API-Key", a.rawKey, http.StatusOK},
+		{"Authorization", "ApiKey " + a.rawKey, http.StatusOK},
+		{"X-API-Key", models.APIKeyPrefix + "unknown", http.StatusUnauthorized},
+		// API keys are not JWTs
+		{"Authorization", "Bearer " + a.rawKey, http.StatusUnauthorized},
+	} {
+		code, scopes := authenticate(tt.header, tt.value)
+		if code != tt.status {
+			t.Errorf("%s: %.20s... status = %d, want %d", tt.header, tt.value, code, tt.status)
+		}
+		if code == http.StatusOK && !reflect.DeepEqual(scopes, a.key.Scopes) {
+			t.Errorf("%s: scopes = %v, want the key's %v", tt.header, scopes, a.key.Scopes)
+		}
+	}
+}
+
+func TestRevokedAPIKeysAreRejected(t *testing.T) {
+	a := newAuthTest(t)
+	parent := &utils.Claims{UserID: a.user.ID, Username: a.user.Username, Scopes: a.key.Scopes, APIKeyID: a.key.ID}
+	minted, _, err := utils.GenerateScopedToken(parent, a.key.Scopes, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := authenticate("Authorization", "Bearer "+minted); code != http.StatusOK {
+		t.Fatalf("token minted from the key: status = %d", code)
+	}
+
+	if err := a.keys.Revoke(a.key.ID, a.user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := authenticate("X-API-Key", a.rawKey); code != http.StatusUnauthorized {
+		t.Errorf("revoked key: status = %d, want 401", code)
+	}
+	// Tokens minted from the key die with it
+	if code, _ := authenticate("Authorization", "Bearer "+minted); code != http.StatusUnauthorized {
+		t.Errorf("token minted from the revoked key: status = %d, want 401", code)
+	}
+}
+
+func TestLegacyTokensGetDefaultScopes(t *testing.T) {
+	a := newAuthTest(t)
+	token, err := utils.SignClaims(&utils.Claims{UserID: a.user.ID, Username: a.user.Username})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, scopes := authenticate("Authorization", "Bearer "+token)
+	if code != http.StatusOK || !reflect.DeepEqual(scopes, utils.DefaultUserScopes()) {
+		t.Errorf("token without scopes: status %d, scopes %v, want the default user scopes %v", code, scopes, utils.DefaultUserScopes())
+	}
+}
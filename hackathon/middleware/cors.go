@@ -0,0 +1,23 @@
+package middleware
+
+import "net/http"
+
+// AllowCrossOrigin lets pages on any origin call a read-only route with a bearer token
+// or API key, as IIIF viewers embedded in partner sites do. Credentials are never sent
+// by browsers with a wildcard origin, so access is still decided by the token or key.
+// Preflight requests are answered directly, before authentication.
+func AllowCrossOrigin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Link, Content-Disposition")
+
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, X-API-Key, If-None-Match, If-Modified-Since, Range")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
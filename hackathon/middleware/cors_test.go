@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAllowCrossOriginPreflightAllowsAPIKeys(t *testing.T) {
+	called := false
+	handler := AllowCrossOrigin(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	r := httptest.NewRequest(http.MethodOptions, "/iiif/abc/info.json", nil)
+	r.Header.Set("Origin", "https://viewer.example.org")
+	r.Header.Set("Access-Control-Request-Headers", "x-api-key")
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if w.Code != http.StatusNoContent || called {
+		t.Fatalf("preflight status = %d, reached handler %t, want 204 before the handler", w.Code, called)
+	}
+	allowed := strings.Split(w.Header().Get("Access-Control-Allow-Headers"), ", ")
+	for _, header := range []string{"Authorization", "X-API-Key"} {
+		found := false
+		for _, name := range allowed {
+			found = found || strings.EqualFold(name, header)
+		}
+		if !found {
+			t.Errorf("Access-Control-Allow-Headers %v does not include %s", allowed, header)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"file-uploader/utils"
+)
+
+// IsImpersonating reports whether the request was made with an impersonation token
+func IsImpersonating(r *http.Request) bool {
+	_, ok := r.Context().Value("impersonator").(*utils.ActorClaim)
+	return ok
+}
+
+// BlockImpersonation rejects requests made with an impersonation token or by an
+// OAuth client. It protects actions that only the account owner may take, such as
+// changing the password or deleting the account. It must run after AuthMiddleware.
+func BlockImpersonation(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if OAuthClientID(r) != "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "This action is not available to third-party applications",
+				"code":  "oauth_client_forbidden",
+			})
+			return
+		}
+		if IsImpersonating(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "This action is not allowed while impersonating a user",
+				"code":  "impersonation_forbidden",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"net/http"
+
+	"file-uploader/models"
+)
+
+// oauthClientModel is used to reject tokens of revoked OAuth clients
+var oauthClientModel *models.OAuthClientModel
+
+// SetOAuthClientModel enables client revocation checks in AuthMiddleware
+func SetOAuthClientModel(m *models.OAuthClientModel) {
+	oauthClientModel = m
+}
+
+// OAuthClientID returns the OAuth client the request was made by, or "" for first-party requests
+func OAuthClientID(r *http.Request) string {
+	clientID, _ := r.Context().Value("client_id").(string)
+	return clientID
+}
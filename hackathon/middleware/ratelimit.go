@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitWindow is the period a client's requests are counted over
+const rateLimitWindow = time.Minute
+
+// maxRateLimitClients bounds the clients tracked at once. Requests from further
+// clients are refused until the next cleanup, so memory stays bounded.
+const maxRateLimitClients = 100000
+
+// rateWindow counts a client's requests in the current window
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// RateLimiter allows each client a number of requests per minute. Clients are told
+// apart by the address of the connection, not by forwarding headers, which clients
+// could set to anything.
+type RateLimiter struct {
+	perMinute int
+	mutex     sync.Mutex
+	windows   map[string]*rateWindow
+}
+
+// NewRateLimiter creates a RateLimiter and starts removing finished windows in the background
+func NewRateLimiter(perMinute int) *RateLimiter {
+	l := &RateLimiter{
+		perMinute: perMinute,
+		windows:   make(map[string]*rateWindow),
+	}
+	go func() {
+		ticker := time.NewTicker(rateLimitWindow)
+		defer ticker.Stop()
+		for range ticker.C {
+			l.cleanup()
+		}
+	}()
+	return l
+}
+
+// Allow counts a request of the client and reports whether it is within the limit
+func (l *RateLimiter) Allow(client string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	window, exists := l.windows[client]
+	if !exists {
+		if len(l.windows) >= maxRateLimitClients {
+			return false
+		}
+		window = &rateWindow{start: now}
+		l.windows[client] = window
+	}
+	if now.Sub(window.start) >= rateLimitWindow {
+		window.start, window.count = now, 0
+	}
+	window.count++
+	return window.count <= l.perMinute
+}
+
+// cleanup removes the windows that have ended
+func (l *RateLimiter) cleanup() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	for client, window := range l.windows {
+		if now.Sub(window.start) >= rateLimitWindow {
+			delete(l.windows, client)
+		}
+	}
+}
+
+// Limit rejects requests beyond the limiter's rate with 429 Too Many Requests
+func (l *RateLimiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+
+		if !l.Allow(client) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(int(rateLimitWindow.Seconds())))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Too many requests, try again later",
+				"code":  "rate_limited",
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimiterLimitsEachClient(t *testing.T) {
+	limiter := NewRateLimiter(2)
+	handler := limiter.Limit(func(w http.ResponseWriter, r *http.Request) {})
+
+	request := func(remoteAddr, forwardedFor string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/oidc/login", nil)
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := request("192.0.2.1:1000", ""); code != http.StatusOK {
+			t.Fatalf("request %d status = %d, want 200", i, code)
+		}
+	}
+	// Another port or a forged forwarding header is still the same client
+	if code := request("192.0.2.1:2000", "198.51.100.9"); code != http.StatusTooManyRequests {
+		t.Errorf("third request status = %d, want 429", code)
+	}
+	if code := request("192.0.2.2:1000", ""); code != http.StatusOK {
+		t.Errorf("other client status = %d, want 200", code)
+	}
+
+	// A new window starts once the old one has ended
+	limiter.windows["192.0.2.1"].start = limiter.windows["192.0.2.1"].start.Add(-rateLimitWindow)
+	if code := request("192.0.2.1:1000", ""); code != http.StatusOK {
+		t.Errorf("request in a new window status = %d, want 200", code)
+	}
+}
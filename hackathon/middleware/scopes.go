@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"file-uploader/utils"
+)
+
+// InsufficientScopeResponse is returned when a request lacks required scopes
+type InsufficientScopeResponse struct {
+	Error          string   `json:"error"`
+	Code           string   `json:"code"`
+	RequiredScopes []string `json:"required_scopes"`
+	GrantedScopes  []string `json:"granted_scopes"`
+}
+
+// RequireScopes rejects requests whose credentials do not carry every listed scope.
+// It must run after AuthMiddleware, which places the granted scopes in the context.
+func RequireScopes(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		granted, _ := r.Context().Value("scopes").([]string)
+
+		if !utils.IsSubset(scopes, granted) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+utils.JoinScopes(scopes)+`"`)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(InsufficientScopeResponse{
+				Error:          "Insufficient scope",
+				Code:           "insufficient_scope",
+				RequiredScopes: scopes,
+				GrantedScopes:  granted,
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// Protect wraps a handler with authentication and the scopes it requires
+func Protect(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return AuthMiddleware(RequireScopes(next, scopes...))
+}
@@ -0,0 +1,251 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"file-uploader/utils"
+)
+
+// APIKeyPrefix is prepended to every generated API key so they are easy to recognize
+const APIKeyPrefix = "fu_"
+
+var (
+	// ErrAPIKeyNotFound is returned when no key matches the presented secret
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	// ErrAPIKeyExpired is returned when the key is past its expiry date
+	ErrAPIKeyExpired = errors.New("api key has expired")
+	// ErrAPIKeyRevoked is returned when the key has been revoked
+	ErrAPIKeyRevoked = errors.New("api key has been revoked")
+)
+
+// APIKey represents a personal API key owned by a user
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Username   string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"` // Never exposed, the raw key is shown once on creation
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// APIKeyModel handles API key database operations
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// NewAPIKeyModel creates a new APIKeyModel
+func NewAPIKeyModel(db *sql.DB) *APIKeyModel {
+	return &APIKeyModel{DB: db}
+}
+
+// CreateTable creates the api_keys table if it doesn't exist
+func (m *APIKeyModel) CreateTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT UNIQUE NOT NULL,
+		scopes TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME,
+		last_used_at DATETIME,
+		revoked_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	)`
+	_, err := m.DB.Exec(query)
+	return err
+}
+
+// HashAPIKey returns the digest stored for a raw API key
+func HashAPIKey(rawKey string) string {
+	return utils.HashToken(rawKey)
+}
+
+// generateRawAPIKey creates a new random API key
+func generateRawAPIKey() (string, error) {
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + token, nil
+}
+
+// Create generates a new API key for a user and returns it together with the raw key
+func (m *APIKeyModel) Create(userID int, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error) {
+	rawKey, err := generateRawAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var expires interface{}
+	if expiresAt != nil {
+		expires = expiresAt.UTC()
+	}
+
+	query := `
+	INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := m.DB.Exec(query,
+		userID,
+		name,
+		rawKey[:len(APIKeyPrefix)+8],
+		HashAPIKey(rawKey),
+		utils.JoinScopes(scopes),
+		expires,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, err := m.GetByID(int(id))
+	if err != nil {
+		return nil, "", err
+	}
+	return key, rawKey, nil
+}
+
+const apiKeyColumns = `k.id, k.user_id, u.username, k.name, k.prefix, k.key_hash, k.scopes,
+	k.expires_at, k.last_used_at, k.revoked_at, k.created_at`
+
+// scanAPIKey scans a row selected with apiKeyColumns
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	key := &APIKey{}
+	var scopes string
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Username,
+		&key.Name,
+		&key.Prefix,
+		&key.KeyHash,
+		&scopes,
+		&expiresAt,
+		&lastUsedAt,
+		&revokedAt,
+		&key.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Scopes = utils.ParseScopes(scopes)
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
+
+// IsUsable reports whether the key is neither revoked nor expired
+func (k *APIKey) IsUsable() bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || k.ExpiresAt.After(time.Now()))
+}
+
+// GetByID retrieves an API key by ID
+func (m *APIKeyModel) GetByID(id int) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + `
+	FROM api_keys k JOIN users u ON u.id = k.user_id
+	WHERE k.id = ?`
+	return scanAPIKey(m.DB.QueryRow(query, id))
+}
+
+// ListByUser retrieves all API keys belonging to a user, newest first
+func (m *APIKeyModel) ListByUser(userID int) ([]*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + `
+	FROM api_keys k JOIN users u ON u.id = k.user_id
+	WHERE k.user_id = ?
+	ORDER BY k.id DESC`
+
+	rows, err := m.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Lookup looks up a raw API key and checks that it is usable without recording its use
+func (m *APIKeyModel) Lookup(rawKey string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + `
+	FROM api_keys k JOIN users u ON u.id = k.user_id
+	WHERE k.key_hash = ?`
+
+	key, err := scanAPIKey(m.DB.QueryRow(query, HashAPIKey(rawKey)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+
+	if key.RevokedAt != nil {
+		return nil, ErrAPIKeyRevoked
+	}
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+		return nil, ErrAPIKeyExpired
+	}
+	return key, nil
+}
+
+// Authenticate looks up a raw API key, checks that it is usable and records its use
+func (m *APIKeyModel) Authenticate(rawKey string) (*APIKey, error) {
+	key, err := m.Lookup(rawKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Track last usage, failing to do so should not block the request
+	now := time.Now().UTC()
+	if _, err := m.DB.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, now, key.ID); err == nil {
+		key.LastUsedAt = &now
+	}
+
+	return key, nil
+}
+
+// Revoke marks an API key owned by the user as revoked
+func (m *APIKeyModel) Revoke(id, userID int) error {
+	query := `UPDATE api_keys SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL`
+	result, err := m.DB.Exec(query, time.Now().UTC(), id, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Audit event outcomes
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+	AuditOutcomeDenied  = "denied"
+)
+
+// AuditEvent is a single entry of the audit log
+type AuditEvent struct {
+	ID            int    `json:"id"`
+	ActorID       *int   `json:"actor_id,omitempty"` // Unset for anonymous requests
+	ActorUsername string `json:"actor_username,omitempty"`
+	// ImpersonatorID is the administrator who acted as ActorID, if any
+	ImpersonatorID *int      `json:"impersonator_id,omitempty"`
+	Action         string    `json:"action"`
+	TargetType     string    `json:"target_type,omitempty"`
+	TargetID       string    `json:"target_id,omitempty"`
+	IP             string    `json:"ip"`
+	UserAgent      string    `json:"user_agent"`
+	Outcome        string    `json:"outcome"`
+	Detail         string    `json:"detail,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// AuditFilter narrows down audit log queries. Zero fields match everything.
+type AuditFilter struct {
+	ActorID int
+	Action  string // Exact action, or a prefix ending in "." such as "auth."
+	Since   time.Time
+	Until   time.Time
+	Limit   int // 0 means no limit
+	Offset  int
+}
+
+// AuditModel handles audit log database operations.
+// The log is append-only, there are no methods to change or remove events.
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// NewAuditModel creates a new AuditModel
+func NewAuditModel(db *sql.DB) *AuditModel {
+	return &AuditModel{DB: db}
+}
+
+// CreateTable creates the audit_log table if it doesn't exist.
+// Triggers reject updates and deletes so events cannot be altered through SQL either.
+func (m *AuditModel) CreateTable() error {
+	queries := []string{`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor_id INTEGER,
+		actor_username TEXT,
+		impersonator_id INTEGER,
+		action TEXT NOT NULL,
+		target_type TEXT,
+		target_id TEXT,
+		ip TEXT,
+		user_agent TEXT,
+		outcome TEXT NOT NULL,
+		detail TEXT,
+		created_at DATETIME NOT NULL
+	)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log (actor_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_created ON audit_log (created_at)`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`,
+	}
+	for _, query := range queries {
+		if _, err := m.DB.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	// Upgrade databases created by older versions
+	return addColumnIfMissing(m.DB, "audit_log", "impersonator_id", "INTEGER")
+}
+
+// Record appends an event to the audit log
+func (m *AuditModel) Record(event *AuditEvent) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+
+	query := `
+	INSERT INTO audit_log (actor_id, actor_username, impersonator_id, action, target_type, target_id, ip, user_agent, outcome, detail, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := m.DB.Exec(query,
+		event.ActorID,
+		event.ActorUsername,
+		event.ImpersonatorID,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.IP,
+		event.UserAgent,
+		event.Outcome,
+		event.Detail,
+		event.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	event.ID = int(id)
+	return nil
+}
+
+// auditWhere builds the WHERE clause for a filter
+func auditWhere(filter AuditFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if filter.ActorID != 0 {
+		conditions = append(conditions, `actor_id = ?`)
+		args = append(args, filter.ActorID)
+	}
+	if filter.Action != "" {
+		if strings.HasSuffix(filter.Action, ".") {
+			conditions = append(conditions, `substr(action, 1, ?) = ?`)
+			args = append(args, len(filter.Action), filter.Action)
+		} else {
+			conditions = append(conditions, `action = ?`)
+			args = append(args, filter.Action)
+		}
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, `created_at >= ?`)
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, `created_at < ?`)
+		args = append(args, filter.Until.UTC())
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return ` WHERE ` + strings.Join(conditions, " AND "), args
+}
+
+const auditColumns = `id, actor_id, actor_username, impersonator_id, action, target_type, target_id, ip, user_agent, outcome, detail, created_at`
+
+// scanAuditEvent scans a row selected with auditColumns
+func scanAuditEvent(row interface{ Scan(...interface{}) error }) (*AuditEvent, error) {
+	event := &AuditEvent{}
+	var actorID, impersonatorID sql.NullInt64
+	var actorUsername, targetType, targetID, ip, userAgent, detail sql.NullString
+	err := row.Scan(
+		&event.ID,
+		&actorID,
+		&actorUsername,
+		&impersonatorID,
+		&event.Action,
+		&targetType,
+		&targetID,
+		&ip,
+		&userAgent,
+		&event.Outcome,
+		&detail,
+		&event.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if actorID.Valid {
+		id := int(actorID.Int64)
+		event.ActorID = &id
+	}
+	if impersonatorID.Valid {
+		id := int(impersonatorID.Int64)
+		event.ImpersonatorID = &id
+	}
+	event.ActorUsername = actorUsername.String
+	event.TargetType = targetType.String
+	event.TargetID = targetID.String
+	event.IP = ip.String
+	event.UserAgent = userAgent.String
+	event.Detail = detail.String
+	return event, nil
+}
+
+// Query returns events matching the filter, newest first, and the total number of matches
+func (m *AuditModel) Query(filter AuditFilter) ([]*AuditEvent, int, error) {
+	where, args := auditWhere(filter)
+
+	var total int
+	if err := m.DB.QueryRow(`SELECT COUNT(*) FROM audit_log`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	events := []*AuditEvent{}
+	err := m.Each(filter, func(event *AuditEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+// Each calls fn for every event matching the filter, newest first,
+// without loading the whole result into memory
+func (m *AuditModel) Each(filter AuditFilter, fn func(*AuditEvent) error) error {
+	where, args := auditWhere(filter)
+
+	query := `SELECT ` + auditColumns + ` FROM audit_log` + where + ` ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, filter.Limit, filter.Offset)
+	}
+
+	rows, err := m.DB.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
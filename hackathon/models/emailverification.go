@@ -0,0 +1,111 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"file-uploader/utils"
+)
+
+// ErrVerificationTokenInvalid is returned for unknown, used, expired or outdated tokens
+var ErrVerificationTokenInvalid = errors.New("verification token is invalid or has expired")
+
+// EmailVerificationModel handles email verification token database operations
+type EmailVerificationModel struct {
+	DB *sql.DB
+}
+
+// NewEmailVerificationModel creates a new EmailVerificationModel
+func NewEmailVerificationModel(db *sql.DB) *EmailVerificationModel {
+	return &EmailVerificationModel{DB: db}
+}
+
+// CreateTable creates the email_verifications table if it doesn't exist
+func (m *EmailVerificationModel) CreateTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS email_verifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		token_hash TEXT UNIQUE NOT NULL,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	)`
+	_, err := m.DB.Exec(query)
+	return err
+}
+
+// Create issues a new verification token for the user's email and returns the raw token.
+// Only the hash of the token is stored.
+func (m *EmailVerificationModel) Create(userID int, email string, ttl time.Duration) (string, error) {
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	query := `INSERT INTO email_verifications (user_id, email, token_hash, expires_at) VALUES (?, ?, ?, ?)`
+	_, err = m.DB.Exec(query, userID, email, utils.HashToken(token), time.Now().Add(ttl).UTC())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// LastSentAt returns when the most recent token for the user was issued
+func (m *EmailVerificationModel) LastSentAt(userID int) (time.Time, error) {
+	var createdAt time.Time
+	query := `SELECT created_at FROM email_verifications WHERE user_id = ? ORDER BY id DESC LIMIT 1`
+	err := m.DB.QueryRow(query, userID).Scan(&createdAt)
+	return createdAt, err
+}
+
+// Verify consumes a token and marks the user's email as verified.
+// Tokens issued for an address the user no longer has are rejected.
+func (m *EmailVerificationModel) Verify(rawToken string) (int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var (
+		id        int
+		userID    int
+		email     string
+		expiresAt time.Time
+		usedAt    sql.NullTime
+	)
+	query := `SELECT id, user_id, email, expires_at, used_at FROM email_verifications WHERE token_hash = ?`
+	err = tx.QueryRow(query, utils.HashToken(rawToken)).Scan(&id, &userID, &email, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return 0, ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+	if usedAt.Valid || expiresAt.Before(time.Now()) {
+		return 0, ErrVerificationTokenInvalid
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec(`UPDATE email_verifications SET used_at = ? WHERE id = ?`, now, id); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`UPDATE users SET email_verified_at = ? WHERE id = ? AND email = ?`, now, userID, email)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if affected == 0 {
+		return 0, ErrVerificationTokenInvalid
+	}
+
+	return userID, tx.Commit()
+}
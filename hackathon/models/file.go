@@ -2,20 +2,40 @@ package models
 
 import (
 	"database/sql"
+	"errors"
 	"time"
+
+	"file-uploader/utils"
+)
+
+var (
+	// ErrFileRevisionConflict is returned when a file was changed since the client read it
+	ErrFileRevisionConflict = errors.New("file was modified by another request")
+	// ErrOrgQuotaExceeded is returned when content would take an organization over its storage quota
+	ErrOrgQuotaExceeded = errors.New("organization storage quota exceeded")
 )
 
 // FileMetadata represents uploaded file metadata
 type FileMetadata struct {
-	ID          int       `json:"id"`
-	UserID      int       `json:"user_id"`
+	ID          int       `json:"id"`               // Legacy sequential ID, kept while clients migrate
+	PublicID    string    `json:"public_id"`        // Random UUIDv7 that addresses the file in URLs
+	UserID      int       `json:"user_id"`          // Uploader
+	OrgID       *int      `json:"org_id,omitempty"` // Owning organization, unset for personal files
 	Filename    string    `json:"filename"`
+	Description string    `json:"description"`
+	AltText     string    `json:"alt_text"` // Accessibility text for images
 	ContentType string    `json:"content_type"`
 	Size        int64     `json:"size"`
+	ContentHash string    `json:"content_hash,omitempty"` // Hex SHA-256 of the stored bytes
 	FilePath    string    `json:"file_path"`
 	UserAgent   string    `json:"user_agent"`
 	RemoteAddr  string    `json:"remote_addr"`
 	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Version     int       `json:"version"`  // Current content version
+	Revision    int       `json:"revision"` // Incremented on every change
+	// ExpiresAt is when the file is deleted, unset for files kept forever
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 // FileModel handles file metadata database operations
@@ -33,34 +53,123 @@ func (m *FileModel) CreateTable() error {
 	query := `
 	CREATE TABLE IF NOT EXISTS files (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		public_id TEXT,
 		user_id INTEGER NOT NULL,
+		org_id INTEGER,
 		filename TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		alt_text TEXT NOT NULL DEFAULT '',
 		content_type TEXT NOT NULL,
 		size INTEGER NOT NULL,
+		content_hash TEXT,
 		file_path TEXT NOT NULL,
 		user_agent TEXT,
 		remote_addr TEXT,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (user_id) REFERENCES users (id)
+		updated_at DATETIME,
+		version INTEGER NOT NULL DEFAULT 1,
+		revision INTEGER NOT NULL DEFAULT 1,
+		expires_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users (id),
+		FOREIGN KEY (org_id) REFERENCES organizations (id)
 	)`
-	_, err := m.DB.Exec(query)
-	return err
+	if _, err := m.DB.Exec(query); err != nil {
+		return err
+	}
+
+	// Upgrade databases created by older versions
+	if err := addColumnIfMissing(m.DB, "files", "org_id", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(m.DB, "files", "content_hash", "TEXT"); err != nil {
+		return err
+	}
+	for _, column := range []struct{ name, definition string }{
+		{"description", "TEXT NOT NULL DEFAULT ''"},
+		{"alt_text", "TEXT NOT NULL DEFAULT ''"},
+		{"updated_at", "DATETIME"},
+		{"revision", "INTEGER NOT NULL DEFAULT 1"},
+		{"version", "INTEGER NOT NULL DEFAULT 1"},
+		{"expires_at", "DATETIME"},
+		{"public_id", "TEXT"},
+	} {
+		if err := addColumnIfMissing(m.DB, "files", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	if _, err := m.DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_files_public_id ON files (public_id)`); err != nil {
+		return err
+	}
+	if err := m.assignPublicIDs(); err != nil {
+		return err
+	}
+	return m.createVersionsTable()
+}
+
+// assignPublicIDs gives files uploaded before public IDs were introduced a public ID
+func (m *FileModel) assignPublicIDs() error {
+	rows, err := m.DB.Query(`SELECT id FROM files WHERE public_id IS NULL`)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		publicID, err := utils.NewUUIDv7()
+		if err != nil {
+			return err
+		}
+		if _, err := m.DB.Exec(`UPDATE files SET public_id = ? WHERE id = ?`, publicID, id); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Create stores file metadata in the database
-func (m *FileModel) Create(metadata *FileMetadata) (*FileMetadata, error) {
+// Create stores file metadata in the database, recording the content as version 1.
+// If commit is not nil it is called after the rows are written and before the transaction
+// commits, so the content can be moved into place; if it fails nothing is recorded.
+// Files of an organization that would exceed its quota return ErrOrgQuotaExceeded.
+func (m *FileModel) Create(metadata *FileMetadata, commit func() error) (*FileMetadata, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	publicID, err := utils.NewUUIDv7()
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
-	INSERT INTO files (user_id, filename, content_type, size, file_path, user_agent, remote_addr)
-	VALUES (?, ?, ?, ?, ?, ?, ?)`
+	INSERT INTO files (public_id, user_id, org_id, filename, content_type, size, content_hash, file_path, user_agent, remote_addr, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	result, err := m.DB.Exec(query,
+	result, err := tx.Exec(query,
+		publicID,
 		metadata.UserID,
+		metadata.OrgID,
 		metadata.Filename,
 		metadata.ContentType,
 		metadata.Size,
+		metadata.ContentHash,
 		metadata.FilePath,
 		metadata.UserAgent,
 		metadata.RemoteAddr,
+		metadata.ExpiresAt,
 	)
 	if err != nil {
 		return nil, err
@@ -71,29 +180,325 @@ func (m *FileModel) Create(metadata *FileMetadata) (*FileMetadata, error) {
 		return nil, err
 	}
 
+	if err := insertVersion(tx, &FileVersion{
+		FileID:      int(id),
+		Version:     1,
+		UserID:      metadata.UserID,
+		ContentType: metadata.ContentType,
+		Size:        metadata.Size,
+		ContentHash: metadata.ContentHash,
+		FilePath:    metadata.FilePath,
+	}); err != nil {
+		return nil, err
+	}
+	if metadata.OrgID != nil {
+		if err := checkOrgQuota(tx, *metadata.OrgID); err != nil {
+			return nil, err
+		}
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	return m.GetByID(int(id))
 }
 
-// GetByID retrieves file metadata by ID
-func (m *FileModel) GetByID(id int) (*FileMetadata, error) {
-	metadata := &FileMetadata{}
-	query := `
-	SELECT id, user_id, filename, content_type, size, file_path, user_agent, remote_addr, created_at
-	FROM files WHERE id = ?`
+const fileColumns = `id, public_id, user_id, org_id, filename, description, alt_text, content_type, size, content_hash, file_path, user_agent, remote_addr, created_at, updated_at, version, revision, expires_at`
 
-	err := m.DB.QueryRow(query, id).Scan(
+// notExpired restricts a query on files to files that have not expired, the current
+// time is its argument. Expired files are treated as deleted until they are swept.
+const notExpired = `(expires_at IS NULL OR expires_at > ?)`
+
+// scanFile scans a row selected with fileColumns
+func scanFile(row interface{ Scan(...interface{}) error }) (*FileMetadata, error) {
+	metadata := &FileMetadata{}
+	var orgID sql.NullInt64
+	var publicID, contentHash sql.NullString
+	var updatedAt, expiresAt sql.NullTime
+	err := row.Scan(
 		&metadata.ID,
+		&publicID,
 		&metadata.UserID,
+		&orgID,
 		&metadata.Filename,
+		&metadata.Description,
+		&metadata.AltText,
 		&metadata.ContentType,
 		&metadata.Size,
+		&contentHash,
 		&metadata.FilePath,
 		&metadata.UserAgent,
 		&metadata.RemoteAddr,
 		&metadata.CreatedAt,
+		&updatedAt,
+		&metadata.Version,
+		&metadata.Revision,
+		&expiresAt,
 	)
 	if err != nil {
 		return nil, err
 	}
+
+	if orgID.Valid {
+		id := int(orgID.Int64)
+		metadata.OrgID = &id
+	}
+	metadata.PublicID = publicID.String
+	metadata.ContentHash = contentHash.String
+	metadata.UpdatedAt = metadata.CreatedAt
+	if updatedAt.Valid {
+		metadata.UpdatedAt = updatedAt.Time
+	}
+	if expiresAt.Valid {
+		metadata.ExpiresAt = &expiresAt.Time
+	}
 	return metadata, nil
 }
+
+// queryFiles runs a query selecting fileColumns and scans all rows
+func (m *FileModel) queryFiles(query string, args ...interface{}) ([]*FileMetadata, error) {
+	rows, err := m.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []*FileMetadata{}
+	for rows.Next() {
+		metadata, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, metadata)
+	}
+	return files, rows.Err()
+}
+
+// FileUsage summarises the files stored by a user or organization.
+// The total includes the retained old versions of the files.
+type FileUsage struct {
+	FileCount  int   `json:"file_count"`
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// checkOrgQuota returns ErrOrgQuotaExceeded if an organization's stored content exceeds
+// its quota. It runs after the new rows are written: SQLite then holds the write lock until
+// the transaction ends, so concurrent uploads cannot each see room for themselves.
+func checkOrgQuota(tx *sql.Tx, orgID int) error {
+	var quota, used int64
+	query := `SELECT quota_bytes, (SELECT COALESCE(SUM(v.size), 0) FROM file_versions v
+		JOIN files f ON f.id = v.file_id WHERE f.org_id = organizations.id)
+	FROM organizations WHERE id = ?`
+	if err := tx.QueryRow(query, orgID).Scan(&quota, &used); err != nil {
+		return err
+	}
+	if quota > 0 && used > quota {
+		return ErrOrgQuotaExceeded
+	}
+	return nil
+}
+
+// GetUsageByUser returns the number and total size of the files a user uploaded
+func (m *FileModel) GetUsageByUser(userID int) (*FileUsage, error) {
+	usage := &FileUsage{}
+	query := `SELECT COUNT(*), COALESCE(SUM((SELECT SUM(size) FROM file_versions WHERE file_id = files.id)), 0)
+	FROM files WHERE user_id = ?`
+	if err := m.DB.QueryRow(query, userID).Scan(&usage.FileCount, &usage.TotalBytes); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// GetUsageByOrg returns the number and total size of an organization's files
+func (m *FileModel) GetUsageByOrg(orgID int) (*FileUsage, error) {
+	usage := &FileUsage{}
+	query := `SELECT COUNT(*), COALESCE(SUM((SELECT SUM(size) FROM file_versions WHERE file_id = files.id)), 0)
+	FROM files WHERE org_id = ?`
+	if err := m.DB.QueryRow(query, orgID).Scan(&usage.FileCount, &usage.TotalBytes); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// ListByUser retrieves the metadata of files a user uploaded, newest first
+func (m *FileModel) ListByUser(userID int) ([]*FileMetadata, error) {
+	query := `SELECT ` + fileColumns + ` FROM files WHERE user_id = ? AND ` + notExpired + ` ORDER BY id DESC`
+	return m.queryFiles(query, userID, time.Now().UTC())
+}
+
+// ListByOrg retrieves the metadata of an organization's files, newest first
+func (m *FileModel) ListByOrg(orgID int) ([]*FileMetadata, error) {
+	query := `SELECT ` + fileColumns + ` FROM files WHERE org_id = ? AND ` + notExpired + ` ORDER BY id DESC`
+	return m.queryFiles(query, orgID, time.Now().UTC())
+}
+
+// ListAccessible retrieves the user's personal files and the files of every
+// organization the user belongs to, newest first
+func (m *FileModel) ListAccessible(userID int) ([]*FileMetadata, error) {
+	query := `SELECT ` + fileColumns + ` FROM files
+	WHERE ((org_id IS NULL AND user_id = ?)
+	OR org_id IN (SELECT org_id FROM organization_members WHERE user_id = ?))
+	AND ` + notExpired + `
+	ORDER BY id DESC`
+	return m.queryFiles(query, userID, userID, time.Now().UTC())
+}
+
+// GetByID retrieves file metadata by ID, returning sql.ErrNoRows for expired files
+func (m *FileModel) GetByID(id int) (*FileMetadata, error) {
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND ` + notExpired
+	return scanFile(m.DB.QueryRow(query, id, time.Now().UTC()))
+}
+
+// GetByPublicID retrieves file metadata by public ID
+func (m *FileModel) GetByPublicID(publicID string) (*FileMetadata, error) {
+	query := `SELECT ` + fileColumns + ` FROM files WHERE public_id = ? AND ` + notExpired
+	return scanFile(m.DB.QueryRow(query, publicID, time.Now().UTC()))
+}
+
+// SetContentHash stores the content hash of a file uploaded before hashes were recorded
+func (m *FileModel) SetContentHash(id int, contentHash string) error {
+	_, err := m.DB.Exec(`UPDATE files SET content_hash = ? WHERE id = ?`, contentHash, id)
+	return err
+}
+
+// FileMetadataUpdate holds the editable metadata of a file, nil fields are left unchanged
+type FileMetadataUpdate struct {
+	Filename    *string
+	Description *string
+	AltText     *string
+}
+
+// UpdateMetadata changes the editable metadata of a file if it is still at the given
+// revision, returning ErrFileRevisionConflict otherwise
+func (m *FileModel) UpdateMetadata(id, revision int, update FileMetadataUpdate) (*FileMetadata, error) {
+	query := `
+	UPDATE files
+	SET filename = COALESCE(?, filename),
+		description = COALESCE(?, description),
+		alt_text = COALESCE(?, alt_text),
+		updated_at = CURRENT_TIMESTAMP,
+		revision = revision + 1
+	WHERE id = ? AND revision = ?`
+
+	result, err := m.DB.Exec(query, update.Filename, update.Description, update.AltText, id, revision)
+	if err != nil {
+		return nil, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		if _, err := m.GetByID(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrFileRevisionConflict
+	}
+	return m.GetByID(id)
+}
+
+// DeleteExpired deletes the files that expired before now with all their versions.
+// It returns the number of deleted files and the paths of their content, which the
+// caller removes from disk once the rows are gone.
+func (m *FileModel) DeleteExpired(now time.Time) (int, []string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	expired := `SELECT id FROM files WHERE expires_at IS NOT NULL AND expires_at <= ?`
+	rows, err := tx.Query(`SELECT file_path FROM file_versions WHERE file_id IN (`+expired+`)`, now.UTC())
+	if err != nil {
+		return 0, nil, err
+	}
+	var candidates []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		candidates = append(candidates, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM file_versions WHERE file_id IN (`+expired+`)`, now.UTC()); err != nil {
+		return 0, nil, err
+	}
+	result, err := tx.Exec(`DELETE FROM files WHERE expires_at IS NOT NULL AND expires_at <= ?`, now.UTC())
+	if err != nil {
+		return 0, nil, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	filePaths, err := unreferencedPaths(tx, candidates)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return int(deleted), filePaths, nil
+}
+
+// Delete deletes a file with all its versions. It returns the paths that are no longer
+// referenced, which the caller removes from disk once the rows are gone.
+func (m *FileModel) Delete(id int) ([]string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT file_path FROM file_versions WHERE file_id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM file_versions WHERE file_id = ?`, id); err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec(`DELETE FROM files WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if affected == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	filePaths, err := unreferencedPaths(tx, candidates)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return filePaths, nil
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCreateKeepsOrganizationsWithinQuota(t *testing.T) {
+	db := newTestDB(t)
+	users, orgs, files := NewUserModel(db), NewOrganizationModel(db), NewFileModel(db)
+
+	alice, err := users.CreateExternal("alice", AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err := orgs.Create("acme", alice.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(orgID *int, size int64, path string) error {
+		committed := false
+		_, err := files.Create(&FileMetadata{
+			UserID: alice.ID, OrgID: orgID, Filename: "a.png", ContentType: "image/png", Size: size, FilePath: path,
+		}, func() error { committed = true; return nil })
+		if err != nil && committed {
+			t.Errorf("%s: content was moved into place for a rejected file", path)
+		}
+		return err
+	}
+
+	// Uploads that each fit on their own, started together, cannot add up past the quota
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = upload(&org.ID, 60, fmt.Sprintf("/uploads/%d", i))
+		}(i)
+	}
+	wg.Wait()
+	accepted := 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+			accepted++
+		case ErrOrgQuotaExceeded:
+		default:
+			t.Errorf("Create = %v, want nil or ErrOrgQuotaExceeded", err)
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("%d concurrent uploads accepted, want 1", accepted)
+	}
+	if usage, _ := files.GetUsageByOrg(org.ID); usage.FileCount != 1 || usage.TotalBytes != 60 {
+		t.Errorf("usage = %+v, want the one accepted file", usage)
+	}
+
+	if err := upload(&org.ID, 40, "/uploads/fits"); err != nil {
+		t.Errorf("file filling the quota exactly: %v", err)
+	}
+	// Personal files do not count towards organization quotas
+	if err := upload(nil, 1000, "/uploads/personal"); err != nil {
+		t.Errorf("personal file: %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// FileVersion is one stored content of a file. The current content of a file is its newest version.
+type FileVersion struct {
+	FileID       int       `json:"file_id"`
+	Version      int       `json:"version"`
+	UserID       int       `json:"user_id"` // Uploader of this version
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	ContentHash  string    `json:"content_hash,omitempty"`
+	FilePath     string    `json:"file_path"`
+	RestoredFrom *int      `json:"restored_from,omitempty"` // Version whose content was restored
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// createVersionsTable creates the file_versions table and records the content of files
+// uploaded before versions were kept as their current version
+func (m *FileModel) createVersionsTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS file_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		content_hash TEXT,
+		file_path TEXT NOT NULL,
+		restored_from INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (file_id, version),
+		FOREIGN KEY (file_id) REFERENCES files (id)
+	)`
+	if _, err := m.DB.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := m.DB.Exec(`
+	INSERT INTO file_versions (file_id, version, user_id, content_type, size, content_hash, file_path, created_at)
+	SELECT id, version, user_id, content_type, size, content_hash, file_path, created_at FROM files
+	WHERE id NOT IN (SELECT file_id FROM file_versions)`)
+	return err
+}
+
+// insertVersion records a version of a file
+func insertVersion(tx *sql.Tx, version *FileVersion) error {
+	query := `
+	INSERT INTO file_versions (file_id, version, user_id, content_type, size, content_hash, file_path, restored_from)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := tx.Exec(query,
+		version.FileID,
+		version.Version,
+		version.UserID,
+		version.ContentType,
+		version.Size,
+		version.ContentHash,
+		version.FilePath,
+		version.RestoredFrom,
+	)
+	return err
+}
+
+const fileVersionColumns = `file_id, version, user_id, content_type, size, content_hash, file_path, restored_from, created_at`
+
+// scanFileVersion scans a row selected with fileVersionColumns
+func scanFileVersion(row interface{ Scan(...interface{}) error }) (*FileVersion, error) {
+	version := &FileVersion{}
+	var contentHash sql.NullString
+	var restoredFrom sql.NullInt64
+	err := row.Scan(
+		&version.FileID,
+		&version.Version,
+		&version.UserID,
+		&version.ContentType,
+		&version.Size,
+		&contentHash,
+		&version.FilePath,
+		&restoredFrom,
+		&version.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	version.ContentHash = contentHash.String
+	if restoredFrom.Valid {
+		from := int(restoredFrom.Int64)
+		version.RestoredFrom = &from
+	}
+	return version, nil
+}
+
+// AddVersion makes new content the current version of a file. If revision is not zero the
+// file must still be at that revision, otherwise ErrFileRevisionConflict is returned.
+// The version number is assigned here. commit works as for Create. Versions of an
+// organization file that would exceed its quota return ErrOrgQuotaExceeded.
+func (m *FileModel) AddVersion(fileID, revision int, version *FileVersion, commit func() error) (*FileMetadata, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var current, currentRevision int
+	var orgID sql.NullInt64
+	err = tx.QueryRow(`SELECT version, revision, org_id FROM files WHERE id = ?`, fileID).Scan(&current, &currentRevision, &orgID)
+	if err != nil {
+		return nil, err
+	}
+	if revision != 0 && revision != currentRevision {
+		return nil, ErrFileRevisionConflict
+	}
+
+	version.FileID = fileID
+	version.Version = current + 1
+	if err := insertVersion(tx, version); err != nil {
+		return nil, err
+	}
+
+	query := `
+	UPDATE files
+	SET content_type = ?, size = ?, content_hash = ?, file_path = ?, version = ?,
+		updated_at = CURRENT_TIMESTAMP,
+		revision = revision + 1
+	WHERE id = ? AND revision = ?`
+	result, err := tx.Exec(query,
+		version.ContentType,
+		version.Size,
+		version.ContentHash,
+		version.FilePath,
+		version.Version,
+		fileID,
+		currentRevision,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if affected == 0 {
+		return nil, ErrFileRevisionConflict
+	}
+	if orgID.Valid {
+		if err := checkOrgQuota(tx, int(orgID.Int64)); err != nil {
+			return nil, err
+		}
+	}
+
+	if commit != nil {
+		if err := commit(); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return m.GetByID(fileID)
+}
+
+// ListVersions retrieves the versions of a file, newest first
+func (m *FileModel) ListVersions(fileID int) ([]*FileVersion, error) {
+	query := `SELECT ` + fileVersionColumns + ` FROM file_versions WHERE file_id = ? ORDER BY version DESC`
+	rows, err := m.DB.Query(query, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []*FileVersion{}
+	for rows.Next() {
+		version, err := scanFileVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// GetVersion retrieves one version of a file
+func (m *FileModel) GetVersion(fileID, version int) (*FileVersion, error) {
+	query := `SELECT ` + fileVersionColumns + ` FROM file_versions WHERE file_id = ? AND version = ?`
+	return scanFileVersion(m.DB.QueryRow(query, fileID, version))
+}
+
+// PruneVersions deletes the old versions of a file beyond the newest keep ones, never the
+// current version. It returns the paths that are no longer referenced, which the caller
+// removes from disk once the rows are gone.
+func (m *FileModel) PruneVersions(fileID, keep int) ([]string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	SELECT id, file_path FROM file_versions
+	WHERE file_id = ? AND version < (SELECT version FROM files WHERE id = ?)
+	ORDER BY version DESC
+	LIMIT -1 OFFSET ?`
+	rows, err := tx.Query(query, fileID, fileID, keep)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	var candidates []string
+	for rows.Next() {
+		var id int
+		var path string
+		if err := rows.Scan(&id, &path); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		candidates = append(candidates, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.Exec(`DELETE FROM file_versions WHERE id = ?`, id); err != nil {
+			return nil, err
+		}
+	}
+
+	filePaths, err := unreferencedPaths(tx, candidates)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return filePaths, nil
+}
+
+// unreferencedPaths returns the distinct paths that no remaining version or file points to,
+// so their content can be removed after rows were deleted
+func unreferencedPaths(tx *sql.Tx, candidates []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var filePaths []string
+	for _, path := range candidates {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		var references int
+		err := tx.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM file_versions WHERE file_path = ?) + (SELECT COUNT(*) FROM files WHERE file_path = ?)`,
+			path, path).Scan(&references)
+		if err != nil {
+			return nil, err
+		}
+		if references == 0 {
+			filePaths = append(filePaths, path)
+		}
+	}
+	return filePaths, nil
+}
+
+// ListAllVersions retrieves every stored version of every file, ordered by file and version
+func (m *FileModel) ListAllVersions() ([]*FileVersion, error) {
+	query := `SELECT ` + fileVersionColumns + ` FROM file_versions ORDER BY file_id, version`
+	rows, err := m.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []*FileVersion{}
+	for rows.Next() {
+		version, err := scanFileVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// DeleteVersion deletes an old version of a file. It returns the paths that are no longer
+// referenced, which the caller removes from disk once the rows are gone.
+func (m *FileModel) DeleteVersion(fileID, version int) ([]string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var filePath string
+	query := `
+	SELECT file_path FROM file_versions
+	WHERE file_id = ? AND version = ? AND version < (SELECT version FROM files WHERE id = ?)`
+	if err := tx.QueryRow(query, fileID, version, fileID).Scan(&filePath); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM file_versions WHERE file_id = ? AND version = ?`, fileID, version); err != nil {
+		return nil, err
+	}
+
+	filePaths, err := unreferencedPaths(tx, []string{filePath})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return filePaths, nil
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// UserIdentity links a local user to an account at an external identity provider
+type UserIdentity struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UserIdentityModel handles external identity database operations
+type UserIdentityModel struct {
+	DB *sql.DB
+}
+
+// NewUserIdentityModel creates a new UserIdentityModel
+func NewUserIdentityModel(db *sql.DB) *UserIdentityModel {
+	return &UserIdentityModel{DB: db}
+}
+
+// CreateTable creates the user_identities table if it doesn't exist
+func (m *UserIdentityModel) CreateTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		email TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (issuer, subject),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	)`
+	_, err := m.DB.Exec(query)
+	return err
+}
+
+// Link records that the external account (issuer, subject) belongs to a user
+func (m *UserIdentityModel) Link(userID int, issuer, subject, email string) (*UserIdentity, error) {
+	query := `INSERT INTO user_identities (user_id, issuer, subject, email) VALUES (?, ?, ?, ?)`
+	if _, err := m.DB.Exec(query, userID, issuer, subject, email); err != nil {
+		return nil, err
+	}
+	return m.GetBySubject(issuer, subject)
+}
+
+// GetBySubject retrieves the identity for an external account
+func (m *UserIdentityModel) GetBySubject(issuer, subject string) (*UserIdentity, error) {
+	identity := &UserIdentity{}
+	var email sql.NullString
+	query := `
+	SELECT id, user_id, issuer, subject, email, created_at
+	FROM user_identities WHERE issuer = ? AND subject = ?`
+	err := m.DB.QueryRow(query, issuer, subject).Scan(
+		&identity.ID,
+		&identity.UserID,
+		&identity.Issuer,
+		&identity.Subject,
+		&email,
+		&identity.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	identity.Email = email.String
+	return identity, nil
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"file-uploader/utils"
+)
+
+var (
+	// ErrOAuthClientNotFound is returned when no client matches the given ID
+	ErrOAuthClientNotFound = errors.New("oauth client not found")
+	// ErrOAuthClientRevoked is returned for clients that have been revoked
+	ErrOAuthClientRevoked = errors.New("oauth client has been revoked")
+	// ErrInvalidClientSecret is returned when the client secret does not match
+	ErrInvalidClientSecret = errors.New("invalid client secret")
+)
+
+// OAuthClient is a third-party application registered by a user.
+// Confidential clients hold a secret and may use the client credentials grant,
+// public clients (mobile and single-page apps) rely on PKCE alone.
+type OAuthClient struct {
+	ID           int        `json:"id"`
+	ClientID     string     `json:"client_id"`
+	UserID       int        `json:"user_id"` // Owner, and the account acting for client credentials tokens
+	Name         string     `json:"name"`
+	SecretHash   string     `json:"-"` // Empty for public clients
+	RedirectURIs []string   `json:"redirect_uris"`
+	Scopes       []string   `json:"scopes"` // Upper bound of the scopes the client may request
+	Confidential bool       `json:"confidential"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// HasRedirectURI checks if the redirect URI was registered for the client
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if uri == registered {
+			return true
+		}
+	}
+	return false
+}
+
+// OAuthClientModel handles OAuth client database operations
+type OAuthClientModel struct {
+	DB *sql.DB
+}
+
+// NewOAuthClientModel creates a new OAuthClientModel
+func NewOAuthClientModel(db *sql.DB) *OAuthClientModel {
+	return &OAuthClientModel{DB: db}
+}
+
+// CreateTable creates the oauth_clients table if it doesn't exist
+func (m *OAuthClientModel) CreateTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS oauth_clients (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		client_id TEXT UNIQUE NOT NULL,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		secret_hash TEXT NOT NULL DEFAULT '',
+		redirect_uris TEXT NOT NULL DEFAULT '',
+		scopes TEXT NOT NULL DEFAULT '',
+		revoked_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	)`
+	_, err := m.DB.Exec(query)
+	return err
+}
+
+// Create registers a client and returns it together with its raw secret,
+// which is empty for public clients
+func (m *OAuthClientModel) Create(userID int, name string, redirectURIs, scopes []string, confidential bool) (*OAuthClient, string, error) {
+	clientID, err := utils.RandomToken(16)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var secret, secretHash string
+	if confidential {
+		secret, err = utils.RandomToken(32)
+		if err != nil {
+			return nil, "", err
+		}
+		secretHash = utils.HashToken(secret)
+	}
+
+	query := `
+	INSERT INTO oauth_clients (client_id, user_id, name, secret_hash, redirect_uris, scopes)
+	VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err := m.DB.Exec(query,
+		clientID,
+		userID,
+		name,
+		secretHash,
+		strings.Join(redirectURIs, " "),
+		utils.JoinScopes(scopes),
+	); err != nil {
+		return nil, "", err
+	}
+
+	client, err := m.GetByClientID(clientID)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, secret, nil
+}
+
+const oauthClientColumns = `id, client_id, user_id, name, secret_hash, redirect_uris, scopes, revoked_at, created_at`
+
+// scanOAuthClient scans a row selected with oauthClientColumns
+func scanOAuthClient(row interface{ Scan(...interface{}) error }) (*OAuthClient, error) {
+	client := &OAuthClient{}
+	var redirectURIs, scopes string
+	var revokedAt sql.NullTime
+	err := row.Scan(
+		&client.ID,
+		&client.ClientID,
+		&client.UserID,
+		&client.Name,
+		&client.SecretHash,
+		&redirectURIs,
+		&scopes,
+		&revokedAt,
+		&client.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.Scopes = utils.ParseScopes(scopes)
+	client.Confidential = client.SecretHash != ""
+	if revokedAt.Valid {
+		client.RevokedAt = &revokedAt.Time
+	}
+	return client, nil
+}
+
+// GetByClientID retrieves a client by its public client ID, including revoked clients
+func (m *OAuthClientModel) GetByClientID(clientID string) (*OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients WHERE client_id = ?`
+	client, err := scanOAuthClient(m.DB.QueryRow(query, clientID))
+	if err == sql.ErrNoRows {
+		return nil, ErrOAuthClientNotFound
+	}
+	return client, err
+}
+
+// GetActive retrieves a client that has not been revoked
+func (m *OAuthClientModel) GetActive(clientID string) (*OAuthClient, error) {
+	client, err := m.GetByClientID(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client.RevokedAt != nil {
+		return nil, ErrOAuthClientRevoked
+	}
+	return client, nil
+}
+
+// Authenticate checks the secret of a confidential client
+func (m *OAuthClientModel) Authenticate(clientID, secret string) (*OAuthClient, error) {
+	client, err := m.GetActive(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Confidential || subtle.ConstantTimeCompare([]byte(utils.HashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, ErrInvalidClientSecret
+	}
+	return client, nil
+}
+
+// ListByUser retrieves the clients registered by a user, newest first
+func (m *OAuthClientModel) ListByUser(userID int) ([]*OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients WHERE user_id = ? ORDER BY id DESC`
+	rows, err := m.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+// Revoke marks a client owned by the user as revoked. Tokens issued to it stop working.
+func (m *OAuthClientModel) Revoke(clientID string, userID int) error {
+	query := `UPDATE oauth_clients SET revoked_at = ? WHERE client_id = ? AND user_id = ? AND revoked_at IS NULL`
+	result, err := m.DB.Exec(query, time.Now().UTC(), clientID, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrOAuthClientNotFound
+	}
+	return nil
+}
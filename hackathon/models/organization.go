@@ -0,0 +1,418 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Organization member roles, from most to least privileged
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleEditor = "editor"
+	OrgRoleViewer = "viewer"
+)
+
+var (
+	// ErrNotOrgMember is returned when a user does not belong to an organization
+	ErrNotOrgMember = errors.New("user is not a member of the organization")
+	// ErrLastOrgOwner is returned when a change would leave an organization without owners
+	ErrLastOrgOwner = errors.New("organization must keep at least one owner")
+	// ErrInvitationNotFound is returned for unknown or foreign invitations
+	ErrInvitationNotFound = errors.New("invitation not found")
+	// ErrAlreadyOrgMember is returned when inviting a user who already belongs to the organization
+	ErrAlreadyOrgMember = errors.New("user is already a member of the organization")
+)
+
+// IsValidOrgRole reports whether role is a known organization role
+func IsValidOrgRole(role string) bool {
+	return role == OrgRoleOwner || role == OrgRoleEditor || role == OrgRoleViewer
+}
+
+// OrgRoleAtLeast reports whether role grants at least the permissions of required
+func OrgRoleAtLeast(role, required string) bool {
+	rank := map[string]int{OrgRoleViewer: 1, OrgRoleEditor: 2, OrgRoleOwner: 3}
+	return rank[role] >= rank[required] && rank[role] > 0
+}
+
+// Organization is a group of users sharing a file space
+type Organization struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`
+	QuotaBytes int64     `json:"quota_bytes"` // 0 means unlimited
+	CreatedBy  int       `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	Role       string    `json:"role,omitempty"` // The requesting user's role, when listed for a member
+}
+
+// OrgMember is a user's membership in an organization
+type OrgMember struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrgInvitation is a pending invitation of a user to an organization
+type OrgInvitation struct {
+	ID        int       `json:"id"`
+	OrgID     int       `json:"org_id"`
+	OrgName   string    `json:"org_name"`
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	InvitedBy int       `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrganizationModel handles organization, membership and invitation database operations
+type OrganizationModel struct {
+	DB *sql.DB
+}
+
+// NewOrganizationModel creates a new OrganizationModel
+func NewOrganizationModel(db *sql.DB) *OrganizationModel {
+	return &OrganizationModel{DB: db}
+}
+
+// CreateTable creates the organization tables if they don't exist
+func (m *OrganizationModel) CreateTable() error {
+	queries := []string{`
+	CREATE TABLE IF NOT EXISTS organizations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL,
+		quota_bytes INTEGER NOT NULL DEFAULT 0,
+		created_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`, `
+	CREATE TABLE IF NOT EXISTS organization_members (
+		org_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (org_id, user_id),
+		FOREIGN KEY (org_id) REFERENCES organizations (id),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	)`, `
+	CREATE TABLE IF NOT EXISTS organization_invitations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		invited_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (org_id, user_id),
+		FOREIGN KEY (org_id) REFERENCES organizations (id),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	)`}
+	for _, query := range queries {
+		if _, err := m.DB.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create creates an organization with the creator as its first owner
+func (m *OrganizationModel) Create(name string, creatorID int, quotaBytes int64) (*Organization, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO organizations (name, quota_bytes, created_by) VALUES (?, ?, ?)`, name, quotaBytes, creatorID)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO organization_members (org_id, user_id, role) VALUES (?, ?, ?)`, id, creatorID, OrgRoleOwner); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return m.GetByID(int(id))
+}
+
+// GetByID retrieves an organization by ID
+func (m *OrganizationModel) GetByID(id int) (*Organization, error) {
+	org := &Organization{}
+	query := `SELECT id, name, quota_bytes, created_by, created_at FROM organizations WHERE id = ?`
+	err := m.DB.QueryRow(query, id).Scan(&org.ID, &org.Name, &org.QuotaBytes, &org.CreatedBy, &org.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// ListByUser retrieves the organizations a user belongs to, with the user's role
+func (m *OrganizationModel) ListByUser(userID int) ([]*Organization, error) {
+	query := `
+	SELECT o.id, o.name, o.quota_bytes, o.created_by, o.created_at, om.role
+	FROM organizations o JOIN organization_members om ON om.org_id = o.id
+	WHERE om.user_id = ?
+	ORDER BY o.name`
+
+	rows, err := m.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []*Organization{}
+	for rows.Next() {
+		org := &Organization{}
+		if err := rows.Scan(&org.ID, &org.Name, &org.QuotaBytes, &org.CreatedBy, &org.CreatedAt, &org.Role); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+// SetQuota changes an organization's storage quota, 0 removes the limit
+func (m *OrganizationModel) SetQuota(id int, quotaBytes int64) error {
+	_, err := m.DB.Exec(`UPDATE organizations SET quota_bytes = ? WHERE id = ?`, quotaBytes, id)
+	return err
+}
+
+// Delete removes an organization with its memberships and invitations.
+// Callers must make sure the organization owns no files.
+func (m *OrganizationModel) Delete(id int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM organization_invitations WHERE org_id = ?`,
+		`DELETE FROM organization_members WHERE org_id = ?`,
+		`DELETE FROM organizations WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetRole returns the user's role in the organization, or ErrNotOrgMember
+func (m *OrganizationModel) GetRole(orgID, userID int) (string, error) {
+	var role string
+	err := m.DB.QueryRow(`SELECT role FROM organization_members WHERE org_id = ? AND user_id = ?`, orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotOrgMember
+	}
+	return role, err
+}
+
+// ListMembers retrieves the members of an organization
+func (m *OrganizationModel) ListMembers(orgID int) ([]*OrgMember, error) {
+	query := `
+	SELECT om.user_id, u.username, om.role, om.created_at
+	FROM organization_members om JOIN users u ON u.id = om.user_id
+	WHERE om.org_id = ?
+	ORDER BY u.username`
+
+	rows, err := m.DB.Query(query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*OrgMember{}
+	for rows.Next() {
+		member := &OrgMember{}
+		if err := rows.Scan(&member.UserID, &member.Username, &member.Role, &member.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// countOwners counts the owners of an organization within a transaction
+func countOwners(tx *sql.Tx, orgID int) (int, error) {
+	var owners int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM organization_members WHERE org_id = ? AND role = ?`, orgID, OrgRoleOwner).Scan(&owners)
+	return owners, err
+}
+
+// SetMemberRole changes a member's role. The last owner cannot be demoted.
+func (m *OrganizationModel) SetMemberRole(orgID, userID int, role string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow(`SELECT role FROM organization_members WHERE org_id = ? AND user_id = ?`, orgID, userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return ErrNotOrgMember
+	} else if err != nil {
+		return err
+	}
+
+	if current == OrgRoleOwner && role != OrgRoleOwner {
+		owners, err := countOwners(tx, orgID)
+		if err != nil {
+			return err
+		}
+		if owners <= 1 {
+			return ErrLastOrgOwner
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE organization_members SET role = ? WHERE org_id = ? AND user_id = ?`, role, orgID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveMember removes a user from an organization. The last owner cannot be removed.
+func (m *OrganizationModel) RemoveMember(orgID, userID int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow(`SELECT role FROM organization_members WHERE org_id = ? AND user_id = ?`, orgID, userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return ErrNotOrgMember
+	} else if err != nil {
+		return err
+	}
+
+	if current == OrgRoleOwner {
+		owners, err := countOwners(tx, orgID)
+		if err != nil {
+			return err
+		}
+		if owners <= 1 {
+			return ErrLastOrgOwner
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM organization_members WHERE org_id = ? AND user_id = ?`, orgID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Invite creates or replaces a pending invitation for a user who is not yet a member
+func (m *OrganizationModel) Invite(orgID, userID int, role string, invitedBy int) (*OrgInvitation, error) {
+	if _, err := m.GetRole(orgID, userID); err == nil {
+		return nil, ErrAlreadyOrgMember
+	} else if err != ErrNotOrgMember {
+		return nil, err
+	}
+
+	query := `
+	INSERT INTO organization_invitations (org_id, user_id, role, invited_by) VALUES (?, ?, ?, ?)
+	ON CONFLICT (org_id, user_id) DO UPDATE SET role = excluded.role, invited_by = excluded.invited_by, created_at = CURRENT_TIMESTAMP`
+	if _, err := m.DB.Exec(query, orgID, userID, role, invitedBy); err != nil {
+		return nil, err
+	}
+
+	return scanInvitation(m.DB.QueryRow(`SELECT `+invitationColumns+invitationFrom+` WHERE i.org_id = ? AND i.user_id = ?`, orgID, userID))
+}
+
+const invitationColumns = `i.id, i.org_id, o.name, i.user_id, u.username, i.role, i.invited_by, i.created_at`
+
+const invitationFrom = `
+	FROM organization_invitations i
+	JOIN organizations o ON o.id = i.org_id
+	JOIN users u ON u.id = i.user_id`
+
+// scanInvitation scans a row selected with invitationColumns
+func scanInvitation(row interface{ Scan(...interface{}) error }) (*OrgInvitation, error) {
+	invitation := &OrgInvitation{}
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.OrgID,
+		&invitation.OrgName,
+		&invitation.UserID,
+		&invitation.Username,
+		&invitation.Role,
+		&invitation.InvitedBy,
+		&invitation.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// ListInvitationsByUser retrieves the pending invitations addressed to a user
+func (m *OrganizationModel) ListInvitationsByUser(userID int) ([]*OrgInvitation, error) {
+	rows, err := m.DB.Query(`SELECT `+invitationColumns+invitationFrom+` WHERE i.user_id = ? ORDER BY i.id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*OrgInvitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	return invitations, rows.Err()
+}
+
+// AcceptInvitation turns a user's invitation into a membership
+func (m *OrganizationModel) AcceptInvitation(id, userID int) (*OrgInvitation, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	invitation, err := scanInvitation(tx.QueryRow(`SELECT `+invitationColumns+invitationFrom+` WHERE i.id = ? AND i.user_id = ?`, id, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvitationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM organization_invitations WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	query := `INSERT INTO organization_members (org_id, user_id, role) VALUES (?, ?, ?) ON CONFLICT (org_id, user_id) DO NOTHING`
+	if _, err := tx.Exec(query, invitation.OrgID, userID, invitation.Role); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// DeclineInvitation deletes a user's invitation
+func (m *OrganizationModel) DeclineInvitation(id, userID int) error {
+	result, err := m.DB.Exec(`DELETE FROM organization_invitations WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrInvitationNotFound
+	}
+	return nil
+}
@@ -2,17 +2,57 @@ package models
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"file-uploader/utils"
+)
+
+// User roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Authentication sources a user can be provisioned from
+const (
+	AuthSourceLocal = "local"
+	AuthSourceOIDC  = "oidc"
+	AuthSourceLDAP  = "ldap"
 )
 
 // User represents a user in the system
 type User struct {
-	ID        int       `json:"id"`
-	Username  string    `json:"username"`
-	Password  string    `json:"-"` // Not included in JSON responses
-	CreatedAt time.Time `json:"created_at"`
+	ID              int        `json:"id"`
+	Username        string     `json:"username"`
+	Password        string     `json:"-"` // Not included in JSON responses
+	Role            string     `json:"role"`
+	AuthSource      string     `json:"auth_source"`
+	Email           string     `json:"email,omitempty"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	DisabledAt      *time.Time `json:"disabled_at,omitempty"`
+	// DeletionScheduledAt is when a deletion requested by the user will be carried out
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	// PasswordResetRequired blocks the account until the user sets a new password
+	PasswordResetRequired bool `json:"password_reset_required"`
+	// FileRetentionHours overrides the default lifetime of the user's uploads, 0 keeps them forever
+	FileRetentionHours *int      `json:"file_retention_hours,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+// User account states used to filter searches
+const (
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+)
+
+// UserFilter narrows down user searches. Empty fields match everything.
+type UserFilter struct {
+	Query  string // Substring of the username or email
+	Role   string
+	Status string // UserStatusActive or UserStatusDisabled
+	Limit  int
+	Offset int
 }
 
 // UserModel handles user database operations
@@ -32,23 +72,61 @@ func (m *UserModel) CreateTable() error {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		username TEXT UNIQUE NOT NULL,
 		password TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'user',
+		auth_source TEXT NOT NULL DEFAULT 'local',
+		email TEXT,
+		email_verified_at DATETIME,
+		disabled_at DATETIME,
+		password_reset_required INTEGER NOT NULL DEFAULT 0,
+		deletion_scheduled_at DATETIME,
+		file_retention_hours INTEGER,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	)`
-	_, err := m.DB.Exec(query)
-	return err
+	if _, err := m.DB.Exec(query); err != nil {
+		return err
+	}
+
+	// Upgrade databases created by older versions
+	if err := addColumnIfMissing(m.DB, "users", "role", "TEXT NOT NULL DEFAULT 'user'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(m.DB, "users", "auth_source", "TEXT NOT NULL DEFAULT 'local'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(m.DB, "users", "email", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(m.DB, "users", "email_verified_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(m.DB, "users", "disabled_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(m.DB, "users", "password_reset_required", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(m.DB, "users", "deletion_scheduled_at", "DATETIME"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(m.DB, "users", "file_retention_hours", "INTEGER")
 }
 
-// Create creates a new user with hashed password
-func (m *UserModel) Create(username, password string) (*User, error) {
+// Create creates a new user with hashed password and an optional, unverified email
+func (m *UserModel) Create(username, password, email string) (*User, error) {
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := utils.HashPassword(password)
 	if err != nil {
 		return nil, err
 	}
 
+	var emailValue interface{}
+	if email != "" {
+		emailValue = email
+	}
+
 	// Insert user
-	query := `INSERT INTO users (username, password) VALUES (?, ?)`
-	result, err := m.DB.Exec(query, username, string(hashedPassword))
+	query := `INSERT INTO users (username, password, email) VALUES (?, ?, ?)`
+	result, err := m.DB.Exec(query, username, hashedPassword, emailValue)
 	if err != nil {
 		return nil, err
 	}
@@ -62,30 +140,407 @@ func (m *UserModel) Create(username, password string) (*User, error) {
 	return m.GetByID(int(id))
 }
 
-// GetByUsername retrieves a user by username
-func (m *UserModel) GetByUsername(username string) (*User, error) {
+// UnusablePassword is stored for accounts that cannot log in with a local password,
+// such as users provisioned from an external identity provider. It is not a valid
+// password hash, so password validation always fails.
+const UnusablePassword = "!"
+
+// CreateExternal creates a user that authenticates through an external source only
+func (m *UserModel) CreateExternal(username, source string) (*User, error) {
+	query := `INSERT INTO users (username, password, auth_source) VALUES (?, ?, ?)`
+	result, err := m.DB.Exec(query, username, UnusablePassword, source)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.GetByID(int(id))
+}
+
+// CreateLinked creates a user that authenticates through an external source together
+// with the link to its external account (issuer, subject), in one transaction, so a
+// failed link never leaves behind an account no login can reach
+func (m *UserModel) CreateLinked(username, source, issuer, subject, email string) (*User, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO users (username, password, auth_source) VALUES (?, ?, ?)`, username, UnusablePassword, source)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO user_identities (user_id, issuer, subject, email) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(query, id, issuer, subject, email); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return m.GetByID(int(id))
+}
+
+const userColumns = `id, username, password, role, auth_source, email, email_verified_at, disabled_at, password_reset_required, deletion_scheduled_at, file_retention_hours, created_at`
+
+// scanUser scans a row selected with userColumns
+func scanUser(row interface{ Scan(...interface{}) error }) (*User, error) {
 	user := &User{}
-	query := `SELECT id, username, password, created_at FROM users WHERE username = ?`
-	err := m.DB.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.Password, &user.CreatedAt)
+	var email sql.NullString
+	var emailVerifiedAt, disabledAt, deletionScheduledAt sql.NullTime
+	var fileRetentionHours sql.NullInt64
+	err := row.Scan(
+		&user.ID,
+		&user.Username,
+		&user.Password,
+		&user.Role,
+		&user.AuthSource,
+		&email,
+		&emailVerifiedAt,
+		&disabledAt,
+		&user.PasswordResetRequired,
+		&deletionScheduledAt,
+		&fileRetentionHours,
+		&user.CreatedAt,
+	)
 	if err != nil {
 		return nil, err
 	}
+
+	user.Email = email.String
+	if emailVerifiedAt.Valid {
+		user.EmailVerifiedAt = &emailVerifiedAt.Time
+	}
+	if disabledAt.Valid {
+		user.DisabledAt = &disabledAt.Time
+	}
+	if deletionScheduledAt.Valid {
+		user.DeletionScheduledAt = &deletionScheduledAt.Time
+	}
+	if fileRetentionHours.Valid {
+		hours := int(fileRetentionHours.Int64)
+		user.FileRetentionHours = &hours
+	}
 	return user, nil
 }
 
+// GetByUsername retrieves a user by username
+func (m *UserModel) GetByUsername(username string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = ?`
+	return scanUser(m.DB.QueryRow(query, username))
+}
+
 // GetByID retrieves a user by ID
 func (m *UserModel) GetByID(id int) (*User, error) {
-	user := &User{}
-	query := `SELECT id, username, password, created_at FROM users WHERE id = ?`
-	err := m.DB.QueryRow(query, id).Scan(&user.ID, &user.Username, &user.Password, &user.CreatedAt)
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ?`
+	return scanUser(m.DB.QueryRow(query, id))
+}
+
+// Search lists users matching the filter, ordered by ID, and returns the total number of matches
+func (m *UserModel) Search(filter UserFilter) ([]*User, int, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.Query != "" {
+		pattern := "%" + strings.ToLower(filter.Query) + "%"
+		conditions = append(conditions, `(LOWER(username) LIKE ? OR LOWER(COALESCE(email, '')) LIKE ?)`)
+		args = append(args, pattern, pattern)
+	}
+	if filter.Role != "" {
+		conditions = append(conditions, `role = ?`)
+		args = append(args, filter.Role)
+	}
+	switch filter.Status {
+	case UserStatusActive:
+		conditions = append(conditions, `disabled_at IS NULL`)
+	case UserStatusDisabled:
+		conditions = append(conditions, `disabled_at IS NOT NULL`)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := m.DB.QueryRow(`SELECT COUNT(*) FROM users`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + userColumns + ` FROM users` + where + ` ORDER BY id LIMIT ? OFFSET ?`
+	rows, err := m.DB.Query(query, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+// SetRole changes the role of a user
+func (m *UserModel) SetRole(id int, role string) error {
+	_, err := m.DB.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, id)
+	return err
+}
+
+// SetFileRetention changes the lifetime of a user's future uploads, nil restores the default
+func (m *UserModel) SetFileRetention(id int, hours *int) error {
+	_, err := m.DB.Exec(`UPDATE users SET file_retention_hours = ? WHERE id = ?`, hours, id)
+	return err
+}
+
+// SetRoleByUsername changes the role of the user with the given username
+func (m *UserModel) SetRoleByUsername(username, role string) (bool, error) {
+	result, err := m.DB.Exec(`UPDATE users SET role = ? WHERE username = ?`, role, username)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// UpdatePassword replaces a user's password hash
+func (m *UserModel) UpdatePassword(id int, password string) error {
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = m.DB.Exec(`UPDATE users SET password = ? WHERE id = ?`, hashedPassword, id)
+	return err
+}
+
+// ChangePassword sets a new password chosen by the user and clears a pending forced reset
+func (m *UserModel) ChangePassword(id int, password string) error {
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = m.DB.Exec(`UPDATE users SET password = ?, password_reset_required = 0 WHERE id = ?`, hashedPassword, id)
+	return err
+}
+
+// SetPasswordResetRequired forces the user to choose a new password on next login
+func (m *UserModel) SetPasswordResetRequired(id int, required bool) error {
+	_, err := m.DB.Exec(`UPDATE users SET password_reset_required = ? WHERE id = ?`, required, id)
+	return err
+}
+
+// SetDisabled disables or re-enables an account
+func (m *UserModel) SetDisabled(id int, disabled bool) error {
+	var disabledAt interface{}
+	if disabled {
+		disabledAt = time.Now().UTC()
+	}
+	_, err := m.DB.Exec(`UPDATE users SET disabled_at = ? WHERE id = ?`, disabledAt, id)
+	return err
+}
+
+// ScheduleDeletion marks the account for deletion at the given time
+func (m *UserModel) ScheduleDeletion(id int, at time.Time) error {
+	_, err := m.DB.Exec(`UPDATE users SET deletion_scheduled_at = ? WHERE id = ?`, at.UTC(), id)
+	return err
+}
+
+// CancelDeletion clears a scheduled deletion
+func (m *UserModel) CancelDeletion(id int) error {
+	_, err := m.DB.Exec(`UPDATE users SET deletion_scheduled_at = NULL WHERE id = ?`, id)
+	return err
+}
+
+// ListDueForDeletion returns the IDs of users whose scheduled deletion time has passed
+func (m *UserModel) ListDueForDeletion(now time.Time) ([]int, error) {
+	rows, err := m.DB.Query(`SELECT id FROM users WHERE deletion_scheduled_at IS NOT NULL AND deletion_scheduled_at <= ?`, now.UTC())
 	if err != nil {
 		return nil, err
 	}
-	return user, nil
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// soleOwnerQuery counts the organizations in which the user is the only owner
+const soleOwnerQuery = `
+	SELECT COUNT(*) FROM organization_members m
+	WHERE m.user_id = ? AND m.role = ? AND NOT EXISTS (
+		SELECT 1 FROM organization_members o
+		WHERE o.org_id = m.org_id AND o.role = ? AND o.user_id != m.user_id
+	)`
+
+// CheckDeletable returns ErrLastOrgOwner when deleting the user would leave an
+// organization without owners
+func (m *UserModel) CheckDeletable(id int) error {
+	return checkNotSoleOwner(m.DB.QueryRow(soleOwnerQuery, id, OrgRoleOwner, OrgRoleOwner))
+}
+
+// checkNotSoleOwner turns the result of soleOwnerQuery into ErrLastOrgOwner
+func checkNotSoleOwner(row *sql.Row) error {
+	var owned int
+	if err := row.Scan(&owned); err != nil {
+		return err
+	}
+	if owned > 0 {
+		return ErrLastOrgOwner
+	}
+	return nil
+}
+
+// Delete removes a user together with all rows that reference it, in one transaction.
+// It returns the paths of every version of the user's personal files, which the caller removes from disk
+// once the rows are gone. Files uploaded to an organization belong to the organization
+// and are kept, and handed to one of its owners. Users who are the last owner of an
+// organization cannot be deleted (ErrLastOrgOwner) until they transfer ownership.
+func (m *UserModel) Delete(id int) ([]string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := checkNotSoleOwner(tx.QueryRow(soleOwnerQuery, id, OrgRoleOwner, OrgRoleOwner)); err != nil {
+		return nil, err
+	}
+
+	personalFiles := `SELECT id FROM files WHERE user_id = ? AND org_id IS NULL`
+	rows, err := tx.Query(`SELECT DISTINCT file_path FROM file_versions WHERE file_id IN (`+personalFiles+`)`, id)
+	if err != nil {
+		return nil, err
+	}
+	var filePaths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		filePaths = append(filePaths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM file_versions WHERE file_id IN (`+personalFiles+`)`, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM files WHERE user_id = ? AND org_id IS NULL`, id); err != nil {
+		return nil, err
+	}
+
+	// Organizations with files cannot be deleted, and the check above leaves every
+	// organization the user owned with another owner, so one is always found
+	nextOwner := `
+		SELECT o.user_id FROM organization_members o
+		WHERE o.org_id = files.org_id AND o.role = ? AND o.user_id != ?
+		ORDER BY o.created_at, o.user_id LIMIT 1`
+	if _, err := tx.Exec(`
+		UPDATE file_versions SET user_id = (
+			SELECT (`+nextOwner+`) FROM files WHERE files.id = file_versions.file_id
+		)
+		WHERE user_id = ? AND file_id IN (SELECT id FROM files WHERE org_id IS NOT NULL)`,
+		OrgRoleOwner, id, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE files SET user_id = (`+nextOwner+`) WHERE user_id = ? AND org_id IS NOT NULL`,
+		OrgRoleOwner, id, id); err != nil {
+		return nil, err
+	}
+	for _, table := range []string{"api_keys", "user_identities", "email_verifications", "organization_members", "organization_invitations", "oauth_clients", "webauthn_credentials"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_id = ?`, id); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if affected == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return filePaths, nil
+}
+
+// SetEmail changes a user's email address and resets its verification,
+// unless verified is true (e.g. the address was asserted by a trusted identity provider)
+func (m *UserModel) SetEmail(id int, email string, verified bool) error {
+	var verifiedAt interface{}
+	if verified {
+		verifiedAt = time.Now().UTC()
+	}
+	_, err := m.DB.Exec(`UPDATE users SET email = ?, email_verified_at = ? WHERE id = ?`, email, verifiedAt, id)
+	return err
 }
 
 // ValidatePassword checks if the provided password matches the user's password
 func (u *User) ValidatePassword(password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
-	return err == nil
+	match, _ := utils.VerifyPassword(u.Password, password)
+	return match
+}
+
+// CheckPassword verifies the password and reports whether the stored hash is outdated
+func (u *User) CheckPassword(password string) (match bool, needsRehash bool) {
+	return utils.VerifyPassword(u.Password, password)
+}
+
+// EmailVerified reports whether the user has confirmed their current email address
+func (u *User) EmailVerified() bool {
+	return u.Email != "" && u.EmailVerifiedAt != nil
+}
+
+// IsDisabled reports whether an administrator has disabled the account
+func (u *User) IsDisabled() bool {
+	return u.DisabledAt != nil
+}
+
+// IsPendingDeletion reports whether the user has requested deletion of the account
+func (u *User) IsPendingDeletion() bool {
+	return u.DeletionScheduledAt != nil
+}
+
+// CanAuthenticate reports whether existing tokens and API keys of the user may be used
+func (u *User) CanAuthenticate() bool {
+	return !u.IsDisabled() && !u.IsPendingDeletion() && !u.PasswordResetRequired
+}
+
+// Scopes returns the permission scopes granted to the user by their role
+func (u *User) Scopes() []string {
+	scopes := utils.DefaultUserScopes()
+	if u.Role == RoleAdmin {
+		scopes = append(scopes, utils.ScopeAdmin)
+	}
+	return scopes
 }
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestDB creates an empty database with every table
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, create := range []func() error{
+		NewUserModel(db).CreateTable,
+		NewOrganizationModel(db).CreateTable,
+		NewFileModel(db).CreateTable,
+		NewAPIKeyModel(db).CreateTable,
+		NewUserIdentityModel(db).CreateTable,
+		NewEmailVerificationModel(db).CreateTable,
+		NewOAuthClientModel(db).CreateTable,
+		NewWebAuthnCredentialModel(db).CreateTable,
+	} {
+		if err := create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestDeleteUserKeepsOrganizationsOwned(t *testing.T) {
+	db := newTestDB(t)
+	users, orgs, files := NewUserModel(db), NewOrganizationModel(db), NewFileModel(db)
+
+	alice, err := users.CreateExternal("alice", AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := users.CreateExternal("bob", AuthSourceLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err := orgs.Create("acme", alice.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitation, err := orgs.Invite(org.ID, bob.ID, OrgRoleEditor, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orgs.AcceptInvitation(invitation.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(userID int, orgID *int, path string) *FileMetadata {
+		file, err := files.Create(&FileMetadata{
+			UserID: userID, OrgID: orgID, Filename: "a.png", ContentType: "image/png", Size: 1, FilePath: path,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	orgFile := upload(alice.ID, &org.ID, "/uploads/org")
+	upload(alice.ID, nil, "/uploads/personal")
+
+	// Alice is the only owner of acme
+	if err := users.CheckDeletable(alice.ID); err != ErrLastOrgOwner {
+		t.Errorf("CheckDeletable = %v, want ErrLastOrgOwner", err)
+	}
+	if _, err := users.Delete(alice.ID); err != ErrLastOrgOwner {
+		t.Fatalf("Delete = %v, want ErrLastOrgOwner", err)
+	}
+	if _, err := users.GetByID(alice.ID); err != nil {
+		t.Fatalf("refused deletion removed the user: %v", err)
+	}
+
+	// Once bob co-owns acme alice can go, and her organization file stays with bob
+	if err := orgs.SetMemberRole(org.ID, bob.ID, OrgRoleOwner); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := users.Delete(alice.ID)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if len(paths) != 1 || paths[0] != "/uploads/personal" {
+		t.Errorf("paths = %v, want only the personal file", paths)
+	}
+
+	kept, err := files.GetByID(orgFile.ID)
+	if err != nil || kept.UserID != bob.ID {
+		t.Fatalf("organization file = %+v, %v, want it handed to bob", kept, err)
+	}
+	var versionOwner int
+	if err := db.QueryRow(`SELECT user_id FROM file_versions WHERE file_id = ?`, orgFile.ID).Scan(&versionOwner); err != nil || versionOwner != bob.ID {
+		t.Errorf("version owner = %d, %v, want bob", versionOwner, err)
+	}
+	var dangling int
+	db.QueryRow(`SELECT COUNT(*) FROM files WHERE user_id = ?`, alice.ID).Scan(&dangling)
+	if dangling != 0 {
+		t.Errorf("%d files still reference the deleted user", dangling)
+	}
+}
@@ -0,0 +1,181 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrCredentialNotFound is returned when no passkey matches
+var ErrCredentialNotFound = errors.New("credential not found")
+
+// WebAuthnCredential is a passkey registered by a user
+type WebAuthnCredential struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id"`
+	Name         string     `json:"name"`
+	CredentialID string     `json:"credential_id"` // base64url, as used by browsers
+	PublicKey    []byte     `json:"-"`             // COSE_Key encoded
+	Algorithm    int64      `json:"algorithm"`
+	SignCount    uint32     `json:"sign_count"`
+	AAGUID       string     `json:"aaguid,omitempty"` // Hex encoded authenticator model
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// WebAuthnCredentialModel handles passkey database operations
+type WebAuthnCredentialModel struct {
+	DB *sql.DB
+}
+
+// NewWebAuthnCredentialModel creates a new WebAuthnCredentialModel
+func NewWebAuthnCredentialModel(db *sql.DB) *WebAuthnCredentialModel {
+	return &WebAuthnCredentialModel{DB: db}
+}
+
+// CreateTable creates the webauthn_credentials table if it doesn't exist
+func (m *WebAuthnCredentialModel) CreateTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		credential_id TEXT UNIQUE NOT NULL,
+		public_key BLOB NOT NULL,
+		algorithm INTEGER NOT NULL,
+		sign_count INTEGER NOT NULL DEFAULT 0,
+		aaguid TEXT,
+		last_used_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	)`
+	_, err := m.DB.Exec(query)
+	return err
+}
+
+// Create stores a new passkey
+func (m *WebAuthnCredentialModel) Create(credential *WebAuthnCredential) (*WebAuthnCredential, error) {
+	query := `
+	INSERT INTO webauthn_credentials (user_id, name, credential_id, public_key, algorithm, sign_count, aaguid)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+	result, err := m.DB.Exec(query,
+		credential.UserID,
+		credential.Name,
+		credential.CredentialID,
+		credential.PublicKey,
+		credential.Algorithm,
+		credential.SignCount,
+		credential.AAGUID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return m.getBy(`id = ?`, id)
+}
+
+const webAuthnCredentialColumns = `id, user_id, name, credential_id, public_key, algorithm, sign_count, aaguid, last_used_at, created_at`
+
+// scanWebAuthnCredential scans a row selected with webAuthnCredentialColumns
+func scanWebAuthnCredential(row interface{ Scan(...interface{}) error }) (*WebAuthnCredential, error) {
+	credential := &WebAuthnCredential{}
+	var aaguid sql.NullString
+	var lastUsedAt sql.NullTime
+	err := row.Scan(
+		&credential.ID,
+		&credential.UserID,
+		&credential.Name,
+		&credential.CredentialID,
+		&credential.PublicKey,
+		&credential.Algorithm,
+		&credential.SignCount,
+		&aaguid,
+		&lastUsedAt,
+		&credential.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	credential.AAGUID = aaguid.String
+	if lastUsedAt.Valid {
+		credential.LastUsedAt = &lastUsedAt.Time
+	}
+	return credential, nil
+}
+
+// getBy retrieves a single credential matching the condition
+func (m *WebAuthnCredentialModel) getBy(condition string, args ...interface{}) (*WebAuthnCredential, error) {
+	query := `SELECT ` + webAuthnCredentialColumns + ` FROM webauthn_credentials WHERE ` + condition
+	credential, err := scanWebAuthnCredential(m.DB.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, ErrCredentialNotFound
+	}
+	return credential, err
+}
+
+// GetByCredentialID retrieves a passkey by its base64url credential ID
+func (m *WebAuthnCredentialModel) GetByCredentialID(credentialID string) (*WebAuthnCredential, error) {
+	return m.getBy(`credential_id = ?`, credentialID)
+}
+
+// ListByUser retrieves the passkeys of a user, oldest first
+func (m *WebAuthnCredentialModel) ListByUser(userID int) ([]*WebAuthnCredential, error) {
+	query := `SELECT ` + webAuthnCredentialColumns + ` FROM webauthn_credentials WHERE user_id = ? ORDER BY id`
+	rows, err := m.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []*WebAuthnCredential{}
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+// RecordUse stores the signature counter reported by the authenticator and the time of use.
+// The update only applies while the stored counter is still the one the caller checked,
+// so two concurrent logins with a cloned authenticator cannot both succeed.
+func (m *WebAuthnCredentialModel) RecordUse(id int, previousCount, signCount uint32) error {
+	query := `UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ? WHERE id = ? AND sign_count = ?`
+	result, err := m.DB.Exec(query, signCount, time.Now().UTC(), id, previousCount)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+// Delete removes a passkey owned by the user
+func (m *WebAuthnCredentialModel) Delete(id, userID int) error {
+	result, err := m.DB.Exec(`DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// cborVectors are encodings from RFC 8949 appendix A and their decoded values
+var cborVectors = []struct {
+	hex  string
+	want interface{}
+}{
+	{"00", int64(0)},
+	{"17", int64(23)},
+	{"1818", int64(24)},
+	{"1903e8", int64(1000)},
+	{"1a000f4240", int64(1000000)},
+	{"1b000000e8d4a51000", int64(1000000000000)},
+	{"20", int64(-1)},
+	{"3903e7", int64(-1000)},
+	{"f4", false},
+	{"f5", true},
+	{"f6", nil},
+	{"f93c00", 1.0},
+	{"fa47c35000", 100000.0},
+	{"fb3ff199999999999a", 1.1},
+	{"40", []byte{}},
+	{"4401020304", []byte{1, 2, 3, 4}},
+	{"60", ""},
+	{"6449455446", "IETF"},
+	{"80", []interface{}{}},
+	{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+	{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+	{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+	{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+	{"c11a514b67b0", int64(1363896240)}, // Tags are skipped
+}
+
+func TestDecodeCBORVectors(t *testing.T) {
+	for _, tt := range cborVectors {
+		data, _ := hex.DecodeString(tt.hex)
+		value, n, err := DecodeCBOR(data)
+		if err != nil || n != len(data) || !reflect.DeepEqual(value, tt.want) {
+			t.Errorf("DecodeCBOR(%s) = %#v, %d, %v, want %#v", tt.hex, value, n, err, tt.want)
+		}
+	}
+
+	// Only the first item is decoded
+	if value, n, err := DecodeCBOR([]byte{0x01, 0x02}); err != nil || n != 1 || value != int64(1) {
+		t.Errorf("first of two items = %v, %d, %v", value, n, err)
+	}
+	if value, _, _ := DecodeCBOR([]byte{0xf9, 0x7c, 0x00}); value != math.Inf(1) {
+		t.Errorf("half float infinity = %v", value)
+	}
+}
+
+func TestDecodeCBORRejectsMalformedInput(t *testing.T) {
+	nested := bytes.Repeat([]byte{0x81}, maxCBORDepth+2)
+	for name, input := range map[string]string{
+		"empty":                    "",
+		"truncated argument":       "19 03",
+		"truncated string":         "44 0102",
+		"truncated array":          "83 0102",
+		"truncated map":            "a2 0102 03",
+		"huge byte string":         "5b ffffffffffffffff",
+		"huge array":               "9b ffffffffffffffff",
+		"huge map":                 "bb ffffffffffffffff",
+		"integer overflow":         "1b ffffffffffffffff",
+		"negative overflow":        "3b ffffffffffffffff",
+		"indefinite length":        "5f 4101 ff",
+		"array map key":            "a1 80 01",
+		"unsupported simple":       "f0",
+		"reserved additional info": "1c",
+		"nesting too deep":         hex.EncodeToString(nested),
+	} {
+		data, err := hex.DecodeString(string(bytes.ReplaceAll([]byte(input), []byte(" "), nil)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if value, _, err := DecodeCBOR(data); err == nil {
+			t.Errorf("%s: decoded %#v, want an error", name, value)
+		}
+	}
+}
+
+// FuzzDecodeCBOR checks that arbitrary input never panics or claims more bytes than it has
+func FuzzDecodeCBOR(f *testing.F) {
+	for _, tt := range cborVectors {
+		data, _ := hex.DecodeString(tt.hex)
+		f.Add(data)
+	}
+	f.Add(bytes.Repeat([]byte{0x81}, 64))
+	f.Add([]byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, n, err := DecodeCBOR(data)
+		if err == nil && (n <= 0 || n > len(data)) {
+			t.Fatalf("consumed %d of %d bytes", n, len(data))
+		}
+	})
+}
+
+// FuzzParseAttestationObject runs attacker-controlled registration data through the
+// attestation, authenticator data and COSE key parsers
+func FuzzParseAttestationObject(f *testing.F) {
+	// {"fmt": "none", "attStmt": {}, "authData": <37 bytes without credential data>}
+	f.Add(append(mustDecodeHex("a363666d74646e6f6e656761747453746d74a068617574684461746158"+"25"), make([]byte, 37)...))
+	f.Add(mustDecodeHex("a168617574684461746140"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		authData, _, err := ParseAttestationObject(data)
+		if err != nil {
+			return
+		}
+		ParseCOSEKey(authData.PublicKey)
+	})
+}
+
+func mustDecodeHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
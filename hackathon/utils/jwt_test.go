@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestScopedTokensStayWithinTheirParent(t *testing.T) {
+	parentExpiry := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+	parent := &Claims{
+		UserID:           1,
+		Username:         "alice",
+		Scopes:           []string{ScopeFilesRead, ScopeFilesWrite},
+		APIKeyID:         7,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(parentExpiry)},
+	}
+
+	for _, tt := range []struct {
+		name   string
+		scopes []string
+		ttl    time.Duration
+		err    error
+	}{
+		{"subset", []string{ScopeFilesRead}, time.Minute, nil},
+		{"same scopes", []string{ScopeFilesWrite, ScopeFilesRead}, time.Minute, nil},
+		{"scope the parent lacks", []string{ScopeFilesRead, ScopeFilesDelete}, time.Minute, ErrScopeEscalation},
+		{"admin", []string{ScopeAdmin}, time.Minute, ErrScopeEscalation},
+		{"no scopes", nil, time.Minute, ErrNoScopes},
+		{"no lifetime", []string{ScopeFilesRead}, 0, ErrUnboundedToken},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			token, claims, err := GenerateScopedToken(parent, tt.scopes, tt.ttl)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			validated, err := ValidateToken(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(validated.Scopes, tt.scopes) || validated.APIKeyID != parent.APIKeyID || validated.UserID != parent.UserID {
+				t.Errorf("claims = %+v, want the parent's identity with scopes %v", validated, tt.scopes)
+			}
+			if !claims.ExpiresAt.Time.Before(parentExpiry.Add(time.Second)) {
+				t.Errorf("expires at %v, after the parent's %v", claims.ExpiresAt.Time, parentExpiry)
+			}
+		})
+	}
+
+	// A longer lifetime than the parent has left is cut to the parent's expiry
+	_, claims, err := GenerateScopedToken(parent, []string{ScopeFilesRead}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claims.ExpiresAt.Time.Equal(parentExpiry) {
+		t.Errorf("expires at %v, want the parent's expiry %v", claims.ExpiresAt.Time, parentExpiry)
+	}
+
+	// Parents without an expiry, such as API keys, are bounded by the lifetime alone
+	parent.ExpiresAt = nil
+	_, claims, err = GenerateScopedToken(parent, []string{ScopeFilesRead}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := time.Until(claims.ExpiresAt.Time); remaining <= 59*time.Minute || remaining > time.Hour {
+		t.Errorf("token without a parent expiry lives %v, want an hour", remaining)
+	}
+}
+
+func TestLegacyClaimsGrantDefaultScopes(t *testing.T) {
+	token, err := SignClaims(&Claims{UserID: 1, Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Scopes != nil || !reflect.DeepEqual(claims.GrantedScopes(), DefaultUserScopes()) {
+		t.Errorf("scopes %v, granted %v, want the default user scopes", claims.Scopes, claims.GrantedScopes())
+	}
+	if HasScope(claims.GrantedScopes(), ScopeAdmin) {
+		t.Error("legacy tokens must not grant admin")
+	}
+
+	// Tokens minted from a legacy token are bounded by the default scopes too
+	if _, _, err := GenerateScopedToken(claims, []string{ScopeFilesRead}, time.Minute); err != nil {
+		t.Errorf("minting files:read from a legacy token: %v", err)
+	}
+	if _, _, err := GenerateScopedToken(claims, []string{ScopeAdmin}, time.Minute); err != ErrScopeEscalation {
+		t.Errorf("minting admin from a legacy token: err = %v, want ErrScopeEscalation", err)
+	}
+}
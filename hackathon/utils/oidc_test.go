@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestUnknownKeyIDsRefreshKeysAtMostOncePerInterval(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwksRequests atomic.Int32
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwksRequests.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "current",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+
+	provider := NewOIDCProvider(&OIDCConfig{IssuerURL: server.URL, ClientID: "client"})
+	verify := func(kid string) error {
+		t.Helper()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, &IDTokenClaims{
+			Nonce: "nonce",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    server.URL,
+				Subject:   "subject",
+				Audience:  jwt.ClaimStrings{"client"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+			},
+		})
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = provider.VerifyIDToken(signed, "nonce")
+		return err
+	}
+
+	if err := verify("current"); err != nil || jwksRequests.Load() != 1 {
+		t.Fatalf("first token: %v after %d JWKS requests, want success after 1", err, jwksRequests.Load())
+	}
+	// Tokens with made-up key IDs do not reach the provider again within the interval
+	for i := 0; i < 5; i++ {
+		if err := verify("made-up"); err == nil {
+			t.Fatal("token with an unknown key ID was accepted")
+		}
+	}
+	if n := jwksRequests.Load(); n != 1 {
+		t.Errorf("JWKS requests = %d after unknown key IDs, want 1", n)
+	}
+	if err := verify("current"); err != nil {
+		t.Errorf("known key after refusals: %v", err)
+	}
+
+	// Once the interval has passed, an unknown key ID may fetch rotated keys again
+	provider.mutex.Lock()
+	provider.keysRequestedAt = time.Now().Add(-jwksRefreshInterval)
+	provider.mutex.Unlock()
+	verify("rotated")
+	if n := jwksRequests.Load(); n != 2 {
+		t.Errorf("JWKS requests = %d after the interval, want 2", n)
+	}
+}
@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported password hashing algorithms
+const (
+	PasswordAlgorithmArgon2id = "argon2id"
+	PasswordAlgorithmBcrypt   = "bcrypt"
+)
+
+// ErrUnsupportedHash is returned for stored hashes in an unknown format
+var ErrUnsupportedHash = errors.New("unsupported password hash format")
+
+// Argon2Params holds the tunable Argon2id parameters
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// getEnvUint reads a positive integer environment variable with a default
+func getEnvUint(name string, defaultValue uint64, bitSize int) uint64 {
+	value, err := strconv.ParseUint(os.Getenv(name), 10, bitSize)
+	if err != nil || value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// GetPasswordHashAlgorithm returns the algorithm used for new password hashes
+func GetPasswordHashAlgorithm() string {
+	if os.Getenv("PASSWORD_HASH_ALGORITHM") == PasswordAlgorithmBcrypt {
+		return PasswordAlgorithmBcrypt
+	}
+	return PasswordAlgorithmArgon2id
+}
+
+// GetArgon2Params returns the Argon2id parameters from environment or defaults
+func GetArgon2Params() Argon2Params {
+	return Argon2Params{
+		Memory:      uint32(getEnvUint("ARGON2_MEMORY_KB", 64*1024, 32)),
+		Iterations:  uint32(getEnvUint("ARGON2_ITERATIONS", 3, 32)),
+		Parallelism: uint8(getEnvUint("ARGON2_PARALLELISM", 2, 8)),
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+// getBcryptCost returns the bcrypt cost from environment or the library default
+func getBcryptCost() int {
+	cost := int(getEnvUint("BCRYPT_COST", uint64(bcrypt.DefaultCost), 8))
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return bcrypt.DefaultCost
+	}
+	return cost
+}
+
+// HashPassword hashes a password with the configured algorithm.
+// Argon2id hashes are encoded in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	if GetPasswordHashAlgorithm() == PasswordAlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), getBcryptCost())
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	params := GetArgon2Params()
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.Memory,
+		params.Iterations,
+		params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// VerifyPassword checks a password against a stored hash. needsRehash reports
+// whether the hash was produced with an outdated algorithm or parameters and
+// should be replaced now that the plaintext is known.
+func VerifyPassword(encodedHash, password string) (match bool, needsRehash bool) {
+	switch {
+	case strings.HasPrefix(encodedHash, "$argon2id$"):
+		params, salt, key, err := decodeArgon2Hash(encodedHash)
+		if err != nil {
+			return false, false
+		}
+		otherKey := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+			return false, false
+		}
+		current := GetArgon2Params()
+		outdated := GetPasswordHashAlgorithm() != PasswordAlgorithmArgon2id ||
+			params.Memory != current.Memory ||
+			params.Iterations != current.Iterations ||
+			params.Parallelism != current.Parallelism ||
+			params.KeyLength != current.KeyLength
+		return true, outdated
+
+	case strings.HasPrefix(encodedHash, "$2a$"), strings.HasPrefix(encodedHash, "$2b$"), strings.HasPrefix(encodedHash, "$2y$"):
+		if bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost([]byte(encodedHash))
+		outdated := GetPasswordHashAlgorithm() != PasswordAlgorithmBcrypt || err != nil || cost != getBcryptCost()
+		return true, outdated
+
+	default:
+		return false, false
+	}
+}
+
+// decodeArgon2Hash parses a PHC formatted Argon2id hash
+func decodeArgon2Hash(encodedHash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useCheapArgon2 configures small Argon2id parameters so the tests stay fast
+func useCheapArgon2(t *testing.T) {
+	t.Helper()
+	t.Setenv("PASSWORD_HASH_ALGORITHM", "")
+	t.Setenv("ARGON2_MEMORY_KB", "1024")
+	t.Setenv("ARGON2_ITERATIONS", "1")
+	t.Setenv("ARGON2_PARALLELISM", "1")
+}
+
+func TestArgon2idHashesUsePHCFormat(t *testing.T) {
+	useCheapArgon2(t)
+
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("hash %q is not a PHC string with the configured parameters", hash)
+	}
+	params, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Memory != 1024 || params.Iterations != 1 || params.Parallelism != 1 || len(salt) != 16 || len(key) != 32 {
+		t.Errorf("decoded %+v with %d byte salt and %d byte key", params, len(salt), len(key))
+	}
+
+	if other, _ := HashPassword("correct horse"); other == hash {
+		t.Error("hashing the same password twice gave the same hash, the salt is not random")
+	}
+	if match, needsRehash := VerifyPassword(hash, "correct horse"); !match || needsRehash {
+		t.Errorf("correct password: match %t, needsRehash %t", match, needsRehash)
+	}
+	if match, _ := VerifyPassword(hash, "correct horse "); match {
+		t.Error("wrong password matched")
+	}
+
+	// Malformed hashes never match
+	parts := strings.Split(hash, "$")
+	for _, malformed := range []string{
+		strings.Join(parts[:5], "$"),
+		strings.Replace(hash, "v=19", "v=16", 1),
+		strings.Replace(hash, "m=1024", "m=x", 1),
+		strings.Join(append(parts[:4:4], "!!!", parts[5]), "$"),
+		strings.Join(append(parts[:5:5], "!!!"), "$"),
+		"plaintext",
+	} {
+		if _, _, _, err := decodeArgon2Hash(malformed); malformed != "plaintext" && err != ErrUnsupportedHash {
+			t.Errorf("decoding %q: err = %v, want ErrUnsupportedHash", malformed, err)
+		}
+		if match, _ := VerifyPassword(malformed, "correct horse"); match {
+			t.Errorf("malformed hash %q matched", malformed)
+		}
+	}
+}
+
+func TestBcryptHashesStillVerify(t *testing.T) {
+	useCheapArgon2(t)
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if match, needsRehash := VerifyPassword(string(legacy), "correct horse"); !match || !needsRehash {
+		t.Errorf("bcrypt hash with argon2id configured: match %t, needsRehash %t, want a match that needs rehashing", match, needsRehash)
+	}
+	if match, _ := VerifyPassword(string(legacy), "wrong"); match {
+		t.Error("wrong password matched a bcrypt hash")
+	}
+
+	// Hashes made with the configured algorithm and cost are kept
+	t.Setenv("PASSWORD_HASH_ALGORITHM", PasswordAlgorithmBcrypt)
+	t.Setenv("BCRYPT_COST", "4")
+	if match, needsRehash := VerifyPassword(string(legacy), "correct horse"); !match || needsRehash {
+		t.Errorf("bcrypt hash with bcrypt configured: match %t, needsRehash %t", match, needsRehash)
+	}
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, err := bcrypt.Cost([]byte(hash)); err != nil || cost != 4 {
+		t.Errorf("new bcrypt hash has cost %d (%v), want 4", cost, err)
+	}
+}
+
+func TestOutdatedHashesNeedRehash(t *testing.T) {
+	useCheapArgon2(t)
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name, value string
+		env         string
+		needsRehash bool
+	}{
+		{"same parameters", "1024", "ARGON2_MEMORY_KB", false},
+		{"more memory", "2048", "ARGON2_MEMORY_KB", true},
+		{"more iterations", "2", "ARGON2_ITERATIONS", true},
+		{"more parallelism", "2", "ARGON2_PARALLELISM", true},
+		{"bcrypt configured", PasswordAlgorithmBcrypt, "PASSWORD_HASH_ALGORITHM", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			match, needsRehash := VerifyPassword(hash, "correct horse")
+			if !match || needsRehash != tt.needsRehash {
+				t.Errorf("match %t, needsRehash %t, want %t", match, needsRehash, tt.needsRehash)
+			}
+		})
+	}
+
+	// Bcrypt hashes with another cost are upgraded as well
+	t.Setenv("PASSWORD_HASH_ALGORITHM", PasswordAlgorithmBcrypt)
+	t.Setenv("BCRYPT_COST", "5")
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if match, needsRehash := VerifyPassword(string(legacy), "correct horse"); !match || !needsRehash {
+		t.Errorf("bcrypt hash with another cost: match %t, needsRehash %t", match, needsRehash)
+	}
+}
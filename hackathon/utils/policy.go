@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// commonPasswords is the bundled list of breached and frequently used passwords
+//
+//go:embed data/common-passwords.txt
+var commonPasswords string
+
+// defaultReservedUsernames cannot be registered unless USERNAME_RESERVED overrides them
+var defaultReservedUsernames = []string{
+	"admin", "administrator", "root", "system", "sysadmin", "superuser",
+	"support", "help", "security", "api", "www", "mail", "webmaster",
+	"postmaster", "hostmaster", "abuse", "noreply", "no-reply", "null",
+	"undefined", "anonymous", "guest", "me", "self", "public", "static",
+}
+
+// PolicyViolation describes a single failed policy rule
+type PolicyViolation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicy defines the requirements for new passwords
+type PasswordPolicy struct {
+	MinLength        int
+	MaxLength        int
+	RequireUpper     bool
+	RequireLower     bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	RejectCommon     bool
+	RejectUsername   bool
+	blockedPasswords map[string]bool
+}
+
+// UsernamePolicy defines the requirements for new usernames
+type UsernamePolicy struct {
+	MinLength      int
+	MaxLength      int
+	AllowedPattern *regexp.Regexp
+	Reserved       map[string]bool
+}
+
+var (
+	passwordPolicy     *PasswordPolicy
+	passwordPolicyOnce sync.Once
+	usernamePolicy     *UsernamePolicy
+	usernamePolicyOnce sync.Once
+)
+
+// getEnvInt reads an integer environment variable with a default
+func getEnvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvBool reads a boolean environment variable with a default
+func getEnvBool(name string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// GetPasswordPolicy returns the password policy configured by environment variables
+func GetPasswordPolicy() *PasswordPolicy {
+	passwordPolicyOnce.Do(func() {
+		passwordPolicy = &PasswordPolicy{
+			MinLength:      getEnvInt("PASSWORD_MIN_LENGTH", 8),
+			MaxLength:      getEnvInt("PASSWORD_MAX_LENGTH", 128),
+			RequireUpper:   getEnvBool("PASSWORD_REQUIRE_UPPER", false),
+			RequireLower:   getEnvBool("PASSWORD_REQUIRE_LOWER", false),
+			RequireDigit:   getEnvBool("PASSWORD_REQUIRE_DIGIT", false),
+			RequireSymbol:  getEnvBool("PASSWORD_REQUIRE_SYMBOL", false),
+			RejectCommon:   getEnvBool("PASSWORD_REJECT_COMMON", true),
+			RejectUsername: true,
+		}
+		passwordPolicy.blockedPasswords = loadBlockedPasswords(os.Getenv("PASSWORD_BLOCKLIST_FILE"))
+	})
+	return passwordPolicy
+}
+
+// GetUsernamePolicy returns the username policy configured by environment variables
+func GetUsernamePolicy() *UsernamePolicy {
+	usernamePolicyOnce.Do(func() {
+		pattern := os.Getenv("USERNAME_ALLOWED_PATTERN")
+		if pattern == "" {
+			pattern = `^[a-z0-9][a-z0-9._-]*$`
+		}
+		allowed, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Printf("Invalid USERNAME_ALLOWED_PATTERN, using default: %v", err)
+			allowed = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+		}
+
+		reservedNames := defaultReservedUsernames
+		if value := os.Getenv("USERNAME_RESERVED"); value != "" {
+			reservedNames = strings.Split(value, ",")
+		}
+		reserved := make(map[string]bool)
+		for _, name := range reservedNames {
+			if name = NormalizeUsername(name); name != "" {
+				reserved[name] = true
+			}
+		}
+
+		usernamePolicy = &UsernamePolicy{
+			MinLength:      getEnvInt("USERNAME_MIN_LENGTH", 3),
+			MaxLength:      getEnvInt("USERNAME_MAX_LENGTH", 32),
+			AllowedPattern: allowed,
+			Reserved:       reserved,
+		}
+	})
+	return usernamePolicy
+}
+
+// loadBlockedPasswords reads the bundled list plus an optional extra file
+func loadBlockedPasswords(extraFile string) map[string]bool {
+	blocked := make(map[string]bool)
+	addBlockedPasswords(blocked, commonPasswords)
+
+	if extraFile != "" {
+		data, err := os.ReadFile(extraFile)
+		if err != nil {
+			log.Printf("Failed to read PASSWORD_BLOCKLIST_FILE: %v", err)
+		} else {
+			addBlockedPasswords(blocked, string(data))
+		}
+	}
+	return blocked
+}
+
+// addBlockedPasswords parses one password per line, skipping comments
+func addBlockedPasswords(blocked map[string]bool, list string) {
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		blocked[strings.ToLower(line)] = true
+	}
+}
+
+// NormalizeUsername applies Unicode NFKC normalization, case folding and trimming,
+// so visually equivalent spellings map to the same account
+func NormalizeUsername(username string) string {
+	username = norm.NFKC.String(strings.TrimSpace(username))
+	return cases.Fold().String(username)
+}
+
+// Validate checks a raw username and returns its normalized form with any violations
+func (p *UsernamePolicy) Validate(raw string) (string, []PolicyViolation) {
+	username := NormalizeUsername(raw)
+	var violations []PolicyViolation
+
+	length := utf8.RuneCountInString(username)
+	if length < p.MinLength || length > p.MaxLength {
+		violations = append(violations, PolicyViolation{
+			Field:   "username",
+			Rule:    "length",
+			Message: fmt.Sprintf("Username must be between %d and %d characters long", p.MinLength, p.MaxLength),
+		})
+	}
+	if !p.AllowedPattern.MatchString(username) {
+		violations = append(violations, PolicyViolation{
+			Field:   "username",
+			Rule:    "charset",
+			Message: "Username may only contain lowercase letters, digits, '.', '_' and '-', and must start with a letter or digit",
+		})
+	}
+	if p.Reserved[username] {
+		violations = append(violations, PolicyViolation{
+			Field:   "username",
+			Rule:    "reserved",
+			Message: "Username is reserved",
+		})
+	}
+	return username, violations
+}
+
+// ExternalUsername picks the local username for an account provisioned from an external
+// identity. Names that fail the policy, for example reserved ones, are replaced by a
+// generated "user-" name, the same rules that apply to registration.
+func (p *UsernamePolicy) ExternalUsername(candidate string) (string, error) {
+	username, violations := p.Validate(candidate)
+	if len(violations) == 0 {
+		return username, nil
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return "user-" + hex.EncodeToString(suffix), nil
+}
+
+// Validate checks a new password, optionally against the (normalized) username
+func (p *PasswordPolicy) Validate(password, username string) []PolicyViolation {
+	var violations []PolicyViolation
+	add := func(rule, message string) {
+		violations = append(violations, PolicyViolation{Field: "password", Rule: rule, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		add("min_length", fmt.Sprintf("Password must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add("max_length", fmt.Sprintf("Password must be at most %d characters long", p.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			hasSymbol = true
+		}
+	}
+	if p.RequireUpper && !hasUpper {
+		add("require_upper", "Password must contain an uppercase letter")
+	}
+	if p.RequireLower && !hasLower {
+		add("require_lower", "Password must contain a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		add("require_digit", "Password must contain a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		add("require_symbol", "Password must contain a symbol")
+	}
+
+	lowered := strings.ToLower(password)
+	if p.RejectCommon && p.blockedPasswords[lowered] {
+		add("common", "Password is too common or has appeared in a data breach")
+	}
+	if p.RejectUsername && username != "" && strings.Contains(lowered, username) {
+		add("contains_username", "Password must not contain the username")
+	}
+	return violations
+}
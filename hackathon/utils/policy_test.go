@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// testUsernamePolicy returns the default username policy without reading the environment
+func testUsernamePolicy() *UsernamePolicy {
+	reserved := make(map[string]bool)
+	for _, name := range defaultReservedUsernames {
+		reserved[name] = true
+	}
+	return &UsernamePolicy{
+		MinLength:      3,
+		MaxLength:      32,
+		AllowedPattern: regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`),
+		Reserved:       reserved,
+	}
+}
+
+// rules returns the rules of the violations
+func rules(violations []PolicyViolation) []string {
+	var names []string
+	for _, v := range violations {
+		names = append(names, v.Rule)
+	}
+	return names
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	for raw, want := range map[string]string{
+		"alice":      "alice",
+		"  Alice\t":  "alice",
+		"ＡＬＩＣＥ":      "alice",       // Fullwidth letters
+		"Kate":       "kate",        // Kelvin sign
+		"ﬁle.server": "file.server", // Ligature
+		"Straße":     "strasse",
+		"ΣΊΣΥΦΟΣ":    "σίσυφοσ",
+	} {
+		if got := NormalizeUsername(raw); got != want {
+			t.Errorf("NormalizeUsername(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestUsernamePolicy(t *testing.T) {
+	policy := testUsernamePolicy()
+
+	for _, tt := range []struct {
+		raw      string
+		username string
+		rules    []string
+	}{
+		{"alice", "alice", nil},
+		{"Alice.Smith-2", "alice.smith-2", nil},
+		{"ab", "ab", []string{"length"}},
+		{"-alice", "-alice", []string{"charset"}},
+		{"alice smith", "alice smith", []string{"charset"}},
+		{"Admin", "admin", []string{"reserved"}},
+		{"ＡＤＭＩＮ", "admin", []string{"reserved"}},
+		{"me", "me", []string{"length", "reserved"}},
+	} {
+		username, violations := policy.Validate(tt.raw)
+		if username != tt.username || !equalStrings(rules(violations), tt.rules) {
+			t.Errorf("Validate(%q) = %q %v, want %q %v", tt.raw, username, rules(violations), tt.username, tt.rules)
+		}
+	}
+}
+
+func TestExternalUsernameFallsBackToGeneratedName(t *testing.T) {
+	policy := testUsernamePolicy()
+
+	if username, err := policy.ExternalUsername("Alice.Smith"); err != nil || username != "alice.smith" {
+		t.Errorf("valid name = %q, %v, want the normalized name", username, err)
+	}
+
+	generated := regexp.MustCompile(`^user-[0-9a-f]{8}$`)
+	for _, candidate := range []string{"admin", "Root", "x", "alice@example.com", ""} {
+		username, err := policy.ExternalUsername(candidate)
+		if err != nil || !generated.MatchString(username) {
+			t.Errorf("ExternalUsername(%q) = %q, %v, want a generated name", candidate, username, err)
+		}
+		if _, violations := policy.Validate(username); len(violations) != 0 {
+			t.Errorf("generated name %q fails the policy: %v", username, rules(violations))
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	extra := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(extra, []byte("# Company specific\nAcmeCorp2024\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy := &PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        20,
+		RejectCommon:     true,
+		RejectUsername:   true,
+		blockedPasswords: loadBlockedPasswords(extra),
+	}
+
+	for _, tt := range []struct {
+		password, username string
+		rules              []string
+	}{
+		{"tr0ub4dor&3", "alice", nil},
+		{"short", "alice", []string{"min_length"}},
+		{"this one is far too long", "alice", []string{"max_length"}},
+		{"password", "alice", []string{"common"}},
+		{"PassWord", "alice", []string{"common"}},
+		{"acmecorp2024", "alice", []string{"common"}},
+		{"alice-2024!", "alice", []string{"contains_username"}},
+		{"MyALICEpass", "alice", []string{"contains_username"}},
+		// Without a username, for example for an external account, the rule does not apply
+		{"alice-2024!", "", nil},
+		// Comments in blocklists are not passwords
+		{"# Company specific", "alice", nil},
+	} {
+		if violations := policy.Validate(tt.password, tt.username); !equalStrings(rules(violations), tt.rules) {
+			t.Errorf("Validate(%q, %q) = %v, want %v", tt.password, tt.username, rules(violations), tt.rules)
+		}
+	}
+
+	policy.RequireUpper, policy.RequireLower, policy.RequireDigit, policy.RequireSymbol = true, true, true, true
+	if got := rules(policy.Validate("abcdefgh", "")); !equalStrings(got, []string{"require_upper", "require_digit", "require_symbol"}) {
+		t.Errorf("character classes: %v", got)
+	}
+	if got := rules(policy.Validate("Abcdef1!", "")); got != nil {
+		t.Errorf("password with every character class: %v", got)
+	}
+}
+
+// equalStrings compares two string slices, treating nil and empty alike
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Supported permission scopes
+const (
+	ScopeFilesRead   = "files:read"
+	ScopeFilesWrite  = "files:write"
+	ScopeFilesDelete = "files:delete"
+	ScopeOrgsManage  = "orgs:manage" // Create organizations, change members and invitations
+	ScopeAccount     = "account"     // Change credentials, identities and the account itself
+	ScopeAdmin       = "admin"
+)
+
+// knownScopes lists every scope that may be granted
+var knownScopes = []string{
+	ScopeFilesRead,
+	ScopeFilesWrite,
+	ScopeFilesDelete,
+	ScopeOrgsManage,
+	ScopeAccount,
+	ScopeAdmin,
+}
+
+// ErrScopeNotDelegable is returned when a delegated credential asks for a session-only scope
+var ErrScopeNotDelegable = fmt.Errorf("scope %s is only granted by logging in and cannot be delegated", ScopeAccount)
+
+// DefaultUserScopes returns the scopes granted to a regular user
+func DefaultUserScopes() []string {
+	return []string{ScopeFilesRead, ScopeFilesWrite, ScopeFilesDelete, ScopeOrgsManage, ScopeAccount}
+}
+
+// DelegableScopes returns the granted scopes that API keys, OAuth clients and minted
+// tokens may carry. The account scope stays with tokens from an interactive login, so a
+// leaked delegated credential can never take over the account.
+func DelegableScopes(granted []string) []string {
+	return RemoveScope(granted, ScopeAccount)
+}
+
+// IsKnownScope checks if a scope is supported
+func IsKnownScope(scope string) bool {
+	for _, known := range knownScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateScopes ensures every scope in the list is supported
+func ValidateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if !IsKnownScope(scope) {
+			return fmt.Errorf("unknown scope: %s", scope)
+		}
+	}
+	return nil
+}
+
+// ValidateDelegatedScopes ensures every scope is supported and may be delegated
+func ValidateDelegatedScopes(scopes []string) error {
+	if err := ValidateScopes(scopes); err != nil {
+		return err
+	}
+	if HasScope(scopes, ScopeAccount) {
+		return ErrScopeNotDelegable
+	}
+	return nil
+}
+
+// HasScope checks if the granted scopes contain the given scope
+func HasScope(granted []string, scope string) bool {
+	for _, s := range granted {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveScope returns the granted scopes without the given scope
+func RemoveScope(granted []string, scope string) []string {
+	var remaining []string
+	for _, s := range granted {
+		if s != scope {
+			remaining = append(remaining, s)
+		}
+	}
+	return remaining
+}
+
+// IsSubset checks if every requested scope is part of the granted scopes
+func IsSubset(requested, granted []string) bool {
+	for _, scope := range requested {
+		if !HasScope(granted, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// JoinScopes serializes scopes as a space-separated string (OAuth2 style)
+func JoinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// ParseScopes parses a space-separated scope string
+func ParseScopes(s string) []string {
+	return strings.Fields(s)
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// MaxStateEntries bounds the values a StateStore holds. The stores are written by
+// unauthenticated requests, so without a bound anonymous clients could exhaust memory.
+const MaxStateEntries = 10000
+
+// stateCleanupInterval is how often expired values are removed
+const stateCleanupInterval = time.Minute
+
+// ErrStateStoreFull is returned when a StateStore already holds MaxStateEntries values
+var ErrStateStoreFull = errors.New("too many pending requests")
+
+// stateEntry holds a stored value and its expiry
+type stateEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// StateStore keeps short-lived, single-use values such as login states and challenges
+type StateStore struct {
+	entries    map[string]stateEntry
+	maxEntries int
+	mutex      sync.Mutex
+}
+
+// NewStateStore creates a new StateStore instance and starts removing expired values
+// in the background
+func NewStateStore() *StateStore {
+	s := &StateStore{
+		entries:    make(map[string]stateEntry),
+		maxEntries: MaxStateEntries,
+	}
+	go func() {
+		ticker := time.NewTicker(stateCleanupInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.cleanup()
+		}
+	}()
+	return s
+}
+
+// Put stores a value under key for the given duration. New values are refused while
+// the store is full, until values are taken or expire.
+func (s *StateStore) Put(key string, value interface{}, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.entries[key]; !exists && len(s.entries) >= s.maxEntries {
+		return ErrStateStoreFull
+	}
+	s.entries[key] = stateEntry{value: value, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+// Take returns the value stored under key and removes it, so it can only be used once
+func (s *StateStore) Take(key string) (interface{}, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, exists := s.entries[key]
+	if !exists {
+		return nil, false
+	}
+	delete(s.entries, key)
+	if time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// cleanup removes expired entries
+func (s *StateStore) cleanup() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for key, entry := range s.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// RandomToken returns a URL-safe random string built from n random bytes
+func RandomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HashToken returns the hex encoded SHA-256 digest of a random token.
+// Tokens carry at least 256 bits of randomness, so a fast hash is sufficient.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
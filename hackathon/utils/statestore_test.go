@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStateStoreValuesAreSingleUse(t *testing.T) {
+	s := NewStateStore()
+	if err := s.Put("state", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := s.Take("state"); !ok || value != "value" {
+		t.Fatalf("Take = %v, %t, want the stored value", value, ok)
+	}
+	if _, ok := s.Take("state"); ok {
+		t.Error("second Take returned the value again")
+	}
+
+	if err := s.Put("expired", "value", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Take("expired"); ok {
+		t.Error("Take returned an expired value")
+	}
+}
+
+func TestStateStoreRefusesValuesWhenFull(t *testing.T) {
+	s := NewStateStore()
+	s.maxEntries = 3
+	for i := 0; i < 3; i++ {
+		if err := s.Put(strconv.Itoa(i), i, time.Minute); err != nil {
+			t.Fatalf("Put %d: %v", i, err)
+		}
+	}
+	if err := s.Put("one-more", 3, time.Minute); err != ErrStateStoreFull {
+		t.Fatalf("Put into a full store = %v, want ErrStateStoreFull", err)
+	}
+
+	// Taking a value makes room again
+	s.Take("0")
+	if err := s.Put("one-more", 3, time.Minute); err != nil {
+		t.Errorf("Put after Take: %v", err)
+	}
+
+	// Expired values are removed by the cleanup, not by Put
+	s.Put("1", 1, -time.Second)
+	if err := s.Put("another", 4, time.Minute); err != ErrStateStoreFull {
+		t.Fatalf("Put before cleanup = %v, want ErrStateStoreFull", err)
+	}
+	s.cleanup()
+	if err := s.Put("another", 4, time.Minute); err != nil {
+		t.Errorf("Put after cleanup: %v", err)
+	}
+}
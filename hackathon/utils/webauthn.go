@@ -0,0 +1,268 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// COSE algorithm identifiers supported for passkeys
+const (
+	COSEAlgES256 = -7
+	COSEAlgEdDSA = -8
+	COSEAlgRS256 = -257
+)
+
+// Authenticator data flags (WebAuthn section 6.1)
+const (
+	AuthenticatorFlagUserPresent  = 0x01
+	AuthenticatorFlagUserVerified = 0x04
+	AuthenticatorFlagAttestedData = 0x40
+)
+
+// WebAuthn ceremony types found in the client data
+const (
+	WebAuthnTypeCreate = "webauthn.create"
+	WebAuthnTypeGet    = "webauthn.get"
+)
+
+// WebAuthnConfig identifies this server as a WebAuthn relying party
+type WebAuthnConfig struct {
+	RPID    string   // Effective domain passkeys are bound to, e.g. "example.com"
+	RPName  string   // Name shown by the authenticator
+	Origins []string // Origins the browser may report, e.g. "https://example.com"
+}
+
+// GetWebAuthnConfig reads the relying party configuration from environment variables
+func GetWebAuthnConfig() *WebAuthnConfig {
+	cfg := &WebAuthnConfig{
+		RPID:   os.Getenv("WEBAUTHN_RP_ID"),
+		RPName: os.Getenv("WEBAUTHN_RP_NAME"),
+	}
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			cfg.Origins = append(cfg.Origins, origin)
+		}
+	}
+	if cfg.RPID == "" {
+		cfg.RPID = "localhost"
+	}
+	if cfg.RPName == "" {
+		cfg.RPName = "File Uploader"
+	}
+	if len(cfg.Origins) == 0 {
+		cfg.Origins = []string{"http://localhost:8080"}
+	}
+	return cfg
+}
+
+// CollectedClientData is the client data JSON signed by the authenticator
+type CollectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// VerifyClientData parses client data JSON and checks its ceremony type and origin.
+// The caller must still check the challenge.
+func (c *WebAuthnConfig) VerifyClientData(raw []byte, expectedType string) (*CollectedClientData, error) {
+	clientData := &CollectedClientData{}
+	if err := json.Unmarshal(raw, clientData); err != nil {
+		return nil, errors.New("malformed client data")
+	}
+	if clientData.Type != expectedType {
+		return nil, fmt.Errorf("unexpected ceremony type %q", clientData.Type)
+	}
+	for _, origin := range c.Origins {
+		if clientData.Origin == origin {
+			return clientData, nil
+		}
+	}
+	return nil, fmt.Errorf("origin %q is not allowed", clientData.Origin)
+}
+
+// AuthenticatorData is the parsed authenticator data of a ceremony
+type AuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte // Only set when credential data is attested
+	CredentialID []byte
+	PublicKey    []byte // COSE_Key encoded credential public key
+}
+
+// UserPresent reports whether the user touched the authenticator
+func (d *AuthenticatorData) UserPresent() bool {
+	return d.Flags&AuthenticatorFlagUserPresent != 0
+}
+
+// UserVerified reports whether the authenticator verified the user (PIN, biometrics)
+func (d *AuthenticatorData) UserVerified() bool {
+	return d.Flags&AuthenticatorFlagUserVerified != 0
+}
+
+// ParseAuthenticatorData parses authenticator data including attested credential data
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+
+	authData := &AuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.Flags&AuthenticatorFlagAttestedData == 0 {
+		return authData, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data is too short")
+	}
+	authData.AAGUID = rest[:16]
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return nil, errors.New("credential ID is truncated")
+	}
+	authData.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	// The public key is followed by optional extensions, decoding finds its end
+	_, n, err := DecodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %w", err)
+	}
+	authData.PublicKey = rest[:n]
+	return authData, nil
+}
+
+// CheckRPIDHash checks that the authenticator data was created for this relying party
+func (c *WebAuthnConfig) CheckRPIDHash(authData *AuthenticatorData) bool {
+	sum := sha256.Sum256([]byte(c.RPID))
+	return bytes.Equal(authData.RPIDHash, sum[:])
+}
+
+// ParseAttestationObject extracts the authenticator data from an attestation object.
+// Attestation statements are not verified: passkeys are trusted on first use like
+// passwords, and most platform authenticators only provide "none" attestation.
+func ParseAttestationObject(data []byte) (*AuthenticatorData, []byte, error) {
+	decoded, _, err := DecodeCBOR(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, errors.New("attestation object is not a map")
+	}
+	rawAuthData, ok := object["authData"].([]byte)
+	if !ok {
+		return nil, nil, errors.New("attestation object has no authenticator data")
+	}
+
+	authData, err := ParseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if authData.PublicKey == nil {
+		return nil, nil, errors.New("attestation object has no credential data")
+	}
+	return authData, rawAuthData, nil
+}
+
+// ParseCOSEKey decodes a COSE_Key (RFC 9053) into a public key and its algorithm
+func ParseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := DecodeCBOR(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("COSE key is not a map")
+	}
+
+	keyType, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	switch {
+	case keyType == 2 && alg == COSEAlgES256:
+		curve, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if curve != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid P-256 key")
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, 0, errors.New("P-256 point is not on the curve")
+		}
+		return publicKey, alg, nil
+
+	case keyType == 1 && alg == COSEAlgEdDSA:
+		curve, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if curve != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+
+	case keyType == 3 && alg == COSEAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("invalid RSA key")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported COSE key type %d with algorithm %d", keyType, alg)
+}
+
+// VerifyWebAuthnSignature verifies an assertion signature over the authenticator data
+// and the hash of the client data JSON
+func VerifyWebAuthnSignature(coseKey, authData, clientDataJSON, signature []byte) error {
+	publicKey, _, err := ParseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, signed, signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	}
+	return errors.New("signature verification failed")
+}
+
+// DecodeBase64URL decodes base64url data with or without padding, as sent by browsers
+func DecodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}